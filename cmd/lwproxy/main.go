@@ -1,126 +1,695 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"errors"
 	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"math/rand/v2"
+	"net/http"
 	"os"
 	"os/signal"
+	"regexp"
+	"strings"
 	"sync"
 	"syscall"
 	"time"
 
 	"github.com/cristalhq/aconfig"
 	"github.com/cristalhq/aconfig/aconfigyaml"
+	"github.com/davseby/lwproxy/internal/admin"
 	"github.com/davseby/lwproxy/internal/db/memory"
 	"github.com/davseby/lwproxy/internal/proxy"
+	"github.com/davseby/lwproxy/internal/request/process/batch"
+	"github.com/davseby/lwproxy/internal/request/process/noop"
+	"github.com/davseby/lwproxy/internal/request/process/sample"
 	"github.com/davseby/lwproxy/internal/request/process/stdout"
+	"github.com/davseby/lwproxy/internal/request/process/syslog"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
 	"golang.org/x/exp/slog"
 )
 
-// _retryTimeout is the timeout for retrying.
-const _retryTimeout = 5 * time.Second
+const (
+	// _retryMinTimeout is the initial timeout for retrying.
+	_retryMinTimeout = time.Second
+
+	// _retryMaxTimeout is the maximum timeout for retrying.
+	_retryMaxTimeout = time.Minute
+
+	// _retryResetPeriod is the serving duration after which the serving
+	// is considered successful and the retry backoff is reset.
+	_retryResetPeriod = time.Minute
+
+	// _shutdownTimeout is the timeout for shutting the services down.
+	_shutdownTimeout = 5 * time.Second
+
+	// _configFetchTimeout is the timeout for fetching the configuration
+	// from a URL.
+	_configFetchTimeout = 10 * time.Second
+
+	// _configFile is the name of the in-memory configuration file that
+	// holds the configuration read from stdin, a file or a URL.
+	_configFile = "config.yaml"
+)
+
+// _envVarRef matches the ${VAR} environment variable references in the
+// configuration.
+var _envVarRef = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
 
 // Config is the application configuration.
 type Config struct {
+	// InstanceName is the name of the running proxy instance. When it is
+	// set, it is attached to every log line and request record.
+	InstanceName string
+
 	// Proxy is the proxy server configuration.
 	Proxy proxy.Config
 
+	// Admin is the admin server configuration.
+	Admin admin.Config
+
+	// Record is the requests recording configuration.
+	Record struct {
+		// Backend is the requests recorder. Available backends: stdout,
+		// syslog, noop.
+		Backend string `default:"stdout"`
+
+		// SampleEvery specifies that only every Nth request is recorded.
+		// Values 0 and 1 record every request.
+		SampleEvery int `default:"1"`
+
+		// Batch is the requests batching configuration. The batched
+		// records are handled by the backend off the request path.
+		Batch struct {
+			// Size is the number of records after which a batch is
+			// handled. Zero turns the batching off.
+			Size int
+
+			// Interval is the maximum time the records wait for their
+			// batch to be handled.
+			Interval time.Duration `default:"1s"`
+		}
+
+		// Stdout is the stdout backend configuration.
+		Stdout struct {
+			// Format is the records output format. Available formats:
+			// text, json.
+			Format stdout.Format `default:"text"`
+		}
+
+		// Syslog is the syslog backend configuration.
+		Syslog struct {
+			// Network is the network of the syslog server. Empty
+			// network connects to the local syslog server.
+			Network string `default:"udp"`
+
+			// Address is the address of the syslog server.
+			Address string `default:"localhost:514"`
+
+			// Tag is the tag of the syslog messages.
+			Tag string `default:"lwproxy"`
+		}
+	}
+
 	// Log is the logging configuration.
 	Log struct {
 		// Level is the logging level.
 		Level slog.Level `default:"info"`
+
+		// Format is the logging format. Available formats: text, json.
+		Format string `default:"text"`
+
+		// Output is the logging destination. It can be either stdout,
+		// stderr or a path to a file.
+		Output string `default:"stdout"`
+	}
+
+	// Trace is the tracing configuration.
+	Trace struct {
+		// Exporter is the spans exporter. Tracing is turned off when it
+		// is set to none.
+		Exporter string `default:"none"`
 	}
 }
 
 func main() {
-	var configPath string
+	os.Exit(run())
+}
+
+// run runs the application and returns the process exit code.
+func run() int {
+	var (
+		configPath string
+		check      bool
+	)
 
-	flag.StringVar(&configPath, "config", "config/.env.config.yaml", "path to the configuration file")
+	flag.StringVar(
+		&configPath,
+		"config",
+		"config/.env.config.yaml",
+		"path to the configuration file, - to read it from stdin or an http(s) URL to fetch it from",
+	)
+	flag.BoolVar(&check, "check", false, "validate the configuration and exit")
 	flag.Parse()
 
-	var cfg Config
+	if check {
+		return checkConfig(os.Stdout, configPath, os.Stdin)
+	}
+
+	cfg, err := loadConfig(configPath, os.Stdin)
+	if err != nil {
+		slog.Default().Error("loading configuration", slog.String("error", err.Error()))
+
+		return 1
+	}
+
+	output, closeOutput, err := openLogOutput(cfg.Log.Output)
+	if err != nil {
+		slog.Default().Error("opening log output", slog.String("error", err.Error()))
+
+		return 1
+	}
+
+	defer func() {
+		if err := closeOutput(); err != nil {
+			slog.Default().Error("closing log output", slog.String("error", err.Error()))
+		}
+	}()
+
+	log, err := newLogger(output, cfg.Log.Level, cfg.Log.Format, cfg.InstanceName)
+	if err != nil {
+		slog.Default().Error("creating logger", slog.String("error", err.Error()))
+
+		return 1
+	}
+
+	defer log.Info("application shutdown")
+
+	// NOTE: The request records carry the instance name themselves, so
+	// the records are logged without the instance attached once more.
+	recLog, err := newLogger(output, cfg.Log.Level, cfg.Log.Format, "")
+	if err != nil {
+		log.Error("creating records logger", slog.String("error", err.Error()))
+		return 1
+	}
 
-	err := aconfig.LoaderFor(&cfg, aconfig.Config{
+	stop, errCh, err := startServices(log, recLog, output, cfg)
+	if err != nil {
+		log.Error("starting services", slog.String("error", err.Error()))
+		return 1
+	}
+
+	defer stop()
+
+	terminationCh := make(chan os.Signal, 1)
+
+	signal.Notify(terminationCh, syscall.SIGINT, syscall.SIGTERM)
+
+	if err := trapInstance(log, terminationCh, errCh); err != nil {
+		log.Error("running services", slog.String("error", err.Error()))
+		return 1
+	}
+
+	return 0
+}
+
+// loadConfig loads the application configuration. The source can be
+// either a path to a YAML file, - to read the YAML from the provided stdin
+// or an http(s) URL to fetch the YAML from. The ${VAR} references in the
+// YAML are replaced with the environment variable values.
+func loadConfig(source string, stdin io.Reader) (Config, error) {
+	acfg := aconfig.Config{
 		SkipEnv:   true,
 		SkipFlags: true,
 		Files: []string{
-			configPath,
+			source,
 		},
 		FileDecoders: map[string]aconfig.FileDecoder{
 			".yaml": aconfigyaml.New(),
 		},
-	}).Load()
+	}
+
+	var (
+		data []byte
+		err  error
+	)
+
+	switch {
+	case source == "-":
+		data, err = io.ReadAll(stdin)
+	case strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://"):
+		data, err = fetchConfig(source)
+	default:
+		data, err = os.ReadFile(source)
+
+		// NOTE: A missing file is not an error, the defaults are used
+		// instead.
+		if errors.Is(err, fs.ErrNotExist) {
+			data, err = nil, nil
+		}
+	}
+
 	if err != nil {
-		slog.Default().Error("loading configuration", slog.String("error", err.Error()))
+		return Config{}, err
+	}
 
-		return
+	if data != nil {
+		data, err = expandEnv(data)
+		if err != nil {
+			return Config{}, err
+		}
+
+		acfg.Files = []string{_configFile}
+		acfg.FileSystem = configFS(data)
 	}
 
-	log := slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{
-		Level: cfg.Log.Level,
-	}))
-	defer log.Info("application shutdown")
+	var cfg Config
+
+	if err := aconfig.LoaderFor(&cfg, acfg).Load(); err != nil {
+		return Config{}, err
+	}
+
+	return cfg, nil
+}
+
+// configFS is a file system that holds the configuration data as a single
+// in-memory file.
+type configFS []byte
+
+// Open opens the configuration file. Other files do not exist.
+func (cf configFS) Open(name string) (fs.File, error) {
+	if name != _configFile {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+
+	return &configFile{
+		Reader: bytes.NewReader(cf),
+		size:   int64(len(cf)),
+	}, nil
+}
+
+// configFile is an opened in-memory configuration file.
+type configFile struct {
+	*bytes.Reader
+
+	size int64
+}
+
+// Stat returns the configuration file info.
+func (cf *configFile) Stat() (fs.FileInfo, error) {
+	return configFileInfo{size: cf.size}, nil
+}
+
+// Close does nothing.
+func (*configFile) Close() error {
+	return nil
+}
+
+// configFileInfo describes the in-memory configuration file.
+type configFileInfo struct {
+	size int64
+}
+
+// Name returns the configuration file name.
+func (configFileInfo) Name() string { return _configFile }
+
+// Size returns the configuration data length.
+func (cfi configFileInfo) Size() int64 { return cfi.size }
+
+// Mode returns the read-only file mode.
+func (configFileInfo) Mode() fs.FileMode { return 0o444 }
+
+// ModTime returns the zero time.
+func (configFileInfo) ModTime() time.Time { return time.Time{} }
+
+// IsDir returns false.
+func (configFileInfo) IsDir() bool { return false }
+
+// Sys returns nil.
+func (configFileInfo) Sys() any { return nil }
+
+// expandEnv replaces the ${VAR} references with the environment variable
+// values. An error is returned if any of the referenced variables is not
+// set, so that secrets are not silently left empty.
+func expandEnv(data []byte) ([]byte, error) {
+	var missing []string
+
+	data = _envVarRef.ReplaceAllFunc(data, func(ref []byte) []byte {
+		name := string(_envVarRef.FindSubmatch(ref)[1])
+
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			missing = append(missing, name)
+			return ref
+		}
+
+		return []byte(value)
+	})
 
-	stop, err := startServices(log, cfg)
+	if len(missing) > 0 {
+		return nil, fmt.Errorf("environment variables are not set: %s", strings.Join(missing, ", "))
+	}
+
+	return data, nil
+}
+
+// checkConfig loads and validates the configuration without starting the
+// services. The result is written to the writer and the process exit code
+// is returned.
+func checkConfig(w io.Writer, source string, stdin io.Reader) int {
+	err := func() error {
+		cfg, err := loadConfig(source, stdin)
+		if err != nil {
+			return err
+		}
+
+		return validateConfig(cfg)
+	}()
 	if err != nil {
-		log.Error("starting services", slog.String("error", err.Error()))
-		return
+		fmt.Fprintf(w, "invalid configuration: %s\n", err)
+		return 1
 	}
 
-	defer stop()
+	fmt.Fprintln(w, "OK")
+
+	return 0
+}
+
+// validateConfig checks whether the configuration is valid.
+func validateConfig(cfg Config) error {
+	if err := cfg.Proxy.Validate(); err != nil {
+		return fmt.Errorf("proxy: %w", err)
+	}
+
+	if _, err := newLogger(io.Discard, cfg.Log.Level, cfg.Log.Format, cfg.InstanceName); err != nil {
+		return fmt.Errorf("log: %w", err)
+	}
+
+	rec, err := newRecorder(slog.Default(), io.Discard, cfg)
+	if err != nil {
+		return fmt.Errorf("record: %w", err)
+	}
+
+	// NOTE: The recorder is only created to check the configuration, so
+	// its resources, e.g. the batching worker, are released right away.
+	if closer, ok := rec.(io.Closer); ok {
+		if err := closer.Close(); err != nil {
+			return fmt.Errorf("record: %w", err)
+		}
+	}
+
+	if cfg.Record.SampleEvery < 0 {
+		return errors.New("record: sample every must not be negative")
+	}
+
+	if cfg.Record.Batch.Size < 0 {
+		return errors.New("record: batch size must not be negative")
+	}
+
+	switch cfg.Trace.Exporter {
+	case "none", "stdout":
+	default:
+		return fmt.Errorf("trace: unsupported trace exporter %q", cfg.Trace.Exporter)
+	}
+
+	return nil
+}
+
+// fetchConfig fetches the configuration from the URL.
+func fetchConfig(url string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), _configFetchTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, http.NoBody)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected configuration response status %d", resp.StatusCode)
+	}
+
+	return io.ReadAll(resp.Body)
+}
+
+// openLogOutput opens the logs destination. The output can be either
+// stdout, stderr or a path to a file which is opened in the append mode.
+// The returned function closes the output.
+func openLogOutput(output string) (io.Writer, func() error, error) {
+	noop := func() error { return nil }
+
+	switch output {
+	case "stdout":
+		return os.Stdout, noop, nil
+	case "stderr":
+		return os.Stderr, noop, nil
+	default:
+		f, err := os.OpenFile(output, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		return f, f.Close, nil
+	}
+}
+
+// newLogger creates a new logger that writes logs in the provided format.
+// The instance name, if it is not empty, is attached to every log line.
+func newLogger(w io.Writer, level slog.Level, format, instance string) (*slog.Logger, error) {
+	opts := &slog.HandlerOptions{
+		Level: level,
+	}
+
+	var handler slog.Handler
+
+	switch format {
+	case "text":
+		handler = slog.NewTextHandler(w, opts)
+	case "json":
+		handler = slog.NewJSONHandler(w, opts)
+	default:
+		return nil, fmt.Errorf("unsupported log format %q", format)
+	}
+
+	log := slog.New(handler)
 
-	trapInstance(log)
+	if instance != "" {
+		log = log.With(slog.String("instance", instance))
+	}
+
+	return log, nil
 }
 
-// startServices starts the application services.
-func startServices(log *slog.Logger, cfg Config) (func(), error) {
+// startServices starts the application services. The request records of
+// the stdout backend are logged with recLog or written to recOut in the
+// JSON format. The returned channel receives an error if the services
+// fail and cannot be restarted.
+func startServices(log, recLog *slog.Logger, recOut io.Writer, cfg Config) (func(), <-chan error, error) {
+	tp, err := newTracerProvider(cfg.Trace.Exporter)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	rec, err := newRecorder(recLog, recOut, cfg)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	db := memory.NewDB()
+
 	ctx, cancel := context.WithCancel(context.Background())
 
 	server, err := proxy.NewProxy(
 		log,
-		stdout.NewProcessor(log),
-		memory.NewDB(),
 		cfg.Proxy,
+		proxy.WithRecorder(sample.NewProcessor(rec, cfg.Record.SampleEvery)),
+		proxy.WithTracerProvider(tp),
+		proxy.WithDB(db),
+		proxy.WithInstance(cfg.InstanceName),
 	)
 	if err != nil {
 		cancel()
-		return nil, err
+		return nil, nil, err
 	}
 
+	// NOTE: Every service can send a single error, so the channel is
+	// buffered for all of them to not block the shutdown.
+	errCh := make(chan error, 2)
+
 	var wg sync.WaitGroup
 
+	if cfg.Admin.Addr != "" {
+		adminServer := admin.NewServer(log, server, server, cfg.Admin)
+
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			if err := adminServer.ListenAndServe(ctx); err != nil {
+				errCh <- fmt.Errorf("serving admin: %w", err)
+			}
+		}()
+	}
+
 	wg.Add(1)
 
 	go func() {
 		defer wg.Done()
 
+		var attempt int
+
 		for ctx.Err() == nil {
-			server.ListenAndServe(ctx)
+			start := time.Now()
+
+			if err := server.ListenAndServe(ctx); err != nil {
+				errCh <- err
+				return
+			}
 
-			contextRetry(ctx)
+			if time.Since(start) >= _retryResetPeriod {
+				attempt = 0
+			}
+
+			contextRetry(ctx, retryBackoff(attempt))
+
+			attempt++
 		}
 	}()
 
 	return func() {
 		cancel()
 		wg.Wait()
-	}, nil
+
+		closureCtx, closureCancel := context.WithTimeout(context.Background(), _shutdownTimeout)
+		defer closureCancel()
+
+		if err := tp.Shutdown(closureCtx); err != nil {
+			log.Error("shutting tracer provider down", slog.String("error", err.Error()))
+		}
+
+		// NOTE: The recorder is closed only after the proxy has stopped,
+		// so that the queued records could still be handled.
+		if closer, ok := rec.(io.Closer); ok {
+			if err := closer.Close(); err != nil {
+				log.Error("closing requests recorder", slog.String("error", err.Error()))
+			}
+		}
+	}, errCh, nil
 }
 
-// trapInstance blocks until a termination signal is received.
-func trapInstance(logger *slog.Logger) {
-	terminationCh := make(chan os.Signal, 1)
+// newRecorder creates a requests recorder for the configured backend. The
+// backend records are handled in batches when the batching is turned on.
+func newRecorder(log *slog.Logger, out io.Writer, cfg Config) (proxy.Recorder, error) { //nolint: ireturn // the backend is selected at runtime.
+	rec, err := newBackend(log, out, cfg)
+	if err != nil {
+		return nil, err
+	}
 
-	signal.Notify(terminationCh, syscall.SIGINT, syscall.SIGTERM)
+	if cfg.Record.Batch.Size <= 0 {
+		return rec, nil
+	}
+
+	return batch.NewProcessor(
+		log,
+		batch.NewHandlerSink(rec),
+		cfg.Record.Batch.Size,
+		cfg.Record.Batch.Interval,
+	), nil
+}
+
+// newBackend creates a requests recorder backend. The stdout backend
+// writes the records to out.
+func newBackend(log *slog.Logger, out io.Writer, cfg Config) (proxy.Recorder, error) { //nolint: ireturn // the backend is selected at runtime.
+	switch cfg.Record.Backend {
+	case "stdout":
+		proc, err := stdout.NewProcessor(log, out, cfg.Record.Stdout.Format)
+		if err != nil {
+			return nil, err
+		}
+
+		return proc, nil
+	case "syslog":
+		return syslog.NewProcessor(
+			cfg.Record.Syslog.Network,
+			cfg.Record.Syslog.Address,
+			cfg.Record.Syslog.Tag,
+		), nil
+	case "noop":
+		return noop.NewProcessor(), nil
+	default:
+		return nil, fmt.Errorf("unsupported record backend %q", cfg.Record.Backend)
+	}
+}
+
+// newTracerProvider creates a tracer provider that exports spans with the
+// given exporter. If the exporter is none, the spans are never sampled.
+func newTracerProvider(exporter string) (*sdktrace.TracerProvider, error) {
+	switch exporter {
+	case "none":
+		return sdktrace.NewTracerProvider(
+			sdktrace.WithSampler(sdktrace.NeverSample()),
+		), nil
+	case "stdout":
+		exp, err := stdouttrace.New()
+		if err != nil {
+			return nil, err
+		}
+
+		return sdktrace.NewTracerProvider(sdktrace.WithBatcher(exp)), nil
+	default:
+		return nil, fmt.Errorf("unsupported trace exporter %q", exporter)
+	}
+}
+
+// trapInstance blocks until a termination signal or a services error is
+// received. The received signal is logged as the shutdown reason. The
+// services error is returned.
+func trapInstance(logger *slog.Logger, terminationCh <-chan os.Signal, errCh <-chan error) error {
+	var sig os.Signal
+
+	select {
+	case sig = <-terminationCh:
+	case err := <-errCh:
+		logger.Info("initiating shutdown due to a services error")
+		return err
+	}
+
+	logger.Info("initiating shutdown", slog.String("signal", sig.String()))
+
+	return nil
+}
+
+// retryBackoff returns the timeout before the next retry. The timeout grows
+// exponentially with every attempt up to the maximum timeout. A random
+// jitter of up to a half of the timeout is subtracted to avoid retrying in
+// lockstep.
+func retryBackoff(attempt int) time.Duration {
+	timeout := _retryMinTimeout
+
+	for i := 0; i < attempt && timeout < _retryMaxTimeout; i++ {
+		timeout *= 2
+	}
 
-	<-terminationCh
+	timeout = min(timeout, _retryMaxTimeout)
 
-	logger.Info("initiating shutdown")
+	return timeout - time.Duration(rand.Int64N(int64(timeout/2)+1)) //nolint: gosec // jitter does not require a secure random source.
 }
 
 // contextRetry waits for the context to be done or the timeout to be reached.
-func contextRetry(ctx context.Context) {
-	tc := time.NewTimer(_retryTimeout)
+func contextRetry(ctx context.Context, timeout time.Duration) {
+	tc := time.NewTimer(timeout)
 	defer func() {
 		tc.Stop()
 
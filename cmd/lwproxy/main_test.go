@@ -0,0 +1,498 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/davseby/lwproxy/internal/clock"
+	"github.com/davseby/lwproxy/internal/proxy"
+	"github.com/davseby/lwproxy/internal/request"
+	"github.com/davseby/lwproxy/internal/request/process/batch"
+	"github.com/davseby/lwproxy/internal/request/process/noop"
+	"github.com/davseby/lwproxy/internal/request/process/stdout"
+	"github.com/davseby/lwproxy/internal/request/process/syslog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/exp/slog"
+)
+
+func Test_loadConfig(t *testing.T) {
+	const data = "instance_name: proxy-1\nproxy:\n  addr: :9000\n"
+
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/config.yaml" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		_, _ = io.WriteString(w, data)
+	}))
+	t.Cleanup(target.Close)
+
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	require.NoError(t, os.WriteFile(path, []byte(data), 0o600))
+
+	tests := map[string]struct {
+		Source string
+		Stdin  string
+		Error  bool
+	}{
+		"Invalid stdin configuration": {
+			Source: "-",
+			Stdin:  "proxy: [",
+			Error:  true,
+		},
+		"Configuration URL responded with an error": {
+			Source: target.URL + "/missing.yaml",
+			Error:  true,
+		},
+		"Configuration URL is unreachable": {
+			Source: "http://127.0.0.1:0/config.yaml",
+			Error:  true,
+		},
+		"Successfully loaded configuration from a file": {
+			Source: path,
+		},
+		"Successfully loaded configuration from stdin": {
+			Source: "-",
+			Stdin:  data,
+		},
+		"Successfully loaded configuration from a URL": {
+			Source: target.URL + "/config.yaml",
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			cfg, err := loadConfig(test.Source, strings.NewReader(test.Stdin))
+			if test.Error {
+				require.Error(t, err)
+				return
+			}
+
+			require.NoError(t, err)
+			assert.Equal(t, "proxy-1", cfg.InstanceName)
+			assert.Equal(t, ":9000", cfg.Proxy.Addr)
+
+			// NOTE: The defaults are applied to the missing fields.
+			assert.Equal(t, "text", cfg.Log.Format)
+		})
+	}
+}
+
+func Test_loadConfig_Env(t *testing.T) {
+	t.Setenv("LWPROXY_TEST_PASSWORD", "secret")
+	t.Setenv("LWPROXY_TEST_EMPTY", "")
+
+	// resolved
+	cfg, err := loadConfig(
+		"-",
+		strings.NewReader("instance_name: proxy-${LWPROXY_TEST_EMPTY}1\nproxy:\n  auth:\n    password: ${LWPROXY_TEST_PASSWORD}\n    realm: $LWPROXY_TEST_PASSWORD\n"),
+	)
+	require.NoError(t, err)
+	assert.Equal(t, "proxy-1", cfg.InstanceName)
+	assert.Equal(t, "secret", cfg.Proxy.Auth.Password)
+	assert.Equal(t, "$LWPROXY_TEST_PASSWORD", cfg.Proxy.Auth.Realm)
+
+	// resolved from a file
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	require.NoError(t, os.WriteFile(path, []byte("proxy:\n  auth:\n    password: ${LWPROXY_TEST_PASSWORD}\n"), 0o600))
+
+	cfg, err = loadConfig(path, nil)
+	require.NoError(t, err)
+	assert.Equal(t, "secret", cfg.Proxy.Auth.Password)
+
+	// missing
+	_, err = loadConfig(
+		"-",
+		strings.NewReader("proxy:\n  auth:\n    username: ${LWPROXY_TEST_MISSING_USERNAME}\n    password: ${LWPROXY_TEST_MISSING_PASSWORD}\n"),
+	)
+	assert.EqualError(
+		t,
+		err,
+		"environment variables are not set: LWPROXY_TEST_MISSING_USERNAME, LWPROXY_TEST_MISSING_PASSWORD",
+	)
+}
+
+func Test_loadConfig_MaxBytes(t *testing.T) {
+	tests := map[string]struct {
+		Value  string
+		Result proxy.ByteSize
+		Error  bool
+	}{
+		"Invalid size": {
+			Value: "1PB",
+			Error: true,
+		},
+		"Bare integer": {
+			Value:  "1000",
+			Result: 1000,
+		},
+		"Decimal size": {
+			Value:  "1GB",
+			Result: 1_000_000_000,
+		},
+		"Binary size": {
+			Value:  "512MiB",
+			Result: 512 << 20,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			cfg, err := loadConfig("-", strings.NewReader("proxy:\n  max_bytes: "+test.Value+"\n"))
+			if test.Error {
+				require.Error(t, err)
+				return
+			}
+
+			require.NoError(t, err)
+			assert.Equal(t, test.Result, cfg.Proxy.MaxBytes)
+		})
+	}
+
+	// default
+	cfg, err := loadConfig("-", strings.NewReader("proxy:\n  addr: :9000\n"))
+	require.NoError(t, err)
+	assert.Equal(t, proxy.ByteSize(1_000_000_000), cfg.Proxy.MaxBytes)
+}
+
+func Test_configFS(t *testing.T) {
+	data := []byte("proxy:\n  addr: :9000\n")
+
+	read, err := fs.ReadFile(configFS(data), _configFile)
+	require.NoError(t, err)
+	assert.Equal(t, data, read)
+
+	info, err := fs.Stat(configFS(data), _configFile)
+	require.NoError(t, err)
+	assert.Equal(t, _configFile, info.Name())
+	assert.Equal(t, int64(len(data)), info.Size())
+	assert.False(t, info.IsDir())
+
+	_, err = configFS(data).Open("other.yaml")
+	assert.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func Test_checkConfig(t *testing.T) {
+	tests := map[string]struct {
+		Stdin  string
+		Code   int
+		Output string
+	}{
+		"Configuration cannot be loaded": {
+			Stdin:  "proxy: [",
+			Code:   1,
+			Output: "invalid configuration: ",
+		},
+		"Proxy configuration is invalid": {
+			Stdin:  "proxy:\n  max_bytes: -1\n",
+			Code:   1,
+			Output: "invalid configuration: proxy: max bytes must not be negative\n",
+		},
+		"Log configuration is invalid": {
+			Stdin:  "log:\n  format: xml\n",
+			Code:   1,
+			Output: "invalid configuration: log: unsupported log format \"xml\"\n",
+		},
+		"Record configuration is invalid": {
+			Stdin:  "record:\n  backend: kafka\n",
+			Code:   1,
+			Output: "invalid configuration: record: unsupported record backend \"kafka\"\n",
+		},
+		"Record stdout format is invalid": {
+			Stdin:  "record:\n  stdout:\n    format: xml\n",
+			Code:   1,
+			Output: "invalid configuration: record: unsupported stdout format \"xml\"\n",
+		},
+		"Record sampling is invalid": {
+			Stdin:  "record:\n  sample_every: -1\n",
+			Code:   1,
+			Output: "invalid configuration: record: sample every must not be negative\n",
+		},
+		"Record batching is invalid": {
+			Stdin:  "record:\n  batch:\n    size: -1\n",
+			Code:   1,
+			Output: "invalid configuration: record: batch size must not be negative\n",
+		},
+		"Trace configuration is invalid": {
+			Stdin:  "trace:\n  exporter: jaeger\n",
+			Code:   1,
+			Output: "invalid configuration: trace: unsupported trace exporter \"jaeger\"\n",
+		},
+		"Configuration is valid": {
+			Stdin:  "proxy:\n  addr: :9000\n",
+			Output: "OK\n",
+		},
+		"Batched records configuration is valid": {
+			Stdin:  "record:\n  batch:\n    size: 100\n",
+			Output: "OK\n",
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			var buffer bytes.Buffer
+
+			code := checkConfig(&buffer, "-", strings.NewReader(test.Stdin))
+			assert.Equal(t, test.Code, code)
+			assert.Contains(t, buffer.String(), test.Output)
+		})
+	}
+}
+
+func Test_openLogOutput(t *testing.T) {
+	// stdout
+	w, closeFn, err := openLogOutput("stdout")
+	require.NoError(t, err)
+	assert.Same(t, os.Stdout, w)
+	require.NoError(t, closeFn())
+
+	// stderr
+	w, closeFn, err = openLogOutput("stderr")
+	require.NoError(t, err)
+	assert.Same(t, os.Stderr, w)
+	require.NoError(t, closeFn())
+
+	// bad path
+	w, closeFn, err = openLogOutput(filepath.Join(t.TempDir(), "missing", "app.log"))
+	require.Error(t, err)
+	assert.Nil(t, w)
+	assert.Nil(t, closeFn)
+
+	// file
+	path := filepath.Join(t.TempDir(), "app.log")
+	require.NoError(t, os.WriteFile(path, []byte("first\n"), 0o600))
+
+	w, closeFn, err = openLogOutput(path)
+	require.NoError(t, err)
+
+	_, err = io.WriteString(w, "second\n")
+	require.NoError(t, err)
+	require.NoError(t, closeFn())
+
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, "first\nsecond\n", string(data))
+}
+
+func Test_newLogger(t *testing.T) {
+	tests := map[string]struct {
+		Format   string
+		Instance string
+		Output   string
+		Error    bool
+	}{
+		"Unsupported format": {
+			Format: "xml",
+			Error:  true,
+		},
+		"Successfully created text logger": {
+			Format: "text",
+			Output: "level=INFO msg=hello key=value\n",
+		},
+		"Successfully created json logger": {
+			Format: "json",
+			Output: `"level":"INFO","msg":"hello","key":"value"}` + "\n",
+		},
+		"Successfully created text logger with an instance name": {
+			Format:   "text",
+			Instance: "proxy-1",
+			Output:   "level=INFO msg=hello instance=proxy-1 key=value\n",
+		},
+		"Successfully created json logger with an instance name": {
+			Format:   "json",
+			Instance: "proxy-1",
+			Output:   `"level":"INFO","msg":"hello","instance":"proxy-1","key":"value"}` + "\n",
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			var buffer bytes.Buffer
+
+			log, err := newLogger(&buffer, slog.LevelInfo, test.Format, test.Instance)
+			if test.Error {
+				require.Error(t, err)
+				assert.Nil(t, log)
+
+				return
+			}
+
+			require.NoError(t, err)
+
+			log.Debug("skipped")
+			log.Info("hello", slog.String("key", "value"))
+
+			assert.Contains(t, buffer.String(), test.Output)
+			assert.NotContains(t, buffer.String(), "skipped")
+		})
+	}
+}
+
+func Test_newLogger_RecordOutput(t *testing.T) {
+	var buffer bytes.Buffer
+
+	log, err := newLogger(&buffer, slog.LevelInfo, "text", "")
+	require.NoError(t, err)
+
+	proc, err := stdout.NewProcessor(log, &buffer, stdout.FormatText)
+	require.NoError(t, err)
+
+	rec := request.NewRecord(clock.New(), "example.com")
+	rec.Instance = "proxy-1"
+
+	require.NoError(t, proc.Handle(rec))
+	assert.Contains(t, buffer.String(), "msg=\"publishing request record\" job=requests-stdout-processor")
+	assert.Equal(t, 1, strings.Count(buffer.String(), "instance=proxy-1"))
+}
+
+func Test_newRecorder(t *testing.T) {
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	var cfg Config
+
+	// stdout
+	cfg.Record.Backend = "stdout"
+
+	rec, err := newRecorder(log, io.Discard, cfg)
+	require.NoError(t, err)
+	assert.IsType(t, &stdout.Processor{}, rec)
+
+	// stdout with the json format writes to the provided output
+	var buffer bytes.Buffer
+
+	cfg.Record.Stdout.Format = stdout.FormatJSON
+
+	rec, err = newRecorder(log, &buffer, cfg)
+	require.NoError(t, err)
+	require.NoError(t, rec.Handle(request.Record{Host: "example.com"}))
+	assert.Contains(t, buffer.String(), `"host":"example.com"`)
+
+	// stdout with an unsupported format
+	cfg.Record.Stdout.Format = "xml"
+
+	rec, err = newRecorder(log, io.Discard, cfg)
+	require.Error(t, err)
+	assert.Nil(t, rec)
+
+	// syslog
+	cfg.Record.Backend = "syslog"
+
+	rec, err = newRecorder(log, io.Discard, cfg)
+	require.NoError(t, err)
+	assert.IsType(t, &syslog.Processor{}, rec)
+
+	// noop
+	cfg.Record.Backend = "noop"
+
+	rec, err = newRecorder(log, io.Discard, cfg)
+	require.NoError(t, err)
+	assert.IsType(t, &noop.Processor{}, rec)
+
+	// batched
+	cfg.Record.Batch.Size = 10
+
+	rec, err = newRecorder(log, io.Discard, cfg)
+	require.NoError(t, err)
+	require.IsType(t, &batch.Processor{}, rec)
+	assert.NoError(t, rec.(*batch.Processor).Close()) //nolint: forcetypeassert // the type is checked above.
+
+	cfg.Record.Batch.Size = 0
+
+	// unsupported
+	cfg.Record.Backend = "kafka"
+
+	rec, err = newRecorder(log, io.Discard, cfg)
+	require.Error(t, err)
+	assert.Nil(t, rec)
+}
+
+func Test_retryBackoff(t *testing.T) {
+	tests := map[int]time.Duration{
+		0:  time.Second,
+		1:  2 * time.Second,
+		2:  4 * time.Second,
+		5:  32 * time.Second,
+		6:  time.Minute,
+		7:  time.Minute,
+		64: time.Minute,
+	}
+
+	for attempt, timeout := range tests {
+		t.Run(strconv.Itoa(attempt), func(t *testing.T) {
+			t.Parallel()
+
+			for i := 0; i < 100; i++ {
+				backoff := retryBackoff(attempt)
+				assert.LessOrEqual(t, backoff, timeout)
+				assert.GreaterOrEqual(t, backoff, timeout/2)
+			}
+		})
+	}
+}
+
+func Test_trapInstance(t *testing.T) {
+	tests := map[string]struct {
+		Signal os.Signal
+		Error  error
+		Output string
+	}{
+		"Interrupt signal": {
+			Signal: syscall.SIGINT,
+			Output: "level=INFO msg=\"initiating shutdown\" signal=interrupt\n",
+		},
+		"Termination signal": {
+			Signal: syscall.SIGTERM,
+			Output: "level=INFO msg=\"initiating shutdown\" signal=terminated\n",
+		},
+		"Services error": {
+			Error:  errors.New("error"),
+			Output: "level=INFO msg=\"initiating shutdown due to a services error\"\n",
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			var buffer bytes.Buffer
+
+			log := slog.New(slog.NewTextHandler(&buffer, nil))
+
+			terminationCh := make(chan os.Signal, 1)
+			errCh := make(chan error, 1)
+
+			if test.Signal != nil {
+				terminationCh <- test.Signal
+			}
+
+			if test.Error != nil {
+				errCh <- test.Error
+			}
+
+			err := trapInstance(log, terminationCh, errCh)
+			assert.Equal(t, test.Error, err)
+			assert.Contains(t, buffer.String(), test.Output)
+		})
+	}
+}
@@ -0,0 +1,144 @@
+// Code generated by moq; DO NOT EDIT.
+// github.com/matryer/moq
+
+package admin
+
+import (
+	"context"
+	"sync"
+)
+
+// Ensure, that ProxyMock does implement Proxy.
+// If this is not the case, regenerate this file with moq.
+var _ Proxy = &ProxyMock{}
+
+// ProxyMock is a mock implementation of Proxy.
+//
+//	func TestSomethingThatUsesProxy(t *testing.T) {
+//
+//		// make and configure a mocked Proxy
+//		mockedProxy := &ProxyMock{
+//			SetMaxBytesFunc: func(maxBytes int64)  {
+//				panic("mock out the SetMaxBytes method")
+//			},
+//		}
+//
+//		// use mockedProxy in code that requires Proxy
+//		// and then make assertions.
+//
+//	}
+type ProxyMock struct {
+	// SetMaxBytesFunc mocks the SetMaxBytes method.
+	SetMaxBytesFunc func(maxBytes int64)
+
+	// calls tracks calls to the methods.
+	calls struct {
+		// SetMaxBytes holds details about calls to the SetMaxBytes method.
+		SetMaxBytes []struct {
+			// MaxBytes is the maxBytes argument value.
+			MaxBytes int64
+		}
+	}
+	lockSetMaxBytes sync.RWMutex
+}
+
+// SetMaxBytes calls SetMaxBytesFunc.
+func (mock *ProxyMock) SetMaxBytes(maxBytes int64) {
+	callInfo := struct {
+		MaxBytes int64
+	}{
+		MaxBytes: maxBytes,
+	}
+	mock.lockSetMaxBytes.Lock()
+	mock.calls.SetMaxBytes = append(mock.calls.SetMaxBytes, callInfo)
+	mock.lockSetMaxBytes.Unlock()
+	if mock.SetMaxBytesFunc == nil {
+		return
+	}
+	mock.SetMaxBytesFunc(maxBytes)
+}
+
+// SetMaxBytesCalls gets all the calls that were made to SetMaxBytes.
+// Check the length with:
+//
+//	len(mockedProxy.SetMaxBytesCalls())
+func (mock *ProxyMock) SetMaxBytesCalls() []struct {
+	MaxBytes int64
+} {
+	var calls []struct {
+		MaxBytes int64
+	}
+	mock.lockSetMaxBytes.RLock()
+	calls = mock.calls.SetMaxBytes
+	mock.lockSetMaxBytes.RUnlock()
+	return calls
+}
+
+// Ensure, that UsageMock does implement Usage.
+// If this is not the case, regenerate this file with moq.
+var _ Usage = &UsageMock{}
+
+// UsageMock is a mock implementation of Usage.
+//
+//	func TestSomethingThatUsesUsage(t *testing.T) {
+//
+//		// make and configure a mocked Usage
+//		mockedUsage := &UsageMock{
+//			ResetUsageFunc: func(ctx context.Context) error {
+//				panic("mock out the ResetUsage method")
+//			},
+//		}
+//
+//		// use mockedUsage in code that requires Usage
+//		// and then make assertions.
+//
+//	}
+type UsageMock struct {
+	// ResetUsageFunc mocks the ResetUsage method.
+	ResetUsageFunc func(ctx context.Context) error
+
+	// calls tracks calls to the methods.
+	calls struct {
+		// ResetUsage holds details about calls to the ResetUsage method.
+		ResetUsage []struct {
+			// Ctx is the ctx argument value.
+			Ctx context.Context
+		}
+	}
+	lockResetUsage sync.RWMutex
+}
+
+// ResetUsage calls ResetUsageFunc.
+func (mock *UsageMock) ResetUsage(ctx context.Context) error {
+	callInfo := struct {
+		Ctx context.Context
+	}{
+		Ctx: ctx,
+	}
+	mock.lockResetUsage.Lock()
+	mock.calls.ResetUsage = append(mock.calls.ResetUsage, callInfo)
+	mock.lockResetUsage.Unlock()
+	if mock.ResetUsageFunc == nil {
+		var (
+			errOut error
+		)
+		return errOut
+	}
+	return mock.ResetUsageFunc(ctx)
+}
+
+// ResetUsageCalls gets all the calls that were made to ResetUsage.
+// Check the length with:
+//
+//	len(mockedUsage.ResetUsageCalls())
+func (mock *UsageMock) ResetUsageCalls() []struct {
+	Ctx context.Context
+} {
+	var calls []struct {
+		Ctx context.Context
+	}
+	mock.lockResetUsage.RLock()
+	calls = mock.calls.ResetUsage
+	mock.lockResetUsage.RUnlock()
+	return calls
+}
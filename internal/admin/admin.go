@@ -0,0 +1,186 @@
+// package admin provides an HTTP server to manage the running proxy.
+//
+//go:generate moq --stub -out 0moq_test.go . Proxy:ProxyMock Usage:UsageMock
+package admin
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/pprof"
+	"time"
+
+	"golang.org/x/exp/slog"
+)
+
+const (
+	// _readHeaderTimeout is the timeout for reading the header.
+	_readHeaderTimeout = 5 * time.Second
+
+	// _closeTimeout is the timeout for closing the server.
+	_closeTimeout = 5 * time.Second
+)
+
+// Server is an admin HTTP server.
+type Server struct {
+	log *slog.Logger
+	srv *http.Server
+
+	proxy Proxy
+	usage Usage
+	cfg   Config
+}
+
+// Config holds the settings for the admin server.
+type Config struct {
+	// Addr is the address to listen on. The admin server is turned off
+	// when it is empty.
+	Addr string
+
+	// Username is the username used for basic authentication.
+	Username string `default:"admin"`
+
+	// Password is the password used for basic authentication.
+	Password string `default:"admin"`
+
+	// Pprof specifies whether the profiling handlers should be served
+	// under the /debug/pprof/ path.
+	Pprof bool
+}
+
+// NewServer creates a new admin server.
+func NewServer(log *slog.Logger, proxy Proxy, usage Usage, cfg Config) *Server {
+	s := &Server{
+		log:   log.With("job", "admin"),
+		proxy: proxy,
+		usage: usage,
+		cfg:   cfg,
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /limit", s.limitHandler)
+	mux.HandleFunc("POST /usage/reset", s.resetUsageHandler)
+
+	if cfg.Pprof {
+		mux.HandleFunc("GET /debug/pprof/", pprof.Index)
+		mux.HandleFunc("GET /debug/pprof/cmdline", pprof.Cmdline)
+		mux.HandleFunc("GET /debug/pprof/profile", pprof.Profile)
+		mux.HandleFunc("GET /debug/pprof/symbol", pprof.Symbol)
+		mux.HandleFunc("GET /debug/pprof/trace", pprof.Trace)
+	}
+
+	s.srv = &http.Server{
+		Addr:              cfg.Addr,
+		Handler:           s.authHandler(mux),
+		ReadHeaderTimeout: _readHeaderTimeout,
+	}
+
+	return s
+}
+
+// ListenAndServe listens for and serves the admin requests. It blocks
+// until the context is done or the server fails.
+func (s *Server) ListenAndServe(ctx context.Context) error {
+	s.log.Info("starting serving")
+
+	stopCh := make(chan struct{})
+
+	var serveErr error
+
+	go func() {
+		defer close(stopCh)
+
+		if err := s.srv.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+			serveErr = err
+		}
+	}()
+
+	select {
+	case <-stopCh:
+	case <-ctx.Done():
+		closureCtx, closureCancel := context.WithTimeout(context.Background(), _closeTimeout)
+		defer closureCancel()
+
+		if err := s.srv.Shutdown(closureCtx); err != nil { //nolint: contextcheck // we cannot use base context here as it is already cancelled and we want to give time for a shutdown.
+			s.log.Error("shutting server down", slog.String("error", err.Error()))
+		}
+
+		<-stopCh
+	}
+
+	return serveErr
+}
+
+// authHandler checks the basic authentication credentials before passing
+// the request to the next handler.
+func (s *Server) authHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		username, password, ok := r.BasicAuth()
+		if !ok ||
+			subtle.ConstantTimeCompare([]byte(username), []byte(s.cfg.Username)) != 1 ||
+			subtle.ConstantTimeCompare([]byte(password), []byte(s.cfg.Password)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Basic realm="lwproxy-admin"`)
+			http.Error(w, "authentication required", http.StatusUnauthorized)
+
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// limitRequest is the body of the limit request.
+type limitRequest struct {
+	// MaxBytes is the new bytes limit. Zero turns the limit off.
+	MaxBytes *int64 `json:"max_bytes"`
+}
+
+// limitHandler sets a new bytes limit of the proxy.
+func (s *Server) limitHandler(w http.ResponseWriter, r *http.Request) {
+	var req limitRequest
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if req.MaxBytes == nil || *req.MaxBytes < 0 {
+		http.Error(w, "max_bytes must be a non-negative integer", http.StatusBadRequest)
+		return
+	}
+
+	s.proxy.SetMaxBytes(*req.MaxBytes)
+
+	s.log.Info("bytes limit changed", slog.Int64("max_bytes", *req.MaxBytes))
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// resetUsageHandler resets the bytes used by the proxy.
+func (s *Server) resetUsageHandler(w http.ResponseWriter, r *http.Request) {
+	if err := s.usage.ResetUsage(r.Context()); err != nil {
+		s.log.Error("resetting bytes usage", slog.String("error", err.Error()))
+		http.Error(w, "cannot reset bytes usage", http.StatusInternalServerError)
+
+		return
+	}
+
+	s.log.Info("bytes usage reset")
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Proxy should be used to manage the running proxy.
+type Proxy interface {
+	// SetMaxBytes should set a new bytes limit. Zero should turn the
+	// limit off.
+	SetMaxBytes(maxBytes int64)
+}
+
+// Usage should be used to manage the bytes used by the proxy.
+type Usage interface {
+	// ResetUsage should set the amount of bytes used to zero.
+	ResetUsage(ctx context.Context) error
+}
@@ -0,0 +1,247 @@
+package admin
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/exp/slog"
+)
+
+func Test_NewServer(t *testing.T) {
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+	pm := &ProxyMock{}
+	um := &UsageMock{}
+
+	s := NewServer(log, pm, um, Config{Addr: ":9090"})
+	require.NotNil(t, s)
+	assert.Same(t, pm, s.proxy)
+	assert.Same(t, um, s.usage)
+	assert.Equal(t, log.With("job", "admin"), s.log)
+	assert.Equal(t, ":9090", s.srv.Addr)
+}
+
+func Test_Server_ListenAndServe(t *testing.T) {
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	// error
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	defer ln.Close()
+
+	s := NewServer(log, &ProxyMock{}, &UsageMock{}, Config{Addr: ln.Addr().String()})
+	require.Error(t, s.ListenAndServe(context.Background()))
+
+	// success
+	ctx, cancel := context.WithCancel(context.Background())
+
+	s = NewServer(log, &ProxyMock{}, &UsageMock{}, Config{Addr: "127.0.0.1:0"})
+
+	errCh := make(chan error, 1)
+
+	go func() {
+		errCh <- s.ListenAndServe(ctx)
+	}()
+
+	cancel()
+
+	select {
+	case err := <-errCh:
+		assert.NoError(t, err)
+	case <-time.After(time.Second):
+		assert.Fail(t, "server was not stopped")
+	}
+}
+
+func Test_Server_handlers(t *testing.T) {
+	tests := map[string]struct {
+		Method   string
+		Path     string
+		Body     string
+		Username string
+		Password string
+		Pprof    bool
+		Usage    *UsageMock
+		Status   int
+		MaxBytes []int64
+		Resets   int
+	}{
+		"Missing credentials": {
+			Method: http.MethodPost,
+			Path:   "/limit",
+			Body:   `{"max_bytes":100}`,
+			Status: http.StatusUnauthorized,
+		},
+		"Invalid credentials": {
+			Method:   http.MethodPost,
+			Path:     "/limit",
+			Body:     `{"max_bytes":100}`,
+			Username: "user",
+			Password: "invalid",
+			Status:   http.StatusUnauthorized,
+		},
+		"Invalid method": {
+			Method:   http.MethodGet,
+			Path:     "/limit",
+			Username: "user",
+			Password: "pass",
+			Status:   http.StatusMethodNotAllowed,
+		},
+		"Invalid body": {
+			Method:   http.MethodPost,
+			Path:     "/limit",
+			Body:     `{`,
+			Username: "user",
+			Password: "pass",
+			Status:   http.StatusBadRequest,
+		},
+		"Missing limit": {
+			Method:   http.MethodPost,
+			Path:     "/limit",
+			Body:     `{}`,
+			Username: "user",
+			Password: "pass",
+			Status:   http.StatusBadRequest,
+		},
+		"Negative limit": {
+			Method:   http.MethodPost,
+			Path:     "/limit",
+			Body:     `{"max_bytes":-1}`,
+			Username: "user",
+			Password: "pass",
+			Status:   http.StatusBadRequest,
+		},
+		"Limit is changed": {
+			Method:   http.MethodPost,
+			Path:     "/limit",
+			Body:     `{"max_bytes":100}`,
+			Username: "user",
+			Password: "pass",
+			Status:   http.StatusNoContent,
+			MaxBytes: []int64{100},
+		},
+		"Limit is turned off": {
+			Method:   http.MethodPost,
+			Path:     "/limit",
+			Body:     `{"max_bytes":0}`,
+			Username: "user",
+			Password: "pass",
+			Status:   http.StatusNoContent,
+			MaxBytes: []int64{0},
+		},
+		"Usage reset requires credentials": {
+			Method: http.MethodPost,
+			Path:   "/usage/reset",
+			Status: http.StatusUnauthorized,
+		},
+		"Usage reset has an invalid method": {
+			Method:   http.MethodGet,
+			Path:     "/usage/reset",
+			Username: "user",
+			Password: "pass",
+			Status:   http.StatusMethodNotAllowed,
+		},
+		"Usage reset failed": {
+			Method:   http.MethodPost,
+			Path:     "/usage/reset",
+			Username: "user",
+			Password: "pass",
+			Usage: &UsageMock{
+				ResetUsageFunc: func(_ context.Context) error {
+					return assert.AnError
+				},
+			},
+			Status: http.StatusInternalServerError,
+			Resets: 1,
+		},
+		"Usage is reset": {
+			Method:   http.MethodPost,
+			Path:     "/usage/reset",
+			Username: "user",
+			Password: "pass",
+			Status:   http.StatusNoContent,
+			Resets:   1,
+		},
+		"Profiling is turned off": {
+			Method:   http.MethodGet,
+			Path:     "/debug/pprof/",
+			Username: "user",
+			Password: "pass",
+			Status:   http.StatusNotFound,
+		},
+		"Profiling requires credentials": {
+			Method: http.MethodGet,
+			Path:   "/debug/pprof/",
+			Pprof:  true,
+			Status: http.StatusUnauthorized,
+		},
+		"Profiling is turned on": {
+			Method:   http.MethodGet,
+			Path:     "/debug/pprof/",
+			Username: "user",
+			Password: "pass",
+			Pprof:    true,
+			Status:   http.StatusOK,
+		},
+		"Profile is served": {
+			Method:   http.MethodGet,
+			Path:     "/debug/pprof/goroutine",
+			Username: "user",
+			Password: "pass",
+			Pprof:    true,
+			Status:   http.StatusOK,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			pm := &ProxyMock{}
+
+			um := test.Usage
+			if um == nil {
+				um = &UsageMock{}
+			}
+
+			s := NewServer(
+				slog.New(slog.NewTextHandler(io.Discard, nil)),
+				pm,
+				um,
+				Config{Username: "user", Password: "pass", Pprof: test.Pprof},
+			)
+
+			r := httptest.NewRequest(test.Method, test.Path, strings.NewReader(test.Body))
+
+			if test.Username != "" {
+				r.SetBasicAuth(test.Username, test.Password)
+			}
+
+			w := httptest.NewRecorder()
+			s.srv.Handler.ServeHTTP(w, r)
+
+			assert.Equal(t, test.Status, w.Code)
+
+			if test.Status == http.StatusUnauthorized {
+				assert.Equal(t, `Basic realm="lwproxy-admin"`, w.Header().Get("WWW-Authenticate"))
+			}
+
+			calls := pm.SetMaxBytesCalls()
+			require.Len(t, calls, len(test.MaxBytes))
+
+			for i, maxBytes := range test.MaxBytes {
+				assert.Equal(t, maxBytes, calls[i].MaxBytes)
+			}
+
+			assert.Len(t, um.ResetUsageCalls(), test.Resets)
+		})
+	}
+}
@@ -0,0 +1,69 @@
+// Package clock provides an abstraction over the time functions, so that
+// the time based features could be tested deterministically.
+package clock
+
+import "time"
+
+// Clock provides the current time and timers.
+type Clock interface {
+	// Now should return the current time.
+	Now() time.Time
+
+	// NewTimer should create a new timer that fires once the duration
+	// elapses.
+	NewTimer(d time.Duration) Timer
+
+	// AfterFunc should create a new timer that calls the function in its
+	// own goroutine once the duration elapses. The timer channel is not
+	// used.
+	AfterFunc(d time.Duration, f func()) Timer
+}
+
+// Timer is a single event timer.
+type Timer interface {
+	// C should return the channel on which the time is delivered once
+	// the timer fires.
+	C() <-chan time.Time
+
+	// Stop should prevent the timer from firing. It should return false
+	// if the timer has already fired or been stopped.
+	Stop() bool
+
+	// Reset should change the timer to fire once the duration elapses.
+	// It should return false if the timer has already fired or been
+	// stopped.
+	Reset(d time.Duration) bool
+}
+
+// Real is a clock that uses the system time.
+type Real struct{}
+
+// New creates a new system time clock.
+func New() Real {
+	return Real{}
+}
+
+// Now returns the current system time.
+func (Real) Now() time.Time {
+	return time.Now()
+}
+
+// NewTimer creates a new system timer.
+func (Real) NewTimer(d time.Duration) Timer { //nolint: ireturn // the timer is swapped in tests.
+	return realTimer{Timer: time.NewTimer(d)}
+}
+
+// AfterFunc creates a new system timer that calls the function.
+func (Real) AfterFunc(d time.Duration, f func()) Timer { //nolint: ireturn // the timer is swapped in tests.
+	return realTimer{Timer: time.AfterFunc(d, f)}
+}
+
+// realTimer is a system timer.
+type realTimer struct {
+	*time.Timer
+}
+
+// C returns the timer channel.
+func (rt realTimer) C() <-chan time.Time {
+	return rt.Timer.C
+}
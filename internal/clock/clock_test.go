@@ -0,0 +1,51 @@
+package clock
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_Real_Now(t *testing.T) {
+	assert.WithinDuration(t, time.Now(), New().Now(), time.Second)
+}
+
+func Test_Real_NewTimer(t *testing.T) {
+	// fired
+	timer := New().NewTimer(time.Millisecond)
+
+	select {
+	case <-timer.C():
+	case <-time.After(time.Second):
+		assert.Fail(t, "timer has not fired")
+	}
+
+	assert.False(t, timer.Stop())
+
+	// stopped
+	timer = New().NewTimer(time.Hour)
+	assert.True(t, timer.Stop())
+}
+
+func Test_Real_AfterFunc(t *testing.T) {
+	// fired
+	called := make(chan struct{})
+
+	timer := New().AfterFunc(time.Millisecond, func() { close(called) })
+
+	select {
+	case <-called:
+	case <-time.After(time.Second):
+		assert.Fail(t, "function has not been called")
+	}
+
+	assert.False(t, timer.Stop())
+
+	// reset and stopped
+	timer = New().AfterFunc(time.Hour, func() {
+		assert.Fail(t, "function has been called")
+	})
+	assert.True(t, timer.Reset(time.Hour))
+	assert.True(t, timer.Stop())
+}
@@ -1,14 +1,35 @@
 package memory
 
-import "context"
+import (
+	"context"
+	"math"
+)
 
 // FetchBytes fetches bytes from the database.
 func (d *DB) FetchBytes(_ context.Context) (int64, error) {
 	return d.bytes.Load(), nil
 }
 
-// IncreaseBytes increases the amount of bytes used.
-func (d *DB) IncreaseBytes(_ context.Context, usedBytes int64) error {
-	d.bytes.Add(usedBytes)
+// IncreaseBytes increases the amount of bytes used and returns the new
+// total. The total is clamped at math.MaxInt64 instead of overflowing.
+func (d *DB) IncreaseBytes(_ context.Context, usedBytes int64) (int64, error) {
+	for {
+		current := d.bytes.Load()
+
+		total := current + usedBytes
+		if usedBytes > 0 && current > math.MaxInt64-usedBytes {
+			total = math.MaxInt64
+		}
+
+		if d.bytes.CompareAndSwap(current, total) {
+			return total, nil
+		}
+	}
+}
+
+// Reset sets the amount of bytes used to zero.
+func (d *DB) Reset(_ context.Context) error {
+	d.bytes.Store(0)
+
 	return nil
 }
@@ -2,6 +2,8 @@ package memory
 
 import (
 	"context"
+	"math"
+	"sync"
 	"sync/atomic"
 	"testing"
 
@@ -26,8 +28,65 @@ func Test_DB_IncreaseBytes(t *testing.T) {
 		bytes: &atomic.Int64{},
 	}
 
-	err := db.IncreaseBytes(context.Background(), 5)
+	total, err := db.IncreaseBytes(context.Background(), 5)
 	require.NoError(t, err)
+	assert.Equal(t, int64(5), total)
 
-	assert.Equal(t, db.bytes.Load(), int64(5))
+	total, err = db.IncreaseBytes(context.Background(), 3)
+	require.NoError(t, err)
+	assert.Equal(t, int64(8), total)
+
+	assert.Equal(t, db.bytes.Load(), int64(8))
+}
+
+func Test_DB_IncreaseBytes_Overflow(t *testing.T) {
+	db := DB{
+		bytes: &atomic.Int64{},
+	}
+
+	db.bytes.Store(math.MaxInt64 - 5)
+
+	total, err := db.IncreaseBytes(context.Background(), 10)
+	require.NoError(t, err)
+	assert.Equal(t, int64(math.MaxInt64), total)
+
+	total, err = db.IncreaseBytes(context.Background(), math.MaxInt64)
+	require.NoError(t, err)
+	assert.Equal(t, int64(math.MaxInt64), total)
+
+	assert.Equal(t, int64(math.MaxInt64), db.bytes.Load())
+}
+
+func Test_DB_IncreaseBytes_Concurrent(t *testing.T) {
+	db := NewDB()
+
+	var wg sync.WaitGroup
+
+	for range 10 {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			for range 100 {
+				_, err := db.IncreaseBytes(context.Background(), 1)
+				assert.NoError(t, err)
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	assert.Equal(t, int64(1000), db.bytes.Load())
+}
+
+func Test_DB_Reset(t *testing.T) {
+	db := DB{
+		bytes: &atomic.Int64{},
+	}
+
+	db.bytes.Store(500)
+
+	require.NoError(t, db.Reset(context.Background()))
+	assert.Zero(t, db.bytes.Load())
 }
@@ -0,0 +1,57 @@
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+)
+
+const (
+	// _fetchBytesQuery fetches the amount of bytes used.
+	_fetchBytesQuery = `SELECT bytes FROM lwproxy_usage WHERE key = $1`
+
+	// _increaseBytesQuery atomically increases the amount of bytes used,
+	// creating the usage row if it does not exist. The total is clamped at
+	// the maximum bigint value instead of overflowing.
+	_increaseBytesQuery = `INSERT INTO lwproxy_usage (key, bytes) VALUES ($1, $2)
+ON CONFLICT (key) DO UPDATE SET bytes = CASE
+	WHEN lwproxy_usage.bytes > 9223372036854775807 - EXCLUDED.bytes THEN 9223372036854775807
+	ELSE lwproxy_usage.bytes + EXCLUDED.bytes
+END
+RETURNING bytes`
+
+	// _resetBytesQuery sets the amount of bytes used to zero.
+	_resetBytesQuery = `UPDATE lwproxy_usage SET bytes = 0 WHERE key = $1`
+)
+
+// FetchBytes fetches bytes from the database. Zero is returned if no
+// bytes have been used yet.
+func (d *DB) FetchBytes(ctx context.Context) (int64, error) {
+	var bytes int64
+
+	err := d.db.QueryRowContext(ctx, _fetchBytesQuery, d.key).Scan(&bytes)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, nil
+	}
+
+	return bytes, err
+}
+
+// IncreaseBytes increases the amount of bytes used and returns the new
+// total. The increase is a single statement, so it is atomic across the
+// instances sharing the key.
+func (d *DB) IncreaseBytes(ctx context.Context, usedBytes int64) (int64, error) {
+	var total int64
+
+	if err := d.db.QueryRowContext(ctx, _increaseBytesQuery, d.key, usedBytes).Scan(&total); err != nil {
+		return 0, err
+	}
+
+	return total, nil
+}
+
+// Reset sets the amount of bytes used to zero.
+func (d *DB) Reset(ctx context.Context) error {
+	_, err := d.db.ExecContext(ctx, _resetBytesQuery, d.key)
+	return err
+}
@@ -0,0 +1,124 @@
+package postgres
+
+import (
+	"context"
+	"math"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestDB(t *testing.T, key string) (*DB, *fakeDriver) {
+	t.Helper()
+
+	sqlDB, drv := newFakeDB(t)
+
+	db := NewDB(sqlDB, key)
+	require.NoError(t, db.CreateTable(context.Background()))
+
+	return db, drv
+}
+
+func Test_DB_FetchBytes(t *testing.T) {
+	db, drv := newTestDB(t, "key")
+
+	bytes, err := db.FetchBytes(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, int64(0), bytes)
+
+	drv.table["key"] = 5
+	drv.table["other"] = 10
+
+	bytes, err = db.FetchBytes(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, int64(5), bytes)
+}
+
+func Test_DB_FetchBytes_Error(t *testing.T) {
+	sqlDB, _ := newFakeDB(t)
+	db := NewDB(sqlDB, "key")
+
+	_, err := db.FetchBytes(context.Background())
+	assert.Error(t, err)
+}
+
+func Test_DB_IncreaseBytes(t *testing.T) {
+	db, drv := newTestDB(t, "key")
+
+	total, err := db.IncreaseBytes(context.Background(), 5)
+	require.NoError(t, err)
+	assert.Equal(t, int64(5), total)
+
+	total, err = db.IncreaseBytes(context.Background(), 3)
+	require.NoError(t, err)
+	assert.Equal(t, int64(8), total)
+
+	assert.Equal(t, map[string]int64{"key": 8}, drv.table)
+}
+
+func Test_DB_IncreaseBytes_Overflow(t *testing.T) {
+	db, drv := newTestDB(t, "key")
+
+	drv.table["key"] = math.MaxInt64 - 5
+
+	total, err := db.IncreaseBytes(context.Background(), 10)
+	require.NoError(t, err)
+	assert.Equal(t, int64(math.MaxInt64), total)
+
+	total, err = db.IncreaseBytes(context.Background(), math.MaxInt64)
+	require.NoError(t, err)
+	assert.Equal(t, int64(math.MaxInt64), total)
+}
+
+func Test_DB_IncreaseBytes_Concurrent(t *testing.T) {
+	db, drv := newTestDB(t, "key")
+
+	var wg sync.WaitGroup
+
+	for range 10 {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			for range 100 {
+				_, err := db.IncreaseBytes(context.Background(), 1)
+				assert.NoError(t, err)
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	assert.Equal(t, int64(1000), drv.table["key"])
+}
+
+func Test_DB_IncreaseBytes_ContextCanceled(t *testing.T) {
+	db, drv := newTestDB(t, "key")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err := db.IncreaseBytes(ctx, 5)
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Empty(t, drv.table)
+
+	_, err = db.FetchBytes(ctx)
+	assert.ErrorIs(t, err, context.Canceled)
+}
+
+func Test_DB_Reset(t *testing.T) {
+	db, drv := newTestDB(t, "key")
+
+	// resetting a missing usage is not an error.
+	require.NoError(t, db.Reset(context.Background()))
+	assert.Empty(t, drv.table)
+
+	drv.table["key"] = 5
+	drv.table["other"] = 10
+
+	require.NoError(t, db.Reset(context.Background()))
+	assert.Equal(t, map[string]int64{"key": 0, "other": 10}, drv.table)
+}
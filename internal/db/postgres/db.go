@@ -0,0 +1,38 @@
+// package postgres implements a Postgres database for the proxy service.
+// The bytes usage is stored in a table, one row per usage key, so that
+// multiple proxy instances could share the same limit.
+package postgres
+
+import (
+	"context"
+	"database/sql"
+)
+
+// _createTableQuery creates the bytes usage table.
+const _createTableQuery = `CREATE TABLE IF NOT EXISTS lwproxy_usage (
+	key TEXT PRIMARY KEY,
+	bytes BIGINT NOT NULL DEFAULT 0
+)`
+
+// DB is a Postgres database.
+type DB struct {
+	db  *sql.DB
+	key string
+}
+
+// NewDB creates a new Postgres database. The key identifies the bytes
+// usage row, the instances sharing the key share the usage. The caller
+// is responsible for opening the database with a Postgres driver and
+// closing it.
+func NewDB(db *sql.DB, key string) *DB {
+	return &DB{
+		db:  db,
+		key: key,
+	}
+}
+
+// CreateTable creates the bytes usage table if it does not exist.
+func (d *DB) CreateTable(ctx context.Context) error {
+	_, err := d.db.ExecContext(ctx, _createTableQuery)
+	return err
+}
@@ -0,0 +1,31 @@
+package postgres
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_NewDB(t *testing.T) {
+	sqlDB, _ := newFakeDB(t)
+
+	db := NewDB(sqlDB, "key")
+	require.NotNil(t, db)
+	assert.Equal(t, sqlDB, db.db)
+	assert.Equal(t, "key", db.key)
+}
+
+func Test_DB_CreateTable(t *testing.T) {
+	sqlDB, drv := newFakeDB(t)
+	db := NewDB(sqlDB, "key")
+
+	require.NoError(t, db.CreateTable(context.Background()))
+	assert.NotNil(t, drv.table)
+
+	// the table is only created once.
+	drv.table["key"] = 5
+	require.NoError(t, db.CreateTable(context.Background()))
+	assert.Equal(t, int64(5), drv.table["key"])
+}
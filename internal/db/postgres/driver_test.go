@@ -0,0 +1,147 @@
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// fakeDriver is a database/sql driver that emulates the usage table
+// queries, so that the database could be tested without a Postgres
+// server.
+type fakeDriver struct {
+	mu    sync.Mutex
+	table map[string]int64
+}
+
+var _fakeDriverID atomic.Int64
+
+// newFakeDB opens a database backed by a new fake driver.
+func newFakeDB(t *testing.T) (*sql.DB, *fakeDriver) {
+	t.Helper()
+
+	drv := &fakeDriver{}
+	name := fmt.Sprintf("fake-postgres-%d", _fakeDriverID.Add(1))
+	sql.Register(name, drv)
+
+	db, err := sql.Open(name, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { db.Close() })
+
+	return db, drv
+}
+
+func (d *fakeDriver) Open(string) (driver.Conn, error) {
+	return &fakeConn{drv: d}, nil
+}
+
+type fakeConn struct {
+	drv *fakeDriver
+}
+
+func (c *fakeConn) Prepare(string) (driver.Stmt, error) {
+	return nil, errors.New("prepared statements are not supported")
+}
+
+func (c *fakeConn) Close() error {
+	return nil
+}
+
+func (c *fakeConn) Begin() (driver.Tx, error) {
+	return nil, errors.New("transactions are not supported")
+}
+
+func (c *fakeConn) ExecContext(_ context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	c.drv.mu.Lock()
+	defer c.drv.mu.Unlock()
+
+	switch query {
+	case _createTableQuery:
+		if c.drv.table == nil {
+			c.drv.table = make(map[string]int64)
+		}
+	case _resetBytesQuery:
+		if c.drv.table == nil {
+			return nil, errors.New("relation does not exist")
+		}
+
+		key := args[0].Value.(string)
+		if _, ok := c.drv.table[key]; ok {
+			c.drv.table[key] = 0
+			return driver.RowsAffected(1), nil
+		}
+	default:
+		return nil, fmt.Errorf("unexpected query %q", query)
+	}
+
+	return driver.RowsAffected(0), nil
+}
+
+func (c *fakeConn) QueryContext(_ context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	c.drv.mu.Lock()
+	defer c.drv.mu.Unlock()
+
+	if c.drv.table == nil {
+		return nil, errors.New("relation does not exist")
+	}
+
+	key := args[0].Value.(string)
+
+	switch query {
+	case _fetchBytesQuery:
+		bytes, ok := c.drv.table[key]
+		if !ok {
+			return &fakeRows{}, nil
+		}
+
+		return &fakeRows{values: []int64{bytes}}, nil
+	case _increaseBytesQuery:
+		bytes := args[1].Value.(int64)
+
+		current := c.drv.table[key]
+		if current > math.MaxInt64-bytes {
+			current = math.MaxInt64
+		} else {
+			current += bytes
+		}
+
+		c.drv.table[key] = current
+
+		return &fakeRows{values: []int64{current}}, nil
+	}
+
+	return nil, fmt.Errorf("unexpected query %q", query)
+}
+
+type fakeRows struct {
+	values []int64
+}
+
+func (r *fakeRows) Columns() []string {
+	return []string{"bytes"}
+}
+
+func (r *fakeRows) Close() error {
+	return nil
+}
+
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if len(r.values) == 0 {
+		return io.EOF
+	}
+
+	dest[0] = r.values[0]
+	r.values = r.values[1:]
+
+	return nil
+}
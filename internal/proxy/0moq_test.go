@@ -0,0 +1,498 @@
+// Code generated by moq; DO NOT EDIT.
+// github.com/matryer/moq
+
+package proxy
+
+import (
+	"context"
+	"github.com/davseby/lwproxy/internal/request"
+	"net/http"
+	"sync"
+)
+
+// Ensure, that RecorderMock does implement Recorder.
+// If this is not the case, regenerate this file with moq.
+var _ Recorder = &RecorderMock{}
+
+// RecorderMock is a mock implementation of Recorder.
+//
+//	func TestSomethingThatUsesRecorder(t *testing.T) {
+//
+//		// make and configure a mocked Recorder
+//		mockedRecorder := &RecorderMock{
+//			HandleFunc: func(rec request.Record) error {
+//				panic("mock out the Handle method")
+//			},
+//		}
+//
+//		// use mockedRecorder in code that requires Recorder
+//		// and then make assertions.
+//
+//	}
+type RecorderMock struct {
+	// HandleFunc mocks the Handle method.
+	HandleFunc func(rec request.Record) error
+
+	// calls tracks calls to the methods.
+	calls struct {
+		// Handle holds details about calls to the Handle method.
+		Handle []struct {
+			// Rec is the rec argument value.
+			Rec request.Record
+		}
+	}
+	lockHandle sync.RWMutex
+}
+
+// Handle calls HandleFunc.
+func (mock *RecorderMock) Handle(rec request.Record) error {
+	callInfo := struct {
+		Rec request.Record
+	}{
+		Rec: rec,
+	}
+	mock.lockHandle.Lock()
+	mock.calls.Handle = append(mock.calls.Handle, callInfo)
+	mock.lockHandle.Unlock()
+	if mock.HandleFunc == nil {
+		var (
+			errOut error
+		)
+		return errOut
+	}
+	return mock.HandleFunc(rec)
+}
+
+// HandleCalls gets all the calls that were made to Handle.
+// Check the length with:
+//
+//	len(mockedRecorder.HandleCalls())
+func (mock *RecorderMock) HandleCalls() []struct {
+	Rec request.Record
+} {
+	var calls []struct {
+		Rec request.Record
+	}
+	mock.lockHandle.RLock()
+	calls = mock.calls.Handle
+	mock.lockHandle.RUnlock()
+	return calls
+}
+
+// Ensure, that AuthorizerMock does implement Authorizer.
+// If this is not the case, regenerate this file with moq.
+var _ Authorizer = &AuthorizerMock{}
+
+// AuthorizerMock is a mock implementation of Authorizer.
+//
+//	func TestSomethingThatUsesAuthorizer(t *testing.T) {
+//
+//		// make and configure a mocked Authorizer
+//		mockedAuthorizer := &AuthorizerMock{
+//			AuthorizeFunc: func(r *http.Request) (bool, error) {
+//				panic("mock out the Authorize method")
+//			},
+//		}
+//
+//		// use mockedAuthorizer in code that requires Authorizer
+//		// and then make assertions.
+//
+//	}
+type AuthorizerMock struct {
+	// AuthorizeFunc mocks the Authorize method.
+	AuthorizeFunc func(r *http.Request) (bool, error)
+
+	// calls tracks calls to the methods.
+	calls struct {
+		// Authorize holds details about calls to the Authorize method.
+		Authorize []struct {
+			// R is the r argument value.
+			R *http.Request
+		}
+	}
+	lockAuthorize sync.RWMutex
+}
+
+// Authorize calls AuthorizeFunc.
+func (mock *AuthorizerMock) Authorize(r *http.Request) (bool, error) {
+	callInfo := struct {
+		R *http.Request
+	}{
+		R: r,
+	}
+	mock.lockAuthorize.Lock()
+	mock.calls.Authorize = append(mock.calls.Authorize, callInfo)
+	mock.lockAuthorize.Unlock()
+	if mock.AuthorizeFunc == nil {
+		var (
+			bOut   bool
+			errOut error
+		)
+		return bOut, errOut
+	}
+	return mock.AuthorizeFunc(r)
+}
+
+// AuthorizeCalls gets all the calls that were made to Authorize.
+// Check the length with:
+//
+//	len(mockedAuthorizer.AuthorizeCalls())
+func (mock *AuthorizerMock) AuthorizeCalls() []struct {
+	R *http.Request
+} {
+	var calls []struct {
+		R *http.Request
+	}
+	mock.lockAuthorize.RLock()
+	calls = mock.calls.Authorize
+	mock.lockAuthorize.RUnlock()
+	return calls
+}
+
+// Ensure, that MetricsMock does implement Metrics.
+// If this is not the case, regenerate this file with moq.
+var _ Metrics = &MetricsMock{}
+
+// MetricsMock is a mock implementation of Metrics.
+//
+//	func TestSomethingThatUsesMetrics(t *testing.T) {
+//
+//		// make and configure a mocked Metrics
+//		mockedMetrics := &MetricsMock{
+//			AddBytesFunc: func(n int64)  {
+//				panic("mock out the AddBytes method")
+//			},
+//			IncAuthFailureFunc: func()  {
+//				panic("mock out the IncAuthFailure method")
+//			},
+//			IncLimitRejectionFunc: func()  {
+//				panic("mock out the IncLimitRejection method")
+//			},
+//			IncRequestsFunc: func()  {
+//				panic("mock out the IncRequests method")
+//			},
+//		}
+//
+//		// use mockedMetrics in code that requires Metrics
+//		// and then make assertions.
+//
+//	}
+type MetricsMock struct {
+	// AddBytesFunc mocks the AddBytes method.
+	AddBytesFunc func(n int64)
+
+	// IncAuthFailureFunc mocks the IncAuthFailure method.
+	IncAuthFailureFunc func()
+
+	// IncLimitRejectionFunc mocks the IncLimitRejection method.
+	IncLimitRejectionFunc func()
+
+	// IncRequestsFunc mocks the IncRequests method.
+	IncRequestsFunc func()
+
+	// calls tracks calls to the methods.
+	calls struct {
+		// AddBytes holds details about calls to the AddBytes method.
+		AddBytes []struct {
+			// N is the n argument value.
+			N int64
+		}
+		// IncAuthFailure holds details about calls to the IncAuthFailure method.
+		IncAuthFailure []struct {
+		}
+		// IncLimitRejection holds details about calls to the IncLimitRejection method.
+		IncLimitRejection []struct {
+		}
+		// IncRequests holds details about calls to the IncRequests method.
+		IncRequests []struct {
+		}
+	}
+	lockAddBytes          sync.RWMutex
+	lockIncAuthFailure    sync.RWMutex
+	lockIncLimitRejection sync.RWMutex
+	lockIncRequests       sync.RWMutex
+}
+
+// AddBytes calls AddBytesFunc.
+func (mock *MetricsMock) AddBytes(n int64) {
+	callInfo := struct {
+		N int64
+	}{
+		N: n,
+	}
+	mock.lockAddBytes.Lock()
+	mock.calls.AddBytes = append(mock.calls.AddBytes, callInfo)
+	mock.lockAddBytes.Unlock()
+	if mock.AddBytesFunc == nil {
+		return
+	}
+	mock.AddBytesFunc(n)
+}
+
+// AddBytesCalls gets all the calls that were made to AddBytes.
+// Check the length with:
+//
+//	len(mockedMetrics.AddBytesCalls())
+func (mock *MetricsMock) AddBytesCalls() []struct {
+	N int64
+} {
+	var calls []struct {
+		N int64
+	}
+	mock.lockAddBytes.RLock()
+	calls = mock.calls.AddBytes
+	mock.lockAddBytes.RUnlock()
+	return calls
+}
+
+// IncAuthFailure calls IncAuthFailureFunc.
+func (mock *MetricsMock) IncAuthFailure() {
+	callInfo := struct {
+	}{}
+	mock.lockIncAuthFailure.Lock()
+	mock.calls.IncAuthFailure = append(mock.calls.IncAuthFailure, callInfo)
+	mock.lockIncAuthFailure.Unlock()
+	if mock.IncAuthFailureFunc == nil {
+		return
+	}
+	mock.IncAuthFailureFunc()
+}
+
+// IncAuthFailureCalls gets all the calls that were made to IncAuthFailure.
+// Check the length with:
+//
+//	len(mockedMetrics.IncAuthFailureCalls())
+func (mock *MetricsMock) IncAuthFailureCalls() []struct {
+} {
+	var calls []struct {
+	}
+	mock.lockIncAuthFailure.RLock()
+	calls = mock.calls.IncAuthFailure
+	mock.lockIncAuthFailure.RUnlock()
+	return calls
+}
+
+// IncLimitRejection calls IncLimitRejectionFunc.
+func (mock *MetricsMock) IncLimitRejection() {
+	callInfo := struct {
+	}{}
+	mock.lockIncLimitRejection.Lock()
+	mock.calls.IncLimitRejection = append(mock.calls.IncLimitRejection, callInfo)
+	mock.lockIncLimitRejection.Unlock()
+	if mock.IncLimitRejectionFunc == nil {
+		return
+	}
+	mock.IncLimitRejectionFunc()
+}
+
+// IncLimitRejectionCalls gets all the calls that were made to IncLimitRejection.
+// Check the length with:
+//
+//	len(mockedMetrics.IncLimitRejectionCalls())
+func (mock *MetricsMock) IncLimitRejectionCalls() []struct {
+} {
+	var calls []struct {
+	}
+	mock.lockIncLimitRejection.RLock()
+	calls = mock.calls.IncLimitRejection
+	mock.lockIncLimitRejection.RUnlock()
+	return calls
+}
+
+// IncRequests calls IncRequestsFunc.
+func (mock *MetricsMock) IncRequests() {
+	callInfo := struct {
+	}{}
+	mock.lockIncRequests.Lock()
+	mock.calls.IncRequests = append(mock.calls.IncRequests, callInfo)
+	mock.lockIncRequests.Unlock()
+	if mock.IncRequestsFunc == nil {
+		return
+	}
+	mock.IncRequestsFunc()
+}
+
+// IncRequestsCalls gets all the calls that were made to IncRequests.
+// Check the length with:
+//
+//	len(mockedMetrics.IncRequestsCalls())
+func (mock *MetricsMock) IncRequestsCalls() []struct {
+} {
+	var calls []struct {
+	}
+	mock.lockIncRequests.RLock()
+	calls = mock.calls.IncRequests
+	mock.lockIncRequests.RUnlock()
+	return calls
+}
+
+// Ensure, that DBMock does implement DB.
+// If this is not the case, regenerate this file with moq.
+var _ DB = &DBMock{}
+
+// DBMock is a mock implementation of DB.
+//
+//	func TestSomethingThatUsesDB(t *testing.T) {
+//
+//		// make and configure a mocked DB
+//		mockedDB := &DBMock{
+//			FetchBytesFunc: func(ctx context.Context) (int64, error) {
+//				panic("mock out the FetchBytes method")
+//			},
+//			IncreaseBytesFunc: func(ctx context.Context, usedBytes int64) (int64, error) {
+//				panic("mock out the IncreaseBytes method")
+//			},
+//			ResetFunc: func(ctx context.Context) error {
+//				panic("mock out the Reset method")
+//			},
+//		}
+//
+//		// use mockedDB in code that requires DB
+//		// and then make assertions.
+//
+//	}
+type DBMock struct {
+	// FetchBytesFunc mocks the FetchBytes method.
+	FetchBytesFunc func(ctx context.Context) (int64, error)
+
+	// IncreaseBytesFunc mocks the IncreaseBytes method.
+	IncreaseBytesFunc func(ctx context.Context, usedBytes int64) (int64, error)
+
+	// ResetFunc mocks the Reset method.
+	ResetFunc func(ctx context.Context) error
+
+	// calls tracks calls to the methods.
+	calls struct {
+		// FetchBytes holds details about calls to the FetchBytes method.
+		FetchBytes []struct {
+			// Ctx is the ctx argument value.
+			Ctx context.Context
+		}
+		// IncreaseBytes holds details about calls to the IncreaseBytes method.
+		IncreaseBytes []struct {
+			// Ctx is the ctx argument value.
+			Ctx context.Context
+			// UsedBytes is the usedBytes argument value.
+			UsedBytes int64
+		}
+		// Reset holds details about calls to the Reset method.
+		Reset []struct {
+			// Ctx is the ctx argument value.
+			Ctx context.Context
+		}
+	}
+	lockFetchBytes    sync.RWMutex
+	lockIncreaseBytes sync.RWMutex
+	lockReset         sync.RWMutex
+}
+
+// FetchBytes calls FetchBytesFunc.
+func (mock *DBMock) FetchBytes(ctx context.Context) (int64, error) {
+	callInfo := struct {
+		Ctx context.Context
+	}{
+		Ctx: ctx,
+	}
+	mock.lockFetchBytes.Lock()
+	mock.calls.FetchBytes = append(mock.calls.FetchBytes, callInfo)
+	mock.lockFetchBytes.Unlock()
+	if mock.FetchBytesFunc == nil {
+		var (
+			nOut   int64
+			errOut error
+		)
+		return nOut, errOut
+	}
+	return mock.FetchBytesFunc(ctx)
+}
+
+// FetchBytesCalls gets all the calls that were made to FetchBytes.
+// Check the length with:
+//
+//	len(mockedDB.FetchBytesCalls())
+func (mock *DBMock) FetchBytesCalls() []struct {
+	Ctx context.Context
+} {
+	var calls []struct {
+		Ctx context.Context
+	}
+	mock.lockFetchBytes.RLock()
+	calls = mock.calls.FetchBytes
+	mock.lockFetchBytes.RUnlock()
+	return calls
+}
+
+// IncreaseBytes calls IncreaseBytesFunc.
+func (mock *DBMock) IncreaseBytes(ctx context.Context, usedBytes int64) (int64, error) {
+	callInfo := struct {
+		Ctx       context.Context
+		UsedBytes int64
+	}{
+		Ctx:       ctx,
+		UsedBytes: usedBytes,
+	}
+	mock.lockIncreaseBytes.Lock()
+	mock.calls.IncreaseBytes = append(mock.calls.IncreaseBytes, callInfo)
+	mock.lockIncreaseBytes.Unlock()
+	if mock.IncreaseBytesFunc == nil {
+		var (
+			nOut   int64
+			errOut error
+		)
+		return nOut, errOut
+	}
+	return mock.IncreaseBytesFunc(ctx, usedBytes)
+}
+
+// IncreaseBytesCalls gets all the calls that were made to IncreaseBytes.
+// Check the length with:
+//
+//	len(mockedDB.IncreaseBytesCalls())
+func (mock *DBMock) IncreaseBytesCalls() []struct {
+	Ctx       context.Context
+	UsedBytes int64
+} {
+	var calls []struct {
+		Ctx       context.Context
+		UsedBytes int64
+	}
+	mock.lockIncreaseBytes.RLock()
+	calls = mock.calls.IncreaseBytes
+	mock.lockIncreaseBytes.RUnlock()
+	return calls
+}
+
+// Reset calls ResetFunc.
+func (mock *DBMock) Reset(ctx context.Context) error {
+	callInfo := struct {
+		Ctx context.Context
+	}{
+		Ctx: ctx,
+	}
+	mock.lockReset.Lock()
+	mock.calls.Reset = append(mock.calls.Reset, callInfo)
+	mock.lockReset.Unlock()
+	if mock.ResetFunc == nil {
+		var (
+			errOut error
+		)
+		return errOut
+	}
+	return mock.ResetFunc(ctx)
+}
+
+// ResetCalls gets all the calls that were made to Reset.
+// Check the length with:
+//
+//	len(mockedDB.ResetCalls())
+func (mock *DBMock) ResetCalls() []struct {
+	Ctx context.Context
+} {
+	var calls []struct {
+		Ctx context.Context
+	}
+	mock.lockReset.RLock()
+	calls = mock.calls.Reset
+	mock.lockReset.RUnlock()
+	return calls
+}
@@ -0,0 +1,104 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"os"
+	"sync"
+	"time"
+
+	"golang.org/x/exp/slog"
+)
+
+// certificateReloader serves the proxy listener TLS certificate. The
+// certificate is loaded again once its files are modified, so renewed
+// certificates are used for the new handshakes without a restart while
+// the established connections are kept.
+type certificateReloader struct {
+	log *slog.Logger
+
+	certFile string
+	keyFile  string
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	certMod time.Time
+	keyMod  time.Time
+}
+
+// newCertificateReloader creates a new certificate reloader and loads the
+// initial certificate.
+func newCertificateReloader(log *slog.Logger, certFile, keyFile string) (*certificateReloader, error) {
+	cr := &certificateReloader{
+		log:      log,
+		certFile: certFile,
+		keyFile:  keyFile,
+	}
+
+	certMod, keyMod, err := cr.modTimes()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := cr.load(certMod, keyMod); err != nil {
+		return nil, err
+	}
+
+	return cr, nil
+}
+
+// GetCertificate returns the current certificate. The certificate is
+// reloaded if its files were modified since the last load. When the
+// reload fails, the previous certificate is returned.
+func (cr *certificateReloader) GetCertificate(_ *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+
+	certMod, keyMod, err := cr.modTimes()
+	if err != nil {
+		cr.log.Error("checking tls certificate files", slog.String("error", err.Error()))
+		return cr.cert, nil
+	}
+
+	if certMod.Equal(cr.certMod) && keyMod.Equal(cr.keyMod) {
+		return cr.cert, nil
+	}
+
+	if err := cr.load(certMod, keyMod); err != nil {
+		cr.log.Error("reloading tls certificate", slog.String("error", err.Error()))
+		return cr.cert, nil
+	}
+
+	cr.log.Info("tls certificate reloaded")
+
+	return cr.cert, nil
+}
+
+// load loads the certificate and remembers the files modification times.
+func (cr *certificateReloader) load(certMod, keyMod time.Time) error {
+	cert, err := tls.LoadX509KeyPair(cr.certFile, cr.keyFile)
+	if err != nil {
+		return err
+	}
+
+	cr.cert = &cert
+	cr.certMod = certMod
+	cr.keyMod = keyMod
+
+	return nil
+}
+
+// modTimes returns the modification times of the certificate and key
+// files.
+func (cr *certificateReloader) modTimes() (time.Time, time.Time, error) {
+	certInfo, err := os.Stat(cr.certFile)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+
+	keyInfo, err := os.Stat(cr.keyFile)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+
+	return certInfo.ModTime(), keyInfo.ModTime(), nil
+}
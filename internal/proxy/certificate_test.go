@@ -0,0 +1,142 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/tls"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/exp/slog"
+)
+
+func Test_newCertificateReloader(t *testing.T) {
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	// missing files
+	cr, err := newCertificateReloader(
+		log,
+		filepath.Join(t.TempDir(), "missing.pem"),
+		filepath.Join(t.TempDir(), "missing.pem"),
+	)
+	require.Error(t, err)
+	assert.Nil(t, cr)
+
+	// invalid files
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+
+	require.NoError(t, os.WriteFile(certFile, []byte("invalid"), 0o600))
+	require.NoError(t, os.WriteFile(keyFile, []byte("invalid"), 0o600))
+
+	cr, err = newCertificateReloader(log, certFile, keyFile)
+	require.Error(t, err)
+	assert.Nil(t, cr)
+
+	// success
+	certFile, keyFile, _ = generateCertificate(t, t.TempDir())
+
+	cr, err = newCertificateReloader(log, certFile, keyFile)
+	require.NoError(t, err)
+	require.NotNil(t, cr.cert)
+}
+
+func Test_certificateReloader_GetCertificate(t *testing.T) {
+	var buffer bytes.Buffer
+
+	certFile, keyFile, _ := generateCertificate(t, t.TempDir())
+
+	cr, err := newCertificateReloader(slog.New(slog.NewTextHandler(&buffer, nil)), certFile, keyFile)
+	require.NoError(t, err)
+
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		GetCertificate: cr.GetCertificate,
+		MinVersion:     tls.VersionTLS12,
+	})
+	require.NoError(t, err)
+
+	defer ln.Close()
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer conn.Close()
+
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	dial := func() (*tls.Conn, []byte) {
+		conn, err := tls.Dial("tcp", ln.Addr().String(), &tls.Config{
+			InsecureSkipVerify: true, //nolint: gosec // the served certificate is inspected.
+		})
+		require.NoError(t, err)
+
+		t.Cleanup(func() {
+			conn.Close()
+		})
+
+		return conn, conn.ConnectionState().PeerCertificates[0].Raw
+	}
+
+	ping := func(conn net.Conn) {
+		_, err := conn.Write([]byte("ping"))
+		require.NoError(t, err)
+
+		data := make([]byte, 4)
+
+		_, err = io.ReadFull(conn, data)
+		require.NoError(t, err)
+		assert.Equal(t, "ping", string(data))
+	}
+
+	oldConn, oldCert := dial()
+	ping(oldConn)
+
+	// NOTE: The new certificate replaces the old files and their
+	// modification times are moved forward, so the change is detected
+	// regardless of the file system timestamps precision.
+	newCertFile, newKeyFile, _ := generateCertificate(t, t.TempDir())
+
+	replace := func(src, dst string) {
+		data, err := os.ReadFile(src)
+		require.NoError(t, err)
+		require.NoError(t, os.WriteFile(dst, data, 0o600))
+
+		mod := time.Now().Add(time.Minute)
+		require.NoError(t, os.Chtimes(dst, mod, mod))
+	}
+
+	replace(newCertFile, certFile)
+	replace(newKeyFile, keyFile)
+
+	newConn, newCert := dial()
+	ping(newConn)
+	assert.NotEqual(t, oldCert, newCert)
+	assert.Contains(t, buffer.String(), "tls certificate reloaded")
+
+	// NOTE: The established connection is not affected.
+	ping(oldConn)
+
+	// NOTE: Invalid files keep the current certificate.
+	require.NoError(t, os.WriteFile(certFile, []byte("invalid"), 0o600))
+
+	mod := time.Now().Add(2 * time.Minute)
+	require.NoError(t, os.Chtimes(certFile, mod, mod))
+
+	_, cert := dial()
+	assert.Equal(t, newCert, cert)
+	assert.Contains(t, buffer.String(), "reloading tls certificate")
+}
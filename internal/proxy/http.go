@@ -0,0 +1,192 @@
+package proxy
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+
+	"go.opentelemetry.io/otel/codes"
+	"golang.org/x/exp/slog"
+)
+
+// _stripUserAgent is the User-Agent override value that removes the
+// header from the forwarded requests.
+const _stripUserAgent = "-"
+
+// _hopHeaders are the hop-by-hop headers which apply only to a single
+// connection and must not be forwarded.
+var _hopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Proxy-Connection",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// httpHandler handles plain HTTP requests proxying. The request is
+// forwarded to the target service and the response is written back
+// without hijacking the connection, so the client connection can be kept
+// alive for the sequential requests.
+func (p *Proxy) httpHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, span := p.tracer.Start(r.Context(), "proxy.http")
+	defer span.End()
+
+	if !r.URL.IsAbs() {
+		span.SetStatus(codes.Error, "request target is not an absolute URL")
+		p.writeError(w, "request target must be an absolute URL", http.StatusBadRequest)
+
+		return
+	}
+
+	addr, err := targetAddr(r)
+	if err != nil {
+		span.SetStatus(codes.Error, err.Error())
+		p.writeError(w, err.Error(), http.StatusBadRequest)
+
+		return
+	}
+
+	if p.loopTarget(ctx, addr) {
+		span.SetStatus(codes.Error, "request target is the proxy itself")
+		p.writeError(w, "request target is the proxy itself", http.StatusMisdirectedRequest)
+
+		return
+	}
+
+	// NOTE: Legacy clients use the Proxy-Connection header instead of the
+	// Connection header to ask the proxy to close the connection.
+	if strings.EqualFold(r.Header.Get("Proxy-Connection"), "close") {
+		w.Header().Set("Connection", "close")
+	}
+
+	// NOTE: The outgoing request inherits the client request context,
+	// which is cancelled by the server as soon as the client connection
+	// is closed, so the target service is not queried after the client
+	// has gone away.
+	outReq := r.Clone(ctx)
+	outReq.RequestURI = ""
+	removeHopHeaders(outReq.Header)
+
+	switch ua := p.cfg.UserAgentOverride; ua {
+	case "":
+	case _stripUserAgent:
+		// NOTE: An empty value stops the transport from adding its
+		// default User-Agent header.
+		outReq.Header.Set("User-Agent", "")
+	default:
+		outReq.Header.Set("User-Agent", ua)
+	}
+
+	resp, err := p.transport.RoundTrip(outReq)
+	if err != nil {
+		p.logger(ctx).Debug("forwarding request to the target service", slog.String("error", err.Error()))
+		span.SetStatus(codes.Error, err.Error())
+		p.writeError(w, "target service is unreachable", http.StatusServiceUnavailable)
+
+		return
+	}
+
+	defer resp.Body.Close()
+
+	maxBytes := p.cfg.MaxResponseBytes
+
+	if maxBytes > 0 && resp.ContentLength > maxBytes {
+		p.logger(ctx).Warn(
+			"target service response is too large",
+			slog.Int64("content_length", resp.ContentLength),
+			slog.Int64("max_response_bytes", maxBytes),
+		)
+		span.SetStatus(codes.Error, "response is too large")
+		p.writeError(w, "target service response is too large", http.StatusBadGateway)
+
+		return
+	}
+
+	removeHopHeaders(resp.Header)
+	filterHeaders(resp.Header, p.cfg.ResponseHeaders.Allow, p.cfg.ResponseHeaders.Deny)
+
+	for key, values := range resp.Header {
+		for _, value := range values {
+			w.Header().Add(key, value)
+		}
+	}
+
+	w.WriteHeader(resp.StatusCode)
+
+	if maxBytes <= 0 {
+		if _, err := io.Copy(w, resp.Body); err != nil {
+			p.silentError(ctx, err, "copying response from the target service")
+		}
+
+		return
+	}
+
+	_, err = io.CopyN(w, resp.Body, maxBytes)
+	switch {
+	case errors.Is(err, io.EOF):
+		return
+	case err != nil:
+		p.silentError(ctx, err, "copying response from the target service")
+		return
+	}
+
+	// NOTE: The limit is reached, so a single byte is read to check
+	// whether the response continues.
+	if n, _ := io.ReadFull(resp.Body, make([]byte, 1)); n > 0 {
+		p.logger(ctx).Warn(
+			"target service response is too large, aborting transfer",
+			slog.Int64("max_response_bytes", maxBytes),
+		)
+		span.SetStatus(codes.Error, "response is too large")
+
+		// NOTE: The status line has already been written, so the
+		// transfer is aborted by closing the client connection, otherwise
+		// the client would take the truncated body as complete.
+		_ = http.NewResponseController(w).Flush()
+
+		panic(http.ErrAbortHandler)
+	}
+}
+
+// removeHopHeaders removes the hop-by-hop headers, including the ones
+// listed in the Connection header.
+func removeHopHeaders(h http.Header) {
+	for _, value := range h.Values("Connection") {
+		for _, key := range strings.Split(value, ",") {
+			if key = strings.TrimSpace(key); key != "" {
+				h.Del(key)
+			}
+		}
+	}
+
+	for _, key := range _hopHeaders {
+		h.Del(key)
+	}
+}
+
+// filterHeaders removes the denied headers and, when the allow list is not
+// empty, all headers that are not allowed.
+func filterHeaders(h http.Header, allow, deny []string) {
+	if len(allow) > 0 {
+		allowed := make(map[string]struct{}, len(allow))
+
+		for _, key := range allow {
+			allowed[http.CanonicalHeaderKey(key)] = struct{}{}
+		}
+
+		for key := range h {
+			if _, ok := allowed[http.CanonicalHeaderKey(key)]; !ok {
+				delete(h, key)
+			}
+		}
+	}
+
+	for _, key := range deny {
+		h.Del(key)
+	}
+}
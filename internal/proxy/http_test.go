@@ -0,0 +1,488 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/davseby/lwproxy/internal/clock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/trace/noop"
+	"golang.org/x/exp/slog"
+)
+
+func Test_Proxy_httpHandler(t *testing.T) {
+	var targetConns atomic.Int64
+
+	target := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Connection", "X-Hop")
+		w.Header().Set("X-Hop", "hop")
+		w.Header().Set("X-Target", "target")
+
+		fmt.Fprintf(
+			w,
+			"%s %s %s",
+			r.URL.Path,
+			r.Header.Get("Proxy-Authorization"),
+			r.Header.Get("Proxy-Connection"),
+		)
+	}))
+	target.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			targetConns.Add(1)
+		}
+	}
+	target.Start()
+	t.Cleanup(target.Close)
+
+	p, err := NewProxy(
+		slog.New(slog.NewTextHandler(io.Discard, nil)),
+		testConfig(),
+		WithRecorder(&RecorderMock{}),
+	)
+	require.NoError(t, err)
+
+	var proxyConns atomic.Int64
+
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(p.deadlineHandler))
+	srv.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			proxyConns.Add(1)
+		}
+	}
+	srv.Start()
+	t.Cleanup(srv.Close)
+
+	conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+	require.NoError(t, err)
+
+	defer conn.Close()
+
+	br := bufio.NewReader(conn)
+
+	send := func(path, headers string) *http.Response {
+		_, err := fmt.Fprintf(
+			conn,
+			"GET http://%[1]s%[2]s HTTP/1.1\r\nHost: %[1]s\r\nProxy-Authorization: Basic dXNlcjpwYXNz\r\n%[3]s\r\n",
+			target.Listener.Addr().String(),
+			path,
+			headers,
+		)
+		require.NoError(t, err)
+
+		resp, err := http.ReadResponse(br, nil)
+		require.NoError(t, err)
+
+		return resp
+	}
+
+	for _, path := range []string{"/first", "/second"} {
+		resp := send(path, "Proxy-Connection: keep-alive\r\n")
+
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		resp.Body.Close()
+
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.False(t, resp.Close)
+		assert.Equal(t, path+"  ", string(body))
+		assert.Equal(t, "target", resp.Header.Get("X-Target"))
+		assert.Empty(t, resp.Header.Get("X-Hop"))
+	}
+
+	resp := send("/third", "Proxy-Connection: close\r\n")
+	resp.Body.Close()
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.True(t, resp.Close)
+
+	assert.Equal(t, int64(1), proxyConns.Load())
+	assert.Equal(t, int64(1), targetConns.Load())
+}
+
+func Test_Proxy_httpHandler_ClientDisconnect(t *testing.T) {
+	receivedCh := make(chan struct{})
+	cancelledCh := make(chan struct{})
+
+	target := httptest.NewServer(http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+		close(receivedCh)
+
+		select {
+		case <-r.Context().Done():
+			close(cancelledCh)
+		case <-time.After(5 * time.Second):
+		}
+	}))
+	t.Cleanup(target.Close)
+
+	p, err := NewProxy(
+		slog.New(slog.NewTextHandler(io.Discard, nil)),
+		testConfig(),
+		WithRecorder(&RecorderMock{}),
+	)
+	require.NoError(t, err)
+
+	srv := httptest.NewServer(http.HandlerFunc(p.deadlineHandler))
+	t.Cleanup(srv.Close)
+
+	conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+	require.NoError(t, err)
+
+	_, err = fmt.Fprintf(
+		conn,
+		"GET http://%[1]s/slow HTTP/1.1\r\nHost: %[1]s\r\n\r\n",
+		target.Listener.Addr().String(),
+	)
+	require.NoError(t, err)
+
+	select {
+	case <-receivedCh:
+	case <-time.After(time.Second):
+		require.Fail(t, "request was not forwarded to the target service")
+	}
+
+	require.NoError(t, conn.Close())
+
+	select {
+	case <-cancelledCh:
+	case <-time.After(time.Second):
+		assert.Fail(t, "target service request was not cancelled")
+	}
+}
+
+func Test_Proxy_httpHandler_Compressed(t *testing.T) {
+	var compressed bytes.Buffer
+
+	gw := gzip.NewWriter(&compressed)
+	_, err := gw.Write([]byte("compressed response"))
+	require.NoError(t, err)
+	require.NoError(t, gw.Close())
+
+	var acceptEncoding atomic.Value
+
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		acceptEncoding.Store(r.Header.Get("Accept-Encoding"))
+
+		w.Header().Set("Content-Encoding", "gzip")
+		_, _ = w.Write(compressed.Bytes())
+	}))
+	t.Cleanup(target.Close)
+
+	p, err := NewProxy(
+		slog.New(slog.NewTextHandler(io.Discard, nil)),
+		testConfig(),
+		WithRecorder(&RecorderMock{}),
+	)
+	require.NoError(t, err)
+
+	w := httptest.NewRecorder()
+	p.httpHandler(w, httptest.NewRequest(http.MethodGet, target.URL+"/path", http.NoBody))
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "gzip", w.Header().Get("Content-Encoding"))
+	assert.Equal(t, compressed.Bytes(), w.Body.Bytes())
+	assert.Equal(t, "", acceptEncoding.Load())
+}
+
+func Test_Proxy_httpHandler_BadRequest(t *testing.T) {
+	p := &Proxy{
+		log:    slog.New(slog.NewTextHandler(io.Discard, nil)),
+		tracer: noop.NewTracerProvider().Tracer(""),
+		clock:  clock.New(),
+	}
+
+	// relative request target
+	w := httptest.NewRecorder()
+	p.httpHandler(w, httptest.NewRequest(http.MethodGet, "/path", http.NoBody))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	// invalid port
+	w = httptest.NewRecorder()
+	p.httpHandler(w, httptest.NewRequest(http.MethodGet, "http://example.com:0/path", http.NoBody))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func Test_Proxy_httpHandler_JSONError(t *testing.T) {
+	p := &Proxy{
+		log:    slog.New(slog.NewTextHandler(io.Discard, nil)),
+		tracer: noop.NewTracerProvider().Tracer(""),
+		clock:  clock.New(),
+		cfg:    Config{ErrorFormat: "json"},
+	}
+
+	w := httptest.NewRecorder()
+	p.httpHandler(w, httptest.NewRequest(http.MethodGet, "/path", http.NoBody))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+	assert.JSONEq(t, `{"error":"request target must be an absolute URL","code":400}`, w.Body.String())
+}
+
+func Test_removeHopHeaders(t *testing.T) {
+	h := http.Header{
+		"Connection":          {"X-Custom, Keep-Alive"},
+		"X-Custom":            {"custom"},
+		"Keep-Alive":          {"timeout=5"},
+		"Proxy-Authorization": {"Basic dXNlcjpwYXNz"},
+		"Proxy-Connection":    {"keep-alive"},
+		"Upgrade":             {"websocket"},
+		"X-Forwarded":         {"value"},
+	}
+
+	removeHopHeaders(h)
+
+	assert.Equal(t, http.Header{
+		"X-Forwarded": {"value"},
+	}, h)
+}
+
+func Test_filterHeaders(t *testing.T) {
+	header := func() http.Header {
+		return http.Header{
+			"Server":       {"nginx"},
+			"Set-Cookie":   {"a=b", "c=d"},
+			"Content-Type": {"text/plain"},
+			"X-Target":     {"target"},
+		}
+	}
+
+	tests := map[string]struct {
+		Allow  []string
+		Deny   []string
+		Result http.Header
+	}{
+		"No filtering": {
+			Result: header(),
+		},
+		"Denied headers are removed": {
+			Deny: []string{"server", "SET-COOKIE"},
+			Result: http.Header{
+				"Content-Type": {"text/plain"},
+				"X-Target":     {"target"},
+			},
+		},
+		"Only allowed headers are passed": {
+			Allow: []string{"content-type", "x-TARGET"},
+			Result: http.Header{
+				"Content-Type": {"text/plain"},
+				"X-Target":     {"target"},
+			},
+		},
+		"Denied headers are removed even if they are allowed": {
+			Allow: []string{"Content-Type", "Server"},
+			Deny:  []string{"server"},
+			Result: http.Header{
+				"Content-Type": {"text/plain"},
+			},
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			h := header()
+			filterHeaders(h, test.Allow, test.Deny)
+			assert.Equal(t, test.Result, h)
+		})
+	}
+}
+
+func Test_Proxy_httpHandler_ResponseHeaders(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Server", "nginx")
+		w.Header().Set("Set-Cookie", "a=b")
+		w.Header().Set("X-Target", "target")
+	}))
+	t.Cleanup(target.Close)
+
+	cfg := testConfig()
+
+	cfg.ResponseHeaders.Deny = []string{"server", "set-cookie"}
+
+	p, err := NewProxy(
+		slog.New(slog.NewTextHandler(io.Discard, nil)),
+		cfg,
+		WithRecorder(&RecorderMock{}),
+	)
+	require.NoError(t, err)
+
+	w := httptest.NewRecorder()
+	p.httpHandler(w, httptest.NewRequest(http.MethodGet, target.URL+"/path", http.NoBody))
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Empty(t, w.Header().Get("Server"))
+	assert.Empty(t, w.Header().Get("Set-Cookie"))
+	assert.Equal(t, "target", w.Header().Get("X-Target"))
+}
+
+func Test_Proxy_httpHandler_MaxResponseBytes(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body := bytes.Repeat([]byte("a"), 100)
+
+		if r.URL.Path == "/chunked" {
+			// NOTE: Flushing first makes the response size unknown.
+			w.(http.Flusher).Flush()
+		}
+
+		w.Write(body) //nolint: errcheck // the test client reads the body.
+	}))
+	t.Cleanup(target.Close)
+
+	tests := map[string]struct {
+		Path     string
+		MaxBytes int64
+		Status   int
+		Body     string
+		Log      string
+	}{
+		"Response within the limit": {
+			Path:     "/small",
+			MaxBytes: 100,
+			Status:   http.StatusOK,
+			Body:     string(bytes.Repeat([]byte("a"), 100)),
+		},
+		"Response with known size exceeds the limit": {
+			Path:     "/large",
+			MaxBytes: 50,
+			Status:   http.StatusBadGateway,
+			Body:     "target service response is too large\n",
+			Log:      "target service response is too large",
+		},
+		"Response with unknown size exceeds the limit": {
+			Path:     "/chunked",
+			MaxBytes: 50,
+			Status:   http.StatusOK,
+			Body:     string(bytes.Repeat([]byte("a"), 50)),
+			Log:      "target service response is too large, aborting transfer",
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			var (
+				mu   sync.Mutex
+				logs bytes.Buffer
+			)
+
+			cfg := testConfig()
+			cfg.MaxResponseBytes = test.MaxBytes
+
+			p, err := NewProxy(
+				slog.New(slog.NewTextHandler(&lockedWriter{mu: &mu, w: &logs}, nil)),
+				cfg,
+				WithRecorder(&RecorderMock{}),
+			)
+			require.NoError(t, err)
+
+			srv := httptest.NewServer(http.HandlerFunc(p.deadlineHandler))
+			srv.Config.ErrorLog = log.New(io.Discard, "", 0)
+			t.Cleanup(srv.Close)
+
+			conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+			require.NoError(t, err)
+
+			defer conn.Close()
+
+			_, err = fmt.Fprintf(
+				conn,
+				"GET http://%[1]s%[2]s HTTP/1.1\r\nHost: %[1]s\r\nProxy-Authorization: Basic dXNlcjpwYXNz\r\n\r\n",
+				target.Listener.Addr().String(),
+				test.Path,
+			)
+			require.NoError(t, err)
+
+			resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+			require.NoError(t, err)
+
+			defer resp.Body.Close()
+
+			assert.Equal(t, test.Status, resp.StatusCode)
+
+			body, err := io.ReadAll(resp.Body)
+			if test.Path == "/chunked" {
+				assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+			} else {
+				assert.NoError(t, err)
+			}
+
+			assert.Equal(t, test.Body, string(body))
+
+			srv.Close()
+
+			mu.Lock()
+			defer mu.Unlock()
+
+			if test.Log != "" {
+				assert.Contains(t, logs.String(), `msg="`+test.Log+`"`)
+			} else {
+				assert.NotContains(t, logs.String(), "too large")
+			}
+		})
+	}
+}
+
+func Test_Proxy_httpHandler_UserAgentOverride(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ua, ok := r.Header["User-Agent"]
+		fmt.Fprintf(w, "%t %s", ok, strings.Join(ua, ","))
+	}))
+	t.Cleanup(target.Close)
+
+	tests := map[string]struct {
+		Override string
+		Result   string
+	}{
+		"User-Agent is left as is": {
+			Override: "",
+			Result:   "true client/1.0",
+		},
+		"User-Agent is stripped": {
+			Override: "-",
+			Result:   "false ",
+		},
+		"User-Agent is replaced": {
+			Override: "lwproxy",
+			Result:   "true lwproxy",
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			cfg := testConfig()
+			cfg.UserAgentOverride = test.Override
+
+			p, err := NewProxy(
+				slog.New(slog.NewTextHandler(io.Discard, nil)),
+				cfg,
+				WithRecorder(&RecorderMock{}),
+			)
+			require.NoError(t, err)
+
+			r := httptest.NewRequest(http.MethodGet, target.URL+"/path", http.NoBody)
+			r.Header.Set("User-Agent", "client/1.0")
+
+			w := httptest.NewRecorder()
+
+			p.httpHandler(w, r)
+
+			assert.Equal(t, http.StatusOK, w.Code)
+			assert.Equal(t, test.Result, w.Body.String())
+		})
+	}
+}
@@ -0,0 +1,41 @@
+// package account provides an API to attribute the bytes usage to the
+// destination hosts.
+package account
+
+import "sync"
+
+// Hosts accumulates the amount of bytes used per destination host.
+type Hosts struct {
+	mu sync.Mutex
+
+	bytes map[string]int64
+}
+
+// NewHosts creates a new hosts accounting.
+func NewHosts() *Hosts {
+	return &Hosts{
+		bytes: make(map[string]int64),
+	}
+}
+
+// AddHostBytes adds the provided number of bytes to the host total.
+func (h *Hosts) AddHostBytes(host string, n int64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.bytes[host] += n
+}
+
+// Snapshot returns a copy of the bytes used per host.
+func (h *Hosts) Snapshot() map[string]int64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	snapshot := make(map[string]int64, len(h.bytes))
+
+	for host, n := range h.bytes {
+		snapshot[host] = n
+	}
+
+	return snapshot
+}
@@ -0,0 +1,51 @@
+package account
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_NewHosts(t *testing.T) {
+	h := NewHosts()
+	require.NotNil(t, h)
+	assert.NotNil(t, h.bytes)
+}
+
+func Test_Hosts_AddHostBytes(t *testing.T) {
+	h := NewHosts()
+
+	var wg sync.WaitGroup
+
+	for range 10 {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			h.AddHostBytes("example.com", 10)
+			h.AddHostBytes("example.org", 5)
+		}()
+	}
+
+	wg.Wait()
+
+	assert.Equal(t, map[string]int64{
+		"example.com": 100,
+		"example.org": 50,
+	}, h.bytes)
+}
+
+func Test_Hosts_Snapshot(t *testing.T) {
+	h := NewHosts()
+	h.AddHostBytes("example.com", 10)
+
+	snapshot := h.Snapshot()
+	assert.Equal(t, map[string]int64{"example.com": 10}, snapshot)
+
+	// NOTE: The snapshot must not change with the further usage.
+	h.AddHostBytes("example.com", 10)
+	assert.Equal(t, map[string]int64{"example.com": 10}, snapshot)
+}
@@ -21,7 +21,7 @@ var _ DB = &DBMock{}
 //			FetchBytesFunc: func(ctx context.Context) (int64, error) {
 //				panic("mock out the FetchBytes method")
 //			},
-//			IncreaseBytesFunc: func(ctx context.Context, usedBytes int64) error {
+//			IncreaseBytesFunc: func(ctx context.Context, usedBytes int64) (int64, error) {
 //				panic("mock out the IncreaseBytes method")
 //			},
 //		}
@@ -35,7 +35,7 @@ type DBMock struct {
 	FetchBytesFunc func(ctx context.Context) (int64, error)
 
 	// IncreaseBytesFunc mocks the IncreaseBytes method.
-	IncreaseBytesFunc func(ctx context.Context, usedBytes int64) error
+	IncreaseBytesFunc func(ctx context.Context, usedBytes int64) (int64, error)
 
 	// calls tracks calls to the methods.
 	calls struct {
@@ -93,7 +93,7 @@ func (mock *DBMock) FetchBytesCalls() []struct {
 }
 
 // IncreaseBytes calls IncreaseBytesFunc.
-func (mock *DBMock) IncreaseBytes(ctx context.Context, usedBytes int64) error {
+func (mock *DBMock) IncreaseBytes(ctx context.Context, usedBytes int64) (int64, error) {
 	callInfo := struct {
 		Ctx       context.Context
 		UsedBytes int64
@@ -106,9 +106,10 @@ func (mock *DBMock) IncreaseBytes(ctx context.Context, usedBytes int64) error {
 	mock.lockIncreaseBytes.Unlock()
 	if mock.IncreaseBytesFunc == nil {
 		var (
+			nOut   int64
 			errOut error
 		)
-		return errOut
+		return nOut, errOut
 	}
 	return mock.IncreaseBytesFunc(ctx, usedBytes)
 }
@@ -6,8 +6,11 @@ package enforce
 import (
 	"context"
 	"errors"
+	"math"
 	"sync"
 	"time"
+
+	"golang.org/x/exp/slog"
 )
 
 // ErrLimitExceeded is an error for when the bytes limit is exceeded.
@@ -16,28 +19,71 @@ var ErrLimitExceeded = errors.New("bytes limit exceeded")
 // _requestTimeout is the timeout for the request.
 const _requestTimeout = 5 * time.Second
 
+// Stats is a snapshot of the limiter state.
+type Stats struct {
+	// Used is the amount of bytes used.
+	Used int64
+
+	// Max is the maximum amount of bytes that can be used. Zero means
+	// that the usage is not limited.
+	Max int64
+}
+
+// Remaining returns the percentage of bytes that can still be used. It
+// returns 100 if the usage is not limited.
+func (s Stats) Remaining() float64 {
+	if s.Max <= 0 {
+		return 100
+	}
+
+	if s.Used >= s.Max {
+		return 0
+	}
+
+	return float64(s.Max-s.Used) / float64(s.Max) * 100
+}
+
 // BytesLimiter is a struct that supervises bytes usage and limits it.
 type BytesLimiter struct {
-	mu sync.RWMutex
-
-	db       DB
-	maxBytes int64
+	log          *slog.Logger
+	db           DB
+	softMaxBytes int64
+	maxBytes     int64
+	graceBytes   int64
+
+	onExceeded   func()
+	exceededOnce sync.Once
 }
 
-// NewBytesLimiter creates a new limiter.
-func NewBytesLimiter(db DB, maxBytes int64) *BytesLimiter {
+// NewBytesLimiter creates a new limiter. MaxBytes is the hard limit above
+// which the usage is rejected. SoftMaxBytes is the limit above which the
+// usage is still allowed, but a warning is logged. Zero soft limit turns
+// the warnings off. GraceBytes is the amount of bytes the active
+// connections can still use once the hard limit is reached, while the new
+// connections are already rejected. OnExceeded is optional, when it is
+// not nil it is called once the hard limit together with the grace bytes
+// is exceeded for the first time.
+func NewBytesLimiter(
+	log *slog.Logger,
+	db DB,
+	softMaxBytes int64,
+	maxBytes int64,
+	graceBytes int64,
+	onExceeded func(),
+) *BytesLimiter {
 	return &BytesLimiter{
-		db:       db,
-		maxBytes: maxBytes,
+		log:          log.With("job", "bytes-limiter"),
+		db:           db,
+		softMaxBytes: softMaxBytes,
+		maxBytes:     maxBytes,
+		graceBytes:   graceBytes,
+		onExceeded:   onExceeded,
 	}
 }
 
-// CheckBytes checks the amount of bytes used and returns an error if the
-// limit is exceeded.
+// CheckBytes checks the amount of bytes used and returns false if the hard
+// limit is exceeded. A warning is logged if the soft limit is exceeded.
 func (bl *BytesLimiter) CheckBytes() (bool, error) {
-	bl.mu.RLock()
-	defer bl.mu.RUnlock()
-
 	ctx, cancel := context.WithTimeout(context.Background(), _requestTimeout)
 	defer cancel()
 
@@ -46,40 +92,82 @@ func (bl *BytesLimiter) CheckBytes() (bool, error) {
 		return false, err
 	}
 
-	return bytes < bl.maxBytes, nil
-}
+	if bytes >= bl.maxBytes {
+		return false, nil
+	}
 
-// UseBytes uses the given amount of bytes and returns true if the limiter
-// hasn't reached a limit.
-func (bl *BytesLimiter) UseBytes(usedBytes int64) error {
-	bl.mu.Lock()
-	defer bl.mu.Unlock()
+	if bl.softMaxBytes > 0 && bytes >= bl.softMaxBytes {
+		bl.log.Warn(
+			"soft bytes limit exceeded",
+			slog.Int64("used_bytes", bytes),
+			slog.Int64("soft_max_bytes", bl.softMaxBytes),
+			slog.Int64("max_bytes", bl.maxBytes),
+		)
+	}
 
+	return true, nil
+}
+
+// Stats returns the current bytes usage together with the limit.
+func (bl *BytesLimiter) Stats() (Stats, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), _requestTimeout)
 	defer cancel()
 
 	bytes, err := bl.db.FetchBytes(ctx)
 	if err != nil {
-		return err
+		return Stats{}, err
 	}
 
-	var overflow bool
+	return Stats{
+		Used: bytes,
+		Max:  bl.maxBytes,
+	}, nil
+}
+
+// UseBytes uses the given amount of bytes and returns ErrLimitExceeded if
+// the usage exceeds the hard limit together with the grace bytes.
+func (bl *BytesLimiter) UseBytes(usedBytes int64) error {
+	err := bl.useBytes(usedBytes)
 
-	if bytes+usedBytes > bl.maxBytes {
-		overflow = true
+	// NOTE: The callback is called without holding the lock, so that it
+	// could use the limiter itself.
+	if errors.Is(err, ErrLimitExceeded) && bl.onExceeded != nil {
+		bl.exceededOnce.Do(bl.onExceeded)
 	}
 
-	if err := bl.db.IncreaseBytes(ctx, usedBytes); err != nil {
+	return err
+}
+
+// useBytes increases the bytes usage and checks the limit.
+func (bl *BytesLimiter) useBytes(usedBytes int64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), _requestTimeout)
+	defer cancel()
+
+	// NOTE: The usage is increased and checked in a single database call,
+	// so that multiple proxy instances sharing the database cannot
+	// overshoot the limit.
+	total, err := bl.db.IncreaseBytes(ctx, usedBytes)
+	if err != nil {
 		return err
 	}
 
-	if overflow {
+	if total > withGrace(bl.maxBytes, bl.graceBytes) {
 		return ErrLimitExceeded
 	}
 
 	return nil
 }
 
+// withGrace returns the limit increased by the grace bytes. The result is
+// clamped at the maximum int64 value instead of overflowing.
+func withGrace(maxBytes, graceBytes int64) int64 {
+	if graceBytes > math.MaxInt64-maxBytes {
+		return math.MaxInt64
+	}
+
+	return maxBytes + graceBytes
+}
+
 // NoopBytesLimiter is a no-op limiter.
 type NoopBytesLimiter struct{}
 
@@ -98,11 +186,17 @@ func (nbl *NoopBytesLimiter) UseBytes(_ int64) error {
 	return nil
 }
 
+// Stats returns empty stats as the no-op limiter does not track usage.
+func (nbl *NoopBytesLimiter) Stats() (Stats, error) {
+	return Stats{}, nil
+}
+
 // DB is an interface for a database communication.
 type DB interface {
 	// FetchBytes should return the amount of bytes used.
 	FetchBytes(ctx context.Context) (int64, error)
 
-	// IncreaseBytes should increase the amount of bytes used.
-	IncreaseBytes(ctx context.Context, usedBytes int64) error
+	// IncreaseBytes should atomically increase the amount of bytes used
+	// and return the new total.
+	IncreaseBytes(ctx context.Context, usedBytes int64) (int64, error)
 }
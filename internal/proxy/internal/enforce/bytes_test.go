@@ -1,20 +1,33 @@
 package enforce
 
 import (
+	"bytes"
 	"context"
+	"io"
+	"math"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"golang.org/x/exp/slog"
 )
 
 func Test_NewBytesLimiter(t *testing.T) {
 	dbMock := &DBMock{}
 
-	bl := NewBytesLimiter(dbMock, 500)
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	bl := NewBytesLimiter(log, dbMock, 400, 500, 50, nil)
 	require.NotNil(t, bl)
+	assert.Equal(t, int64(400), bl.softMaxBytes)
 	assert.Equal(t, int64(500), bl.maxBytes)
+	assert.Equal(t, int64(50), bl.graceBytes)
 	assert.Equal(t, dbMock, bl.db)
+	assert.Equal(t, log.With("job", "bytes-limiter"), bl.log)
+	assert.Nil(t, bl.onExceeded)
+
+	bl = NewBytesLimiter(log, dbMock, 0, 500, 0, func() {})
+	assert.NotNil(t, bl.onExceeded)
 }
 
 func Test_BytesLimiter_CheckBytes(t *testing.T) {
@@ -27,10 +40,13 @@ func Test_BytesLimiter_CheckBytes(t *testing.T) {
 	}
 
 	tests := map[string]struct {
-		DB       *DBMock
-		MaxBytes int64
-		Result   bool
-		Error    error
+		DB           *DBMock
+		SoftMaxBytes int64
+		MaxBytes     int64
+		GraceBytes   int64
+		Result       bool
+		Error        error
+		LogOutput    string
 	}{
 		"db.FetchBytes returned an error": {
 			DB:       stubDatabase(0, assert.AnError),
@@ -46,15 +62,43 @@ func Test_BytesLimiter_CheckBytes(t *testing.T) {
 			MaxBytes: 500,
 			Result:   true,
 		},
+		"Usage is below the soft limit": {
+			DB:           stubDatabase(300, nil),
+			SoftMaxBytes: 400,
+			MaxBytes:     500,
+			Result:       true,
+		},
+		"Usage is between the soft and the hard limits": {
+			DB:           stubDatabase(450, nil),
+			SoftMaxBytes: 400,
+			MaxBytes:     500,
+			Result:       true,
+			LogOutput:    "level=WARN msg=\"soft bytes limit exceeded\" used_bytes=450 soft_max_bytes=400 max_bytes=500\n",
+		},
+		"Usage is above the hard limit": {
+			DB:           stubDatabase(500, nil),
+			SoftMaxBytes: 400,
+			MaxBytes:     500,
+		},
+		"Usage is within the grace bytes": {
+			DB:         stubDatabase(520, nil),
+			MaxBytes:   500,
+			GraceBytes: 50,
+		},
 	}
 
 	for name, test := range tests {
 		t.Run(name, func(t *testing.T) {
 			t.Parallel()
 
+			var buffer bytes.Buffer
+
 			bl := &BytesLimiter{
-				db:       test.DB,
-				maxBytes: test.MaxBytes,
+				log:          slog.New(slog.NewTextHandler(&buffer, nil)),
+				db:           test.DB,
+				softMaxBytes: test.SoftMaxBytes,
+				maxBytes:     test.MaxBytes,
+				graceBytes:   test.GraceBytes,
 			}
 
 			ok, err := bl.CheckBytes()
@@ -62,18 +106,22 @@ func Test_BytesLimiter_CheckBytes(t *testing.T) {
 			assert.Equal(t, test.Error, err)
 
 			assert.Len(t, test.DB.FetchBytesCalls(), 1)
+
+			if test.LogOutput == "" {
+				assert.Empty(t, buffer.String())
+				return
+			}
+
+			assert.Contains(t, buffer.String(), test.LogOutput)
 		})
 	}
 }
 
 func Test_BytesLimiter_UseBytes(t *testing.T) {
-	stubDB := func(bytes int64, fbErr, ibErr error) *DBMock {
+	stubDB := func(total int64, err error) *DBMock {
 		return &DBMock{
-			FetchBytesFunc: func(_ context.Context) (int64, error) {
-				return bytes, fbErr
-			},
-			IncreaseBytesFunc: func(_ context.Context, _ int64) error {
-				return ibErr
+			IncreaseBytesFunc: func(_ context.Context, _ int64) (int64, error) {
+				return total, err
 			},
 		}
 	}
@@ -109,47 +157,79 @@ func Test_BytesLimiter_UseBytes(t *testing.T) {
 	}
 
 	tests := map[string]struct {
-		DB        *DBMock
-		MaxBytes  int64
-		UsedBytes int64
-		Error     error
-		Checks    []check
+		DB         *DBMock
+		MaxBytes   int64
+		GraceBytes int64
+		UsedBytes  int64
+		Error      error
+		Checks     []check
 	}{
-		"db.FetchBytes returned an error": {
-			DB:       stubDB(0, assert.AnError, nil),
-			MaxBytes: 500,
-			Error:    assert.AnError,
-			Checks: []check{
-				wasDBFetchBytesCalled(true),
-				wasDBIncreaseBytesCalled(false, 0),
-			},
-		},
 		"db.IncreaseBytes returned an error": {
-			DB:        stubDB(0, nil, assert.AnError),
+			DB:        stubDB(0, assert.AnError),
 			MaxBytes:  500,
 			UsedBytes: 200,
 			Error:     assert.AnError,
 			Checks: []check{
-				wasDBFetchBytesCalled(true),
+				wasDBFetchBytesCalled(false),
 				wasDBIncreaseBytesCalled(true, 200),
 			},
 		},
 		"Successfully executed, however overflow was reached": {
-			DB:        stubDB(400, nil, nil),
+			DB:        stubDB(700, nil),
 			MaxBytes:  500,
 			UsedBytes: 300,
 			Error:     ErrLimitExceeded,
 			Checks: []check{
-				wasDBFetchBytesCalled(true),
+				wasDBFetchBytesCalled(false),
+				wasDBIncreaseBytesCalled(true, 300),
+			},
+		},
+		"Successfully executed, limit was reached exactly": {
+			DB:        stubDB(500, nil),
+			MaxBytes:  500,
+			UsedBytes: 300,
+			Checks: []check{
+				wasDBFetchBytesCalled(false),
+				wasDBIncreaseBytesCalled(true, 300),
+			},
+		},
+		"Successfully executed, limit was exceeded within the grace bytes": {
+			DB:         stubDB(550, nil),
+			MaxBytes:   500,
+			GraceBytes: 50,
+			UsedBytes:  300,
+			Checks: []check{
+				wasDBFetchBytesCalled(false),
+				wasDBIncreaseBytesCalled(true, 300),
+			},
+		},
+		"Successfully executed, however overflow of the grace bytes was reached": {
+			DB:         stubDB(551, nil),
+			MaxBytes:   500,
+			GraceBytes: 50,
+			UsedBytes:  300,
+			Error:      ErrLimitExceeded,
+			Checks: []check{
+				wasDBFetchBytesCalled(false),
+				wasDBIncreaseBytesCalled(true, 300),
+			},
+		},
+		"Successfully executed, grace bytes are clamped": {
+			DB:         stubDB(math.MaxInt64, nil),
+			MaxBytes:   500,
+			GraceBytes: math.MaxInt64,
+			UsedBytes:  300,
+			Checks: []check{
+				wasDBFetchBytesCalled(false),
 				wasDBIncreaseBytesCalled(true, 300),
 			},
 		},
 		"Successfully executed, no overflow was reached": {
-			DB:        stubDB(100, nil, nil),
+			DB:        stubDB(400, nil),
 			MaxBytes:  500,
 			UsedBytes: 300,
 			Checks: []check{
-				wasDBFetchBytesCalled(true),
+				wasDBFetchBytesCalled(false),
 				wasDBIncreaseBytesCalled(true, 300),
 			},
 		},
@@ -160,8 +240,9 @@ func Test_BytesLimiter_UseBytes(t *testing.T) {
 			t.Parallel()
 
 			bl := &BytesLimiter{
-				db:       test.DB,
-				maxBytes: test.MaxBytes,
+				db:         test.DB,
+				maxBytes:   test.MaxBytes,
+				graceBytes: test.GraceBytes,
 			}
 
 			assert.Equal(t, test.Error, bl.UseBytes(test.UsedBytes))
@@ -191,3 +272,112 @@ func Test_NoopBytesLimiter_UseBytes(t *testing.T) {
 
 	require.NoError(t, bl.UseBytes(500))
 }
+
+func Test_BytesLimiter_UseBytes_OnExceeded(t *testing.T) {
+	var (
+		used  int64
+		calls int
+	)
+
+	db := &DBMock{
+		FetchBytesFunc: func(_ context.Context) (int64, error) {
+			return used, nil
+		},
+		IncreaseBytesFunc: func(_ context.Context, usedBytes int64) (int64, error) {
+			used += usedBytes
+			return used, nil
+		},
+	}
+
+	var bl *BytesLimiter
+
+	bl = NewBytesLimiter(slog.New(slog.NewTextHandler(io.Discard, nil)), db, 0, 500, 0, func() {
+		calls++
+
+		// NOTE: The callback must be able to use the limiter.
+		_, err := bl.Stats()
+		assert.NoError(t, err)
+	})
+
+	require.NoError(t, bl.UseBytes(400))
+	assert.Zero(t, calls)
+
+	for range 3 {
+		assert.ErrorIs(t, bl.UseBytes(200), ErrLimitExceeded)
+	}
+
+	assert.Equal(t, 1, calls)
+}
+
+func Test_BytesLimiter_Stats(t *testing.T) {
+	tests := map[string]struct {
+		DB     *DBMock
+		Result Stats
+		Error  error
+	}{
+		"db.FetchBytes returned an error": {
+			DB: &DBMock{
+				FetchBytesFunc: func(_ context.Context) (int64, error) {
+					return 0, assert.AnError
+				},
+			},
+			Error: assert.AnError,
+		},
+		"Successfully returned stats": {
+			DB: &DBMock{
+				FetchBytesFunc: func(_ context.Context) (int64, error) {
+					return 300, nil
+				},
+			},
+			Result: Stats{
+				Used: 300,
+				Max:  500,
+			},
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			bl := &BytesLimiter{
+				db:       test.DB,
+				maxBytes: 500,
+			}
+
+			stats, err := bl.Stats()
+			assert.Equal(t, test.Result, stats)
+			assert.Equal(t, test.Error, err)
+
+			assert.Len(t, test.DB.FetchBytesCalls(), 1)
+		})
+	}
+}
+
+func Test_Stats_Remaining(t *testing.T) {
+	tests := map[string]struct {
+		Stats  Stats
+		Result float64
+	}{
+		"Usage is not limited": {
+			Stats:  Stats{Used: 300},
+			Result: 100,
+		},
+		"Limit is exceeded": {
+			Stats:  Stats{Used: 600, Max: 500},
+			Result: 0,
+		},
+		"Part of the limit is used": {
+			Stats:  Stats{Used: 100, Max: 400},
+			Result: 75,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			assert.InDelta(t, test.Result, test.Stats.Remaining(), 0.001)
+		})
+	}
+}
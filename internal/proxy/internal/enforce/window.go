@@ -0,0 +1,176 @@
+package enforce
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/davseby/lwproxy/internal/clock"
+	"golang.org/x/exp/slog"
+)
+
+// _windowBuckets is the number of buckets the sliding window is split
+// into. The usage ages out one bucket at a time.
+const _windowBuckets = 60
+
+// windowBucket holds the bytes used during a single bucket period.
+type windowBucket struct {
+	// period is the number of the bucket period since the unix epoch.
+	period int64
+	bytes  int64
+}
+
+// SlidingWindowLimiter is a limiter that limits the bytes used during a
+// sliding time window, e.g. 1GB per hour. The usage is kept in memory in
+// time buckets, so it ages out gradually instead of being reset at once.
+type SlidingWindowLimiter struct {
+	log          *slog.Logger
+	clock        clock.Clock
+	width        time.Duration
+	softMaxBytes int64
+	graceBytes   int64
+	onExceeded   func()
+
+	mu           sync.Mutex
+	maxBytes     int64
+	buckets      [_windowBuckets]windowBucket
+	exceededOnce sync.Once
+}
+
+// NewSlidingWindowLimiter creates a new sliding window limiter. MaxBytes
+// is the amount of bytes that can be used during the window. SoftMaxBytes
+// is the window usage above which a warning is logged, zero turns the
+// warnings off. GraceBytes is the amount of bytes the active connections
+// can still use once the limit is reached. OnExceeded is optional, when
+// it is not nil it is called once the limit together with the grace
+// bytes is exceeded for the first time.
+func NewSlidingWindowLimiter(
+	log *slog.Logger,
+	clk clock.Clock,
+	window time.Duration,
+	softMaxBytes int64,
+	maxBytes int64,
+	graceBytes int64,
+	onExceeded func(),
+) *SlidingWindowLimiter {
+	width := window / _windowBuckets
+	if width <= 0 {
+		width = 1
+	}
+
+	return &SlidingWindowLimiter{
+		log:          log.With("job", "sliding-window-limiter"),
+		clock:        clk,
+		width:        width,
+		softMaxBytes: softMaxBytes,
+		graceBytes:   graceBytes,
+		onExceeded:   onExceeded,
+		maxBytes:     maxBytes,
+	}
+}
+
+// CheckBytes returns false if the bytes used during the window reached
+// the limit. A warning is logged if the soft limit is reached.
+func (swl *SlidingWindowLimiter) CheckBytes() (bool, error) {
+	swl.mu.Lock()
+	used, maxBytes := swl.used(swl.period()), swl.maxBytes
+	swl.mu.Unlock()
+
+	if used >= maxBytes {
+		return false, nil
+	}
+
+	if swl.softMaxBytes > 0 && used >= swl.softMaxBytes {
+		swl.log.Warn(
+			"soft bytes limit exceeded",
+			slog.Int64("used_bytes", used),
+			slog.Int64("soft_max_bytes", swl.softMaxBytes),
+			slog.Int64("max_bytes", maxBytes),
+		)
+	}
+
+	return true, nil
+}
+
+// UseBytes adds the bytes to the current bucket and returns
+// ErrLimitExceeded if the bytes used during the window exceed the limit
+// together with the grace bytes.
+func (swl *SlidingWindowLimiter) UseBytes(usedBytes int64) error {
+	err := swl.useBytes(usedBytes)
+
+	// NOTE: The callback is called without holding the lock, so that it
+	// could use the limiter itself.
+	if errors.Is(err, ErrLimitExceeded) && swl.onExceeded != nil {
+		swl.exceededOnce.Do(swl.onExceeded)
+	}
+
+	return err
+}
+
+// Stats returns the bytes used during the window together with the limit.
+func (swl *SlidingWindowLimiter) Stats() (Stats, error) {
+	swl.mu.Lock()
+	defer swl.mu.Unlock()
+
+	return Stats{
+		Used: swl.used(swl.period()),
+		Max:  swl.maxBytes,
+	}, nil
+}
+
+// SetMaxBytes replaces the limit. The bytes used during the window are
+// kept.
+func (swl *SlidingWindowLimiter) SetMaxBytes(maxBytes int64) {
+	swl.mu.Lock()
+	defer swl.mu.Unlock()
+
+	swl.maxBytes = maxBytes
+}
+
+// Reset drops the bytes used during the window.
+func (swl *SlidingWindowLimiter) Reset() {
+	swl.mu.Lock()
+	defer swl.mu.Unlock()
+
+	swl.buckets = [_windowBuckets]windowBucket{}
+}
+
+// useBytes adds the bytes to the current bucket and checks the limit.
+func (swl *SlidingWindowLimiter) useBytes(usedBytes int64) error {
+	swl.mu.Lock()
+	defer swl.mu.Unlock()
+
+	period := swl.period()
+
+	bucket := &swl.buckets[period%_windowBuckets]
+	if bucket.period != period {
+		*bucket = windowBucket{period: period}
+	}
+
+	bucket.bytes += usedBytes
+
+	if swl.used(period) > withGrace(swl.maxBytes, swl.graceBytes) {
+		return ErrLimitExceeded
+	}
+
+	return nil
+}
+
+// used returns the bytes used during the window that ends with the given
+// bucket period.
+func (swl *SlidingWindowLimiter) used(period int64) int64 {
+	var total int64
+
+	for _, bucket := range swl.buckets {
+		if bucket.period > period-_windowBuckets && bucket.period <= period {
+			total += bucket.bytes
+		}
+	}
+
+	return total
+}
+
+// period returns the current bucket period.
+func (swl *SlidingWindowLimiter) period() int64 {
+	return swl.clock.Now().UnixNano() / int64(swl.width)
+}
@@ -0,0 +1,193 @@
+package enforce
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/davseby/lwproxy/internal/clock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/exp/slog"
+)
+
+// fakeClock is a manually advanced clock. The limiter does not use
+// timers, so they are left to the system clock.
+type fakeClock struct {
+	clock.Real
+
+	now time.Time
+}
+
+// Now returns the current fake time.
+func (fc *fakeClock) Now() time.Time {
+	return fc.now
+}
+
+// Advance moves the fake time forward.
+func (fc *fakeClock) Advance(d time.Duration) {
+	fc.now = fc.now.Add(d)
+}
+
+// newTestSlidingWindowLimiter creates a sliding window limiter that uses
+// a fake clock.
+func newTestSlidingWindowLimiter(window time.Duration, maxBytes int64, onExceeded func()) (*SlidingWindowLimiter, *fakeClock) {
+	clock := &fakeClock{now: time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)}
+
+	swl := NewSlidingWindowLimiter(slog.New(slog.NewTextHandler(io.Discard, nil)), clock, window, 0, maxBytes, 0, onExceeded)
+
+	return swl, clock
+}
+
+func Test_NewSlidingWindowLimiter(t *testing.T) {
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	clk := clock.New()
+
+	swl := NewSlidingWindowLimiter(log, clk, time.Hour, 400, 500, 50, nil)
+	require.NotNil(t, swl)
+	assert.Equal(t, log.With("job", "sliding-window-limiter"), swl.log)
+	assert.Equal(t, clk, swl.clock)
+	assert.Equal(t, time.Minute, swl.width)
+	assert.Equal(t, int64(400), swl.softMaxBytes)
+	assert.Equal(t, int64(500), swl.maxBytes)
+	assert.Equal(t, int64(50), swl.graceBytes)
+	assert.Nil(t, swl.onExceeded)
+
+	// window shorter than the number of buckets
+	swl = NewSlidingWindowLimiter(log, clk, time.Nanosecond, 0, 500, 0, func() {})
+	assert.Equal(t, time.Duration(1), swl.width)
+	assert.NotNil(t, swl.onExceeded)
+}
+
+func Test_SlidingWindowLimiter_UseBytes(t *testing.T) {
+	swl, clock := newTestSlidingWindowLimiter(time.Hour, 500, nil)
+
+	require.NoError(t, swl.UseBytes(300))
+
+	clock.Advance(30 * time.Minute)
+	require.NoError(t, swl.UseBytes(200))
+
+	ok, err := swl.CheckBytes()
+	require.NoError(t, err)
+	assert.False(t, ok)
+	assert.ErrorIs(t, swl.UseBytes(1), ErrLimitExceeded)
+
+	// the first usage ages out
+	clock.Advance(31 * time.Minute)
+
+	ok, err = swl.CheckBytes()
+	require.NoError(t, err)
+	assert.True(t, ok)
+
+	stats, err := swl.Stats()
+	require.NoError(t, err)
+	assert.Equal(t, Stats{Used: 201, Max: 500}, stats)
+
+	require.NoError(t, swl.UseBytes(299))
+	assert.ErrorIs(t, swl.UseBytes(1), ErrLimitExceeded)
+
+	// all usage ages out
+	clock.Advance(2 * time.Hour)
+
+	stats, err = swl.Stats()
+	require.NoError(t, err)
+	assert.Equal(t, Stats{Max: 500}, stats)
+}
+
+func Test_SlidingWindowLimiter_UseBytes_GraceBytes(t *testing.T) {
+	swl, _ := newTestSlidingWindowLimiter(time.Hour, 500, nil)
+	swl.graceBytes = 100
+
+	require.NoError(t, swl.UseBytes(500))
+
+	// new connections are rejected, while the active ones can use the
+	// grace bytes.
+	ok, err := swl.CheckBytes()
+	require.NoError(t, err)
+	assert.False(t, ok)
+
+	require.NoError(t, swl.UseBytes(100))
+	assert.ErrorIs(t, swl.UseBytes(1), ErrLimitExceeded)
+}
+
+func Test_SlidingWindowLimiter_UseBytes_OnExceeded(t *testing.T) {
+	var calls int
+
+	var swl *SlidingWindowLimiter
+
+	swl, _ = newTestSlidingWindowLimiter(time.Hour, 500, func() {
+		calls++
+
+		// NOTE: The callback must be able to use the limiter.
+		_, err := swl.Stats()
+		assert.NoError(t, err)
+	})
+
+	require.NoError(t, swl.UseBytes(400))
+	assert.Zero(t, calls)
+
+	for range 3 {
+		assert.ErrorIs(t, swl.UseBytes(200), ErrLimitExceeded)
+	}
+
+	assert.Equal(t, 1, calls)
+}
+
+func Test_SlidingWindowLimiter_SetMaxBytes(t *testing.T) {
+	swl, _ := newTestSlidingWindowLimiter(time.Hour, 500, nil)
+
+	require.NoError(t, swl.UseBytes(400))
+
+	swl.SetMaxBytes(300)
+
+	stats, err := swl.Stats()
+	require.NoError(t, err)
+	assert.Equal(t, Stats{Used: 400, Max: 300}, stats)
+
+	ok, err := swl.CheckBytes()
+	require.NoError(t, err)
+	assert.False(t, ok)
+}
+
+func Test_SlidingWindowLimiter_CheckBytes_SoftLimit(t *testing.T) {
+	var buffer bytes.Buffer
+
+	swl, _ := newTestSlidingWindowLimiter(time.Hour, 500, nil)
+	swl.log = slog.New(slog.NewTextHandler(&buffer, nil))
+	swl.softMaxBytes = 400
+
+	require.NoError(t, swl.UseBytes(300))
+
+	ok, err := swl.CheckBytes()
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.Empty(t, buffer.String())
+
+	require.NoError(t, swl.UseBytes(150))
+
+	ok, err = swl.CheckBytes()
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.Contains(t, buffer.String(), "level=WARN msg=\"soft bytes limit exceeded\" used_bytes=450 soft_max_bytes=400 max_bytes=500\n")
+}
+
+func Test_SlidingWindowLimiter_Reset(t *testing.T) {
+	swl, clock := newTestSlidingWindowLimiter(time.Hour, 500, nil)
+
+	require.NoError(t, swl.UseBytes(300))
+
+	clock.Advance(time.Minute)
+	require.NoError(t, swl.UseBytes(200))
+
+	swl.Reset()
+
+	stats, err := swl.Stats()
+	require.NoError(t, err)
+	assert.Equal(t, Stats{Max: 500}, stats)
+
+	ok, err := swl.CheckBytes()
+	require.NoError(t, err)
+	assert.True(t, ok)
+}
@@ -19,9 +19,6 @@ var _ BytesLimiter = &BytesLimiterMock{}
 //
 //		// make and configure a mocked BytesLimiter
 //		mockedBytesLimiter := &BytesLimiterMock{
-//			CheckBytesFunc: func() (bool, error) {
-//				panic("mock out the CheckBytes method")
-//			},
 //			UseBytesFunc: func(n int64) error {
 //				panic("mock out the UseBytes method")
 //			},
@@ -32,56 +29,18 @@ var _ BytesLimiter = &BytesLimiterMock{}
 //
 //	}
 type BytesLimiterMock struct {
-	// CheckBytesFunc mocks the CheckBytes method.
-	CheckBytesFunc func() (bool, error)
-
 	// UseBytesFunc mocks the UseBytes method.
 	UseBytesFunc func(n int64) error
 
 	// calls tracks calls to the methods.
 	calls struct {
-		// CheckBytes holds details about calls to the CheckBytes method.
-		CheckBytes []struct {
-		}
 		// UseBytes holds details about calls to the UseBytes method.
 		UseBytes []struct {
 			// N is the n argument value.
 			N int64
 		}
 	}
-	lockCheckBytes sync.RWMutex
-	lockUseBytes   sync.RWMutex
-}
-
-// CheckBytes calls CheckBytesFunc.
-func (mock *BytesLimiterMock) CheckBytes() (bool, error) {
-	callInfo := struct {
-	}{}
-	mock.lockCheckBytes.Lock()
-	mock.calls.CheckBytes = append(mock.calls.CheckBytes, callInfo)
-	mock.lockCheckBytes.Unlock()
-	if mock.CheckBytesFunc == nil {
-		var (
-			bOut   bool
-			errOut error
-		)
-		return bOut, errOut
-	}
-	return mock.CheckBytesFunc()
-}
-
-// CheckBytesCalls gets all the calls that were made to CheckBytes.
-// Check the length with:
-//
-//	len(mockedBytesLimiter.CheckBytesCalls())
-func (mock *BytesLimiterMock) CheckBytesCalls() []struct {
-} {
-	var calls []struct {
-	}
-	mock.lockCheckBytes.RLock()
-	calls = mock.calls.CheckBytes
-	mock.lockCheckBytes.RUnlock()
-	return calls
+	lockUseBytes sync.RWMutex
 }
 
 // UseBytes calls UseBytesFunc.
@@ -119,6 +78,144 @@ func (mock *BytesLimiterMock) UseBytesCalls() []struct {
 	return calls
 }
 
+// Ensure, that MetricsMock does implement Metrics.
+// If this is not the case, regenerate this file with moq.
+var _ Metrics = &MetricsMock{}
+
+// MetricsMock is a mock implementation of Metrics.
+//
+//	func TestSomethingThatUsesMetrics(t *testing.T) {
+//
+//		// make and configure a mocked Metrics
+//		mockedMetrics := &MetricsMock{
+//			AddBytesFunc: func(n int64)  {
+//				panic("mock out the AddBytes method")
+//			},
+//		}
+//
+//		// use mockedMetrics in code that requires Metrics
+//		// and then make assertions.
+//
+//	}
+type MetricsMock struct {
+	// AddBytesFunc mocks the AddBytes method.
+	AddBytesFunc func(n int64)
+
+	// calls tracks calls to the methods.
+	calls struct {
+		// AddBytes holds details about calls to the AddBytes method.
+		AddBytes []struct {
+			// N is the n argument value.
+			N int64
+		}
+	}
+	lockAddBytes sync.RWMutex
+}
+
+// AddBytes calls AddBytesFunc.
+func (mock *MetricsMock) AddBytes(n int64) {
+	callInfo := struct {
+		N int64
+	}{
+		N: n,
+	}
+	mock.lockAddBytes.Lock()
+	mock.calls.AddBytes = append(mock.calls.AddBytes, callInfo)
+	mock.lockAddBytes.Unlock()
+	if mock.AddBytesFunc == nil {
+		return
+	}
+	mock.AddBytesFunc(n)
+}
+
+// AddBytesCalls gets all the calls that were made to AddBytes.
+// Check the length with:
+//
+//	len(mockedMetrics.AddBytesCalls())
+func (mock *MetricsMock) AddBytesCalls() []struct {
+	N int64
+} {
+	var calls []struct {
+		N int64
+	}
+	mock.lockAddBytes.RLock()
+	calls = mock.calls.AddBytes
+	mock.lockAddBytes.RUnlock()
+	return calls
+}
+
+// Ensure, that AccountantMock does implement Accountant.
+// If this is not the case, regenerate this file with moq.
+var _ Accountant = &AccountantMock{}
+
+// AccountantMock is a mock implementation of Accountant.
+//
+//	func TestSomethingThatUsesAccountant(t *testing.T) {
+//
+//		// make and configure a mocked Accountant
+//		mockedAccountant := &AccountantMock{
+//			AddHostBytesFunc: func(host string, n int64)  {
+//				panic("mock out the AddHostBytes method")
+//			},
+//		}
+//
+//		// use mockedAccountant in code that requires Accountant
+//		// and then make assertions.
+//
+//	}
+type AccountantMock struct {
+	// AddHostBytesFunc mocks the AddHostBytes method.
+	AddHostBytesFunc func(host string, n int64)
+
+	// calls tracks calls to the methods.
+	calls struct {
+		// AddHostBytes holds details about calls to the AddHostBytes method.
+		AddHostBytes []struct {
+			// Host is the host argument value.
+			Host string
+			// N is the n argument value.
+			N int64
+		}
+	}
+	lockAddHostBytes sync.RWMutex
+}
+
+// AddHostBytes calls AddHostBytesFunc.
+func (mock *AccountantMock) AddHostBytes(host string, n int64) {
+	callInfo := struct {
+		Host string
+		N    int64
+	}{
+		Host: host,
+		N:    n,
+	}
+	mock.lockAddHostBytes.Lock()
+	mock.calls.AddHostBytes = append(mock.calls.AddHostBytes, callInfo)
+	mock.lockAddHostBytes.Unlock()
+	if mock.AddHostBytesFunc == nil {
+		return
+	}
+	mock.AddHostBytesFunc(host, n)
+}
+
+// AddHostBytesCalls gets all the calls that were made to AddHostBytes.
+// Check the length with:
+//
+//	len(mockedAccountant.AddHostBytesCalls())
+func (mock *AccountantMock) AddHostBytesCalls() []struct {
+	Host string
+	N    int64
+} {
+	var calls []struct {
+		Host string
+		N    int64
+	}
+	mock.lockAddHostBytes.RLock()
+	calls = mock.calls.AddHostBytes
+	mock.lockAddHostBytes.RUnlock()
+	return calls
+}
+
 // Ensure, that connMock does implement conn.
 // If this is not the case, regenerate this file with moq.
 var _ conn = &connMock{}
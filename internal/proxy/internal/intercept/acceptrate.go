@@ -0,0 +1,58 @@
+package intercept
+
+import (
+	"sync"
+	"time"
+)
+
+// acceptLimiter is a token bucket that paces the accepted connections.
+// The bucket holds up to burst tokens and it is refilled at the rate of
+// tokens per second. Every accepted connection takes a single token.
+type acceptLimiter struct {
+	rate  float64
+	burst float64
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// newAcceptLimiter creates a new accept limiter that allows rate
+// connections per second with bursts of up to burst connections. The
+// bucket starts full at the provided time. Nil is returned if the rate is
+// not positive, i.e. the accepts are not limited.
+func newAcceptLimiter(rate float64, burst int, now time.Time) *acceptLimiter {
+	if rate <= 0 {
+		return nil
+	}
+
+	burst = max(burst, 1)
+
+	return &acceptLimiter{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   now,
+	}
+}
+
+// reserve takes a token and returns the duration after which the token
+// becomes available. Zero is returned if the token is available right
+// away.
+func (al *acceptLimiter) reserve(now time.Time) time.Duration {
+	al.mu.Lock()
+	defer al.mu.Unlock()
+
+	if now.After(al.last) {
+		al.tokens = min(al.burst, al.tokens+now.Sub(al.last).Seconds()*al.rate)
+		al.last = now
+	}
+
+	al.tokens--
+
+	if al.tokens >= 0 {
+		return 0
+	}
+
+	return time.Duration(-al.tokens / al.rate * float64(time.Second))
+}
@@ -0,0 +1,110 @@
+package intercept
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/exp/slog"
+)
+
+func Test_newAcceptLimiter(t *testing.T) {
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	assert.Nil(t, newAcceptLimiter(0, 10, now))
+	assert.Nil(t, newAcceptLimiter(-1, 10, now))
+
+	al := newAcceptLimiter(5, 10, now)
+	require.NotNil(t, al)
+	assert.Equal(t, float64(5), al.rate)
+	assert.Equal(t, float64(10), al.burst)
+	assert.Equal(t, float64(10), al.tokens)
+	assert.Equal(t, now, al.last)
+
+	// the burst allows at least a single connection
+	al = newAcceptLimiter(5, 0, now)
+	require.NotNil(t, al)
+	assert.Equal(t, float64(1), al.burst)
+}
+
+func Test_acceptLimiter_reserve(t *testing.T) {
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	al := &acceptLimiter{
+		rate:   10,
+		burst:  2,
+		tokens: 2,
+		last:   now,
+	}
+
+	// burst
+	assert.Zero(t, al.reserve(now))
+	assert.Zero(t, al.reserve(now))
+
+	// paced
+	assert.Equal(t, 100*time.Millisecond, al.reserve(now))
+	assert.Equal(t, 200*time.Millisecond, al.reserve(now))
+
+	// refilled tokens pay off the reserved ones first
+	assert.Equal(t, 200*time.Millisecond, al.reserve(now.Add(100*time.Millisecond)))
+
+	// the bucket is refilled up to the burst
+	now = now.Add(time.Hour)
+
+	assert.Zero(t, al.reserve(now))
+	assert.Zero(t, al.reserve(now))
+	assert.Equal(t, 100*time.Millisecond, al.reserve(now))
+}
+
+func Test_Listener_Accept_AcceptRate(t *testing.T) {
+	pl := &pipeListener{
+		connCh: make(chan net.Conn, 5),
+	}
+
+	l := NewListenerFromListener(
+		slog.New(slog.NewTextHandler(io.Discard, nil)),
+		pl,
+		&BytesLimiterMock{},
+		Config{
+			Metrics:     &MetricsMock{},
+			Accountant:  &AccountantMock{},
+			AcceptRate:  20,
+			AcceptBurst: 2,
+		},
+	)
+
+	defer l.Close()
+
+	for range 5 {
+		server, client := net.Pipe()
+
+		defer client.Close()
+
+		pl.connCh <- server
+	}
+
+	start := time.Now()
+
+	for range 2 {
+		conn, err := l.Accept()
+		require.NoError(t, err)
+
+		defer conn.Close()
+	}
+
+	// the burst is accepted right away
+	assert.Less(t, time.Since(start), 40*time.Millisecond)
+
+	for range 3 {
+		conn, err := l.Accept()
+		require.NoError(t, err)
+
+		defer conn.Close()
+	}
+
+	// the remaining connections are paced at 20 per second
+	assert.GreaterOrEqual(t, time.Since(start), 140*time.Millisecond)
+}
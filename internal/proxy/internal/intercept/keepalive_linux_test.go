@@ -0,0 +1,99 @@
+package intercept
+
+import (
+	"io"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/exp/slog"
+)
+
+func Test_SetKeepAlive(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	defer ln.Close()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	require.NoError(t, err)
+
+	defer conn.Close()
+
+	// enabled
+	require.NoError(t, SetKeepAlive(conn, 42*time.Second))
+	assert.Equal(t, 1, sockoptInt(t, conn, syscall.SOL_SOCKET, syscall.SO_KEEPALIVE))
+	assert.Equal(t, 42, sockoptInt(t, conn, syscall.IPPROTO_TCP, syscall.TCP_KEEPIDLE))
+
+	// disabled
+	require.NoError(t, SetKeepAlive(conn, 0))
+	assert.Equal(t, 0, sockoptInt(t, conn, syscall.SOL_SOCKET, syscall.SO_KEEPALIVE))
+
+	// not a TCP connection
+	server, client := net.Pipe()
+
+	defer server.Close()
+	defer client.Close()
+
+	assert.NoError(t, SetKeepAlive(server, time.Second))
+}
+
+func Test_Listener_Accept_KeepAlive(t *testing.T) {
+	tl, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	l := NewListenerFromListener(
+		slog.New(slog.NewTextHandler(io.Discard, nil)),
+		tl,
+		&BytesLimiterMock{},
+		Config{
+			Metrics:         &MetricsMock{},
+			Accountant:      &AccountantMock{},
+			KeepAlivePeriod: 42 * time.Second,
+		},
+	)
+
+	defer l.Close()
+
+	client, err := net.Dial("tcp", tl.Addr().String())
+	require.NoError(t, err)
+
+	defer client.Close()
+
+	conn, err := l.Accept()
+	require.NoError(t, err)
+
+	defer conn.Close()
+
+	ic, ok := conn.(*Conn)
+	require.True(t, ok)
+
+	assert.Equal(t, 1, sockoptInt(t, ic.conn, syscall.SOL_SOCKET, syscall.SO_KEEPALIVE))
+	assert.Equal(t, 42, sockoptInt(t, ic.conn, syscall.IPPROTO_TCP, syscall.TCP_KEEPIDLE))
+}
+
+// sockoptInt reads an integer socket option of the TCP connection.
+func sockoptInt(t *testing.T, conn net.Conn, level, opt int) int {
+	t.Helper()
+
+	tc, ok := conn.(*net.TCPConn)
+	require.True(t, ok)
+
+	rc, err := tc.SyscallConn()
+	require.NoError(t, err)
+
+	var (
+		value int
+		serr  error
+	)
+
+	require.NoError(t, rc.Control(func(fd uintptr) {
+		value, serr = syscall.GetsockoptInt(int(fd), level, opt)
+	}))
+	require.NoError(t, serr)
+
+	return value
+}
@@ -2,165 +2,610 @@
 // to a connection and checks the bytes used, potentially invalidating the
 // connection.
 //
-//go:generate moq --stub -out 0moq_test.go . BytesLimiter:BytesLimiterMock conn:connMock listener:listenerMock
+//go:generate moq --stub -out 0moq_test.go . BytesLimiter:BytesLimiterMock Metrics:MetricsMock Accountant:AccountantMock conn:connMock listener:listenerMock
 package intercept
 
 import (
-	"bytes"
-	"io"
+	"errors"
 	"net"
-	"net/http"
+	"net/netip"
 	"strings"
+	"sync/atomic"
+	"time"
 
+	"github.com/davseby/lwproxy/internal/clock"
 	"golang.org/x/exp/slog"
 )
 
-// _bytesLimitExceeded is the message to send when the limit is exceeded.
-const _bytesLimitExceeded = "bytes limit has been exceeded"
+const (
+	// _unixPrefix is the address prefix that indicates that the listener
+	// should listen on a unix domain socket.
+	_unixPrefix = "unix:"
+
+	// _minAcceptBackoff and _maxAcceptBackoff bound the delay before the
+	// accept is retried after a temporary error.
+	_minAcceptBackoff = 5 * time.Millisecond
+	_maxAcceptBackoff = time.Second
+)
 
 // Listener is an intercepted listener. It intercepts the accept call.
 type Listener struct {
 	listener
 
-	log     *slog.Logger
-	limiter BytesLimiter
+	log        *slog.Logger
+	clock      clock.Clock
+	limiter    BytesLimiter
+	metrics    Metrics
+	accountant Accountant
+
+	// proxyProtocol specifies whether the accepted connections start with
+	// a PROXY protocol header.
+	proxyProtocol bool
+
+	// idleTimeout is the duration after which a connection without any
+	// reads or writes is closed. Zero turns the timeout off.
+	idleTimeout time.Duration
+
+	// maxLifetime is the duration after which a connection is closed
+	// regardless of its activity. Zero turns the limit off.
+	maxLifetime time.Duration
+
+	// keepAlivePeriod is the TCP keep-alive period of the accepted
+	// connections. Zero turns the keep-alive off.
+	keepAlivePeriod time.Duration
+
+	// flushBytes and flushInterval control how often the connection
+	// bytes are passed to the bytes limiter.
+	flushBytes    int64
+	flushInterval time.Duration
+
+	// allowedCIDRs and deniedCIDRs are the client address ranges from
+	// which the connections are accepted and rejected respectively.
+	allowedCIDRs []netip.Prefix
+	deniedCIDRs  []netip.Prefix
+
+	// acceptLimiter paces the accepted connections. Nil turns the
+	// pacing off.
+	acceptLimiter *acceptLimiter
 }
 
-// NewListener creates a new intercept listener.
+// Config holds the intercept listener settings.
+type Config struct {
+	// Clock provides the time for the connection timers, deadlines and
+	// the accept pacing. Nil uses the system clock.
+	Clock clock.Clock
+
+	// Metrics collects the intercepted bytes. Nil turns the collection
+	// off.
+	Metrics Metrics
+
+	// Accountant attributes the intercepted bytes to the destination
+	// hosts. Nil turns the attribution off.
+	Accountant Accountant
+
+	// ProxyProtocol specifies whether the accepted connections must start
+	// with a PROXY protocol v1 or v2 header which carries the real client
+	// address.
+	ProxyProtocol bool
+
+	// IdleTimeout is the duration after which a connection without any
+	// reads or writes is closed. Zero turns the timeout off.
+	IdleTimeout time.Duration
+
+	// MaxLifetime is the duration after which a connection is closed
+	// regardless of its activity. Zero turns the limit off.
+	MaxLifetime time.Duration
+
+	// KeepAlivePeriod is the interval between the TCP keep-alive probes.
+	// Zero turns them off.
+	KeepAlivePeriod time.Duration
+
+	// FlushBytes and FlushInterval control how often the bytes of an
+	// admitted connection are passed to the bytes limiter. The bytes are
+	// passed once FlushBytes are collected, FlushInterval elapses since
+	// the last flush or the connection is closed. Zero FlushBytes passes
+	// the bytes on every read and write.
+	FlushBytes    int64
+	FlushInterval time.Duration
+
+	// AllowedCIDRs and DeniedCIDRs are the client address ranges from
+	// which the connections are accepted and rejected respectively.
+	// Connections from the denied ranges, or from outside the allowed
+	// ones when they are set, are closed right after they are accepted.
+	// With the PROXY protocol, the client address from the header is
+	// checked instead and the reads of the rejected connections fail.
+	AllowedCIDRs []netip.Prefix
+	DeniedCIDRs  []netip.Prefix
+
+	// AcceptRate is the number of connections accepted per second with
+	// bursts of up to AcceptBurst connections. The excess connections
+	// wait in the operating system backlog. Zero rate turns the pacing
+	// off.
+	AcceptRate  float64
+	AcceptBurst int
+}
+
+// NewListener creates a new intercept listener. The address can be
+// prefixed with "unix:" to listen on a unix domain socket instead of TCP.
+// The socket file is removed when the listener is closed.
 func NewListener(
 	log *slog.Logger,
 	addr string,
 	limiter BytesLimiter,
+	cfg Config,
 ) (*Listener, error) {
-	l, err := net.Listen("tcp", addr)
+	l, err := Listen(addr)
 	if err != nil {
 		return nil, err
 	}
 
+	return NewListenerFromListener(log, l, limiter, cfg), nil
+}
+
+// Listen creates a network listener on the address. The address can be
+// prefixed with "unix:" to listen on a unix domain socket instead of TCP.
+func Listen(addr string) (net.Listener, error) {
+	network := "tcp"
+
+	if path, ok := strings.CutPrefix(addr, _unixPrefix); ok {
+		network, addr = "unix", path
+	}
+
+	return net.Listen(network, addr)
+}
+
+// NewListenerFromListener creates a new intercept listener that wraps an
+// already created listener. This allows using socket activation, custom
+// or in-memory listeners.
+func NewListenerFromListener(
+	log *slog.Logger,
+	l net.Listener,
+	limiter BytesLimiter,
+	cfg Config,
+) *Listener {
+	if cfg.Clock == nil {
+		cfg.Clock = clock.New()
+	}
+
+	if cfg.Metrics == nil {
+		cfg.Metrics = noopMetrics{}
+	}
+
+	if cfg.Accountant == nil {
+		cfg.Accountant = noopAccountant{}
+	}
+
 	return &Listener{
-		listener: l,
-		log:      log.With("job", "intercept-listener"),
-		limiter:  limiter,
-	}, nil
+		listener:        l,
+		log:             log.With("job", "intercept-listener"),
+		clock:           cfg.Clock,
+		limiter:         limiter,
+		metrics:         cfg.Metrics,
+		accountant:      cfg.Accountant,
+		proxyProtocol:   cfg.ProxyProtocol,
+		idleTimeout:     cfg.IdleTimeout,
+		maxLifetime:     cfg.MaxLifetime,
+		keepAlivePeriod: cfg.KeepAlivePeriod,
+		flushBytes:      cfg.FlushBytes,
+		flushInterval:   cfg.FlushInterval,
+		allowedCIDRs:    cfg.AllowedCIDRs,
+		deniedCIDRs:     cfg.DeniedCIDRs,
+		acceptLimiter:   newAcceptLimiter(cfg.AcceptRate, cfg.AcceptBurst, cfg.Clock.Now()),
+	}
+}
+
+// Addr returns the address the listener is bound to. When listening on
+// a port assigned by the operating system, e.g. ":0", it holds the
+// actual port.
+func (l *Listener) Addr() net.Addr {
+	return l.listener.Addr()
 }
 
 // Accept waits for and returns the next connection to the listener. It
-// creates an intercepted connection and checks the bytes limit.
+// checks the client address and creates an intercepted connection. The
+// PROXY protocol header, if enabled, is stripped from the connection
+// data. The connection bytes are passed to the bytes limiter only once
+// the connection is admitted.
 func (l *Listener) Accept() (net.Conn, error) {
-	conn, err := l.listener.Accept()
+	conn, err := l.accept()
 	if err != nil {
 		return nil, err
 	}
 
-	ok, err := l.limiter.CheckBytes()
-
-	switch {
-	case err != nil:
-		var internalErrorResponse = http.Response{
-			StatusCode: http.StatusInternalServerError,
-			ProtoMajor: 1,
-			ProtoMinor: 1,
-			Header: http.Header{
-				"Content-Type": {"text/plain; charset=utf-8"},
-			},
-			Body: io.NopCloser(
-				bytes.NewBufferString(
-					strings.ToLower(
-						http.StatusText(http.StatusInternalServerError),
-					),
-				),
-			),
-			ContentLength: int64(len(http.StatusText(http.StatusInternalServerError))),
+	// NOTE: With the PROXY protocol, the client address is checked once
+	// the header is read by the connection, as reading it here would
+	// block the accept loop on slow clients.
+	if remote := conn.RemoteAddr(); !l.proxyProtocol && !l.allowedAddr(remote) {
+		l.log.Debug("rejected connection from a disallowed address", "remote_addr", remote)
+
+		if err := conn.Close(); err != nil {
+			l.log.Error("failed to close connection", "error", err)
 		}
 
-		if err := internalErrorResponse.Write(conn); err != nil {
-			l.log.Error("failed to write internal error response", "error", err)
+		// NOTE: We don't return an error here as that would cause the
+		// listener to stop accepting connections and exit from the
+		// serve method.
+		return conn, nil
+	}
+
+	if err := SetKeepAlive(conn, l.keepAlivePeriod); err != nil {
+		l.log.Warn("failed to set keep-alive", "error", err)
+	}
+
+	if l.proxyProtocol {
+		conn = newProxyConn(conn, l.allowedAddr, l.clock)
+	}
+
+	return l.newConn(conn, l.limiter), nil
+}
+
+// allowedAddr returns true if the connections from the address are
+// accepted. The denied address ranges take precedence over the allowed
+// ones. Addresses without an IP, e.g. of unix domain sockets, are accepted
+// only when the allowed address ranges are not set.
+func (l *Listener) allowedAddr(addr net.Addr) bool {
+	if len(l.allowedCIDRs) == 0 && len(l.deniedCIDRs) == 0 {
+		return true
+	}
+
+	ip, ok := addrIP(addr)
+	if !ok {
+		return len(l.allowedCIDRs) == 0
+	}
+
+	for _, prefix := range l.deniedCIDRs {
+		if prefix.Contains(ip) {
+			return false
 		}
+	}
+
+	if len(l.allowedCIDRs) == 0 {
+		return true
+	}
 
-		l.log.Error("failed to check bytes", "error", err)
-	case !ok:
-		var exceededLimitResponse = http.Response{
-			StatusCode: http.StatusPaymentRequired,
-			ProtoMajor: 1,
-			ProtoMinor: 1,
-			Header: http.Header{
-				"Content-Type": {"text/plain; charset=utf-8"},
-			},
-			Body:          io.NopCloser(bytes.NewBufferString(_bytesLimitExceeded)),
-			ContentLength: int64(len(_bytesLimitExceeded)),
+	for _, prefix := range l.allowedCIDRs {
+		if prefix.Contains(ip) {
+			return true
 		}
+	}
+
+	return false
+}
+
+// addrIP extracts the IP from the network address. IPv4-mapped IPv6
+// addresses are converted to IPv4.
+func addrIP(addr net.Addr) (netip.Addr, bool) {
+	if addr == nil {
+		return netip.Addr{}, false
+	}
+
+	if ta, ok := addr.(*net.TCPAddr); ok {
+		ip, ok := netip.AddrFromSlice(ta.IP)
+		return ip.Unmap(), ok
+	}
+
+	ap, err := netip.ParseAddrPort(addr.String())
+	if err != nil {
+		return netip.Addr{}, false
+	}
+
+	return ap.Addr().Unmap(), true
+}
 
-		if err := exceededLimitResponse.Write(conn); err != nil {
-			l.log.Error("failed to write exceeded limit response", "error", err)
+// accept accepts the next connection from the underlying listener. The
+// temporary errors, e.g. running out of file descriptors, are retried
+// with an increasing delay instead of being returned, so that the caller
+// neither stops serving nor spins in a tight loop.
+func (l *Listener) accept() (net.Conn, error) {
+	if l.acceptLimiter != nil {
+		if delay := l.acceptLimiter.reserve(l.clock.Now()); delay > 0 {
+			l.log.Debug("pacing accepted connections", slog.Duration("delay", delay))
+			l.sleep(delay)
 		}
 	}
 
-	if err != nil || !ok {
-		err := conn.Close()
-		if err != nil {
-			l.log.Error("failed to close connection", "error", err)
+	var backoff time.Duration
+
+	for {
+		conn, err := l.listener.Accept()
+		if err == nil || !temporaryError(err) {
+			return conn, err
 		}
 
-		// NOTE: We don't return an error here as that would cause the
-		// listener to stop accepting connections and exit from the
-		// serve method.
-		return conn, nil
+		backoff = min(max(2*backoff, _minAcceptBackoff), _maxAcceptBackoff)
+
+		l.log.Warn(
+			"temporary accept error, retrying",
+			slog.String("error", err.Error()),
+			slog.Duration("backoff", backoff),
+		)
+
+		l.sleep(backoff)
 	}
+}
 
-	return &Conn{
-		conn:    conn,
-		limiter: l.limiter,
-	}, nil
+// sleep pauses the current goroutine for the duration.
+func (l *Listener) sleep(d time.Duration) {
+	timer := l.clock.NewTimer(d)
+	<-timer.C()
+}
+
+// temporaryError returns true if the error is marked as temporary.
+func temporaryError(err error) bool {
+	var te interface{ Temporary() bool }
+
+	return errors.As(err, &te) && te.Temporary()
+}
+
+// SetKeepAlive configures the TCP keep-alive of the connection, so that
+// idle long-lived connections are not dropped, e.g. by NAT devices. Zero
+// period turns the keep-alive off. Connections other than TCP are left
+// untouched.
+func SetKeepAlive(conn net.Conn, period time.Duration) error {
+	tc, ok := conn.(*net.TCPConn)
+	if !ok {
+		return nil
+	}
+
+	if period <= 0 {
+		return tc.SetKeepAlive(false)
+	}
+
+	if err := tc.SetKeepAlive(true); err != nil {
+		return err
+	}
+
+	return tc.SetKeepAlivePeriod(period)
+}
+
+// newConn creates a new intercepted connection that uses the provided
+// bytes limiter once it is admitted.
+func (l *Listener) newConn(conn net.Conn, limiter BytesLimiter) *Conn {
+	c := &Conn{
+		conn:        conn,
+		clock:       l.clock,
+		limiter:     limiter,
+		metrics:     l.metrics,
+		accountant:  l.accountant,
+		idleTimeout: l.idleTimeout,
+
+		flushBytes:    l.flushBytes,
+		flushInterval: l.flushInterval,
+	}
+
+	c.deferred.Store(true)
+
+	if l.maxLifetime > 0 {
+		c.lifetimeTimer = l.clock.AfterFunc(l.maxLifetime, func() {
+			_ = conn.Close()
+		})
+	}
+
+	if l.flushBytes > 0 {
+		c.lastFlush.Store(l.clock.Now().UnixNano())
+	}
+
+	if l.idleTimeout > 0 {
+		c.idleTimer = l.clock.AfterFunc(l.idleTimeout, func() {
+			_ = conn.Close()
+		})
+	}
+
+	return c
 }
 
 // Conn is an intercepted connection.
 type Conn struct {
 	conn
 
-	limiter BytesLimiter
+	clock      clock.Clock
+	limiter    BytesLimiter
+	metrics    Metrics
+	accountant Accountant
+
+	// host is the destination host the connection bytes are attributed
+	// to.
+	host atomic.Pointer[string]
+
+	// idleTimer closes the connection once it is idle for longer than
+	// the idle timeout. It is nil when the idle timeout is turned off.
+	idleTimer   clock.Timer
+	idleTimeout time.Duration
+
+	// lifetimeTimer closes the connection once it has been open for
+	// longer than the max lifetime, which starts when the connection is
+	// accepted. It is nil when the lifetime limit is turned off.
+	lifetimeTimer clock.Timer
+
+	// deferred specifies whether the connection is not yet admitted. The
+	// bytes of such connection are collected, but not passed to the
+	// limiter, so that the connections which are never admitted, e.g.
+	// the unauthenticated ones, do not use the limiter at all.
+	deferred atomic.Bool
+
+	// pending holds the bytes that are not yet passed to the limiter.
+	// They are flushed once flushBytes are collected or flushInterval
+	// elapses since the lastFlush, which holds unix nanoseconds.
+	pending       atomic.Int64
+	lastFlush     atomic.Int64
+	flushBytes    int64
+	flushInterval time.Duration
+}
+
+// SetHost sets the destination host the further connection bytes are
+// attributed to.
+func (c *Conn) SetHost(host string) {
+	c.host.Store(&host)
+}
+
+// Admit starts passing the connection bytes to the bytes limiter. The
+// bytes collected before the admission are passed right away. Admitting
+// an already admitted connection does nothing.
+func (c *Conn) Admit() error {
+	if !c.deferred.Swap(false) {
+		return nil
+	}
+
+	return c.flush()
+}
+
+// touch postpones the idle timeout.
+func (c *Conn) touch() {
+	if c.idleTimer != nil {
+		c.idleTimer.Reset(c.idleTimeout)
+	}
+}
+
+// account attributes the bytes to the destination host, if it is set.
+func (c *Conn) account(n int) {
+	if host := c.host.Load(); host != nil {
+		c.accountant.AddHostBytes(*host, int64(n))
+	}
+}
+
+// useBytes collects the bytes and passes them to the bytes limiter when
+// the flush threshold is reached and the connection is admitted.
+func (c *Conn) useBytes(n int) error {
+	if c.deferred.Load() {
+		c.pending.Add(int64(n))
+		return nil
+	}
+
+	if c.flushBytes <= 0 {
+		return c.limiter.UseBytes(int64(n))
+	}
+
+	pending := c.pending.Add(int64(n))
+
+	if pending < c.flushBytes &&
+		c.clock.Now().Sub(time.Unix(0, c.lastFlush.Load())) < c.flushInterval {
+		return nil
+	}
+
+	return c.flush()
+}
+
+// flush passes the collected bytes to the bytes limiter.
+func (c *Conn) flush() error {
+	n := c.pending.Swap(0)
+	if n == 0 {
+		return nil
+	}
+
+	c.lastFlush.Store(c.clock.Now().UnixNano())
+
+	return c.limiter.UseBytes(n)
 }
 
 // Read reads data from the connection and uses the bytes limiter to
-// increase the bytes used.
+// increase the bytes used. The bytes that were read are returned together
+// with the bytes limiter error, so that they are still delivered when the
+// limit is exceeded mid-transfer.
 func (c *Conn) Read(b []byte) (int, error) {
 	n, err := c.conn.Read(b)
-	if err != nil {
+	if n == 0 && err != nil {
 		return 0, err
 	}
 
-	if err := c.limiter.UseBytes(int64(n)); err != nil {
-		return 0, err
+	c.touch()
+	c.metrics.AddBytes(int64(n))
+	c.account(n)
+
+	if err := c.useBytes(n); err != nil {
+		return n, err
 	}
 
-	return n, nil
+	return n, err
 }
 
 // Write writes data to the connection and uses the bytes limiter to
-// increase the bytes used.
+// increase the bytes used. Like Read, it reports the written bytes
+// together with the bytes limiter error.
 func (c *Conn) Write(b []byte) (int, error) {
 	n, err := c.conn.Write(b)
-	if err != nil {
+	if n == 0 && err != nil {
 		return 0, err
 	}
 
-	if err := c.limiter.UseBytes(int64(n)); err != nil {
-		return 0, err
+	c.touch()
+	c.metrics.AddBytes(int64(n))
+	c.account(n)
+
+	if err := c.useBytes(n); err != nil {
+		return n, err
+	}
+
+	return n, err
+}
+
+// Close closes the connection, stops the idle timer and passes the
+// remaining collected bytes to the bytes limiter, if the connection is
+// admitted.
+func (c *Conn) Close() error {
+	if c.idleTimer != nil {
+		c.idleTimer.Stop()
+	}
+
+	if c.lifetimeTimer != nil {
+		c.lifetimeTimer.Stop()
+	}
+
+	// NOTE: The connection is closing, so exceeding the limit does not
+	// change anything.
+	if !c.deferred.Load() {
+		_ = c.flush()
+	}
+
+	return c.conn.Close()
+}
+
+// CloseWrite shuts down the writing side of the connection. It returns
+// errors.ErrUnsupported if the underlying connection does not support
+// half-closing.
+func (c *Conn) CloseWrite() error {
+	cw, ok := c.conn.(interface{ CloseWrite() error })
+	if !ok {
+		return errors.ErrUnsupported
 	}
 
-	return n, nil
+	return cw.CloseWrite()
 }
 
 // BytesLimiter should be used to enforce bytes limitation to the proxy
 // read and write operations.
 type BytesLimiter interface {
-	// CheckBytes should check if the bytes limit is exceeded.
-	CheckBytes() (bool, error)
-
 	// UsedBytes should use the provided number of bytes. If the limit is
 	// exceeded, an error should be returned.
 	UseBytes(n int64) error
 }
 
+// Accountant should be used to attribute the intercepted connections bytes
+// to the destination hosts.
+type Accountant interface {
+	// AddHostBytes should add the provided number of bytes to the host
+	// total.
+	AddHostBytes(host string, n int64)
+}
+
+// Metrics should be used to collect the intercepted connections metrics.
+type Metrics interface {
+	// AddBytes should add the provided number of bytes to the transferred
+	// bytes total.
+	AddBytes(n int64)
+}
+
+// noopMetrics is a metrics collector that does nothing.
+type noopMetrics struct{}
+
+// AddBytes does nothing.
+func (noopMetrics) AddBytes(_ int64) {}
+
+// noopAccountant is an accountant that does nothing.
+type noopAccountant struct{}
+
+// AddHostBytes does nothing.
+func (noopAccountant) AddHostBytes(_ string, _ int64) {}
+
 // conn is an intercepted connection type. We redefine it here to mock it
 // in the tests.
 type conn net.Conn
@@ -2,31 +2,270 @@ package intercept
 
 import (
 	"bytes"
+	"errors"
 	"io"
 	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
+	"github.com/davseby/lwproxy/internal/clock"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"golang.org/x/exp/slog"
 )
 
+func Test_Listen(t *testing.T) {
+	// NOTE: The temporary directory must outlive the parallel subtests.
+	dir := t.TempDir()
+
+	tests := map[string]struct {
+		Addr    string
+		Network string
+		Error   bool
+	}{
+		"Invalid address": {
+			Addr:  "9999",
+			Error: true,
+		},
+		"TCP address": {
+			Addr:    "127.0.0.1:0",
+			Network: "tcp",
+		},
+		"Unix socket": {
+			Addr:    "unix:" + filepath.Join(dir, "listen.sock"),
+			Network: "unix",
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			l, err := Listen(test.Addr)
+			if test.Error {
+				require.Error(t, err)
+				assert.Nil(t, l)
+
+				return
+			}
+
+			require.NoError(t, err)
+			assert.Equal(t, test.Network, l.Addr().Network())
+			assert.NoError(t, l.Close())
+		})
+	}
+}
+
 func Test_NewListener(t *testing.T) {
 	blm := &BytesLimiterMock{}
+	mm := &MetricsMock{}
+	am := &AccountantMock{}
 
 	log := slog.New(slog.NewTextHandler(io.Discard, nil))
 
 	// error
-	l, err := NewListener(log, "9999", blm)
+	l, err := NewListener(log, "9999", blm, Config{})
 	require.Error(t, err)
 	assert.Nil(t, l)
 
 	// success
-	l, err = NewListener(log, ":9999", blm)
+	allowed := []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}
+	denied := []netip.Prefix{netip.MustParsePrefix("10.0.0.1/32")}
+
+	clk := clock.New()
+
+	l, err = NewListener(log, ":9999", blm, Config{
+		Clock:           clk,
+		Metrics:         mm,
+		Accountant:      am,
+		ProxyProtocol:   true,
+		IdleTimeout:     time.Minute,
+		MaxLifetime:     time.Hour,
+		KeepAlivePeriod: 30 * time.Second,
+		FlushBytes:      1024,
+		FlushInterval:   time.Second,
+		AllowedCIDRs:    allowed,
+		DeniedCIDRs:     denied,
+		AcceptRate:      10,
+		AcceptBurst:     5,
+	})
 	require.Empty(t, err)
 	require.NotNil(t, l)
+	assert.Equal(t, clk, l.clock)
+	assert.Same(t, blm, l.limiter)
+	assert.Same(t, mm, l.metrics)
+	assert.Same(t, am, l.accountant)
+	assert.True(t, l.proxyProtocol)
+	assert.Equal(t, time.Minute, l.idleTimeout)
+	assert.Equal(t, time.Hour, l.maxLifetime)
+	assert.Equal(t, 30*time.Second, l.keepAlivePeriod)
+	assert.Equal(t, int64(1024), l.flushBytes)
+	assert.Equal(t, time.Second, l.flushInterval)
+	assert.Equal(t, allowed, l.allowedCIDRs)
+	assert.Equal(t, denied, l.deniedCIDRs)
+	require.NotNil(t, l.acceptLimiter)
+	assert.Equal(t, float64(10), l.acceptLimiter.rate)
+	assert.Equal(t, float64(5), l.acceptLimiter.burst)
+	assert.Equal(t, log.With("job", "intercept-listener"), l.log)
+	require.NoError(t, l.Close())
+}
+
+func Test_Listener_Addr(t *testing.T) {
+	l, err := NewListener(
+		slog.New(slog.NewTextHandler(io.Discard, nil)),
+		"127.0.0.1:0",
+		&BytesLimiterMock{},
+		Config{Metrics: &MetricsMock{}, Accountant: &AccountantMock{}},
+	)
+	require.NoError(t, err)
+
+	defer l.Close()
+
+	addr, ok := l.Addr().(*net.TCPAddr)
+	require.True(t, ok)
+	assert.NotZero(t, addr.Port)
+	assert.Equal(t, "127.0.0.1", addr.IP.String())
+}
+
+func Test_NewListener_Unix(t *testing.T) {
+	dir, err := os.MkdirTemp("", "lwproxy")
+	require.NoError(t, err)
+
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "proxy.sock")
+
+	blm := &BytesLimiterMock{}
+
+	l, err := NewListener(
+		slog.New(slog.NewTextHandler(io.Discard, nil)),
+		"unix:"+path,
+		blm,
+		Config{Metrics: &MetricsMock{}, Accountant: &AccountantMock{}},
+	)
+	require.NoError(t, err)
+	assert.Equal(t, "unix", l.Addr().Network())
+
+	client, err := net.Dial("unix", path)
+	require.NoError(t, err)
+
+	defer client.Close()
+
+	conn, err := l.Accept()
+	require.NoError(t, err)
+	assert.IsType(t, &Conn{}, conn)
+
+	_, err = client.Write([]byte("ping"))
+	require.NoError(t, err)
+
+	data := make([]byte, 4)
+
+	_, err = io.ReadFull(conn, data)
+	require.NoError(t, err)
+	assert.Equal(t, "ping", string(data))
+
+	require.NoError(t, conn.Close())
+	require.NoError(t, l.Close())
+
+	_, err = os.Stat(path)
+	assert.ErrorIs(t, err, os.ErrNotExist)
+}
+
+// pipeListener is an in-memory listener that accepts net.Pipe connections.
+type pipeListener struct {
+	connCh chan net.Conn
+}
+
+// Accept returns the next connection sent to the listener.
+func (pl *pipeListener) Accept() (net.Conn, error) {
+	conn, ok := <-pl.connCh
+	if !ok {
+		return nil, net.ErrClosed
+	}
+
+	return conn, nil
+}
+
+// Close closes the listener.
+func (pl *pipeListener) Close() error {
+	close(pl.connCh)
+	return nil
+}
+
+// Addr returns the listener address.
+func (pl *pipeListener) Addr() net.Addr {
+	return &net.UnixAddr{Name: "pipe", Net: "pipe"}
+}
+
+func Test_NewListenerFromListener(t *testing.T) {
+	blm := &BytesLimiterMock{}
+	mm := &MetricsMock{}
+	am := &AccountantMock{}
+	pl := &pipeListener{
+		connCh: make(chan net.Conn, 1),
+	}
+
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	l := NewListenerFromListener(log, pl, blm, Config{Metrics: mm, Accountant: am})
+	require.NotNil(t, l)
+	assert.Same(t, pl, l.listener)
 	assert.Same(t, blm, l.limiter)
+	assert.Same(t, mm, l.metrics)
+	assert.Same(t, am, l.accountant)
 	assert.Equal(t, log.With("job", "intercept-listener"), l.log)
+
+	nl := NewListenerFromListener(log, pl, blm, Config{})
+	assert.Equal(t, clock.New(), nl.clock)
+	assert.Equal(t, noopMetrics{}, nl.metrics)
+	assert.Equal(t, noopAccountant{}, nl.accountant)
+
+	server, client := net.Pipe()
+
+	defer client.Close()
+
+	pl.connCh <- server
+
+	conn, err := l.Accept()
+	require.NoError(t, err)
+
+	expected := &Conn{
+		clock:      clock.New(),
+		conn:       server,
+		limiter:    blm,
+		metrics:    mm,
+		accountant: am,
+	}
+
+	expected.deferred.Store(true)
+
+	assert.Equal(t, expected, conn)
+
+	go func() {
+		_, _ = client.Write([]byte("ping"))
+	}()
+
+	data := make([]byte, 4)
+
+	_, err = io.ReadFull(conn, data)
+	require.NoError(t, err)
+	assert.Equal(t, "ping", string(data))
+	assert.Empty(t, blm.UseBytesCalls())
+
+	// the bytes are passed to the limiter once the connection is admitted
+	c, ok := conn.(*Conn)
+	require.True(t, ok)
+	require.NoError(t, c.Admit())
+	require.Len(t, blm.UseBytesCalls(), 1)
+	assert.Equal(t, int64(4), blm.UseBytesCalls()[0].N)
+
+	require.NoError(t, l.Close())
+
+	_, err = l.Accept()
+	assert.ErrorIs(t, err, net.ErrClosed)
 }
 
 func Test_Listener_Accept(t *testing.T) {
@@ -38,21 +277,13 @@ func Test_Listener_Accept(t *testing.T) {
 		}
 	}
 
-	stubConn := func(werr, cerr error) *connMock {
+	stubConn := func() *connMock {
 		return &connMock{
 			WriteFunc: func(n []byte) (int, error) {
-				return len(n), werr
+				return len(n), nil
 			},
 			CloseFunc: func() error {
-				return cerr
-			},
-		}
-	}
-
-	stubBytesLimiter := func(ok bool, err error) *BytesLimiterMock {
-		return &BytesLimiterMock{
-			CheckBytesFunc: func() (bool, error) {
-				return ok, err
+				return nil
 			},
 		}
 	}
@@ -70,14 +301,14 @@ func Test_Listener_Accept(t *testing.T) {
 		}
 	}
 
-	wasCheckBytesCalled := func(called bool) check {
+	wasUseBytesCalled := func(called bool) check {
 		return func(t *testing.T, _ *listenerMock, _ *connMock, lim *BytesLimiterMock) {
 			if called {
-				assert.Len(t, lim.CheckBytesCalls(), 1)
+				assert.Len(t, lim.UseBytesCalls(), 1)
 				return
 			}
 
-			assert.Len(t, lim.CheckBytesCalls(), 0)
+			assert.Len(t, lim.UseBytesCalls(), 0)
 		}
 	}
 
@@ -99,148 +330,40 @@ func Test_Listener_Accept(t *testing.T) {
 	}
 
 	type tcase struct {
-		Listener   *listenerMock
-		Limiter    *BytesLimiterMock
-		Success    bool
-		Error      error
-		Conn       *connMock
-		LogOutputs []string
-		Checks     []check
+		Listener *listenerMock
+		Limiter  *BytesLimiterMock
+		Error    error
+		Conn     *connMock
+		Checks   []check
 	}
 
 	tests := map[string]tcase{
 		"listener.Accept returns an error": func() tcase {
-			cm := stubConn(nil, nil)
-			lim := stubBytesLimiter(false, nil)
+			cm := stubConn()
 
 			return tcase{
-				Listener:   stubListener(nil, assert.AnError),
-				Limiter:    lim,
-				Success:    false,
-				Error:      assert.AnError,
-				Conn:       cm,
-				LogOutputs: nil,
+				Listener: stubListener(nil, assert.AnError),
+				Limiter:  &BytesLimiterMock{},
+				Error:    assert.AnError,
+				Conn:     cm,
 				Checks: []check{
 					wasListenerAcceptCalled(true),
-					wasCheckBytesCalled(false),
+					wasUseBytesCalled(false),
 					wasConnWriteCalled(0),
 					wasConnCloseCalled(false),
 				},
 			}
 		}(),
-		"limiter.CheckBytes returns an error": func() tcase {
-			cm := stubConn(nil, nil)
-			lim := stubBytesLimiter(false, assert.AnError)
-
-			return tcase{
-				Listener: stubListener(cm, nil),
-				Limiter:  lim,
-				Success:  false,
-				Conn:     cm,
-				LogOutputs: []string{
-					"level=ERROR msg=\"failed to check bytes\" error=\"assert.AnError general error for testing\"\n",
-				},
-				Checks: []check{
-					wasListenerAcceptCalled(true),
-					wasCheckBytesCalled(true),
-					wasConnWriteCalled(9),
-					wasConnCloseCalled(true),
-				},
-			}
-		}(),
-		"limiter.CheckBytes and conn.Write returns an error": func() tcase {
-			cm := stubConn(assert.AnError, nil)
-			lim := stubBytesLimiter(false, assert.AnError)
-
-			return tcase{
-				Listener: stubListener(cm, nil),
-				Limiter:  lim,
-				Success:  false,
-				Conn:     cm,
-				LogOutputs: []string{
-					"level=ERROR msg=\"failed to check bytes\" error=\"assert.AnError general error for testing\"\n",
-					"level=ERROR msg=\"failed to write internal error response\" error=\"assert.AnError general error for testing\"\n",
-				},
-				Checks: []check{
-					wasListenerAcceptCalled(true),
-					wasCheckBytesCalled(true),
-					wasConnWriteCalled(1),
-					wasConnCloseCalled(true),
-				},
-			}
-		}(),
-		"conn.Write returns an error": func() tcase {
-			cm := stubConn(assert.AnError, nil)
-			lim := stubBytesLimiter(false, nil)
-
-			return tcase{
-				Listener: stubListener(cm, nil),
-				Limiter:  lim,
-				Success:  false,
-				Conn:     cm,
-				LogOutputs: []string{
-					"level=ERROR msg=\"failed to write exceeded limit response\" error=\"assert.AnError general error for testing\"\n",
-				},
-				Checks: []check{
-					wasListenerAcceptCalled(true),
-					wasCheckBytesCalled(true),
-					wasConnWriteCalled(1),
-					wasConnCloseCalled(true),
-				},
-			}
-		}(),
-		"conn.Write and conn.Close returns an error": func() tcase {
-			cm := stubConn(assert.AnError, assert.AnError)
-			lim := stubBytesLimiter(false, nil)
+		"Successfully accepted a connection": func() tcase {
+			cm := stubConn()
 
 			return tcase{
 				Listener: stubListener(cm, nil),
-				Limiter:  lim,
-				Success:  false,
+				Limiter:  &BytesLimiterMock{},
 				Conn:     cm,
-				LogOutputs: []string{
-					"level=ERROR msg=\"failed to write exceeded limit response\" error=\"assert.AnError general error for testing\"\n",
-					"level=ERROR msg=\"failed to close connection\" error=\"assert.AnError general error for testing\"\n",
-				},
 				Checks: []check{
 					wasListenerAcceptCalled(true),
-					wasCheckBytesCalled(true),
-					wasConnWriteCalled(1),
-					wasConnCloseCalled(true),
-				},
-			}
-		}(),
-		"Successfully rejected a connection due to the limits breach": func() tcase {
-			cm := stubConn(nil, nil)
-			lim := stubBytesLimiter(false, nil)
-
-			return tcase{
-				Listener:   stubListener(cm, nil),
-				Limiter:    lim,
-				Success:    false,
-				Conn:       cm,
-				LogOutputs: nil,
-				Checks: []check{
-					wasListenerAcceptCalled(true),
-					wasCheckBytesCalled(true),
-					wasConnWriteCalled(9), // response write makes 9 calls
-					wasConnCloseCalled(true),
-				},
-			}
-		}(),
-		"Successfully accepted a connection": func() tcase {
-			cm := stubConn(nil, nil)
-			lim := stubBytesLimiter(true, nil)
-
-			return tcase{
-				Listener:   stubListener(cm, nil),
-				Limiter:    lim,
-				Success:    true,
-				Conn:       cm,
-				LogOutputs: nil,
-				Checks: []check{
-					wasListenerAcceptCalled(true),
-					wasCheckBytesCalled(true),
+					wasUseBytesCalled(false),
 					wasConnWriteCalled(0),
 					wasConnCloseCalled(false),
 				},
@@ -254,10 +377,14 @@ func Test_Listener_Accept(t *testing.T) {
 
 			var buffer bytes.Buffer
 
+			mm := &MetricsMock{}
+
 			l := &Listener{
+				clock:    clock.New(),
 				log:      slog.New(slog.NewTextHandler(&buffer, nil)),
 				listener: test.Listener,
 				limiter:  test.Limiter,
+				metrics:  mm,
 			}
 
 			conn, err := l.Accept()
@@ -266,6 +393,8 @@ func Test_Listener_Accept(t *testing.T) {
 				check(t, test.Listener, test.Conn, test.Limiter)
 			}
 
+			assert.Empty(t, buffer.String())
+
 			if test.Error != nil {
 				assert.Equal(t, test.Error, err)
 				assert.Nil(t, conn)
@@ -275,22 +404,16 @@ func Test_Listener_Accept(t *testing.T) {
 
 			require.NoError(t, err)
 
-			for i := range test.LogOutputs {
-				assert.Contains(t, buffer.String(), test.LogOutputs[i])
+			expected := &Conn{
+				clock:   clock.New(),
+				conn:    test.Conn,
+				limiter: test.Limiter,
+				metrics: mm,
 			}
 
-			if test.LogOutputs == nil {
-				assert.Empty(t, buffer.String())
-			}
+			expected.deferred.Store(true)
 
-			if test.Success {
-				assert.Equal(t, &Conn{
-					conn:    test.Conn,
-					limiter: test.Limiter,
-				}, conn)
-			} else {
-				assert.Equal(t, test.Conn, conn)
-			}
+			assert.Equal(t, expected, conn)
 		})
 	}
 }
@@ -312,17 +435,17 @@ func Test_Conn_Read(t *testing.T) {
 		}
 	}
 
-	type check func(*testing.T, *connMock, *BytesLimiterMock)
+	type check func(*testing.T, *connMock, *BytesLimiterMock, *MetricsMock)
 
 	wasConnReadCalled := func(b []byte) check {
-		return func(t *testing.T, c *connMock, _ *BytesLimiterMock) {
+		return func(t *testing.T, c *connMock, _ *BytesLimiterMock, _ *MetricsMock) {
 			require.Len(t, c.ReadCalls(), 1)
 			assert.Equal(t, b, c.ReadCalls()[0].B)
 		}
 	}
 
 	wasBytesLimiterUseBytesCalled := func(called bool, size int64) check {
-		return func(t *testing.T, _ *connMock, lim *BytesLimiterMock) {
+		return func(t *testing.T, _ *connMock, lim *BytesLimiterMock, _ *MetricsMock) {
 			if called {
 				assert.Len(t, lim.UseBytesCalls(), 1)
 				assert.Equal(t, size, lim.UseBytesCalls()[0].N)
@@ -334,6 +457,19 @@ func Test_Conn_Read(t *testing.T) {
 		}
 	}
 
+	wasMetricsAddBytesCalled := func(called bool, size int64) check {
+		return func(t *testing.T, _ *connMock, _ *BytesLimiterMock, mm *MetricsMock) {
+			if called {
+				assert.Len(t, mm.AddBytesCalls(), 1)
+				assert.Equal(t, size, mm.AddBytesCalls()[0].N)
+
+				return
+			}
+
+			assert.Len(t, mm.AddBytesCalls(), 0)
+		}
+	}
+
 	tests := map[string]struct {
 		Conn      *connMock
 		SkipCheck bool
@@ -349,6 +485,7 @@ func Test_Conn_Read(t *testing.T) {
 			Checks: []check{
 				wasConnReadCalled([]byte{1, 2, 3}),
 				wasBytesLimiterUseBytesCalled(false, 0),
+				wasMetricsAddBytesCalled(false, 0),
 			},
 		},
 		"limiter.UseBytes returns an error": {
@@ -358,6 +495,29 @@ func Test_Conn_Read(t *testing.T) {
 			Checks: []check{
 				wasConnReadCalled([]byte{1, 2, 3}),
 				wasBytesLimiterUseBytesCalled(true, 0),
+				wasMetricsAddBytesCalled(true, 0),
+			},
+		},
+		"limiter.UseBytes returns an error after bytes are read": {
+			Conn:    stubConn(3, nil),
+			Limiter: stubBytesLimiter(assert.AnError),
+			Size:    3,
+			Error:   assert.AnError,
+			Checks: []check{
+				wasConnReadCalled([]byte{1, 2, 3}),
+				wasBytesLimiterUseBytesCalled(true, 3),
+				wasMetricsAddBytesCalled(true, 3),
+			},
+		},
+		"conn.Read returns an error after bytes are read": {
+			Conn:    stubConn(2, assert.AnError),
+			Limiter: stubBytesLimiter(nil),
+			Size:    2,
+			Error:   assert.AnError,
+			Checks: []check{
+				wasConnReadCalled([]byte{1, 2, 3}),
+				wasBytesLimiterUseBytesCalled(true, 2),
+				wasMetricsAddBytesCalled(true, 2),
 			},
 		},
 		"Successfully read from a connection": {
@@ -367,6 +527,7 @@ func Test_Conn_Read(t *testing.T) {
 			Checks: []check{
 				wasConnReadCalled([]byte{1, 2, 3}),
 				wasBytesLimiterUseBytesCalled(true, 3),
+				wasMetricsAddBytesCalled(true, 3),
 			},
 		},
 	}
@@ -375,15 +536,19 @@ func Test_Conn_Read(t *testing.T) {
 		t.Run(name, func(t *testing.T) {
 			t.Parallel()
 
+			mm := &MetricsMock{}
+
 			c := &Conn{
+				clock:   clock.New(),
 				conn:    test.Conn,
 				limiter: test.Limiter,
+				metrics: mm,
 			}
 
 			n, err := c.Read([]byte{1, 2, 3})
 
 			for _, check := range test.Checks {
-				check(t, test.Conn, test.Limiter)
+				check(t, test.Conn, test.Limiter, mm)
 			}
 
 			assert.Equal(t, test.Error, err)
@@ -392,6 +557,45 @@ func Test_Conn_Read(t *testing.T) {
 	}
 }
 
+func Test_Conn_Read_LimitExceededMidTransfer(t *testing.T) {
+	server, client := net.Pipe()
+
+	defer client.Close()
+
+	var used int64
+
+	c := &Conn{
+		clock: clock.New(),
+		conn:  server,
+		limiter: &BytesLimiterMock{
+			UseBytesFunc: func(n int64) error {
+				used += n
+				if used > 4 {
+					return assert.AnError
+				}
+
+				return nil
+			},
+		},
+		metrics: &MetricsMock{},
+	}
+
+	defer c.Close()
+
+	go func() {
+		_, _ = client.Write([]byte("hello world"))
+		client.Close()
+	}()
+
+	var buffer bytes.Buffer
+
+	_, err := io.Copy(&buffer, c)
+	require.ErrorIs(t, err, assert.AnError)
+
+	// the bytes read by the call that exceeded the limit are delivered.
+	assert.Equal(t, "hello world", buffer.String())
+}
+
 func Test_Conn_Write(t *testing.T) {
 	stubConn := func(length int, err error) *connMock {
 		return &connMock{
@@ -409,17 +613,17 @@ func Test_Conn_Write(t *testing.T) {
 		}
 	}
 
-	type check func(*testing.T, *connMock, *BytesLimiterMock)
+	type check func(*testing.T, *connMock, *BytesLimiterMock, *MetricsMock)
 
 	wasConnWriteCalled := func(b []byte) check {
-		return func(t *testing.T, c *connMock, _ *BytesLimiterMock) {
+		return func(t *testing.T, c *connMock, _ *BytesLimiterMock, _ *MetricsMock) {
 			require.Len(t, c.WriteCalls(), 1)
 			assert.Equal(t, b, c.WriteCalls()[0].B)
 		}
 	}
 
 	wasBytesLimiterUseBytesCalled := func(called bool, size int64) check {
-		return func(t *testing.T, _ *connMock, bl *BytesLimiterMock) {
+		return func(t *testing.T, _ *connMock, bl *BytesLimiterMock, _ *MetricsMock) {
 			if called {
 				assert.Len(t, bl.UseBytesCalls(), 1)
 				assert.Equal(t, size, bl.UseBytesCalls()[0].N)
@@ -431,6 +635,19 @@ func Test_Conn_Write(t *testing.T) {
 		}
 	}
 
+	wasMetricsAddBytesCalled := func(called bool, size int64) check {
+		return func(t *testing.T, _ *connMock, _ *BytesLimiterMock, mm *MetricsMock) {
+			if called {
+				assert.Len(t, mm.AddBytesCalls(), 1)
+				assert.Equal(t, size, mm.AddBytesCalls()[0].N)
+
+				return
+			}
+
+			assert.Len(t, mm.AddBytesCalls(), 0)
+		}
+	}
+
 	tests := map[string]struct {
 		Conn    *connMock
 		Limiter *BytesLimiterMock
@@ -445,6 +662,7 @@ func Test_Conn_Write(t *testing.T) {
 			Checks: []check{
 				wasConnWriteCalled([]byte{1, 2, 3}),
 				wasBytesLimiterUseBytesCalled(false, 0),
+				wasMetricsAddBytesCalled(false, 0),
 			},
 		},
 		"limiter.UseBytes returns an error": {
@@ -454,6 +672,29 @@ func Test_Conn_Write(t *testing.T) {
 			Checks: []check{
 				wasConnWriteCalled([]byte{1, 2, 3}),
 				wasBytesLimiterUseBytesCalled(true, 0),
+				wasMetricsAddBytesCalled(true, 0),
+			},
+		},
+		"limiter.UseBytes returns an error after bytes are written": {
+			Conn:    stubConn(3, nil),
+			Limiter: stubBytesLimiter(assert.AnError),
+			Size:    3,
+			Error:   assert.AnError,
+			Checks: []check{
+				wasConnWriteCalled([]byte{1, 2, 3}),
+				wasBytesLimiterUseBytesCalled(true, 3),
+				wasMetricsAddBytesCalled(true, 3),
+			},
+		},
+		"conn.Write returns an error after bytes are written": {
+			Conn:    stubConn(2, assert.AnError),
+			Limiter: stubBytesLimiter(nil),
+			Size:    2,
+			Error:   assert.AnError,
+			Checks: []check{
+				wasConnWriteCalled([]byte{1, 2, 3}),
+				wasBytesLimiterUseBytesCalled(true, 2),
+				wasMetricsAddBytesCalled(true, 2),
 			},
 		},
 		"Successfully read from a connection": {
@@ -463,6 +704,7 @@ func Test_Conn_Write(t *testing.T) {
 			Checks: []check{
 				wasConnWriteCalled([]byte{1, 2, 3}),
 				wasBytesLimiterUseBytesCalled(true, 3),
+				wasMetricsAddBytesCalled(true, 3),
 			},
 		},
 	}
@@ -471,15 +713,19 @@ func Test_Conn_Write(t *testing.T) {
 		t.Run(name, func(t *testing.T) {
 			t.Parallel()
 
+			mm := &MetricsMock{}
+
 			c := &Conn{
+				clock:   clock.New(),
 				conn:    test.Conn,
 				limiter: test.Limiter,
+				metrics: mm,
 			}
 
 			n, err := c.Write([]byte{1, 2, 3})
 
 			for _, check := range test.Checks {
-				check(t, test.Conn, test.Limiter)
+				check(t, test.Conn, test.Limiter, mm)
 			}
 
 			assert.Equal(t, test.Error, err)
@@ -487,3 +733,597 @@ func Test_Conn_Write(t *testing.T) {
 		})
 	}
 }
+
+func Test_Conn_SetHost(t *testing.T) {
+	am := &AccountantMock{}
+
+	c := &Conn{
+		clock: clock.New(),
+		conn: &connMock{
+			ReadFunc: func(_ []byte) (int, error) {
+				return 3, nil
+			},
+			WriteFunc: func(_ []byte) (int, error) {
+				return 2, nil
+			},
+		},
+		limiter:    &BytesLimiterMock{},
+		metrics:    &MetricsMock{},
+		accountant: am,
+	}
+
+	// NOTE: The bytes are not attributed until the host is set.
+	_, err := c.Read(make([]byte, 3))
+	require.NoError(t, err)
+	assert.Empty(t, am.AddHostBytesCalls())
+
+	c.SetHost("example.com")
+
+	_, err = c.Read(make([]byte, 3))
+	require.NoError(t, err)
+
+	c.SetHost("example.org")
+
+	_, err = c.Write(make([]byte, 2))
+	require.NoError(t, err)
+
+	calls := am.AddHostBytesCalls()
+	require.Len(t, calls, 2)
+	assert.Equal(t, "example.com", calls[0].Host)
+	assert.Equal(t, int64(3), calls[0].N)
+	assert.Equal(t, "example.org", calls[1].Host)
+	assert.Equal(t, int64(2), calls[1].N)
+}
+
+func Test_Conn_CloseWrite(t *testing.T) {
+	// unsupported
+	c := &Conn{
+		clock: clock.New(),
+		conn:  &connMock{},
+	}
+
+	assert.ErrorIs(t, c.CloseWrite(), errors.ErrUnsupported)
+
+	// supported
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	defer ln.Close()
+
+	client, err := net.Dial("tcp", ln.Addr().String())
+	require.NoError(t, err)
+
+	defer client.Close()
+
+	server, err := ln.Accept()
+	require.NoError(t, err)
+
+	defer server.Close()
+
+	c = &Conn{
+		clock: clock.New(),
+		conn:  server,
+	}
+
+	require.NoError(t, c.CloseWrite())
+
+	data, err := io.ReadAll(client)
+	require.NoError(t, err)
+	assert.Empty(t, data)
+}
+
+func Test_Conn_IdleTimeout(t *testing.T) {
+	tcpPair := func(t *testing.T) (net.Conn, net.Conn) {
+		t.Helper()
+
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+
+		defer ln.Close()
+
+		client, err := net.Dial("tcp", ln.Addr().String())
+		require.NoError(t, err)
+
+		server, err := ln.Accept()
+		require.NoError(t, err)
+
+		t.Cleanup(func() {
+			client.Close()
+			server.Close()
+		})
+
+		return client, server
+	}
+
+	blm := &BytesLimiterMock{
+		UseBytesFunc: func(_ int64) error {
+			return nil
+		},
+	}
+
+	l := &Listener{
+		clock:       clock.New(),
+		limiter:     blm,
+		metrics:     &MetricsMock{},
+		idleTimeout: 100 * time.Millisecond,
+	}
+
+	// idle
+	client, server := tcpPair(t)
+	l.newConn(server, blm)
+
+	start := time.Now()
+
+	_, err := io.ReadAll(client)
+	require.NoError(t, err)
+	assert.GreaterOrEqual(t, time.Since(start), 100*time.Millisecond)
+
+	// active
+	client, server = tcpPair(t)
+	c := l.newConn(server, blm)
+
+	for range 4 {
+		time.Sleep(50 * time.Millisecond)
+
+		_, err = c.Write([]byte("ping"))
+		require.NoError(t, err)
+	}
+
+	require.NoError(t, c.Close())
+
+	data, err := io.ReadAll(client)
+	require.NoError(t, err)
+	assert.Equal(t, "pingpingpingping", string(data))
+
+	// turned off
+	l.idleTimeout = 0
+
+	c = l.newConn(server, blm)
+	assert.Nil(t, c.idleTimer)
+}
+
+func Test_Conn_MaxLifetime(t *testing.T) {
+	tcpPair := func(t *testing.T) (net.Conn, net.Conn) {
+		t.Helper()
+
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+
+		defer ln.Close()
+
+		client, err := net.Dial("tcp", ln.Addr().String())
+		require.NoError(t, err)
+
+		server, err := ln.Accept()
+		require.NoError(t, err)
+
+		t.Cleanup(func() {
+			client.Close()
+			server.Close()
+		})
+
+		return client, server
+	}
+
+	blm := &BytesLimiterMock{
+		UseBytesFunc: func(_ int64) error {
+			return nil
+		},
+	}
+
+	l := &Listener{
+		clock:       clock.New(),
+		limiter:     blm,
+		metrics:     &MetricsMock{},
+		maxLifetime: 150 * time.Millisecond,
+	}
+
+	// active
+	client, server := tcpPair(t)
+	active := l.newConn(server, blm)
+
+	start := time.Now()
+	doneCh := make(chan struct{})
+
+	go func() {
+		defer close(doneCh)
+
+		for {
+			time.Sleep(20 * time.Millisecond)
+
+			if _, err := active.Write([]byte("ping")); err != nil {
+				return
+			}
+		}
+	}()
+
+	_, err := io.ReadAll(client)
+	require.NoError(t, err)
+	assert.GreaterOrEqual(t, time.Since(start), 150*time.Millisecond)
+	assert.Less(t, time.Since(start), time.Second)
+
+	<-doneCh
+
+	// closed before the lifetime elapses
+	_, server = tcpPair(t)
+	c := l.newConn(server, blm)
+
+	require.NoError(t, c.Close())
+	assert.False(t, c.lifetimeTimer.Stop())
+
+	// turned off
+	l.maxLifetime = 0
+
+	c = l.newConn(server, blm)
+	assert.Nil(t, c.lifetimeTimer)
+}
+
+func Test_Conn_Admit(t *testing.T) {
+	newConn := func() (*Conn, *BytesLimiterMock) {
+		blm := &BytesLimiterMock{
+			UseBytesFunc: func(_ int64) error {
+				return nil
+			},
+		}
+
+		l := &Listener{
+			clock:   clock.New(),
+			limiter: blm,
+			metrics: &MetricsMock{},
+		}
+
+		return l.newConn(&connMock{
+			ReadFunc: func(b []byte) (int, error) {
+				return len(b), nil
+			},
+			WriteFunc: func(b []byte) (int, error) {
+				return len(b), nil
+			},
+			CloseFunc: func() error {
+				return nil
+			},
+		}, blm), blm
+	}
+
+	// bytes are collected until the connection is admitted
+	c, blm := newConn()
+
+	_, err := c.Read(make([]byte, 100))
+	require.NoError(t, err)
+
+	_, err = c.Write(make([]byte, 50))
+	require.NoError(t, err)
+	assert.Empty(t, blm.UseBytesCalls())
+
+	require.NoError(t, c.Admit())
+	require.Len(t, blm.UseBytesCalls(), 1)
+	assert.Equal(t, int64(150), blm.UseBytesCalls()[0].N)
+
+	_, err = c.Read(make([]byte, 10))
+	require.NoError(t, err)
+	require.Len(t, blm.UseBytesCalls(), 2)
+	assert.Equal(t, int64(10), blm.UseBytesCalls()[1].N)
+
+	// admitting again does nothing
+	require.NoError(t, c.Admit())
+	assert.Len(t, blm.UseBytesCalls(), 2)
+
+	// limiter error is returned
+	c, blm = newConn()
+
+	blm.UseBytesFunc = func(_ int64) error {
+		return assert.AnError
+	}
+
+	_, err = c.Read(make([]byte, 100))
+	require.NoError(t, err)
+	assert.Equal(t, assert.AnError, c.Admit())
+
+	// bytes of a connection that is never admitted are not passed
+	c, blm = newConn()
+
+	_, err = c.Read(make([]byte, 100))
+	require.NoError(t, err)
+	require.NoError(t, c.Close())
+	assert.Empty(t, blm.UseBytesCalls())
+}
+
+func Test_Conn_FlushBytes(t *testing.T) {
+	newConn := func(flushInterval time.Duration) (*Conn, *BytesLimiterMock) {
+		blm := &BytesLimiterMock{
+			UseBytesFunc: func(_ int64) error {
+				return nil
+			},
+		}
+
+		l := &Listener{
+			clock:         clock.New(),
+			limiter:       blm,
+			metrics:       &MetricsMock{},
+			flushBytes:    1000,
+			flushInterval: flushInterval,
+		}
+
+		c := l.newConn(&connMock{
+			ReadFunc: func(b []byte) (int, error) {
+				return len(b), nil
+			},
+			CloseFunc: func() error {
+				return nil
+			},
+		}, blm)
+
+		require.NoError(t, c.Admit())
+
+		return c, blm
+	}
+
+	usedBytes := func(blm *BytesLimiterMock) []int64 {
+		var used []int64
+
+		for _, call := range blm.UseBytesCalls() {
+			used = append(used, call.N)
+		}
+
+		return used
+	}
+
+	// batched by size
+	c, blm := newConn(time.Hour)
+
+	for range 25 {
+		_, err := c.Read(make([]byte, 100))
+		require.NoError(t, err)
+	}
+
+	assert.Equal(t, []int64{1000, 1000}, usedBytes(blm))
+
+	require.NoError(t, c.Close())
+	assert.Equal(t, []int64{1000, 1000, 500}, usedBytes(blm))
+
+	// flushed only once when closed multiple times
+	require.NoError(t, c.Close())
+	assert.Len(t, blm.UseBytesCalls(), 3)
+
+	// batched by time
+	c, blm = newConn(50 * time.Millisecond)
+
+	_, err := c.Read(make([]byte, 100))
+	require.NoError(t, err)
+	assert.Empty(t, blm.UseBytesCalls())
+
+	time.Sleep(60 * time.Millisecond)
+
+	_, err = c.Read(make([]byte, 100))
+	require.NoError(t, err)
+	assert.Equal(t, []int64{200}, usedBytes(blm))
+}
+
+// temporaryErr is a temporary network error.
+type temporaryErr struct{}
+
+// Error returns the error message.
+func (temporaryErr) Error() string {
+	return "temporary error"
+}
+
+// Timeout returns false as the error is not a timeout.
+func (temporaryErr) Timeout() bool {
+	return false
+}
+
+// Temporary returns true as the error is temporary.
+func (temporaryErr) Temporary() bool {
+	return true
+}
+
+func Test_Listener_Accept_TemporaryError(t *testing.T) {
+	server, client := net.Pipe()
+
+	defer client.Close()
+
+	var calls int
+
+	lm := &listenerMock{
+		AcceptFunc: func() (net.Conn, error) {
+			calls++
+
+			if calls <= 2 {
+				return nil, &net.OpError{Op: "accept", Err: temporaryErr{}}
+			}
+
+			return server, nil
+		},
+	}
+
+	var buffer bytes.Buffer
+
+	l := &Listener{
+		clock:    clock.New(),
+		log:      slog.New(slog.NewTextHandler(&buffer, nil)),
+		listener: lm,
+		limiter:  &BytesLimiterMock{},
+		metrics:  &MetricsMock{},
+	}
+
+	start := time.Now()
+
+	conn, err := l.Accept()
+	require.NoError(t, err)
+	assert.IsType(t, &Conn{}, conn)
+	assert.Equal(t, 3, calls)
+	assert.GreaterOrEqual(t, time.Since(start), _minAcceptBackoff+2*_minAcceptBackoff)
+	assert.Contains(t, buffer.String(), `msg="temporary accept error, retrying"`)
+	assert.Contains(t, buffer.String(), "backoff=10ms")
+}
+
+func Test_temporaryError(t *testing.T) {
+	assert.True(t, temporaryError(&net.OpError{Op: "accept", Err: temporaryErr{}}))
+	assert.False(t, temporaryError(net.ErrClosed))
+	assert.False(t, temporaryError(assert.AnError))
+}
+
+func Test_Listener_Accept_CIDRs(t *testing.T) {
+	tests := map[string]struct {
+		RemoteAddr string
+		Allowed    bool
+	}{
+		"Connection from an allowed address": {
+			RemoteAddr: "10.1.2.3:5000",
+			Allowed:    true,
+		},
+		"Connection from a denied address within the allowed range": {
+			RemoteAddr: "10.0.0.1:5000",
+			Allowed:    false,
+		},
+		"Connection from outside the allowed range": {
+			RemoteAddr: "192.0.2.1:5000",
+			Allowed:    false,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			cm := &connMock{
+				RemoteAddrFunc: func() net.Addr {
+					return net.TCPAddrFromAddrPort(netip.MustParseAddrPort(test.RemoteAddr))
+				},
+			}
+
+			lim := &BytesLimiterMock{}
+
+			var buffer bytes.Buffer
+
+			l := &Listener{
+				clock: clock.New(),
+				log:   slog.New(slog.NewTextHandler(&buffer, &slog.HandlerOptions{Level: slog.LevelDebug})),
+				listener: &listenerMock{
+					AcceptFunc: func() (net.Conn, error) {
+						return cm, nil
+					},
+				},
+				limiter:      lim,
+				metrics:      &MetricsMock{},
+				allowedCIDRs: []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")},
+				deniedCIDRs:  []netip.Prefix{netip.MustParsePrefix("10.0.0.1/32")},
+			}
+
+			conn, err := l.Accept()
+			require.NoError(t, err)
+
+			if test.Allowed {
+				assert.IsType(t, &Conn{}, conn)
+				assert.Len(t, cm.CloseCalls(), 0)
+				assert.Empty(t, buffer.String())
+
+				return
+			}
+
+			assert.Equal(t, cm, conn)
+			assert.Len(t, cm.CloseCalls(), 1)
+			assert.Len(t, cm.WriteCalls(), 0)
+			assert.Contains(
+				t,
+				buffer.String(),
+				`level=DEBUG msg="rejected connection from a disallowed address" remote_addr=`+test.RemoteAddr,
+			)
+		})
+	}
+}
+
+func Test_Listener_allowedAddr(t *testing.T) {
+	tcpAddr := func(addr string) net.Addr {
+		return net.TCPAddrFromAddrPort(netip.MustParseAddrPort(addr))
+	}
+
+	allowed := []netip.Prefix{
+		netip.MustParsePrefix("10.0.0.0/8"),
+		netip.MustParsePrefix("fd00::/8"),
+	}
+
+	denied := []netip.Prefix{
+		netip.MustParsePrefix("10.0.0.0/24"),
+	}
+
+	tests := map[string]struct {
+		Allowed []netip.Prefix
+		Denied  []netip.Prefix
+		Addr    net.Addr
+		Result  bool
+	}{
+		"No address ranges": {
+			Addr:   tcpAddr("192.0.2.1:80"),
+			Result: true,
+		},
+		"No address ranges and no address": {
+			Result: true,
+		},
+		"Address within the allowed ranges": {
+			Allowed: allowed,
+			Addr:    tcpAddr("10.1.0.1:80"),
+			Result:  true,
+		},
+		"IPv6 address within the allowed ranges": {
+			Allowed: allowed,
+			Addr:    tcpAddr("[fd00::1]:80"),
+			Result:  true,
+		},
+		"IPv4-mapped IPv6 address within the allowed ranges": {
+			Allowed: allowed,
+			Addr:    tcpAddr("[::ffff:10.1.0.1]:80"),
+			Result:  true,
+		},
+		"Address outside the allowed ranges": {
+			Allowed: allowed,
+			Addr:    tcpAddr("192.0.2.1:80"),
+			Result:  false,
+		},
+		"Address within the allowed and denied ranges": {
+			Allowed: allowed,
+			Denied:  denied,
+			Addr:    tcpAddr("10.0.0.5:80"),
+			Result:  false,
+		},
+		"Address within the denied ranges": {
+			Denied: denied,
+			Addr:   tcpAddr("10.0.0.5:80"),
+			Result: false,
+		},
+		"Address outside the denied ranges": {
+			Denied: denied,
+			Addr:   tcpAddr("10.1.0.5:80"),
+			Result: true,
+		},
+		"Unix address with the allowed ranges": {
+			Allowed: allowed,
+			Addr:    &net.UnixAddr{Name: "/run/lwproxy.sock", Net: "unix"},
+			Result:  false,
+		},
+		"Unix address with the denied ranges": {
+			Denied: denied,
+			Addr:   &net.UnixAddr{Name: "/run/lwproxy.sock", Net: "unix"},
+			Result: true,
+		},
+		"Non TCP address": {
+			Allowed: allowed,
+			Addr:    &net.UDPAddr{IP: net.ParseIP("10.1.0.1"), Port: 80},
+			Result:  true,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			l := &Listener{
+				clock:        clock.New(),
+				allowedCIDRs: test.Allowed,
+				deniedCIDRs:  test.Denied,
+			}
+
+			assert.Equal(t, test.Result, l.allowedAddr(test.Addr))
+		})
+	}
+}
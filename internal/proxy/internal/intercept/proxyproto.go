@@ -0,0 +1,254 @@
+package intercept
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/davseby/lwproxy/internal/clock"
+)
+
+const (
+	// _proxyHeaderTimeout is the maximum duration for reading the PROXY
+	// protocol header.
+	_proxyHeaderTimeout = 5 * time.Second
+
+	// _proxyV1MaxLength is the maximum length of the PROXY protocol v1
+	// header, including the CRLF.
+	_proxyV1MaxLength = 107
+)
+
+// _proxyV2Signature is the PROXY protocol v2 header signature.
+var _proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+var (
+	// errInvalidProxyHeader is returned when the PROXY protocol header
+	// is missing or malformed.
+	errInvalidProxyHeader = errors.New("invalid PROXY protocol header")
+
+	// errDisallowedAddr is returned when the client address received in
+	// the PROXY protocol header is not allowed to connect.
+	errDisallowedAddr = errors.New("client address is not allowed")
+)
+
+// proxyConn is a connection that starts with a PROXY protocol v1 or v2
+// header. The header is read and stripped on the first read or remote
+// address call, so that slow clients do not block the listener.
+type proxyConn struct {
+	net.Conn
+
+	clock clock.Clock
+	once  sync.Once
+	r     *bufio.Reader
+
+	// allow checks whether the client address received in the header is
+	// allowed to connect. Nil allows all addresses.
+	allow func(addr net.Addr) bool
+
+	// remoteAddr is the client address received in the header. It is
+	// nil when the header does not carry the address.
+	remoteAddr net.Addr
+	err        error
+}
+
+// newProxyConn creates a new PROXY protocol connection. The reads fail
+// when allow rejects the client address received in the header.
+func newProxyConn(c net.Conn, allow func(addr net.Addr) bool, clk clock.Clock) *proxyConn {
+	return &proxyConn{
+		Conn:  c,
+		clock: clk,
+		r:     bufio.NewReader(c),
+		allow: allow,
+	}
+}
+
+// init reads the PROXY protocol header once.
+func (pc *proxyConn) init() {
+	pc.once.Do(func() {
+		if err := pc.Conn.SetReadDeadline(pc.clock.Now().Add(_proxyHeaderTimeout)); err != nil {
+			pc.err = err
+			return
+		}
+
+		pc.remoteAddr, pc.err = readProxyHeader(pc.r)
+
+		if err := pc.Conn.SetReadDeadline(time.Time{}); err != nil && pc.err == nil {
+			pc.err = err
+		}
+
+		if pc.err == nil && pc.allow != nil && !pc.allow(pc.clientAddr()) {
+			pc.err = errDisallowedAddr
+		}
+	})
+}
+
+// Read reads data that follows the PROXY protocol header.
+func (pc *proxyConn) Read(b []byte) (int, error) {
+	pc.init()
+
+	if pc.err != nil {
+		return 0, pc.err
+	}
+
+	return pc.r.Read(b)
+}
+
+// RemoteAddr returns the client address received in the PROXY protocol
+// header. The connection remote address is returned when the header does
+// not carry the client address.
+func (pc *proxyConn) RemoteAddr() net.Addr {
+	pc.init()
+
+	return pc.clientAddr()
+}
+
+// clientAddr returns the client address received in the PROXY protocol
+// header or the connection remote address if the header does not carry
+// it.
+func (pc *proxyConn) clientAddr() net.Addr {
+	if pc.remoteAddr != nil {
+		return pc.remoteAddr
+	}
+
+	return pc.Conn.RemoteAddr()
+}
+
+// CloseWrite shuts down the writing side of the connection. It returns
+// errors.ErrUnsupported if the underlying connection does not support
+// half-closing.
+func (pc *proxyConn) CloseWrite() error {
+	cw, ok := pc.Conn.(interface{ CloseWrite() error })
+	if !ok {
+		return errors.ErrUnsupported
+	}
+
+	return cw.CloseWrite()
+}
+
+// readProxyHeader reads either a v1 or a v2 PROXY protocol header and
+// returns the client address. Nil address is returned for the headers
+// that do not carry the client address, e.g. health checks.
+func readProxyHeader(r *bufio.Reader) (net.Addr, error) {
+	prefix, err := r.Peek(5)
+	if err != nil {
+		return nil, err
+	}
+
+	if string(prefix) == "PROXY" {
+		return readProxyHeaderV1(r)
+	}
+
+	sig, err := r.Peek(len(_proxyV2Signature))
+	if err != nil {
+		return nil, err
+	}
+
+	if !bytes.Equal(sig, _proxyV2Signature) {
+		return nil, errInvalidProxyHeader
+	}
+
+	return readProxyHeaderV2(r)
+}
+
+// readProxyHeaderV1 reads a human-readable PROXY protocol v1 header, e.g.
+// "PROXY TCP4 192.0.2.1 192.0.2.2 56324 443\r\n".
+func readProxyHeaderV1(r *bufio.Reader) (net.Addr, error) {
+	var line []byte
+
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) >= _proxyV1MaxLength {
+			return nil, errInvalidProxyHeader
+		}
+
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+
+		line = append(line, b)
+	}
+
+	fields := strings.Fields(string(line))
+
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil //nolint: nilnil // unknown protocol carries no address.
+	}
+
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, errInvalidProxyHeader
+	}
+
+	ip := net.ParseIP(fields[2])
+	if ip == nil {
+		return nil, errInvalidProxyHeader
+	}
+
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if err != nil {
+		return nil, errInvalidProxyHeader
+	}
+
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// readProxyHeaderV2 reads a binary PROXY protocol v2 header.
+func readProxyHeaderV2(r *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, len(_proxyV2Signature)+4)
+
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+
+	verCmd, family := header[12], header[13]
+
+	if verCmd>>4 != 2 {
+		return nil, fmt.Errorf("%w: unsupported version", errInvalidProxyHeader)
+	}
+
+	payload := make([]byte, binary.BigEndian.Uint16(header[14:16]))
+
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, err
+	}
+
+	// NOTE: The LOCAL command is used by the proxies for health checks,
+	// the connection endpoints are then the real ones.
+	if verCmd&0x0F == 0 {
+		return nil, nil //nolint: nilnil // local command carries no address.
+	}
+
+	if verCmd&0x0F != 1 {
+		return nil, fmt.Errorf("%w: unsupported command", errInvalidProxyHeader)
+	}
+
+	var ipLen int
+
+	switch family >> 4 {
+	case 1:
+		ipLen = net.IPv4len
+	case 2:
+		ipLen = net.IPv6len
+	default:
+		// NOTE: Unix and unspecified addresses are ignored.
+		return nil, nil //nolint: nilnil // the address is not an IP address.
+	}
+
+	// NOTE: The payload holds the source and destination addresses
+	// followed by the source and destination ports.
+	if len(payload) < 2*ipLen+4 {
+		return nil, errInvalidProxyHeader
+	}
+
+	return &net.TCPAddr{
+		IP:   net.IP(payload[:ipLen]),
+		Port: int(binary.BigEndian.Uint16(payload[2*ipLen:])),
+	}, nil
+}
@@ -0,0 +1,283 @@
+package intercept
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/netip"
+	"strings"
+	"testing"
+
+	"github.com/davseby/lwproxy/internal/clock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/exp/slog"
+)
+
+// proxyHeaderV2 builds a PROXY protocol v2 header.
+func proxyHeaderV2(cmd, family byte, src, dst net.IP, srcPort, dstPort uint16) []byte {
+	payload := append(append([]byte{}, src...), dst...)
+	payload = binary.BigEndian.AppendUint16(payload, srcPort)
+	payload = binary.BigEndian.AppendUint16(payload, dstPort)
+
+	header := append([]byte{}, _proxyV2Signature...)
+	header = append(header, 0x20|cmd, family)
+	header = binary.BigEndian.AppendUint16(header, uint16(len(payload)))
+
+	return append(header, payload...)
+}
+
+func Test_readProxyHeader(t *testing.T) {
+	tests := map[string]struct {
+		Header string
+		Addr   net.Addr
+		Error  error
+	}{
+		"Header is missing": {
+			Header: "GET / HTTP/1.1\r\n\r\n",
+			Error:  errInvalidProxyHeader,
+		},
+		"Header is truncated": {
+			Header: "PRO",
+			Error:  io.EOF,
+		},
+		"v1 header is too long": {
+			Header: "PROXY TCP4 " + strings.Repeat("1", _proxyV1MaxLength) + "\r\n",
+			Error:  errInvalidProxyHeader,
+		},
+		"v1 header has an unsupported protocol": {
+			Header: "PROXY UDP4 192.0.2.1 192.0.2.2 56324 443\r\n",
+			Error:  errInvalidProxyHeader,
+		},
+		"v1 header has an invalid address": {
+			Header: "PROXY TCP4 192.0.2 192.0.2.2 56324 443\r\n",
+			Error:  errInvalidProxyHeader,
+		},
+		"v1 header has an invalid port": {
+			Header: "PROXY TCP4 192.0.2.1 192.0.2.2 70000 443\r\n",
+			Error:  errInvalidProxyHeader,
+		},
+		"v1 header has an unknown protocol": {
+			Header: "PROXY UNKNOWN\r\n",
+		},
+		"Successfully read v1 TCP4 header": {
+			Header: "PROXY TCP4 192.0.2.1 192.0.2.2 56324 443\r\n",
+			Addr:   &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 56324},
+		},
+		"Successfully read v1 TCP6 header": {
+			Header: "PROXY TCP6 2001:db8::1 2001:db8::2 56324 443\r\n",
+			Addr:   &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 56324},
+		},
+		"v2 header has an unsupported version": {
+			Header: string(append(append([]byte{}, _proxyV2Signature...), 0x11, 0x11, 0, 0)),
+			Error:  errInvalidProxyHeader,
+		},
+		"v2 header has a truncated payload": {
+			Header: string(append(append([]byte{}, _proxyV2Signature...), 0x21, 0x11, 0, 12)),
+			Error:  io.EOF,
+		},
+		"v2 header has a short address block": {
+			Header: string(append(append([]byte{}, _proxyV2Signature...), 0x21, 0x11, 0, 2, 0, 0)),
+			Error:  errInvalidProxyHeader,
+		},
+		"v2 header has a local command": {
+			Header: string(proxyHeaderV2(0, 0x11, net.IPv4(192, 0, 2, 1).To4(), net.IPv4(192, 0, 2, 2).To4(), 56324, 443)),
+		},
+		"Successfully read v2 IPv4 header": {
+			Header: string(proxyHeaderV2(1, 0x11, net.IPv4(192, 0, 2, 1).To4(), net.IPv4(192, 0, 2, 2).To4(), 56324, 443)),
+			Addr:   &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1).To4(), Port: 56324},
+		},
+		"Successfully read v2 IPv6 header": {
+			Header: string(proxyHeaderV2(1, 0x21, net.ParseIP("2001:db8::1"), net.ParseIP("2001:db8::2"), 56324, 443)),
+			Addr:   &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 56324},
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			addr, err := readProxyHeader(bufio.NewReader(strings.NewReader(test.Header)))
+			assert.ErrorIs(t, err, test.Error)
+			assert.Equal(t, test.Addr, addr)
+		})
+	}
+}
+
+func Test_proxyConn(t *testing.T) {
+	tests := map[string]struct {
+		Header     []byte
+		RemoteAddr string
+		Error      error
+	}{
+		"Header is invalid": {
+			Header: []byte("GET / HTTP/1.1\r\n"),
+			Error:  errInvalidProxyHeader,
+		},
+		"Successfully stripped v1 header": {
+			Header:     []byte("PROXY TCP4 192.0.2.1 192.0.2.2 56324 443\r\n"),
+			RemoteAddr: "192.0.2.1:56324",
+		},
+		"Successfully stripped v2 header": {
+			Header:     proxyHeaderV2(1, 0x21, net.ParseIP("2001:db8::1"), net.ParseIP("2001:db8::2"), 56324, 443),
+			RemoteAddr: "[2001:db8::1]:56324",
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			ln, err := net.Listen("tcp", "127.0.0.1:0")
+			require.NoError(t, err)
+
+			defer ln.Close()
+
+			client, err := net.Dial("tcp", ln.Addr().String())
+			require.NoError(t, err)
+
+			defer client.Close()
+
+			server, err := ln.Accept()
+			require.NoError(t, err)
+
+			pc := newProxyConn(server, nil, clock.New())
+
+			defer pc.Close()
+
+			_, err = client.Write(append(test.Header, "ping"...))
+			require.NoError(t, err)
+
+			data := make([]byte, 4)
+
+			_, err = io.ReadFull(pc, data)
+			if test.Error != nil {
+				assert.ErrorIs(t, err, test.Error)
+				assert.Equal(t, client.LocalAddr(), pc.RemoteAddr())
+
+				return
+			}
+
+			require.NoError(t, err)
+			assert.Equal(t, "ping", string(data))
+			assert.Equal(t, test.RemoteAddr, pc.RemoteAddr().String())
+
+			require.NoError(t, pc.CloseWrite())
+		})
+	}
+}
+
+func Test_Listener_Accept_ProxyProtocol(t *testing.T) {
+	pl := &pipeListener{
+		connCh: make(chan net.Conn, 1),
+	}
+
+	l := NewListenerFromListener(
+		slog.New(slog.NewTextHandler(io.Discard, nil)),
+		pl,
+		&BytesLimiterMock{},
+		Config{
+			Metrics:       &MetricsMock{},
+			Accountant:    &AccountantMock{},
+			ProxyProtocol: true,
+		},
+	)
+
+	server, client := net.Pipe()
+
+	defer client.Close()
+
+	pl.connCh <- server
+
+	conn, err := l.Accept()
+	require.NoError(t, err)
+
+	go func() {
+		_, _ = client.Write([]byte("PROXY TCP4 192.0.2.1 192.0.2.2 56324 443\r\nping"))
+	}()
+
+	assert.Equal(t, "192.0.2.1:56324", conn.RemoteAddr().String())
+
+	data := make([]byte, 4)
+
+	_, err = io.ReadFull(conn, data)
+	require.NoError(t, err)
+	assert.Equal(t, "ping", string(data))
+
+	c, ok := conn.(*Conn)
+	require.True(t, ok)
+	assert.ErrorIs(t, c.CloseWrite(), errors.ErrUnsupported)
+}
+
+func Test_Listener_Accept_ProxyProtocolCIDRs(t *testing.T) {
+	tests := map[string]struct {
+		AllowedCIDRs []netip.Prefix
+		DeniedCIDRs  []netip.Prefix
+		Error        error
+	}{
+		"Client address is in the allowed range": {
+			AllowedCIDRs: []netip.Prefix{netip.MustParsePrefix("192.0.2.0/24")},
+		},
+		"Client address is outside of the allowed range": {
+			AllowedCIDRs: []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")},
+			Error:        errDisallowedAddr,
+		},
+		"Client address is in the denied range": {
+			DeniedCIDRs: []netip.Prefix{netip.MustParsePrefix("192.0.2.1/32")},
+			Error:       errDisallowedAddr,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			pl := &pipeListener{
+				connCh: make(chan net.Conn, 1),
+			}
+
+			l := NewListenerFromListener(
+				slog.New(slog.NewTextHandler(io.Discard, nil)),
+				pl,
+				&BytesLimiterMock{},
+				Config{
+					Metrics:       &MetricsMock{},
+					Accountant:    &AccountantMock{},
+					ProxyProtocol: true,
+					AllowedCIDRs:  test.AllowedCIDRs,
+					DeniedCIDRs:   test.DeniedCIDRs,
+				},
+			)
+
+			// NOTE: The pipe connection has no IP address, so it would be
+			// rejected if the directly connected peer was checked.
+			server, client := net.Pipe()
+
+			defer client.Close()
+
+			pl.connCh <- server
+
+			conn, err := l.Accept()
+			require.NoError(t, err)
+
+			defer conn.Close()
+
+			go func() {
+				_, _ = client.Write([]byte("PROXY TCP4 192.0.2.1 192.0.2.2 56324 443\r\nping"))
+			}()
+
+			data := make([]byte, 4)
+
+			_, err = io.ReadFull(conn, data)
+			if test.Error != nil {
+				assert.ErrorIs(t, err, test.Error)
+				return
+			}
+
+			require.NoError(t, err)
+			assert.Equal(t, "ping", string(data))
+		})
+	}
+}
@@ -0,0 +1,205 @@
+// package mitm provides an API to intercept TLS connections by issuing
+// per-host certificates signed by a configured certificate authority.
+package mitm
+
+import (
+	"container/list"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"math/big"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/davseby/lwproxy/internal/clock"
+)
+
+// ErrInvalidCAKey is an error for when the certificate authority key
+// cannot be used to sign certificates.
+var ErrInvalidCAKey = errors.New("certificate authority key cannot sign certificates")
+
+const (
+	// _certificateValidity is the validity period of the issued
+	// certificates.
+	_certificateValidity = 24 * time.Hour
+
+	// _certificateBackdate is used to backdate the issued certificates in
+	// case the client clock is slightly behind.
+	_certificateBackdate = time.Hour
+)
+
+// Authority issues and caches per-host certificates for the hosts that
+// should be intercepted.
+type Authority struct {
+	mu    sync.Mutex
+	clock clock.Clock
+
+	ca    *x509.Certificate
+	caKey crypto.Signer
+	key   *ecdsa.PrivateKey
+
+	hosts []string
+
+	// certs indexes the cached certificates by their host, while order
+	// keeps them sorted from the most to the least recently used one.
+	certs    map[string]*list.Element
+	order    *list.List
+	maxCerts int
+}
+
+// cachedCertificate is an issued certificate kept in the cache.
+type cachedCertificate struct {
+	host string
+	cert *tls.Certificate
+}
+
+// NewAuthority creates a new certificate authority from the PEM encoded
+// certificate and key files. Hosts is a list of host patterns that should
+// be intercepted. A pattern prefixed with "*." matches all subdomains. The
+// clock is used to date the issued certificates and to check their expiry.
+// CacheSize is the maximum number of the issued certificates kept in the
+// cache, once it is reached the least recently used certificate is
+// evicted. Zero turns the caching off.
+func NewAuthority(
+	clk clock.Clock,
+	certFile string,
+	keyFile string,
+	hosts []string,
+	cacheSize int,
+) (*Authority, error) {
+	pair, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	ca, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+
+	caKey, ok := pair.PrivateKey.(crypto.Signer)
+	if !ok {
+		return nil, ErrInvalidCAKey
+	}
+
+	// NOTE: A single key is shared between all of the issued certificates
+	// as generating a key for every host would slow down the handshakes.
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	patterns := make([]string, 0, len(hosts))
+
+	for _, host := range hosts {
+		patterns = append(patterns, strings.ToLower(host))
+	}
+
+	return &Authority{
+		clock:    clk,
+		ca:       ca,
+		caKey:    caKey,
+		key:      key,
+		hosts:    patterns,
+		certs:    make(map[string]*list.Element),
+		order:    list.New(),
+		maxCerts: cacheSize,
+	}, nil
+}
+
+// Match returns true if the host should be intercepted.
+func (a *Authority) Match(host string) bool {
+	host = strings.ToLower(host)
+
+	for _, pattern := range a.hosts {
+		if suffix, ok := strings.CutPrefix(pattern, "*"); ok {
+			if strings.HasSuffix(host, suffix) {
+				return true
+			}
+
+			continue
+		}
+
+		if host == pattern {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Certificate returns a certificate for the provided host signed by the
+// certificate authority. Issued certificates are cached until they
+// expire or are evicted as the least recently used ones.
+func (a *Authority) Certificate(host string) (*tls.Certificate, error) {
+	host = strings.ToLower(host)
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if elem, ok := a.certs[host]; ok {
+		cached := elem.Value.(*cachedCertificate) //nolint: forcetypeassert // only cached certificates are stored.
+		if a.clock.Now().Before(cached.cert.Leaf.NotAfter) {
+			a.order.MoveToFront(elem)
+			return cached.cert, nil
+		}
+
+		a.order.Remove(elem)
+		delete(a.certs, host)
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+
+	now := a.clock.Now()
+
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: host},
+		NotBefore:    now.Add(-_certificateBackdate),
+		NotAfter:     now.Add(_certificateValidity),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+
+	if ip := net.ParseIP(host); ip != nil {
+		tmpl.IPAddresses = []net.IP{ip}
+	} else {
+		tmpl.DNSNames = []string{host}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, a.ca, &a.key.PublicKey, a.caKey)
+	if err != nil {
+		return nil, err
+	}
+
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+
+	cert := &tls.Certificate{
+		Certificate: [][]byte{der, a.ca.Raw},
+		PrivateKey:  a.key,
+		Leaf:        leaf,
+	}
+
+	a.certs[host] = a.order.PushFront(&cachedCertificate{host: host, cert: cert})
+
+	if a.order.Len() > a.maxCerts {
+		oldest := a.order.Back()
+		a.order.Remove(oldest)
+		delete(a.certs, oldest.Value.(*cachedCertificate).host) //nolint: forcetypeassert // only cached certificates are stored.
+	}
+
+	return cert, nil
+}
@@ -0,0 +1,246 @@
+package mitm
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/davseby/lwproxy/internal/clock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_NewAuthority(t *testing.T) {
+	dir := t.TempDir()
+
+	// error
+	a, err := NewAuthority(clock.New(), filepath.Join(dir, "missing.pem"), filepath.Join(dir, "missing.pem"), nil, 10)
+	require.Error(t, err)
+	assert.Nil(t, a)
+
+	// success
+	certPath, keyPath, ca := generateCA(t, dir)
+
+	clk := clock.New()
+
+	a, err = NewAuthority(clk, certPath, keyPath, []string{"Example.com", "*.example.org"}, 10)
+	require.NoError(t, err)
+	require.NotNil(t, a)
+	assert.Equal(t, clk, a.clock)
+	assert.Equal(t, ca, a.ca)
+	assert.NotNil(t, a.caKey)
+	assert.NotNil(t, a.key)
+	assert.Equal(t, []string{"example.com", "*.example.org"}, a.hosts)
+	assert.NotNil(t, a.certs)
+	assert.Equal(t, 10, a.maxCerts)
+}
+
+func Test_Authority_Match(t *testing.T) {
+	a := &Authority{
+		hosts: []string{"example.com", "*.example.org"},
+	}
+
+	tests := map[string]struct {
+		Host   string
+		Result bool
+	}{
+		"Exact host matches": {
+			Host:   "example.com",
+			Result: true,
+		},
+		"Exact host matches regardless of the case": {
+			Host:   "EXAMPLE.com",
+			Result: true,
+		},
+		"Subdomain of an exact host does not match": {
+			Host: "www.example.com",
+		},
+		"Subdomain of a wildcard host matches": {
+			Host:   "www.example.org",
+			Result: true,
+		},
+		"Wildcard host itself does not match": {
+			Host: "example.org",
+		},
+		"Unknown host does not match": {
+			Host: "example.net",
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			assert.Equal(t, test.Result, a.Match(test.Host))
+		})
+	}
+}
+
+func Test_Authority_Certificate(t *testing.T) {
+	certPath, keyPath, ca := generateCA(t, t.TempDir())
+
+	a, err := NewAuthority(clock.New(), certPath, keyPath, nil, 10)
+	require.NoError(t, err)
+
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+
+	for _, host := range []string{"example.com", "127.0.0.1"} {
+		cert, err := a.Certificate(host)
+		require.NoError(t, err)
+		require.NotNil(t, cert.Leaf)
+
+		_, err = cert.Leaf.Verify(x509.VerifyOptions{
+			DNSName: host,
+			Roots:   pool,
+		})
+		require.NoError(t, err)
+
+		cached, err := a.Certificate(host)
+		require.NoError(t, err)
+		assert.Same(t, cert, cached)
+	}
+}
+
+// fakeClock is a manually advanced clock.
+type fakeClock struct {
+	clock.Real
+
+	now time.Time
+}
+
+// Now returns the current fake time.
+func (fc *fakeClock) Now() time.Time {
+	return fc.now
+}
+
+func Test_Authority_Certificate_Expiry(t *testing.T) {
+	certPath, keyPath, _ := generateCA(t, t.TempDir())
+
+	clk := &fakeClock{now: time.Now()}
+
+	a, err := NewAuthority(clk, certPath, keyPath, nil, 10)
+	require.NoError(t, err)
+
+	cert, err := a.Certificate("example.com")
+	require.NoError(t, err)
+	assert.WithinDuration(t, clk.now.Add(_certificateValidity), cert.Leaf.NotAfter, time.Second)
+
+	// still valid
+	clk.now = clk.now.Add(_certificateValidity - time.Minute)
+
+	cached, err := a.Certificate("example.com")
+	require.NoError(t, err)
+	assert.Same(t, cert, cached)
+
+	// expired
+	clk.now = clk.now.Add(time.Minute)
+
+	reissued, err := a.Certificate("example.com")
+	require.NoError(t, err)
+	assert.NotSame(t, cert, reissued)
+	assert.Equal(t, 1, a.order.Len())
+}
+
+func Test_Authority_Certificate_NoCache(t *testing.T) {
+	certPath, keyPath, _ := generateCA(t, t.TempDir())
+
+	a, err := NewAuthority(clock.New(), certPath, keyPath, nil, 0)
+	require.NoError(t, err)
+
+	cert, err := a.Certificate("example.com")
+	require.NoError(t, err)
+
+	reissued, err := a.Certificate("example.com")
+	require.NoError(t, err)
+	assert.NotSame(t, cert, reissued)
+	assert.Zero(t, a.order.Len())
+	assert.Empty(t, a.certs)
+}
+
+func Test_Authority_Certificate_Eviction(t *testing.T) {
+	certPath, keyPath, _ := generateCA(t, t.TempDir())
+
+	a, err := NewAuthority(clock.New(), certPath, keyPath, nil, 2)
+	require.NoError(t, err)
+
+	first, err := a.Certificate("a.example.com")
+	require.NoError(t, err)
+
+	second, err := a.Certificate("b.example.com")
+	require.NoError(t, err)
+
+	// use the first certificate, so that the second one becomes the
+	// least recently used
+	cached, err := a.Certificate("a.example.com")
+	require.NoError(t, err)
+	assert.Same(t, first, cached)
+
+	_, err = a.Certificate("c.example.com")
+	require.NoError(t, err)
+	assert.Equal(t, 2, a.order.Len())
+	assert.Len(t, a.certs, 2)
+	assert.NotContains(t, a.certs, "b.example.com")
+
+	cached, err = a.Certificate("a.example.com")
+	require.NoError(t, err)
+	assert.Same(t, first, cached)
+
+	cached, err = a.Certificate("b.example.com")
+	require.NoError(t, err)
+	assert.NotSame(t, second, cached)
+}
+
+// generateCA generates a self-signed certificate authority and writes it
+// to the provided directory. It returns the certificate and key paths
+// together with the parsed certificate.
+func generateCA(t *testing.T, dir string) (string, string, *x509.Certificate) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "lwproxy test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	require.NoError(t, err)
+
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	certPath := filepath.Join(dir, "ca.pem")
+	keyPath := filepath.Join(dir, "ca-key.pem")
+
+	require.NoError(t, os.WriteFile(
+		certPath,
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		0o600,
+	))
+
+	require.NoError(t, os.WriteFile(
+		keyPath,
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}),
+		0o600,
+	))
+
+	ca, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+
+	return certPath, keyPath, ca
+}
@@ -0,0 +1,46 @@
+package proxy
+
+import (
+	"sync"
+
+	"github.com/davseby/lwproxy/internal/proxy/internal/enforce"
+)
+
+// switchLimiter is a bytes limiter that delegates to a limiter which can
+// be replaced at runtime.
+type switchLimiter struct {
+	mu sync.RWMutex
+
+	limiter bytesLimiter
+}
+
+// CheckBytes checks the bytes usage with the current limiter.
+func (sl *switchLimiter) CheckBytes() (bool, error) {
+	return sl.current().CheckBytes()
+}
+
+// UseBytes uses the bytes with the current limiter.
+func (sl *switchLimiter) UseBytes(n int64) error {
+	return sl.current().UseBytes(n)
+}
+
+// Stats returns the current limiter stats.
+func (sl *switchLimiter) Stats() (enforce.Stats, error) {
+	return sl.current().Stats()
+}
+
+// set replaces the current limiter.
+func (sl *switchLimiter) set(limiter bytesLimiter) {
+	sl.mu.Lock()
+	defer sl.mu.Unlock()
+
+	sl.limiter = limiter
+}
+
+// current returns the current limiter.
+func (sl *switchLimiter) current() bytesLimiter { //nolint: ireturn // the limiter implementation is swapped at runtime.
+	sl.mu.RLock()
+	defer sl.mu.RUnlock()
+
+	return sl.limiter
+}
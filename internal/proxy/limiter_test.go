@@ -0,0 +1,27 @@
+package proxy
+
+import (
+	"testing"
+
+	"github.com/davseby/lwproxy/internal/proxy/internal/enforce"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_switchLimiter(t *testing.T) {
+	sl := &switchLimiter{}
+	sl.set(enforce.NewNoopBytesLimiter())
+
+	ok, err := sl.CheckBytes()
+	require.NoError(t, err)
+	assert.True(t, ok)
+	require.NoError(t, sl.UseBytes(100))
+
+	stats, err := sl.Stats()
+	require.NoError(t, err)
+	assert.Equal(t, enforce.Stats{}, stats)
+
+	limiter := enforce.NewNoopBytesLimiter()
+	sl.set(limiter)
+	assert.Same(t, limiter, sl.current())
+}
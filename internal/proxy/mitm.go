@@ -0,0 +1,155 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// errServerNameMismatch is returned when the intercepted client indicates
+// a server name which differs from the CONNECT target host.
+var errServerNameMismatch = errors.New("server name does not match the target host")
+
+// interceptCommunication terminates the client TLS connection with a
+// certificate issued for the host, records every request sent inside of
+// the tunnel and forwards them to the target over a new TLS connection.
+// Clients indicating a server name other than the host are rejected. The
+// connections are closed when the communication is done.
+func (p *Proxy) interceptCommunication(ctx context.Context, baseConn, targetConn net.Conn, host string) {
+	defer func() {
+		if err := targetConn.Close(); err != nil {
+			p.silentError(ctx, err, "closing target connection")
+		}
+
+		if err := baseConn.Close(); err != nil {
+			p.silentError(ctx, err, "closing base connection")
+		}
+	}()
+
+	p.applyDeadline(ctx, baseConn, targetConn)
+
+	clientConn := tls.Server(baseConn, &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		NextProtos: []string{"http/1.1"},
+		GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			// NOTE: The certificate is issued only for the CONNECT target
+			// host, as the host is what the interception is configured
+			// and the target connection is dialed for.
+			if hello.ServerName != "" && !strings.EqualFold(hello.ServerName, host) {
+				return nil, fmt.Errorf("%w: %q", errServerNameMismatch, hello.ServerName)
+			}
+
+			return p.mitm.Certificate(host)
+		},
+	})
+
+	if err := clientConn.HandshakeContext(ctx); err != nil {
+		p.silentError(ctx, err, "intercepting client handshake")
+		return
+	}
+
+	serverConn := tls.Client(targetConn, &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		NextProtos: []string{"http/1.1"},
+		ServerName: host,
+		RootCAs:    p.mitmRootCAs,
+	})
+
+	if err := serverConn.HandshakeContext(ctx); err != nil {
+		p.silentError(ctx, err, "intercepting target handshake")
+		writeInterceptedError(clientConn, http.StatusBadGateway, "target service handshake failed")
+
+		return
+	}
+
+	clientReader := bufio.NewReader(clientConn)
+	serverReader := bufio.NewReader(serverConn)
+
+	for {
+		req, err := http.ReadRequest(clientReader)
+		if err != nil {
+			if !errors.Is(err, io.EOF) {
+				p.silentError(ctx, err, "reading intercepted request")
+			}
+
+			return
+		}
+
+		rec := p.newRecord(host)
+		rec.Method = req.Method
+		rec.Path = req.URL.Path
+
+		if err := p.rec.Handle(rec); err != nil {
+			writeInterceptedError(clientConn, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		if err := req.Write(serverConn); err != nil {
+			p.silentError(ctx, err, "writing intercepted request to the target service")
+			writeInterceptedError(clientConn, http.StatusBadGateway, "writing request to the target service")
+
+			return
+		}
+
+		resp, err := http.ReadResponse(serverReader, req)
+		if err != nil {
+			p.silentError(ctx, err, "reading intercepted response")
+			writeInterceptedError(clientConn, http.StatusBadGateway, "reading response from the target service")
+
+			return
+		}
+
+		err = resp.Write(clientConn)
+		resp.Body.Close()
+
+		if err != nil {
+			p.silentError(ctx, err, "writing intercepted response")
+			return
+		}
+
+		if req.Close || resp.Close {
+			return
+		}
+	}
+}
+
+// writeInterceptedError writes a plain text error response to the
+// intercepted connection. The response asks the client to close the
+// connection.
+func writeInterceptedError(w io.Writer, code int, msg string) {
+	resp := http.Response{
+		StatusCode: code,
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header: http.Header{
+			"Content-Type": {"text/plain; charset=utf-8"},
+		},
+		Body:          io.NopCloser(strings.NewReader(msg)),
+		ContentLength: int64(len(msg)),
+		Close:         true,
+	}
+
+	// NOTE: The connection is closed right after the error is written, so
+	// there is nothing to do if the write fails.
+	_ = resp.Write(w)
+}
+
+// bufferedConn is a connection which reads are served from a buffered
+// reader. It is used to not lose the data that has already been buffered
+// by the HTTP server before the connection was hijacked.
+type bufferedConn struct {
+	net.Conn
+
+	r *bufio.Reader
+}
+
+// Read reads data from the buffered reader.
+func (bc *bufferedConn) Read(b []byte) (int, error) {
+	return bc.r.Read(b)
+}
@@ -0,0 +1,159 @@
+package proxy
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/davseby/lwproxy/internal/clock"
+	"github.com/davseby/lwproxy/internal/proxy/internal/mitm"
+	"github.com/davseby/lwproxy/internal/request"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/trace/noop"
+	"golang.org/x/exp/slog"
+)
+
+func Test_Proxy_interceptCommunication(t *testing.T) {
+	target := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%s %s", r.Method, r.URL.Path)
+	}))
+	t.Cleanup(target.Close)
+
+	rootCAFile := filepath.Join(t.TempDir(), "roots.pem")
+	require.NoError(t, os.WriteFile(
+		rootCAFile,
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: target.Certificate().Raw}),
+		0o600,
+	))
+
+	caCert, caKey, caPool := generateCertificate(t, t.TempDir())
+
+	cfg := testConfig()
+	cfg.MITM.Hosts = []string{"127.0.0.1"}
+	cfg.MITM.CACertFile = caCert
+	cfg.MITM.CAKeyFile = caKey
+	cfg.MITM.RootCAFile = rootCAFile
+
+	rec := &RecorderMock{
+		HandleFunc: func(_ request.Record) error {
+			return nil
+		},
+	}
+
+	p, err := NewProxy(slog.New(slog.NewTextHandler(io.Discard, nil)), cfg, WithRecorder(rec))
+	require.NoError(t, err)
+
+	srv := httptest.NewServer(http.HandlerFunc(p.tunnelingHandler))
+	t.Cleanup(srv.Close)
+
+	conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+	require.NoError(t, err)
+
+	defer conn.Close()
+
+	targetAddr := target.Listener.Addr().String()
+
+	_, err = fmt.Fprintf(conn, "CONNECT %[1]s HTTP/1.1\r\nHost: %[1]s\r\n\r\n", targetAddr)
+	require.NoError(t, err)
+
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	tlsConn := tls.Client(conn, &tls.Config{
+		RootCAs:    caPool,
+		ServerName: "127.0.0.1",
+		MinVersion: tls.VersionTLS12,
+	})
+
+	br := bufio.NewReader(tlsConn)
+
+	for _, path := range []string{"/first", "/second"} {
+		req, err := http.NewRequest(http.MethodGet, "https://"+targetAddr+path, http.NoBody)
+		require.NoError(t, err)
+		require.NoError(t, req.Write(tlsConn))
+
+		resp, err := http.ReadResponse(br, req)
+		require.NoError(t, err)
+
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		resp.Body.Close()
+
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, "GET "+path, string(body))
+	}
+
+	state := tlsConn.ConnectionState()
+	require.NotEmpty(t, state.PeerCertificates)
+	assert.Equal(t, "127.0.0.1", state.PeerCertificates[0].Subject.CommonName)
+
+	calls := rec.HandleCalls()
+	require.Len(t, calls, 2)
+
+	for i, path := range []string{"/first", "/second"} {
+		assert.Equal(t, "127.0.0.1", calls[i].Rec.Host)
+		assert.Equal(t, http.MethodGet, calls[i].Rec.Method)
+		assert.Equal(t, path, calls[i].Rec.Path)
+	}
+}
+
+func Test_Proxy_interceptCommunication_ServerNameMismatch(t *testing.T) {
+	target := httptest.NewTLSServer(http.HandlerFunc(func(_ http.ResponseWriter, _ *http.Request) {
+		t.Error("request must not reach the target")
+	}))
+	t.Cleanup(target.Close)
+
+	caCert, caKey, caPool := generateCertificate(t, t.TempDir())
+
+	authority, err := mitm.NewAuthority(clock.New(), caCert, caKey, []string{"127.0.0.1"}, 10)
+	require.NoError(t, err)
+
+	rec := &RecorderMock{
+		HandleFunc: func(_ request.Record) error {
+			return nil
+		},
+	}
+
+	p := &Proxy{
+		log:    slog.New(slog.NewTextHandler(io.Discard, nil)),
+		rec:    rec,
+		tracer: noop.NewTracerProvider().Tracer(""),
+		clock:  clock.New(),
+		dial:   (&net.Dialer{}).DialContext,
+		mitm:   authority,
+	}
+
+	srv := httptest.NewServer(http.HandlerFunc(p.tunnelingHandler))
+	t.Cleanup(srv.Close)
+
+	conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+	require.NoError(t, err)
+
+	defer conn.Close()
+
+	_, err = fmt.Fprintf(conn, "CONNECT %[1]s HTTP/1.1\r\nHost: %[1]s\r\n\r\n", target.Listener.Addr().String())
+	require.NoError(t, err)
+
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	tlsConn := tls.Client(conn, &tls.Config{
+		RootCAs:    caPool,
+		ServerName: "example.com",
+		MinVersion: tls.VersionTLS12,
+	})
+
+	require.Error(t, tlsConn.Handshake())
+	assert.Empty(t, rec.HandleCalls())
+}
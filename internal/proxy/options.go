@@ -0,0 +1,138 @@
+package proxy
+
+import (
+	"net"
+
+	"github.com/davseby/lwproxy/internal/clock"
+	"github.com/davseby/lwproxy/internal/db/memory"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+// options holds the optional proxy dependencies.
+type options struct {
+	rec     Recorder
+	authz   Authorizer
+	metrics Metrics
+	tp      trace.TracerProvider
+	dial    DialFunc
+	dns     *net.Resolver
+	db      DB
+	clock   clock.Clock
+
+	instance string
+}
+
+// Option is used to set an optional proxy dependency.
+type Option func(o *options)
+
+// WithRecorder sets the requests recorder. By default the requests are
+// not recorded.
+func WithRecorder(rec Recorder) Option {
+	return func(o *options) {
+		o.rec = rec
+	}
+}
+
+// WithAuthorizer sets the requests authorizer. By default all
+// authenticated requests are allowed.
+func WithAuthorizer(authz Authorizer) Option {
+	return func(o *options) {
+		o.authz = authz
+	}
+}
+
+// WithMetrics sets the metrics collector. By default no metrics are
+// collected.
+func WithMetrics(metrics Metrics) Option {
+	return func(o *options) {
+		o.metrics = metrics
+	}
+}
+
+// WithTracerProvider sets the tracer provider. By default no spans are
+// collected.
+func WithTracerProvider(tp trace.TracerProvider) Option {
+	return func(o *options) {
+		o.tp = tp
+	}
+}
+
+// WithDial sets the function used to connect to the target services. By
+// default the net.Dialer is used. The target hosts are then also resolved
+// by connecting to the DNS servers with the same function.
+func WithDial(dial DialFunc) Option {
+	return func(o *options) {
+		o.dial = dial
+	}
+}
+
+// WithDB sets the database. By default an in-memory database is used.
+func WithDB(db DB) Option {
+	return func(o *options) {
+		o.db = db
+	}
+}
+
+// WithClock sets the clock used for the request records, deadlines and
+// timers. By default the system time is used.
+func WithClock(clk clock.Clock) Option {
+	return func(o *options) {
+		o.clock = clk
+	}
+}
+
+// WithInstance sets the proxy instance name attached to the request
+// records. By default no name is attached.
+func WithInstance(name string) Option {
+	return func(o *options) {
+		o.instance = name
+	}
+}
+
+// newOptions creates the proxy dependencies with the provided options
+// applied. The dependencies that are not set, or are set to nil, fall
+// back to their defaults.
+func newOptions(opts []Option) options {
+	var o options
+
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	if o.rec == nil {
+		o.rec = noopRecorder{}
+	}
+
+	if o.authz == nil {
+		o.authz = allowAuthorizer{}
+	}
+
+	if o.metrics == nil {
+		o.metrics = noopMetrics{}
+	}
+
+	if o.tp == nil {
+		o.tp = noop.NewTracerProvider()
+	}
+
+	if o.dial == nil {
+		o.dial = (&net.Dialer{}).DialContext
+		o.dns = net.DefaultResolver
+	} else {
+		o.dns = &net.Resolver{
+			PreferGo: true,
+			Dial:     o.dial,
+		}
+	}
+
+	if o.db == nil {
+		o.db = memory.NewDB()
+	}
+
+	if o.clock == nil {
+		o.clock = clock.New()
+	}
+
+	return o
+}
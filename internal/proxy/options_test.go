@@ -0,0 +1,177 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/davseby/lwproxy/internal/clock"
+	"github.com/davseby/lwproxy/internal/db/memory"
+	"github.com/davseby/lwproxy/internal/request"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+	"golang.org/x/exp/slog"
+)
+
+func Test_NewProxy_Options(t *testing.T) {
+	// default dependencies
+	cfg := testConfig()
+	cfg.Addr = ":8081"
+
+	p, err := NewProxy(slog.New(slog.NewTextHandler(io.Discard, nil)), cfg)
+	require.NoError(t, err)
+	require.NotNil(t, p)
+	assert.NotNil(t, p.log)
+	assert.Equal(t, noopRecorder{}, p.rec)
+	assert.Equal(t, allowAuthorizer{}, p.authz)
+	assert.Equal(t, noopMetrics{}, p.metrics)
+	assert.Equal(t, noop.NewTracerProvider().Tracer(_tracerName), p.tracer)
+	assert.IsType(t, &memory.DB{}, p.db)
+	assert.NotNil(t, p.dial)
+	assert.Same(t, net.DefaultResolver, p.dns)
+	assert.Equal(t, clock.New(), p.clock)
+	assert.Equal(t, ":8081", p.srv.Addr)
+
+	// custom dependencies
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+	rec := &RecorderMock{}
+	authz := &AuthorizerMock{}
+	mm := &MetricsMock{}
+	tp := sdktrace.NewTracerProvider()
+	db := memory.NewDB()
+
+	var dialed bool
+
+	p, err = NewProxy(
+		log,
+		testConfig(),
+		WithRecorder(rec),
+		WithAuthorizer(authz),
+		WithMetrics(mm),
+		WithTracerProvider(tp),
+		WithDial(func(_ context.Context, _, _ string) (net.Conn, error) {
+			dialed = true
+			return nil, assert.AnError
+		}),
+		WithDB(db),
+		WithClock(fixedClock{}),
+		WithInstance("proxy-1"),
+	)
+	require.NoError(t, err)
+	require.NotNil(t, p)
+	assert.Equal(t, log.With("job", "proxy"), p.log)
+	assert.Same(t, rec, p.rec)
+	assert.Same(t, authz, p.authz)
+	assert.Same(t, mm, p.metrics)
+	assert.Equal(t, tp.Tracer(_tracerName), p.tracer)
+	assert.Same(t, db, p.db)
+	assert.Equal(t, fixedClock{}, p.clock)
+	assert.Equal(t, "proxy-1", p.instance)
+	assert.True(t, p.dns.PreferGo)
+	assert.NotNil(t, p.dns.Dial)
+
+	_, err = p.dial(context.Background(), "tcp", "example.com:80")
+	assert.Equal(t, assert.AnError, err)
+	assert.True(t, dialed)
+
+	// invalid configuration
+	p, err = NewProxy(log, Config{})
+	require.Error(t, err)
+	assert.Nil(t, p)
+}
+
+func Test_NewProxy_NilOptions(t *testing.T) {
+	p, err := NewProxy(
+		slog.New(slog.NewTextHandler(io.Discard, nil)),
+		testConfig(),
+		WithRecorder(nil),
+		WithAuthorizer(nil),
+		WithMetrics(nil),
+		WithTracerProvider(nil),
+		WithDial(nil),
+		WithDB(nil),
+		WithClock(nil),
+	)
+	require.NoError(t, err)
+	require.NotNil(t, p)
+	assert.Equal(t, noopRecorder{}, p.rec)
+	assert.Equal(t, allowAuthorizer{}, p.authz)
+	assert.Equal(t, noopMetrics{}, p.metrics)
+	assert.Equal(t, noop.NewTracerProvider().Tracer(_tracerName), p.tracer)
+	assert.NotNil(t, p.dial)
+	assert.Same(t, net.DefaultResolver, p.dns)
+	assert.IsType(t, &memory.DB{}, p.db)
+	assert.Equal(t, clock.New(), p.clock)
+
+	// NOTE: The unauthenticated request reaches the metrics collector.
+	w := httptest.NewRecorder()
+	p.authHandler(w, httptest.NewRequest(http.MethodGet, "http://example.com", http.NoBody))
+
+	assert.Equal(t, http.StatusProxyAuthRequired, w.Code)
+}
+
+// fixedClock is a clock that always returns the same time.
+type fixedClock struct {
+	clock.Real
+
+	now time.Time
+}
+
+// Now returns the fixed time.
+func (fc fixedClock) Now() time.Time {
+	return fc.now
+}
+
+func Test_NewProxy_WithClock(t *testing.T) {
+	now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	var createdAt time.Time
+
+	p, err := NewProxy(
+		slog.New(slog.NewTextHandler(io.Discard, nil)),
+		testConfig(),
+		WithRecorder(&RecorderMock{
+			HandleFunc: func(rec request.Record) error {
+				createdAt = rec.CreatedAt
+				return assert.AnError
+			},
+		}),
+		WithClock(fixedClock{now: now}),
+	)
+	require.NoError(t, err)
+
+	w := httptest.NewRecorder()
+	p.recordHandler(w, httptest.NewRequest(http.MethodConnect, "example.com:443", http.NoBody))
+
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Equal(t, now, createdAt)
+}
+
+func Test_NewProxy_WithInstance(t *testing.T) {
+	var instance string
+
+	p, err := NewProxy(
+		slog.New(slog.NewTextHandler(io.Discard, nil)),
+		testConfig(),
+		WithRecorder(&RecorderMock{
+			HandleFunc: func(rec request.Record) error {
+				instance = rec.Instance
+				return assert.AnError
+			},
+		}),
+		WithInstance("proxy-1"),
+	)
+	require.NoError(t, err)
+
+	w := httptest.NewRecorder()
+	p.recordHandler(w, httptest.NewRequest(http.MethodConnect, "example.com:443", http.NoBody))
+
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Equal(t, "proxy-1", instance)
+}
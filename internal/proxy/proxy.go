@@ -1,27 +1,45 @@
 // package proxy provides a proxy server implementation for the proxy service.
+//
+//go:generate moq --stub -out 0moq_test.go . Recorder:RecorderMock Authorizer:AuthorizerMock Metrics:MetricsMock DB:DBMock
 package proxy
 
 import (
 	"context"
+	"crypto/subtle"
 	"crypto/tls"
+	"crypto/x509"
 	"encoding/base64"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
 	"net"
 	"net/http"
+	"net/netip"
 	"os"
+	"runtime/debug"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
+	"github.com/davseby/lwproxy/internal/clock"
+	"github.com/davseby/lwproxy/internal/proxy/internal/account"
 	"github.com/davseby/lwproxy/internal/proxy/internal/enforce"
 	"github.com/davseby/lwproxy/internal/proxy/internal/intercept"
+	"github.com/davseby/lwproxy/internal/proxy/internal/mitm"
 	"github.com/davseby/lwproxy/internal/request"
+	"github.com/rs/xid"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 	"golang.org/x/exp/slog"
 )
 
 const (
-	// _closeTimeout is the timeout for closing the proxy.
-	_closeTimeout = 5 * time.Second
-
 	// _targetDialTimeout is the timeout for dialing the target.
 	_targetDialTimeout = 10 * time.Second
 
@@ -30,6 +48,21 @@ const (
 
 	// _readHeaderTimeout is the timeout for reading the header.
 	_readHeaderTimeout = 5 * time.Second
+
+	// _maxIdleConns is the maximum number of idle connections kept to the
+	// plain HTTP target services.
+	_maxIdleConns = 100
+
+	// _idleConnTimeout is the timeout after which idle connections to the
+	// plain HTTP target services are closed.
+	_idleConnTimeout = 90 * time.Second
+
+	// _defaultShutdownTimeout is the shutdown timeout used when it is not
+	// configured.
+	_defaultShutdownTimeout = 5 * time.Second
+
+	// _tracerName is the name of the proxy tracer.
+	_tracerName = "github.com/davseby/lwproxy/internal/proxy"
 )
 
 // Proxy is a proxy server.
@@ -38,20 +71,152 @@ type Proxy struct {
 
 	srv *http.Server
 
+	// draining is set once the server shutdown begins.
+	draining atomic.Bool
+
+	// addrMu protects the address of the active listener.
+	addrMu sync.Mutex
+	addr   net.Addr
+
+	closeOnce sync.Once
+
 	rec     Recorder
-	limiter intercept.BytesLimiter
+	authz   Authorizer
+	metrics Metrics
+	tracer  trace.Tracer
+	dial    DialFunc
+	dns     *net.Resolver
+	clock   clock.Clock
+	limiter *switchLimiter
+	hosts   *account.Hosts
+	db      DB
+
+	transport *http.Transport
+	tlsConfig *tls.Config
+
+	mitm        *mitm.Authority
+	mitmRootCAs *x509.CertPool
+
+	// instance is the proxy instance name attached to the request
+	// records.
+	instance string
 
 	cfg Config
 }
 
+// Response holds a custom response written by the proxy instead of the
+// default error message.
+type Response struct {
+	// ContentType is the Content-Type header of the response. Empty value
+	// uses the plain text content type.
+	ContentType string
+
+	// Body is the response body. Empty value uses the default message.
+	Body string
+}
+
 // Config holds the settings for the proxy server.
 type Config struct {
 	// Addr is the address to listen on.
 	Addr string `default:":8081"`
 
-	// MaxBytes is the maximum amount of bytes that can be used.
-	// The default value is 1GB.
-	MaxBytes int64 `default:"1000000000"`
+	// MaxBytes is the maximum amount of bytes that can be used. It can
+	// be set as a human-readable size, e.g. 1GB or 512MiB. The default
+	// value is 1GB.
+	MaxBytes ByteSize `default:"1000000000"`
+
+	// MaxBytesWindow turns the bytes limit into a sliding window limit,
+	// e.g. MaxBytes per hour, so that the usage ages out over time. The
+	// windowed usage is kept in memory and is not shared between the proxy
+	// instances. Zero applies MaxBytes to the total usage.
+	MaxBytesWindow time.Duration
+
+	// SoftMaxBytes is the amount of bytes after which a warning is logged
+	// for every authenticated request. Zero turns the warnings off.
+	SoftMaxBytes int64
+
+	// GraceBytes is the amount of bytes the active connections can still
+	// use once MaxBytes is reached, so that the in-flight transfers are
+	// not cut off. The new requests are rejected regardless.
+	GraceBytes int64
+
+	// OnLimitExceeded is an optional callback that is called once the
+	// bytes limit is exceeded for the first time. It can only be set
+	// programmatically.
+	OnLimitExceeded func()
+
+	// MaxResponseBytes is the maximum size of a single plain HTTP
+	// response body. Larger responses are rejected, or aborted if their
+	// size is not known upfront. Zero turns the limit off.
+	MaxResponseBytes int64
+
+	// MaxHeaderBytes is the maximum size of the request headers.
+	// The default value is 64KB.
+	MaxHeaderBytes int `default:"65536"`
+
+	// ErrorFormat is the format of the error responses written by the
+	// proxy. Available formats: text, json.
+	ErrorFormat string `default:"text"`
+
+	// LimitExceededResponse customizes the 402 response written to the
+	// authenticated requests once the bytes limit is exceeded, e.g. to
+	// return JSON or a link to top up the quota.
+	LimitExceededResponse Response
+
+	// InternalErrorResponse customizes the 500 response written to the
+	// authenticated requests when the bytes limit cannot be checked.
+	InternalErrorResponse Response
+
+	// RecordBufferSize is the number of request records that can be
+	// queued for the recorder. When it is greater than zero, the records
+	// are handled asynchronously and dropped once the buffer is full.
+	// Otherwise the requests wait until their records are handled.
+	RecordBufferSize int
+
+	// FailOpen specifies whether the requests should be admitted when
+	// the bytes usage cannot be checked. The connections of such requests
+	// are not accounted. By default the requests are rejected.
+	FailOpen bool
+
+	// ProxyProtocol specifies whether the incoming connections start with
+	// a PROXY protocol v1 or v2 header, e.g. when the proxy is behind a
+	// load balancer. The header client address is used as the remote
+	// address of the connection.
+	ProxyProtocol bool
+
+	// IdleTimeout is the duration after which a client connection without
+	// any reads or writes is closed. Zero turns the timeout off, the
+	// connections are then limited by the connection timeout only.
+	IdleTimeout time.Duration
+
+	// MaxConnectionLifetime is the duration after which a client
+	// connection is closed regardless of its activity, so that the
+	// keep-alive clients have to reconnect and authenticate again. Zero
+	// turns the limit off.
+	MaxConnectionLifetime time.Duration
+
+	// KeepAlivePeriod is the TCP keep-alive period of the client and the
+	// tunnel target connections, which keeps the idle long-lived tunnels
+	// from being dropped. Zero turns the keep-alive off.
+	KeepAlivePeriod time.Duration `default:"15s"`
+
+	// ShutdownTimeout is the duration the server waits for the active
+	// requests to complete when it is shutting down. The remaining
+	// connections are closed once it elapses. Zero uses the default of
+	// 5 seconds.
+	ShutdownTimeout time.Duration `default:"5s"`
+
+	// ConnectEstablishTimeout is the maximum duration for establishing a
+	// tunnel, i.e. dialing the target service and receiving its first
+	// bytes. Tunnels that are not established in time are closed. Zero
+	// turns the timeout off, the dial is then limited by the dial timeout
+	// only.
+	ConnectEstablishTimeout time.Duration
+
+	// TargetOverride specifies whether the CONNECT requests can override
+	// the dialed target address with the X-Lwproxy-Target header. It is
+	// meant for testing only and must not be turned on in production.
+	TargetOverride bool
 
 	Auth struct {
 		// Username is the username used for basic authentication.
@@ -59,179 +224,1149 @@ type Config struct {
 
 		// Password is the password used for basic authentication.
 		Password string `default:"admin"`
+
+		// Realm is the realm sent in the authentication challenges.
+		Realm string `default:"lwproxy"`
+
+		// Scheme is the basic authentication scheme name sent in the
+		// challenge, as some clients require specific casing. It must
+		// be a case variant of "Basic". Empty value defaults to "Basic".
+		Scheme string `default:"Basic"`
+
+		// BearerToken is the token accepted with the Bearer scheme. When
+		// it is set, both basic and bearer challenges are sent. Empty
+		// value turns the bearer authentication off.
+		BearerToken string
+
+		// FailureLogLevel is the level at which the authentication
+		// failures are logged.
+		FailureLogLevel slog.Level `default:"info"`
+	}
+
+	// Dial holds the settings for connecting to the tunneled target
+	// services.
+	Dial struct {
+		// Retries is the number of times a failed dial is retried when the
+		// target refuses the connection or the dial times out.
+		Retries int
+
+		// RetryDelay is the delay before the first retry. It is doubled
+		// with every further retry.
+		RetryDelay time.Duration `default:"100ms"`
+	}
+
+	// Accounting holds the settings for passing the connection bytes to
+	// the bytes limiter. The bytes are collected per connection, so that
+	// the database is not queried on every read and write, and the limit
+	// is enforced with a lag of at most FlushBytes or FlushInterval.
+	Accounting struct {
+		// FlushBytes is the amount of collected bytes after which they
+		// are passed to the limiter. Zero passes the bytes on every read
+		// and write.
+		FlushBytes int64 `default:"65536"`
+
+		// FlushInterval is the maximum time the collected bytes are kept
+		// before they are passed to the limiter.
+		FlushInterval time.Duration `default:"1s"`
+	}
+
+	// AllowedCIDRs is a list of client address ranges, e.g. 10.0.0.0/8,
+	// from which the connections are accepted. Connections from all
+	// addresses are accepted when the list is empty. With the PROXY
+	// protocol, the client address from the header is checked.
+	AllowedCIDRs []string `yaml:"allowed_cidrs"`
+
+	// DeniedCIDRs is a list of client address ranges from which the
+	// connections are never accepted. It takes precedence over
+	// AllowedCIDRs.
+	DeniedCIDRs []string `yaml:"denied_cidrs"`
+
+	// SNI holds the settings for capturing the server name indicated in
+	// the TLS client hello of the tunneled communication.
+	SNI struct {
+		// Capture turns the capturing on. The tunnel records are then
+		// published only once the client hello is peeked, so that the
+		// server name is recorded. The TLS communication is not
+		// terminated.
+		Capture bool
+
+		// PeekTimeout is the maximum duration the proxy waits for the
+		// client hello, so that the protocols in which the target
+		// service speaks first are not blocked. Zero turns the timeout
+		// off.
+		PeekTimeout time.Duration `default:"1s"`
+	} `yaml:"sni"`
+
+	// AcceptRate is the maximum number of connections accepted per
+	// second, which protects the proxy from connection floods before the
+	// requests are authenticated. The excess connections wait in the
+	// operating system backlog. Zero turns the limit off.
+	AcceptRate float64
+
+	// AcceptBurst is the maximum number of connections that are accepted
+	// at once, without pacing, when AcceptRate is set.
+	AcceptBurst int `default:"10"`
+
+	// AllowedMethods is a list of request methods, e.g. GET or CONNECT,
+	// that can be proxied. Other requests are rejected with a 405 status
+	// code. All methods are allowed when the list is empty. The methods
+	// are case-insensitive.
+	AllowedMethods []string
+
+	// AllowedConnectPorts is a list of target ports the CONNECT requests
+	// can establish tunnels to, e.g. 443. Other CONNECT requests are
+	// rejected with a 405 status code. All ports are allowed when the list
+	// is empty.
+	AllowedConnectPorts []int
+
+	// UserAgentOverride replaces the User-Agent header of the plain HTTP
+	// requests forwarded to the target services. The header is left as is
+	// when it is empty and it is removed when it is "-". The tunneled
+	// requests cannot be altered.
+	UserAgentOverride string
+
+	// ResponseHeaders holds the settings for filtering the headers of the
+	// plain HTTP responses. The header names are case-insensitive.
+	ResponseHeaders struct {
+		// Allow is a list of headers that are passed to the client. All
+		// headers are passed when the list is empty.
+		Allow []string
+
+		// Deny is a list of headers that are never passed to the client.
+		Deny []string
+	}
+
+	// TLS holds the settings for the proxy listener TLS termination.
+	// TLS is turned off when both files are not set. The certificate is
+	// reloaded once the files are modified.
+	TLS struct {
+		// CertFile is the path to the PEM encoded certificate file.
+		CertFile string
+
+		// KeyFile is the path to the PEM encoded private key file.
+		KeyFile string
+	}
+
+	// MITM holds the settings for the HTTPS requests interception.
+	MITM struct {
+		// Hosts is a list of host patterns whose HTTPS requests should be
+		// intercepted and recorded. A pattern prefixed with "*." matches
+		// all subdomains. Interception is turned off when the list is
+		// empty.
+		Hosts []string
+
+		// CACertFile is the path to the PEM encoded certificate authority
+		// certificate used to sign the intercepted hosts certificates.
+		CACertFile string
+
+		// CAKeyFile is the path to the PEM encoded certificate authority
+		// private key.
+		CAKeyFile string
+
+		// RootCAFile is the path to the PEM encoded certificates used to
+		// verify the intercepted hosts. The system certificate pool is
+		// used when it is empty.
+		RootCAFile string
+
+		// CacheSize is the maximum number of the issued certificates
+		// kept in memory. Once it is reached, the least recently used
+		// certificate is evicted. Zero turns the caching off.
+		CacheSize int `default:"1000"`
+	}
+}
+
+// Validate checks whether the configuration is valid.
+func (cfg Config) Validate() error {
+	switch {
+	case cfg.Addr == "":
+		return errors.New("address must not be empty")
+	case cfg.MaxBytes < 0:
+		return errors.New("max bytes must not be negative")
+	case cfg.MaxBytesWindow < 0:
+		return errors.New("max bytes window must not be negative")
+	case cfg.SoftMaxBytes < 0:
+		return errors.New("soft max bytes must not be negative")
+	case cfg.GraceBytes < 0:
+		return errors.New("grace bytes must not be negative")
+	case cfg.MaxResponseBytes < 0:
+		return errors.New("max response bytes must not be negative")
+	case cfg.MaxHeaderBytes < 0:
+		return errors.New("max header bytes must not be negative")
+	case cfg.RecordBufferSize < 0:
+		return errors.New("record buffer size must not be negative")
+	case cfg.IdleTimeout < 0:
+		return errors.New("idle timeout must not be negative")
+	case cfg.Auth.Username == "":
+		return errors.New("auth username must not be empty")
+	case cfg.Auth.Scheme != "" && !strings.EqualFold(cfg.Auth.Scheme, "Basic"):
+		return errors.New("auth scheme must be basic")
+	case cfg.MaxConnectionLifetime < 0:
+		return errors.New("max connection lifetime must not be negative")
+	case cfg.KeepAlivePeriod < 0:
+		return errors.New("keep alive period must not be negative")
+	case cfg.ShutdownTimeout < 0:
+		return errors.New("shutdown timeout must not be negative")
+	case cfg.ConnectEstablishTimeout < 0:
+		return errors.New("connect establish timeout must not be negative")
+	case cfg.Accounting.FlushBytes < 0:
+		return errors.New("accounting flush bytes must not be negative")
+	case cfg.Accounting.FlushInterval < 0:
+		return errors.New("accounting flush interval must not be negative")
+	case cfg.Dial.Retries < 0:
+		return errors.New("dial retries must not be negative")
+	case cfg.Dial.RetryDelay < 0:
+		return errors.New("dial retry delay must not be negative")
+	case cfg.AcceptRate < 0:
+		return errors.New("accept rate must not be negative")
+	case cfg.AcceptBurst < 0:
+		return errors.New("accept burst must not be negative")
+	case cfg.SNI.PeekTimeout < 0:
+		return errors.New("sni peek timeout must not be negative")
+	case (cfg.TLS.CertFile == "") != (cfg.TLS.KeyFile == ""):
+		return errors.New("both tls certificate and key files must be set")
+	case len(cfg.MITM.Hosts) > 0 && (cfg.MITM.CACertFile == "" || cfg.MITM.CAKeyFile == ""):
+		return errors.New("mitm certificate authority files must be set")
+	case cfg.MITM.CacheSize < 0:
+		return errors.New("mitm cache size must not be negative")
+	}
+
+	for _, method := range cfg.AllowedMethods {
+		if strings.TrimSpace(method) == "" {
+			return errors.New("allowed methods must not be empty")
+		}
 	}
+
+	for _, port := range cfg.AllowedConnectPorts {
+		if port < 1 || port > 65535 {
+			return fmt.Errorf("invalid allowed connect port %d", port)
+		}
+	}
+
+	if _, err := parseCIDRs(cfg.AllowedCIDRs); err != nil {
+		return fmt.Errorf("invalid allowed cidrs: %w", err)
+	}
+
+	if _, err := parseCIDRs(cfg.DeniedCIDRs); err != nil {
+		return fmt.Errorf("invalid denied cidrs: %w", err)
+	}
+
+	switch cfg.ErrorFormat {
+	case "", "text", "json":
+	default:
+		return fmt.Errorf("unsupported error format %q", cfg.ErrorFormat)
+	}
+
+	return nil
 }
 
-// NewProxy creates a new proxy server.
-func NewProxy(
-	log *slog.Logger,
-	rec Recorder,
-	db DB,
-	cfg Config,
-) (*Proxy, error) {
-	var limiter intercept.BytesLimiter = enforce.NewNoopBytesLimiter()
+// parseCIDRs parses the address ranges in the CIDR notation.
+func parseCIDRs(cidrs []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(cidrs))
 
-	if cfg.MaxBytes > 0 {
-		limiter = enforce.NewBytesLimiter(db, cfg.MaxBytes)
+	for _, cidr := range cidrs {
+		prefix, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			return nil, err
+		}
+
+		prefixes = append(prefixes, prefix.Masked())
+	}
+
+	return prefixes, nil
+}
+
+// NewProxy creates a new proxy server. The optional dependencies, such as
+// the requests recorder, authorizer, metrics collector, tracer provider,
+// dial function and database, are set by the provided options.
+func NewProxy(log *slog.Logger, cfg Config, opts ...Option) (*Proxy, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, fmt.Errorf("validating configuration: %w", err)
+	}
+
+	o := newOptions(opts)
+	rec, dial := o.rec, o.dial
+
+	log = log.With("job", "proxy")
+
+	if cfg.RecordBufferSize > 0 {
+		rec = newAsyncRecorder(log, rec, cfg.RecordBufferSize)
 	}
 
 	p := &Proxy{
-		log:     log.With("job", "proxy"),
-		rec:     rec,
-		cfg:     cfg,
-		limiter: limiter,
+		log:      log,
+		rec:      rec,
+		authz:    o.authz,
+		metrics:  o.metrics,
+		tracer:   o.tp.Tracer(_tracerName),
+		dial:     dial,
+		dns:      o.dns,
+		clock:    o.clock,
+		db:       o.db,
+		cfg:      cfg,
+		instance: o.instance,
+		limiter:  &switchLimiter{},
+		hosts:    account.NewHosts(),
+		transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				ctx, cancel := context.WithTimeout(ctx, _targetDialTimeout)
+				defer cancel()
+
+				return dial(ctx, network, addr)
+			},
+			MaxIdleConns:    _maxIdleConns,
+			IdleConnTimeout: _idleConnTimeout,
+
+			// NOTE: The transport must not ask for compressed responses
+			// on its own, otherwise it decompresses them and the client
+			// receives different bytes than the target service sent.
+			DisableCompression: true,
+		},
+	}
+
+	p.SetMaxBytes(int64(cfg.MaxBytes))
+
+	if cfg.TLS.CertFile != "" || cfg.TLS.KeyFile != "" {
+		certs, err := newCertificateReloader(log, cfg.TLS.CertFile, cfg.TLS.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+
+		p.tlsConfig = &tls.Config{
+			GetCertificate: certs.GetCertificate,
+			MinVersion:     tls.VersionTLS12,
+
+			// NOTE: Only HTTP/1.1 is advertised as HTTP/2 support is
+			// disabled for the server.
+			NextProtos: []string{"http/1.1"},
+		}
+	}
+
+	if len(cfg.MITM.Hosts) > 0 {
+		authority, err := mitm.NewAuthority(
+			p.clock,
+			cfg.MITM.CACertFile,
+			cfg.MITM.CAKeyFile,
+			cfg.MITM.Hosts,
+			cfg.MITM.CacheSize,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		p.mitm = authority
+
+		if cfg.MITM.RootCAFile != "" {
+			roots, err := loadCertPool(cfg.MITM.RootCAFile)
+			if err != nil {
+				return nil, err
+			}
+
+			p.mitmRootCAs = roots
+		}
 	}
 
 	p.srv = &http.Server{
 		Addr:              cfg.Addr,
 		Handler:           http.HandlerFunc(p.authHandler),
 		ReadHeaderTimeout: _readHeaderTimeout,
+		MaxHeaderBytes:    cfg.MaxHeaderBytes,
+		ConnContext: func(ctx context.Context, c net.Conn) context.Context {
+			return context.WithValue(ctx, connKey{}, c)
+		},
 
 		// NOTE: We need to set TLSNextProto to an empty map to disable
 		// HTTP/2 support. This is because we need to intercept the
-		// connection and we can't do that with HTTP/2.
+		// connection and we can't do that with HTTP/2. The CONNECT
+		// tunnels are not affected, as their bytes are only relayed, so
+		// the clients still negotiate HTTP/2 with the targets.
 		TLSNextProto: make(map[string]func(*http.Server, *tls.Conn, http.Handler)),
 	}
 
 	return p, nil
 }
 
+// loadCertPool creates a certificate pool from the PEM encoded
+// certificates file.
+func loadCertPool(path string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading certificates: %w", err)
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificates found in %q", path)
+	}
+
+	return pool, nil
+}
+
 // ListenAndServe listens for and serves connections. It blocks until the
-// context is done or server listening procedure returns an error.
-func (p *Proxy) ListenAndServe(ctx context.Context) {
+// context is done or server listening procedure returns an error. An error
+// is returned only when the listener cannot be created due to a fatal
+// reason (e.g. the address is already in use) and retrying is pointless.
+func (p *Proxy) ListenAndServe(ctx context.Context) error {
+	ln, err := p.listen()
+	if err != nil {
+		if fatalListenError(err) {
+			return fmt.Errorf("creating listener: %w", err)
+		}
+
+		p.silentError(ctx, err, "creating listener")
+
+		return nil
+	}
+
+	if err = p.serve(ctx, ln); err != nil {
+		p.silentError(ctx, err, "listening and serving")
+	}
+
+	return nil
+}
+
+// Serve serves connections accepted on the provided listener, e.g. a
+// socket activated or an in-memory one. The listener is wrapped with the
+// same bytes limiting, accounting and connection policies as the one
+// created by ListenAndServe and it is closed once serving stops. Serve
+// blocks until the context is done or the listener fails, in which case
+// the error is returned.
+func (p *Proxy) Serve(ctx context.Context, ln net.Listener) error {
+	return p.serve(ctx, p.intercept(ln))
+}
+
+// serve serves connections accepted on the intercept listener until the
+// context is done or the listener fails.
+func (p *Proxy) serve(ctx context.Context, ln net.Listener) error {
 	p.log.Info("starting serving")
 
-	// NOTE: By having stop channel we can retry opening a server in case
-	// the Serve method fails.
+	p.draining.Store(false)
+
+	p.setAddr(ln.Addr())
+	defer p.setAddr(nil)
+
+	// NOTE: By having stop channel we can close the server once the
+	// context is done while waiting for the Serve method to return.
 	stopCh := make(chan struct{})
 
+	var serveErr error
+
 	go func() {
 		defer close(stopCh)
 
-		il, err := intercept.NewListener(
-			p.log,
-			p.srv.Addr,
-			p.limiter,
-		)
-		if err != nil {
-			p.silentError(err, "creating listener")
-
-			return
-		}
-
-		err = p.srv.Serve(il)
-		if err != nil {
-			p.silentError(err, "listening and serving")
+		if err := p.srv.Serve(ln); !errors.Is(err, http.ErrServerClosed) {
+			serveErr = err
 		}
 	}()
 
 	select {
 	case <-stopCh:
 	case <-ctx.Done():
-		closureCtx, closureCancel := context.WithTimeout(context.Background(), _closeTimeout)
-		defer closureCancel()
+		if err := p.Close(); err != nil { //nolint: contextcheck // we cannot use base context here as it is already cancelled and we want to give time for a shutdown.
+			p.silentError(ctx, err, "shutting server down")
+		}
+
+		<-stopCh
+	}
+
+	return serveErr
+}
+
+// Close gracefully shuts the server down, closes the idle target
+// connections and waits until the queued request records are handled.
+// Connections that are still active once the shutdown timeout elapses
+// are closed forcibly.
+// Once closed, the proxy cannot serve again. It is safe to call Close
+// multiple times, only the first call has an effect.
+func (p *Proxy) Close() error {
+	var err error
+
+	p.closeOnce.Do(func() {
+		p.draining.Store(true)
 
-		err := p.srv.Shutdown(closureCtx) //nolint: contextcheck // we cannot use base context here as it is already cancelled and we want to give time for a shutdown.
+		ctx, cancel := context.WithTimeout(context.Background(), p.shutdownTimeout())
+		defer cancel()
+
+		err = p.srv.Shutdown(ctx)
 		if err != nil {
-			p.silentError(err, "shutting server down")
+			// NOTE: The requests did not complete in time, so their
+			// connections are closed forcibly.
+			if cerr := p.srv.Close(); cerr != nil {
+				err = errors.Join(err, cerr)
+			}
 		}
 
-		<-stopCh
+		p.transport.CloseIdleConnections()
+
+		if ar, ok := p.rec.(*asyncRecorder); ok {
+			ar.Close()
+		}
+	})
+
+	return err
+}
+
+// shutdownTimeout returns the duration the server waits for the active
+// requests to complete when it is shutting down.
+func (p *Proxy) shutdownTimeout() time.Duration {
+	if p.cfg.ShutdownTimeout == 0 {
+		return _defaultShutdownTimeout
 	}
+
+	return p.cfg.ShutdownTimeout
+}
+
+// Addr returns the address the proxy is listening on. It is useful when
+// the configured address lets the operating system choose the port, e.g.
+// ":0". Nil is returned when the proxy is not listening.
+func (p *Proxy) Addr() net.Addr {
+	p.addrMu.Lock()
+	defer p.addrMu.Unlock()
+
+	return p.addr
+}
+
+// setAddr sets the address of the active listener.
+func (p *Proxy) setAddr(addr net.Addr) {
+	p.addrMu.Lock()
+	p.addr = addr
+	p.addrMu.Unlock()
+}
+
+// fatalListenError returns true if the listener creation error cannot be
+// resolved by retrying.
+func fatalListenError(err error) bool {
+	return errors.Is(err, syscall.EADDRINUSE) ||
+		errors.Is(err, syscall.EADDRNOTAVAIL) ||
+		errors.Is(err, syscall.EACCES)
+}
+
+// Stats returns the current bytes usage together with the configured
+// limit. Empty stats are returned when the usage is not limited.
+func (p *Proxy) Stats() (enforce.Stats, error) {
+	return p.limiter.Stats()
+}
+
+// SetMaxBytes replaces the bytes limit of the running proxy. Zero turns
+// the limit off. The bytes already used are kept.
+func (p *Proxy) SetMaxBytes(maxBytes int64) {
+	if maxBytes <= 0 {
+		p.limiter.set(enforce.NewNoopBytesLimiter())
+		return
+	}
+
+	if p.cfg.MaxBytesWindow > 0 {
+		if swl, ok := p.limiter.current().(*enforce.SlidingWindowLimiter); ok {
+			swl.SetMaxBytes(maxBytes)
+			return
+		}
+
+		p.limiter.set(enforce.NewSlidingWindowLimiter(
+			p.log,
+			p.clock,
+			p.cfg.MaxBytesWindow,
+			p.cfg.SoftMaxBytes,
+			maxBytes,
+			p.cfg.GraceBytes,
+			p.cfg.OnLimitExceeded,
+		))
+
+		return
+	}
+
+	p.limiter.set(enforce.NewBytesLimiter(
+		p.log,
+		p.db,
+		p.cfg.SoftMaxBytes,
+		maxBytes,
+		p.cfg.GraceBytes,
+		p.cfg.OnLimitExceeded,
+	))
+}
+
+// ResetUsage sets the bytes used to zero. The usage of the sliding window
+// limiter is dropped as well.
+func (p *Proxy) ResetUsage(ctx context.Context) error {
+	if swl, ok := p.limiter.current().(*enforce.SlidingWindowLimiter); ok {
+		swl.Reset()
+	}
+
+	return p.db.Reset(ctx)
+}
+
+// HostBytes returns the amount of bytes used per destination host.
+func (p *Proxy) HostBytes() map[string]int64 {
+	return p.hosts.Snapshot()
+}
+
+// listen creates an intercept listener on the configured address.
+func (p *Proxy) listen() (net.Listener, error) {
+	ln, err := intercept.Listen(p.srv.Addr)
+	if err != nil {
+		return nil, err
+	}
+
+	return p.intercept(ln), nil
+}
+
+// intercept wraps the listener with an intercept listener. If TLS is
+// configured, the listener terminates TLS connections.
+func (p *Proxy) intercept(ln net.Listener) net.Listener {
+	// NOTE: The address ranges are validated when the proxy is created.
+	allowed, _ := parseCIDRs(p.cfg.AllowedCIDRs)
+	denied, _ := parseCIDRs(p.cfg.DeniedCIDRs)
+
+	il := intercept.NewListenerFromListener(p.log, ln, p.limiter, intercept.Config{
+		Clock:           p.clock,
+		Metrics:         p.metrics,
+		Accountant:      p.hosts,
+		ProxyProtocol:   p.cfg.ProxyProtocol,
+		IdleTimeout:     p.cfg.IdleTimeout,
+		MaxLifetime:     p.cfg.MaxConnectionLifetime,
+		KeepAlivePeriod: p.cfg.KeepAlivePeriod,
+		FlushBytes:      p.cfg.Accounting.FlushBytes,
+		FlushInterval:   p.cfg.Accounting.FlushInterval,
+		AllowedCIDRs:    allowed,
+		DeniedCIDRs:     denied,
+		AcceptRate:      p.cfg.AcceptRate,
+		AcceptBurst:     p.cfg.AcceptBurst,
+	})
+
+	if p.tlsConfig != nil {
+		return tls.NewListener(il, p.tlsConfig)
+	}
+
+	return il
 }
 
 // authHandler checks if the provided proxy credentials are valid. In case
-// they are invalid, the proxy responds with a 407 status code and a
-// Proxy-Authenticate header.
+// they are invalid, the proxy responds with a 407 status code, an error
+// body and the Proxy-Authenticate challenges containing the configured
+// realm. Once the shutdown begins, new requests are rejected with a 503
+// status code so that clients could retry elsewhere.
 func (p *Proxy) authHandler(w http.ResponseWriter, r *http.Request) {
-	if !p.auth(r.Header.Get("Proxy-Authorization")) {
-		w.Header().Set("Proxy-Authenticate", "Basic")
-		w.WriteHeader(http.StatusProxyAuthRequired)
+	if p.draining.Load() {
+		w.Header().Set("Connection", "close")
+		p.writeError(w, "proxy is shutting down", http.StatusServiceUnavailable)
+
+		return
+	}
+
+	if !p.auth(r) {
+		p.metrics.IncAuthFailure()
+
+		for _, challenge := range p.challenges() {
+			w.Header().Add("Proxy-Authenticate", challenge)
+		}
+
+		p.writeError(w, "proxy authentication required", http.StatusProxyAuthRequired)
+
+		return
+	}
+
+	p.methodHandler(w, r)
+}
+
+// methodHandler checks if the request method and, for the CONNECT
+// requests, the target port are allowed. In case they are not, the proxy
+// responds with a 405 status code and an Allow header listing the allowed
+// methods.
+func (p *Proxy) methodHandler(w http.ResponseWriter, r *http.Request) {
+	if !p.methodAllowed(r) {
+		if len(p.cfg.AllowedMethods) > 0 {
+			w.Header().Set("Allow", strings.ToUpper(strings.Join(p.cfg.AllowedMethods, ", ")))
+		}
+
+		p.writeError(w, "method is not allowed", http.StatusMethodNotAllowed)
+
+		return
+	}
+
+	p.authorizeHandler(w, r)
+}
+
+// methodAllowed returns true if the request method is in the allowed
+// methods list and the CONNECT request target port is in the allowed
+// ports list. The CONNECT requests with an invalid target are allowed, so
+// that they are rejected with a 400 status code later.
+func (p *Proxy) methodAllowed(r *http.Request) bool {
+	if len(p.cfg.AllowedMethods) > 0 &&
+		!slices.ContainsFunc(p.cfg.AllowedMethods, func(method string) bool {
+			return strings.EqualFold(method, r.Method)
+		}) {
+		return false
+	}
+
+	if r.Method != http.MethodConnect || len(p.cfg.AllowedConnectPorts) == 0 {
+		return true
+	}
+
+	_, port, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		return true
+	}
+
+	n, err := strconv.Atoi(port)
+	if err != nil {
+		return true
+	}
+
+	return slices.Contains(p.cfg.AllowedConnectPorts, n)
+}
+
+// authorizeHandler checks if the authenticated request is allowed to be
+// proxied. In case it is not, the proxy responds with a 403 status code.
+func (p *Proxy) authorizeHandler(w http.ResponseWriter, r *http.Request) {
+	ok, err := p.authz.Authorize(r)
+	if err != nil {
+		p.log.Error("authorizing request", slog.String("error", err.Error()))
+		p.writeError(w, "authorizing request", http.StatusInternalServerError)
 
 		return
 	}
 
+	if !ok {
+		p.writeError(w, "request is not allowed", http.StatusForbidden)
+		return
+	}
+
+	p.limitHandler(w, r)
+}
+
+// limitHandler checks if the bytes limit is not exceeded. In case it is,
+// the proxy responds with a 402 status code. In case the bytes usage
+// cannot be checked, the proxy responds with a 500 status code, unless
+// the fail-open policy is enabled. The check is done only for the
+// authorized requests, so that the unauthenticated clients do not put
+// pressure on the database. Once admitted, the client connection bytes
+// are passed to the bytes limiter.
+func (p *Proxy) limitHandler(w http.ResponseWriter, r *http.Request) {
+	ok, err := p.limiter.CheckBytes()
+
+	switch {
+	case err != nil && p.cfg.FailOpen:
+		p.log.Warn("checking bytes, admitting request", slog.String("error", err.Error()))
+
+		// NOTE: The bytes usage cannot be stored while the database is
+		// unreachable, so the connection is not admitted and its bytes
+		// are not accounted.
+		p.recordHandler(w, r)
+
+		return
+	case err != nil:
+		p.log.Error("checking bytes", slog.String("error", err.Error()))
+		p.metrics.IncLimitRejection()
+		p.writeResponse(w, p.cfg.InternalErrorResponse, "internal server error", http.StatusInternalServerError)
+
+		return
+	case !ok:
+		p.metrics.IncLimitRejection()
+		p.writeResponse(w, p.cfg.LimitExceededResponse, "bytes limit has been exceeded", http.StatusPaymentRequired)
+
+		return
+	}
+
+	if err := admitConn(r.Context()); err != nil {
+		p.silentError(r.Context(), err, "admitting connection")
+	}
+
 	p.recordHandler(w, r)
 }
 
+// newRecord creates a new request record for the host with the proxy
+// instance name attached.
+func (p *Proxy) newRecord(host string) request.Record {
+	rec := request.NewRecord(p.clock, host)
+	rec.Instance = p.instance
+
+	return rec
+}
+
 // recordHandler creates a new request record and publishes it to the
-// recorder.
+// recorder. It also starts a request span that lasts until the request is
+// handled and attaches the record ID to the request context.
 func (p *Proxy) recordHandler(w http.ResponseWriter, r *http.Request) {
-	if err := p.rec.Handle(request.NewRecord(r.Host)); err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+	p.metrics.IncRequests()
+
+	ctx, span := p.tracer.Start(
+		r.Context(),
+		"proxy.request",
+		trace.WithAttributes(
+			attribute.String("host", r.Host),
+			attribute.String("method", r.Method),
+		),
+	)
+	defer span.End()
+
+	rec := p.newRecord(r.Host)
+	rec.Tunnel = r.Method == http.MethodConnect
+
+	ctx = context.WithValue(ctx, requestIDKey{}, rec.ID)
+
+	defer func() {
+		v := recover()
+		if v == nil {
+			return
+		}
+
+		if v != http.ErrAbortHandler { //nolint: errorlint // the panic value is compared as is.
+			p.logPanic(ctx, v, "handling request")
+		}
+
+		// NOTE: Aborting the handler makes the server close the client
+		// connection without logging the panic once again.
+		panic(http.ErrAbortHandler)
+	}()
+
+	setConnHost(ctx, rec.Host)
+
+	if rec.Tunnel && p.cfg.SNI.Capture {
+		// NOTE: The record is published by the tunneling handler once the
+		// server name is peeked. If the tunnel is not established, the
+		// record is published once the request is handled.
+		ctx = context.WithValue(ctx, pendingRecordKey{}, &pendingRecord{rec: rec})
+
+		defer func() {
+			if err := p.publishRecord(ctx, ""); err != nil {
+				p.silentError(ctx, err, "publishing tunnel record")
+			}
+		}()
+
+		p.deadlineHandler(w, r.WithContext(ctx))
+
 		return
 	}
 
-	p.deadlineHandler(w, r)
+	if err := p.rec.Handle(rec); err != nil {
+		span.SetStatus(codes.Error, err.Error())
+		p.writeError(w, err.Error(), http.StatusBadRequest)
+
+		return
+	}
+
+	p.deadlineHandler(w, r.WithContext(ctx))
 }
 
-// deadlineHandler appends a deadline to the requests context.
+// deadlineHandler appends a deadline to the requests context and passes
+// the request to either the tunneling or the plain HTTP handler.
 func (p *Proxy) deadlineHandler(w http.ResponseWriter, r *http.Request) {
 	ctx, cancel := context.WithDeadline(
 		r.Context(),
-		time.Now().Add(_connectionTimeout),
+		p.clock.Now().Add(_connectionTimeout),
 	)
 	defer cancel()
 
-	p.tunnelingHandler(w, r.WithContext(ctx), r.Method == http.MethodConnect)
+	if r.Method == http.MethodConnect {
+		p.tunnelingHandler(w, r.WithContext(ctx))
+		return
+	}
+
+	p.httpHandler(w, r.WithContext(ctx))
 }
 
-// auth handles proxy authentication checking.
-func (p *Proxy) auth(value string) bool {
+// auth checks the request basic authentication credentials or the bearer
+// token, if it is configured. The failed attempts are logged together
+// with the client address and the attempted username, the password and
+// the token are never logged.
+func (p *Proxy) auth(r *http.Request) bool {
+	value := r.Header.Get("Proxy-Authorization")
 	if value == "" {
-		p.log.Debug("missing proxy-authorization header")
+		// NOTE: Clients send the first request without credentials and
+		// wait for the challenge, so this is not logged as a failure.
+		p.logger(r.Context()).Debug("missing proxy-authorization header")
 		return false
 	}
 
-	bkey := strings.SplitN(value, " ", 2)
-	if bkey[0] != "Basic" {
-		p.log.Debug("invalid missing proxy-authorization header")
+	fail := func(reason, username string) bool {
+		p.logger(r.Context()).Log(
+			r.Context(),
+			p.cfg.Auth.FailureLogLevel,
+			"authentication failed",
+			slog.String("reason", reason),
+			slog.String("remote_addr", r.RemoteAddr),
+			slog.String("username", username),
+		)
 
 		return false
 	}
 
-	key, err := base64.StdEncoding.DecodeString(bkey[1])
-	if err != nil {
-		p.log.Debug("decoding basic auth", slog.String("error", err.Error()))
+	scheme, encoded, ok := strings.Cut(value, " ")
 
-		return false
+	switch {
+	case ok && p.cfg.Auth.BearerToken != "" && strings.EqualFold(scheme, "Bearer"):
+		if subtle.ConstantTimeCompare([]byte(encoded), []byte(p.cfg.Auth.BearerToken)) != 1 {
+			return fail("invalid bearer token", "")
+		}
+
+		return true
+	case !ok || !strings.EqualFold(scheme, "Basic"):
+		return fail("unsupported authentication scheme", "")
 	}
 
-	parts := strings.SplitN(string(key), ":", 2)
-	if len(parts) != 2 || p.cfg.Auth.Username != parts[0] || p.cfg.Auth.Password != parts[1] {
-		p.log.Debug(
-			"invalid basic auth credentials",
-			slog.String("username", parts[0]),
-			slog.String("password", parts[1]),
-		)
+	key, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return fail("invalid basic auth encoding", "")
+	}
 
-		return false
+	username, password, ok := strings.Cut(string(key), ":")
+	if !ok {
+		return fail("invalid basic auth credentials format", "")
+	}
+
+	if p.cfg.Auth.Username != username || p.cfg.Auth.Password != password {
+		return fail("invalid basic auth credentials", username)
 	}
 
 	return true
 }
 
-// silentError returns true if the error can be silenced.
-func (p *Proxy) silentError(err error, msg string) {
-	fn := p.log.Error
+// challenges returns the authentication challenges sent with the 407
+// responses.
+func (p *Proxy) challenges() []string {
+	scheme := p.cfg.Auth.Scheme
+	if scheme == "" {
+		scheme = "Basic"
+	}
+
+	challenges := []string{fmt.Sprintf("%s realm=%q", scheme, p.cfg.Auth.Realm)}
 
+	if p.cfg.Auth.BearerToken != "" {
+		challenges = append(challenges, fmt.Sprintf("Bearer realm=%q", p.cfg.Auth.Realm))
+	}
+
+	return challenges
+}
+
+// silentError logs the error. Errors that are expected during the normal
+// operation are silenced by logging them at the debug level.
+func (p *Proxy) silentError(ctx context.Context, err error, msg string) {
+	log := p.logger(ctx)
+	fn := log.Error
+
+	// NOTE: Closed pipe, broken pipe and connection reset errors are
+	// returned when the client goes away, which is not a proxy failure.
 	if errors.Is(err, os.ErrDeadlineExceeded) ||
 		errors.Is(err, net.ErrClosed) ||
+		errors.Is(err, io.ErrClosedPipe) ||
+		errors.Is(err, syscall.EPIPE) ||
+		errors.Is(err, syscall.ECONNRESET) ||
 		errors.Is(err, enforce.ErrLimitExceeded) ||
 		errors.Is(err, http.ErrServerClosed) {
-		fn = p.log.Debug
+		fn = log.Debug
 	}
 
 	fn(msg, slog.String("error", err.Error()))
 }
 
+// logPanic logs the recovered panic value along with the stack trace.
+func (p *Proxy) logPanic(ctx context.Context, v any, msg string) {
+	p.logger(ctx).Error(
+		msg,
+		slog.String("panic", fmt.Sprint(v)),
+		slog.String("stack", string(debug.Stack())),
+	)
+}
+
+// errorResponse is the body of the JSON error responses.
+type errorResponse struct {
+	Error string `json:"error"`
+	Code  int    `json:"code"`
+}
+
+// writeError replies to the request with the error message and the status
+// code in the configured error format.
+func (p *Proxy) writeError(w http.ResponseWriter, msg string, code int) {
+	if p.cfg.ErrorFormat != "json" {
+		http.Error(w, msg, code)
+		return
+	}
+
+	w.Header().Del("Content-Length")
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(code)
+
+	// NOTE: The status code is already written, so there is nothing to
+	// do if the body cannot be written.
+	_ = json.NewEncoder(w).Encode(errorResponse{
+		Error: msg,
+		Code:  code,
+	})
+}
+
+// writeResponse replies to the request with the custom response. If the
+// custom response is not set, the error message is written in the
+// configured error format.
+func (p *Proxy) writeResponse(w http.ResponseWriter, resp Response, msg string, code int) {
+	if resp == (Response{}) {
+		p.writeError(w, msg, code)
+		return
+	}
+
+	if resp.Body == "" {
+		resp.Body = msg
+	}
+
+	if resp.ContentType == "" {
+		resp.ContentType = "text/plain; charset=utf-8"
+	}
+
+	w.Header().Set("Content-Type", resp.ContentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(code)
+
+	// NOTE: The status code is already written, so there is nothing to
+	// do if the body cannot be written.
+	_, _ = io.WriteString(w, resp.Body)
+}
+
+// requestIDKey is the context key of the request record ID.
+type requestIDKey struct{}
+
+// connKey is the context key of the client connection.
+type connKey struct{}
+
+// logAttrsKey is the context key of the additional log attributes.
+type logAttrsKey struct{}
+
+// setConnHost attributes the further bytes of the client connection
+// stored in the context to the host.
+func setConnHost(ctx context.Context, host string) {
+	conn, ok := ctx.Value(connKey{}).(net.Conn)
+	if !ok {
+		return
+	}
+
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		conn = tlsConn.NetConn()
+	}
+
+	if hc, ok := conn.(interface{ SetHost(host string) }); ok {
+		hc.SetHost(host)
+	}
+}
+
+// admitConn admits the client connection stored in the context, so that
+// its bytes are passed to the bytes limiter.
+func admitConn(ctx context.Context) error {
+	conn, ok := ctx.Value(connKey{}).(net.Conn)
+	if !ok {
+		return nil
+	}
+
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		conn = tlsConn.NetConn()
+	}
+
+	if ac, ok := conn.(interface{ Admit() error }); ok {
+		return ac.Admit()
+	}
+
+	return nil
+}
+
+// logger returns the proxy logger. If the context carries a request record
+// ID or additional log attributes, they are attached to the logger.
+func (p *Proxy) logger(ctx context.Context) *slog.Logger {
+	log := p.log
+
+	if id, ok := ctx.Value(requestIDKey{}).(xid.ID); ok {
+		log = log.With(slog.String("request_id", id.String()))
+	}
+
+	if attrs, ok := ctx.Value(logAttrsKey{}).([]any); ok {
+		log = log.With(attrs...)
+	}
+
+	return log
+}
+
+// withLogAttrs returns a context whose logs include the provided
+// attributes in addition to the ones already attached to the context.
+func withLogAttrs(ctx context.Context, attrs ...any) context.Context {
+	prev, _ := ctx.Value(logAttrsKey{}).([]any)
+
+	return context.WithValue(ctx, logAttrsKey{}, append(slices.Clip(prev), attrs...))
+}
+
 // Recorder should be used to record proxy requests.
 type Recorder interface {
 	// Handle should handle a new record.
 	Handle(rec request.Record) error
 }
 
+// noopRecorder is a recorder that drops all records.
+type noopRecorder struct{}
+
+// Handle does nothing.
+func (noopRecorder) Handle(_ request.Record) error {
+	return nil
+}
+
+// Authorizer should be used to apply custom authorization logic to the
+// authenticated proxy requests.
+type Authorizer interface {
+	// Authorize should return true if the request is allowed to be
+	// proxied.
+	Authorize(r *http.Request) (bool, error)
+}
+
+// allowAuthorizer is an authorizer that allows all requests.
+type allowAuthorizer struct{}
+
+// Authorize allows every request.
+func (allowAuthorizer) Authorize(_ *http.Request) (bool, error) {
+	return true, nil
+}
+
+// Metrics should be used to collect the proxy metrics.
+type Metrics interface {
+	intercept.Metrics
+
+	// IncRequests should increment the proxied requests count.
+	IncRequests()
+
+	// IncAuthFailure should increment the failed authentications count.
+	IncAuthFailure()
+
+	// IncLimitRejection should increment the count of requests rejected
+	// because the bytes limit is exceeded or cannot be checked.
+	IncLimitRejection()
+}
+
+// noopMetrics is a metrics collector that does nothing.
+type noopMetrics struct{}
+
+// AddBytes does nothing.
+func (noopMetrics) AddBytes(_ int64) {}
+
+// IncRequests does nothing.
+func (noopMetrics) IncRequests() {}
+
+// IncAuthFailure does nothing.
+func (noopMetrics) IncAuthFailure() {}
+
+// IncLimitRejection does nothing.
+func (noopMetrics) IncLimitRejection() {}
+
+// DialFunc is a function used to connect to the target services.
+type DialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
 // DB is an interface for a database communication.
 type DB interface {
 	enforce.DB
+
+	// Reset should set the amount of bytes used to zero.
+	Reset(ctx context.Context) error
+}
+
+// bytesLimiter is a bytes limiter which can check the bytes limit and
+// report its usage stats.
+type bytesLimiter interface {
+	intercept.BytesLimiter
+
+	// CheckBytes should check if the bytes limit is exceeded.
+	CheckBytes() (bool, error)
+
+	// Stats should return the current bytes usage and limit.
+	Stats() (enforce.Stats, error)
 }
@@ -0,0 +1,2295 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/davseby/lwproxy/internal/clock"
+	"github.com/davseby/lwproxy/internal/db/memory"
+	"github.com/davseby/lwproxy/internal/proxy/internal/enforce"
+	"github.com/davseby/lwproxy/internal/request"
+	noopprocess "github.com/davseby/lwproxy/internal/request/process/noop"
+	"github.com/davseby/lwproxy/internal/request/process/stdout"
+	"github.com/rs/xid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace/noop"
+	"golang.org/x/exp/slog"
+)
+
+func Test_NewProxy(t *testing.T) {
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+	rec := &RecorderMock{}
+
+	cfg := testConfig()
+	cfg.Addr = ":8081"
+
+	// default dependencies
+	p, err := NewProxy(log, cfg, WithRecorder(rec))
+	require.NoError(t, err)
+	require.NotNil(t, p)
+	assert.Equal(t, allowAuthorizer{}, p.authz)
+	assert.Equal(t, noopMetrics{}, p.metrics)
+	assert.Equal(t, noop.NewTracerProvider().Tracer(_tracerName), p.tracer)
+	assert.Same(t, rec, p.rec)
+	assert.Equal(t, ":8081", p.srv.Addr)
+	assert.NotNil(t, p.transport)
+
+	// custom dependencies
+	authz := &AuthorizerMock{}
+	mm := &MetricsMock{}
+	tp := sdktrace.NewTracerProvider()
+
+	p, err = NewProxy(
+		log,
+		testConfig(),
+		WithRecorder(rec),
+		WithAuthorizer(authz),
+		WithMetrics(mm),
+		WithTracerProvider(tp),
+	)
+	require.NoError(t, err)
+	require.NotNil(t, p)
+	assert.Same(t, authz, p.authz)
+	assert.Same(t, mm, p.metrics)
+	assert.Equal(t, tp.Tracer(_tracerName), p.tracer)
+
+	// asynchronous recorder
+	cfg = testConfig()
+	cfg.RecordBufferSize = 10
+
+	p, err = NewProxy(log, cfg, WithRecorder(rec))
+	require.NoError(t, err)
+	require.IsType(t, &asyncRecorder{}, p.rec)
+	assert.Same(t, rec, p.rec.(*asyncRecorder).rec) //nolint: forcetypeassert // type is asserted above.
+	require.NoError(t, p.Close())
+
+	// invalid configuration
+	cfg = testConfig()
+	cfg.ErrorFormat = "xml"
+
+	p, err = NewProxy(log, cfg, WithRecorder(rec))
+	require.Error(t, err)
+	assert.Nil(t, p)
+}
+
+func Test_NewProxy_NilRecorder(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = io.WriteString(w, "response")
+	}))
+	t.Cleanup(target.Close)
+
+	p, err := NewProxy(slog.New(slog.NewTextHandler(io.Discard, nil)), testConfig(), WithRecorder(nil))
+	require.NoError(t, err)
+	assert.Equal(t, noopRecorder{}, p.rec)
+
+	srv := httptest.NewServer(http.HandlerFunc(p.recordHandler))
+	t.Cleanup(srv.Close)
+
+	proxyURL, err := url.Parse(srv.URL)
+	require.NoError(t, err)
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			Proxy: http.ProxyURL(proxyURL),
+		},
+	}
+
+	resp, err := client.Get(target.URL)
+	require.NoError(t, err)
+
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "response", string(body))
+}
+
+func Test_Proxy_recordHandler_Panic(t *testing.T) {
+	var (
+		buffer bytes.Buffer
+		mu     sync.Mutex
+	)
+
+	rec := &RecorderMock{
+		HandleFunc: func(rec request.Record) error {
+			if rec.Host == "panic.com" {
+				panic("recorder failure")
+			}
+
+			return nil
+		},
+	}
+
+	p, err := NewProxy(
+		slog.New(slog.NewTextHandler(&lockedWriter{mu: &mu, w: &buffer}, nil)),
+		testConfig(),
+		WithRecorder(rec),
+	)
+	require.NoError(t, err)
+
+	srv := httptest.NewServer(http.HandlerFunc(p.recordHandler))
+	t.Cleanup(srv.Close)
+
+	send := func(host string) (*http.Response, error) {
+		conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+		require.NoError(t, err)
+
+		defer conn.Close()
+
+		_, err = fmt.Fprintf(conn, "GET /path HTTP/1.1\r\nHost: %s\r\n\r\n", host)
+		require.NoError(t, err)
+
+		return http.ReadResponse(bufio.NewReader(conn), nil)
+	}
+
+	// NOTE: The connection is closed without a response.
+	_, err = send("panic.com")
+	require.Error(t, err)
+
+	// NOTE: The server keeps serving the further requests.
+	resp, err := send("example.com")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	assert.Contains(t, buffer.String(), "level=ERROR msg=\"handling request\" job=proxy request_id=")
+	assert.Contains(t, buffer.String(), "panic=\"recorder failure\"")
+}
+
+// lockedWriter is a writer that can be used concurrently.
+type lockedWriter struct {
+	mu *sync.Mutex
+	w  io.Writer
+}
+
+// Write writes the data while holding the lock.
+func (lw *lockedWriter) Write(b []byte) (int, error) {
+	lw.mu.Lock()
+	defer lw.mu.Unlock()
+
+	return lw.w.Write(b)
+}
+
+// testConfig returns a valid proxy configuration.
+func testConfig() Config {
+	cfg := Config{
+		Addr:            "127.0.0.1:0",
+		ShutdownTimeout: 5 * time.Second,
+	}
+
+	cfg.Auth.Username = "user"
+	cfg.Auth.Password = "pass"
+
+	return cfg
+}
+
+func Test_Config_Validate(t *testing.T) {
+	tests := map[string]struct {
+		Modify func(cfg *Config)
+		Error  string
+	}{
+		"Address is empty": {
+			Modify: func(cfg *Config) { cfg.Addr = "" },
+			Error:  "address must not be empty",
+		},
+		"Max bytes are negative": {
+			Modify: func(cfg *Config) { cfg.MaxBytes = -1 },
+			Error:  "max bytes must not be negative",
+		},
+		"Max bytes window is negative": {
+			Modify: func(cfg *Config) { cfg.MaxBytesWindow = -time.Second },
+			Error:  "max bytes window must not be negative",
+		},
+		"Soft max bytes are negative": {
+			Modify: func(cfg *Config) { cfg.SoftMaxBytes = -1 },
+			Error:  "soft max bytes must not be negative",
+		},
+		"Grace bytes are negative": {
+			Modify: func(cfg *Config) { cfg.GraceBytes = -1 },
+			Error:  "grace bytes must not be negative",
+		},
+		"Max header bytes are negative": {
+			Modify: func(cfg *Config) { cfg.MaxHeaderBytes = -1 },
+			Error:  "max header bytes must not be negative",
+		},
+		"Max response bytes are negative": {
+			Modify: func(cfg *Config) { cfg.MaxResponseBytes = -1 },
+			Error:  "max response bytes must not be negative",
+		},
+		"Allowed methods contain an empty method": {
+			Modify: func(cfg *Config) { cfg.AllowedMethods = []string{"GET", " "} },
+			Error:  "allowed methods must not be empty",
+		},
+		"Allowed connect ports are invalid": {
+			Modify: func(cfg *Config) { cfg.AllowedConnectPorts = []int{443, 70000} },
+			Error:  "invalid allowed connect port 70000",
+		},
+		"Allowed CIDRs are invalid": {
+			Modify: func(cfg *Config) { cfg.AllowedCIDRs = []string{"10.0.0.0/8", "10.0.0.1"} },
+			Error:  `invalid allowed cidrs: netip.ParsePrefix("10.0.0.1"): no '/'`,
+		},
+		"Denied CIDRs are invalid": {
+			Modify: func(cfg *Config) { cfg.DeniedCIDRs = []string{"10.0.0.0/33"} },
+			Error:  `invalid denied cidrs: netip.ParsePrefix("10.0.0.0/33"): prefix length out of range`,
+		},
+		"Max connection lifetime is negative": {
+			Modify: func(cfg *Config) { cfg.MaxConnectionLifetime = -time.Second },
+			Error:  "max connection lifetime must not be negative",
+		},
+		"Keep alive period is negative": {
+			Modify: func(cfg *Config) { cfg.KeepAlivePeriod = -time.Second },
+			Error:  "keep alive period must not be negative",
+		},
+		"Shutdown timeout is negative": {
+			Modify: func(cfg *Config) { cfg.ShutdownTimeout = -time.Second },
+			Error:  "shutdown timeout must not be negative",
+		},
+		"Record buffer size is negative": {
+			Modify: func(cfg *Config) { cfg.RecordBufferSize = -1 },
+			Error:  "record buffer size must not be negative",
+		},
+		"Idle timeout is negative": {
+			Modify: func(cfg *Config) { cfg.IdleTimeout = -time.Second },
+			Error:  "idle timeout must not be negative",
+		},
+		"Connect establish timeout is negative": {
+			Modify: func(cfg *Config) { cfg.ConnectEstablishTimeout = -time.Second },
+			Error:  "connect establish timeout must not be negative",
+		},
+		"Accounting flush bytes are negative": {
+			Modify: func(cfg *Config) { cfg.Accounting.FlushBytes = -1 },
+			Error:  "accounting flush bytes must not be negative",
+		},
+		"Accounting flush interval is negative": {
+			Modify: func(cfg *Config) { cfg.Accounting.FlushInterval = -time.Second },
+			Error:  "accounting flush interval must not be negative",
+		},
+		"Auth scheme is not basic": {
+			Modify: func(cfg *Config) { cfg.Auth.Scheme = "Digest" },
+			Error:  "auth scheme must be basic",
+		},
+		"Auth username is empty": {
+			Modify: func(cfg *Config) { cfg.Auth.Username = "" },
+			Error:  "auth username must not be empty",
+		},
+		"Dial retries are negative": {
+			Modify: func(cfg *Config) { cfg.Dial.Retries = -1 },
+			Error:  "dial retries must not be negative",
+		},
+		"Dial retry delay is negative": {
+			Modify: func(cfg *Config) { cfg.Dial.RetryDelay = -time.Second },
+			Error:  "dial retry delay must not be negative",
+		},
+		"Accept rate is negative": {
+			Modify: func(cfg *Config) { cfg.AcceptRate = -1 },
+			Error:  "accept rate must not be negative",
+		},
+		"Accept burst is negative": {
+			Modify: func(cfg *Config) { cfg.AcceptBurst = -1 },
+			Error:  "accept burst must not be negative",
+		},
+		"SNI peek timeout is negative": {
+			Modify: func(cfg *Config) { cfg.SNI.PeekTimeout = -1 },
+			Error:  "sni peek timeout must not be negative",
+		},
+		"TLS key file is missing": {
+			Modify: func(cfg *Config) { cfg.TLS.CertFile = "cert.pem" },
+			Error:  "both tls certificate and key files must be set",
+		},
+		"MITM certificate authority is missing": {
+			Modify: func(cfg *Config) { cfg.MITM.Hosts = []string{"example.com"} },
+			Error:  "mitm certificate authority files must be set",
+		},
+		"MITM cache size is negative": {
+			Modify: func(cfg *Config) { cfg.MITM.CacheSize = -1 },
+			Error:  "mitm cache size must not be negative",
+		},
+		"Error format is unsupported": {
+			Modify: func(cfg *Config) { cfg.ErrorFormat = "xml" },
+			Error:  `unsupported error format "xml"`,
+		},
+		"Successfully validated configuration with CIDRs": {
+			Modify: func(cfg *Config) {
+				cfg.AllowedCIDRs = []string{"10.0.0.0/8", "fd00::/8"}
+				cfg.DeniedCIDRs = []string{"10.0.0.1/32"}
+			},
+		},
+		"Successfully validated configuration": {
+			Modify: func(_ *Config) {},
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			cfg := testConfig()
+			test.Modify(&cfg)
+
+			err := cfg.Validate()
+			if test.Error == "" {
+				assert.NoError(t, err)
+				return
+			}
+
+			assert.EqualError(t, err, test.Error)
+		})
+	}
+}
+
+func Test_NewProxy_Dial(t *testing.T) {
+	tunnelTarget := startEchoServer(t)
+
+	httpTarget := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	t.Cleanup(httpTarget.Close)
+
+	var (
+		mu     sync.Mutex
+		dialed []string
+	)
+
+	dial := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		mu.Lock()
+		dialed = append(dialed, addr)
+		mu.Unlock()
+
+		return (&net.Dialer{}).DialContext(ctx, network, addr)
+	}
+
+	p, err := NewProxy(
+		slog.New(slog.NewTextHandler(io.Discard, nil)),
+		testConfig(),
+		WithRecorder(&RecorderMock{}),
+		WithDial(dial),
+	)
+	require.NoError(t, err)
+
+	// tunnel
+	srv := httptest.NewServer(http.HandlerFunc(p.tunnelingHandler))
+	t.Cleanup(srv.Close)
+
+	conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+	require.NoError(t, err)
+
+	defer conn.Close()
+
+	_, err = fmt.Fprintf(conn, "CONNECT %[1]s HTTP/1.1\r\nHost: %[1]s\r\n\r\n", tunnelTarget.Addr().String())
+	require.NoError(t, err)
+
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// http
+	w := httptest.NewRecorder()
+	p.httpHandler(w, httptest.NewRequest(http.MethodGet, httpTarget.URL+"/path", http.NoBody))
+	assert.Equal(t, http.StatusNoContent, w.Code)
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	assert.Equal(t, []string{
+		tunnelTarget.Addr().String(),
+		httpTarget.Listener.Addr().String(),
+	}, dialed)
+}
+
+func Test_NewProxy_TLS(t *testing.T) {
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	// error
+	cfg := testConfig()
+
+	cfg.TLS.CertFile = filepath.Join(t.TempDir(), "missing.pem")
+	cfg.TLS.KeyFile = filepath.Join(t.TempDir(), "missing.pem")
+
+	p, err := NewProxy(log, cfg, WithRecorder(&RecorderMock{}))
+	require.Error(t, err)
+	assert.Nil(t, p)
+
+	// success
+	cfg.TLS.CertFile, cfg.TLS.KeyFile, _ = generateCertificate(t, t.TempDir())
+
+	p, err = NewProxy(log, cfg, WithRecorder(&RecorderMock{}))
+	require.NoError(t, err)
+	require.NotNil(t, p.tlsConfig)
+	assert.NotNil(t, p.tlsConfig.GetCertificate)
+	assert.Equal(t, []string{"http/1.1"}, p.tlsConfig.NextProtos)
+}
+
+func Test_NewProxy_MITM(t *testing.T) {
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+	dir := t.TempDir()
+
+	cfg := testConfig()
+	cfg.MITM.Hosts = []string{"example.com"}
+	cfg.MITM.CACertFile, cfg.MITM.CAKeyFile, _ = generateCertificate(t, dir)
+
+	// missing root certificates file
+	cfg.MITM.RootCAFile = filepath.Join(dir, "missing.pem")
+
+	p, err := NewProxy(log, cfg)
+	require.Error(t, err)
+	assert.Nil(t, p)
+
+	// root certificates file without certificates
+	cfg.MITM.RootCAFile = cfg.MITM.CAKeyFile
+
+	p, err = NewProxy(log, cfg)
+	require.Error(t, err)
+	assert.Nil(t, p)
+
+	// system root certificates
+	cfg.MITM.RootCAFile = ""
+
+	p, err = NewProxy(log, cfg)
+	require.NoError(t, err)
+	assert.NotNil(t, p.mitm)
+	assert.Nil(t, p.mitmRootCAs)
+
+	// custom root certificates
+	cfg.MITM.RootCAFile = cfg.MITM.CACertFile
+
+	p, err = NewProxy(log, cfg)
+	require.NoError(t, err)
+	assert.NotNil(t, p.mitmRootCAs)
+}
+
+func Test_Proxy_listen(t *testing.T) {
+	target := startEchoServer(t)
+
+	cfg := testConfig()
+
+	var pool *x509.CertPool
+
+	cfg.TLS.CertFile, cfg.TLS.KeyFile, pool = generateCertificate(t, t.TempDir())
+
+	p, err := NewProxy(
+		slog.New(slog.NewTextHandler(io.Discard, nil)),
+		cfg,
+		WithRecorder(&RecorderMock{}),
+	)
+	require.NoError(t, err)
+
+	ln, err := p.listen()
+	require.NoError(t, err)
+
+	go func() {
+		_ = p.srv.Serve(ln)
+	}()
+
+	defer p.srv.Close()
+
+	conn, err := tls.Dial("tcp", ln.Addr().String(), &tls.Config{
+		RootCAs:    pool,
+		ServerName: "localhost",
+		MinVersion: tls.VersionTLS12,
+		NextProtos: []string{"h2", "http/1.1"},
+	})
+	require.NoError(t, err)
+
+	defer conn.Close()
+
+	_, err = fmt.Fprintf(
+		conn,
+		"CONNECT %[1]s HTTP/1.1\r\nHost: %[1]s\r\nProxy-Authorization: Basic dXNlcjpwYXNz\r\n\r\n",
+		target.Addr().String(),
+	)
+	require.NoError(t, err)
+
+	br := bufio.NewReader(conn)
+
+	resp, err := http.ReadResponse(br, nil)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "http/1.1", conn.ConnectionState().NegotiatedProtocol)
+
+	_, err = conn.Write([]byte("ping"))
+	require.NoError(t, err)
+
+	data := make([]byte, 4)
+
+	_, err = io.ReadFull(br, data)
+	require.NoError(t, err)
+	assert.Equal(t, "ping", string(data))
+}
+
+func Test_Proxy_limitHandler(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = io.WriteString(w, "hello")
+	}))
+	t.Cleanup(target.Close)
+
+	custom := Response{
+		ContentType: "application/json",
+		Body:        `{"error":"quota exhausted","top_up":"https://example.com/top-up"}`,
+	}
+
+	tests := map[string]struct {
+		UsedBytes     int64
+		Error         error
+		FailOpen      bool
+		Response      Response
+		Authorization string
+		FetchCalls    int
+		Rejections    int
+		Status        int
+		ContentType   string
+		Body          string
+	}{
+		"Unauthenticated request with the bytes limit exceeded": {
+			UsedBytes:   600,
+			Status:      http.StatusProxyAuthRequired,
+			ContentType: "text/plain; charset=utf-8",
+			Body:        "proxy authentication required\n",
+		},
+		"Unauthenticated request with the bytes limit not checkable": {
+			Error:       assert.AnError,
+			Status:      http.StatusProxyAuthRequired,
+			ContentType: "text/plain; charset=utf-8",
+			Body:        "proxy authentication required\n",
+		},
+		"Bytes limit cannot be checked": {
+			Error:         assert.AnError,
+			Authorization: "Basic dXNlcjpwYXNz",
+			FetchCalls:    1,
+			Rejections:    1,
+			Status:        http.StatusInternalServerError,
+			ContentType:   "text/plain; charset=utf-8",
+			Body:          "internal server error\n",
+		},
+		"Bytes limit cannot be checked with a custom response": {
+			Error:         assert.AnError,
+			Response:      custom,
+			Authorization: "Basic dXNlcjpwYXNz",
+			FetchCalls:    1,
+			Rejections:    1,
+			Status:        http.StatusInternalServerError,
+			ContentType:   custom.ContentType,
+			Body:          custom.Body,
+		},
+		"Bytes limit cannot be checked with fail-open policy": {
+			Error:         assert.AnError,
+			FailOpen:      true,
+			Authorization: "Basic dXNlcjpwYXNz",
+			FetchCalls:    1,
+			Status:        http.StatusOK,
+			ContentType:   "text/plain; charset=utf-8",
+			Body:          "hello",
+		},
+		"Bytes limit is exceeded": {
+			UsedBytes:     600,
+			Authorization: "Basic dXNlcjpwYXNz",
+			FetchCalls:    1,
+			Rejections:    1,
+			Status:        http.StatusPaymentRequired,
+			ContentType:   "text/plain; charset=utf-8",
+			Body:          "bytes limit has been exceeded\n",
+		},
+		"Bytes limit is exceeded with fail-open policy": {
+			UsedBytes:     600,
+			FailOpen:      true,
+			Authorization: "Basic dXNlcjpwYXNz",
+			FetchCalls:    1,
+			Rejections:    1,
+			Status:        http.StatusPaymentRequired,
+			ContentType:   "text/plain; charset=utf-8",
+			Body:          "bytes limit has been exceeded\n",
+		},
+		"Bytes limit is exceeded with a custom response": {
+			UsedBytes:     600,
+			Response:      custom,
+			Authorization: "Basic dXNlcjpwYXNz",
+			FetchCalls:    1,
+			Rejections:    1,
+			Status:        http.StatusPaymentRequired,
+			ContentType:   custom.ContentType,
+			Body:          custom.Body,
+		},
+		"Bytes limit is exceeded with a custom body only": {
+			UsedBytes:     600,
+			Response:      Response{Body: "top up at https://example.com"},
+			Authorization: "Basic dXNlcjpwYXNz",
+			FetchCalls:    1,
+			Rejections:    1,
+			Status:        http.StatusPaymentRequired,
+			ContentType:   "text/plain; charset=utf-8",
+			Body:          "top up at https://example.com",
+		},
+		"Bytes limit is not exceeded": {
+			UsedBytes:     100,
+			Authorization: "Basic dXNlcjpwYXNz",
+			FetchCalls:    1,
+			Status:        http.StatusOK,
+			ContentType:   "text/plain; charset=utf-8",
+			Body:          "hello",
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			dbm := &DBMock{
+				FetchBytesFunc: func(_ context.Context) (int64, error) {
+					return test.UsedBytes, test.Error
+				},
+			}
+
+			cfg := testConfig()
+			cfg.MaxBytes = 500
+			cfg.FailOpen = test.FailOpen
+			cfg.LimitExceededResponse = test.Response
+			cfg.InternalErrorResponse = test.Response
+
+			mm := &MetricsMock{}
+
+			p, err := NewProxy(
+				slog.New(slog.NewTextHandler(io.Discard, nil)),
+				cfg,
+				WithRecorder(&RecorderMock{}),
+				WithMetrics(mm),
+				WithDB(dbm),
+			)
+			require.NoError(t, err)
+
+			r := httptest.NewRequest(http.MethodGet, target.URL, http.NoBody)
+
+			if test.Authorization != "" {
+				r.Header.Set("Proxy-Authorization", test.Authorization)
+			}
+
+			w := httptest.NewRecorder()
+
+			p.authHandler(w, r)
+
+			assert.Equal(t, test.Status, w.Code)
+			assert.Equal(t, test.ContentType, w.Header().Get("Content-Type"))
+			assert.Equal(t, test.Body, w.Body.String())
+			assert.Len(t, dbm.FetchBytesCalls(), test.FetchCalls)
+			assert.Len(t, mm.IncLimitRejectionCalls(), test.Rejections)
+		})
+	}
+}
+
+func Test_Proxy_limitHandler_Admit(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = io.WriteString(w, "hello")
+	}))
+	t.Cleanup(target.Close)
+
+	db := memory.NewDB()
+
+	cfg := testConfig()
+	cfg.MaxBytes = 1 << 20
+
+	p, err := NewProxy(
+		slog.New(slog.NewTextHandler(io.Discard, nil)),
+		cfg,
+		WithRecorder(&RecorderMock{}),
+		WithDB(db),
+	)
+	require.NoError(t, err)
+
+	ln, err := p.listen()
+	require.NoError(t, err)
+
+	go func() {
+		_ = p.srv.Serve(ln)
+	}()
+
+	defer p.srv.Close()
+
+	send := func(authorization string) int {
+		t.Helper()
+
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		require.NoError(t, err)
+
+		defer conn.Close()
+
+		_, err = fmt.Fprintf(conn, "GET %s HTTP/1.1\r\nHost: %s\r\n", target.URL, target.Listener.Addr())
+		require.NoError(t, err)
+
+		if authorization != "" {
+			_, err = fmt.Fprintf(conn, "Proxy-Authorization: %s\r\n", authorization)
+			require.NoError(t, err)
+		}
+
+		_, err = io.WriteString(conn, "\r\n")
+		require.NoError(t, err)
+
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		require.NoError(t, err)
+
+		_, err = io.Copy(io.Discard, resp.Body)
+		require.NoError(t, err)
+		require.NoError(t, resp.Body.Close())
+
+		return resp.StatusCode
+	}
+
+	usedBytes := func() int64 {
+		n, err := db.FetchBytes(context.Background())
+		require.NoError(t, err)
+
+		return n
+	}
+
+	// the bytes of the unauthenticated connection are not accounted
+	assert.Equal(t, http.StatusProxyAuthRequired, send(""))
+	assert.Never(t, func() bool {
+		return usedBytes() > 0
+	}, 100*time.Millisecond, 10*time.Millisecond)
+
+	// the bytes of the admitted connection are accounted
+	assert.Equal(t, http.StatusOK, send("Basic dXNlcjpwYXNz"))
+	assert.Eventually(t, func() bool {
+		return usedBytes() > 0
+	}, time.Second, 10*time.Millisecond)
+}
+
+func Test_Proxy_SetMaxBytes(t *testing.T) {
+	target := startEchoServer(t)
+
+	db := memory.NewDB()
+
+	_, err := db.IncreaseBytes(context.Background(), 600)
+	require.NoError(t, err)
+
+	cfg := testConfig()
+
+	cfg.MaxBytes = 500
+	p, err := NewProxy(
+		slog.New(slog.NewTextHandler(io.Discard, nil)),
+		cfg,
+		WithRecorder(&RecorderMock{}),
+		WithDB(db),
+	)
+	require.NoError(t, err)
+
+	ln, err := p.listen()
+	require.NoError(t, err)
+
+	go func() {
+		_ = p.srv.Serve(ln)
+	}()
+
+	defer p.srv.Close()
+
+	connect := func() int {
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		require.NoError(t, err)
+
+		defer conn.Close()
+
+		_, err = fmt.Fprintf(
+			conn,
+			"CONNECT %[1]s HTTP/1.1\r\nHost: %[1]s\r\nProxy-Authorization: Basic dXNlcjpwYXNz\r\n\r\n",
+			target.Addr().String(),
+		)
+		require.NoError(t, err)
+
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		require.NoError(t, err)
+		resp.Body.Close()
+
+		return resp.StatusCode
+	}
+
+	assert.Equal(t, http.StatusPaymentRequired, connect())
+
+	// raised limit
+	p.SetMaxBytes(1000)
+
+	assert.Equal(t, http.StatusOK, connect())
+
+	stats, err := p.Stats()
+	require.NoError(t, err)
+	assert.Equal(t, int64(1000), stats.Max)
+
+	// turned off limit
+	p.SetMaxBytes(0)
+
+	_, err = db.IncreaseBytes(context.Background(), 1000)
+	require.NoError(t, err)
+
+	assert.Equal(t, http.StatusOK, connect())
+
+	stats, err = p.Stats()
+	require.NoError(t, err)
+	assert.Equal(t, enforce.Stats{}, stats)
+}
+
+func Test_Proxy_writeError(t *testing.T) {
+	tests := map[string]struct {
+		Format      string
+		ContentType string
+		Body        string
+	}{
+		"Default format": {
+			ContentType: "text/plain; charset=utf-8",
+			Body:        "target service is unreachable\n",
+		},
+		"Text format": {
+			Format:      "text",
+			ContentType: "text/plain; charset=utf-8",
+			Body:        "target service is unreachable\n",
+		},
+		"JSON format": {
+			Format:      "json",
+			ContentType: "application/json",
+			Body:        "{\"error\":\"target service is unreachable\",\"code\":503}\n",
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			p := &Proxy{
+				cfg: Config{ErrorFormat: test.Format},
+			}
+
+			w := httptest.NewRecorder()
+			p.writeError(w, "target service is unreachable", http.StatusServiceUnavailable)
+
+			assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+			assert.Equal(t, test.ContentType, w.Header().Get("Content-Type"))
+			assert.Equal(t, "nosniff", w.Header().Get("X-Content-Type-Options"))
+			assert.Equal(t, test.Body, w.Body.String())
+		})
+	}
+}
+
+func Test_Proxy_SetMaxBytes_Window(t *testing.T) {
+	cfg := testConfig()
+
+	cfg.MaxBytes = 500
+	cfg.MaxBytesWindow = time.Hour
+
+	p, err := NewProxy(
+		slog.New(slog.NewTextHandler(io.Discard, nil)),
+		cfg,
+		WithRecorder(&RecorderMock{}),
+	)
+	require.NoError(t, err)
+
+	swl, ok := p.limiter.current().(*enforce.SlidingWindowLimiter)
+	require.True(t, ok)
+
+	require.NoError(t, p.limiter.UseBytes(400))
+
+	// raised limit keeps the windowed usage
+	p.SetMaxBytes(1000)
+
+	assert.Same(t, swl, p.limiter.current())
+
+	stats, err := p.Stats()
+	require.NoError(t, err)
+	assert.Equal(t, enforce.Stats{Used: 400, Max: 1000}, stats)
+
+	// turned off limit
+	p.SetMaxBytes(0)
+
+	stats, err = p.Stats()
+	require.NoError(t, err)
+	assert.Equal(t, enforce.Stats{}, stats)
+}
+
+func Test_Proxy_ResetUsage(t *testing.T) {
+	tests := map[string]struct {
+		Window time.Duration
+	}{
+		"Total usage": {},
+		"Windowed usage": {
+			Window: time.Hour,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			cfg := testConfig()
+			cfg.MaxBytes = 500
+			cfg.MaxBytesWindow = test.Window
+
+			p, err := NewProxy(
+				slog.New(slog.NewTextHandler(io.Discard, nil)),
+				cfg,
+				WithRecorder(&RecorderMock{}),
+			)
+			require.NoError(t, err)
+
+			require.NoError(t, p.limiter.UseBytes(400))
+
+			stats, err := p.Stats()
+			require.NoError(t, err)
+			assert.Equal(t, enforce.Stats{Used: 400, Max: 500}, stats)
+
+			require.NoError(t, p.ResetUsage(context.Background()))
+
+			stats, err = p.Stats()
+			require.NoError(t, err)
+			assert.Equal(t, enforce.Stats{Max: 500}, stats)
+		})
+	}
+}
+
+func Test_Proxy_GraceBytes(t *testing.T) {
+	for name, window := range map[string]time.Duration{"Total": 0, "Window": time.Hour} {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			cfg := testConfig()
+
+			cfg.MaxBytes = 500
+			cfg.MaxBytesWindow = window
+			cfg.GraceBytes = 100
+
+			p, err := NewProxy(
+				slog.New(slog.NewTextHandler(io.Discard, nil)),
+				cfg,
+				WithRecorder(&RecorderMock{}),
+				WithDB(memory.NewDB()),
+			)
+			require.NoError(t, err)
+
+			require.NoError(t, p.limiter.UseBytes(500))
+
+			// new connections are rejected once the limit is reached,
+			// while the active ones can use the grace bytes.
+			ok, err := p.limiter.CheckBytes()
+			require.NoError(t, err)
+			assert.False(t, ok)
+
+			require.NoError(t, p.limiter.UseBytes(100))
+			assert.ErrorIs(t, p.limiter.UseBytes(1), enforce.ErrLimitExceeded)
+		})
+	}
+}
+
+func Test_Proxy_MaxHeaderBytes(t *testing.T) {
+	cfg := testConfig()
+
+	cfg.MaxHeaderBytes = 1024
+
+	p, err := NewProxy(
+		slog.New(slog.NewTextHandler(io.Discard, nil)),
+		cfg,
+		WithRecorder(&RecorderMock{}),
+	)
+	require.NoError(t, err)
+	assert.Equal(t, 1024, p.srv.MaxHeaderBytes)
+
+	ln, err := p.listen()
+	require.NoError(t, err)
+
+	go func() {
+		_ = p.srv.Serve(ln)
+	}()
+
+	defer p.srv.Close()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	require.NoError(t, err)
+
+	defer conn.Close()
+
+	// NOTE: The server allows a small overhead over the configured limit,
+	// so the header is made much larger.
+	_, err = fmt.Fprintf(
+		conn,
+		"CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\nX-Large: %s\r\n\r\n",
+		strings.Repeat("a", 16*1024),
+	)
+	require.NoError(t, err)
+
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	require.NoError(t, err)
+	resp.Body.Close()
+
+	assert.Equal(t, http.StatusRequestHeaderFieldsTooLarge, resp.StatusCode)
+}
+
+func Test_Proxy_HostBytes(t *testing.T) {
+	target := startEchoServer(t)
+
+	_, port, err := net.SplitHostPort(target.Addr().String())
+	require.NoError(t, err)
+
+	cfg := testConfig()
+
+	p, err := NewProxy(
+		slog.New(slog.NewTextHandler(io.Discard, nil)),
+		cfg,
+		WithRecorder(&RecorderMock{}),
+	)
+	require.NoError(t, err)
+
+	ln, err := p.listen()
+	require.NoError(t, err)
+
+	go func() {
+		_ = p.srv.Serve(ln)
+	}()
+
+	defer p.srv.Close()
+
+	tunnel := func(host, payload string) {
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		require.NoError(t, err)
+
+		defer conn.Close()
+
+		_, err = fmt.Fprintf(
+			conn,
+			"CONNECT %[1]s HTTP/1.1\r\nHost: %[1]s\r\nProxy-Authorization: Basic dXNlcjpwYXNz\r\n\r\n",
+			net.JoinHostPort(host, port),
+		)
+		require.NoError(t, err)
+
+		br := bufio.NewReader(conn)
+
+		resp, err := http.ReadResponse(br, nil)
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+
+		_, err = conn.Write([]byte(payload))
+		require.NoError(t, err)
+
+		data := make([]byte, len(payload))
+
+		_, err = io.ReadFull(br, data)
+		require.NoError(t, err)
+	}
+
+	tunnel("127.0.0.1", "ping")
+	tunnel("localhost", "longer ping")
+
+	// NOTE: The CONNECT request is read before the host is known, so only
+	// the established response and the tunneled bytes are attributed.
+	established := int64(len("HTTP/1.1 200 Connection established\r\n\r\n"))
+
+	assert.Eventually(t, func() bool {
+		return assert.ObjectsAreEqual(map[string]int64{
+			"127.0.0.1": established + 2*int64(len("ping")),
+			"localhost": established + 2*int64(len("longer ping")),
+		}, p.HostBytes())
+	}, time.Second, 10*time.Millisecond)
+}
+
+func Test_Proxy_ListenAndServe(t *testing.T) {
+	// NOTE: The address is occupied to make the binding fail.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	defer ln.Close()
+
+	cfg := testConfig()
+	cfg.Addr = ln.Addr().String()
+
+	p, err := NewProxy(
+		slog.New(slog.NewTextHandler(io.Discard, nil)),
+		cfg,
+		WithRecorder(&RecorderMock{}),
+	)
+	require.NoError(t, err)
+
+	err = p.ListenAndServe(context.Background())
+	require.Error(t, err)
+	assert.ErrorIs(t, err, syscall.EADDRINUSE)
+}
+
+// pipeListener is an in-memory listener that accepts net.Pipe connections.
+type pipeListener struct {
+	connCh    chan net.Conn
+	closeOnce sync.Once
+	closedCh  chan struct{}
+}
+
+// newPipeListener creates a new in-memory listener.
+func newPipeListener() *pipeListener {
+	return &pipeListener{
+		connCh:   make(chan net.Conn),
+		closedCh: make(chan struct{}),
+	}
+}
+
+// Dial creates a new connection accepted by the listener.
+func (pl *pipeListener) Dial() (net.Conn, error) {
+	server, client := net.Pipe()
+
+	select {
+	case pl.connCh <- server:
+		return client, nil
+	case <-pl.closedCh:
+		return nil, net.ErrClosed
+	}
+}
+
+// Accept returns the next dialed connection.
+func (pl *pipeListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-pl.connCh:
+		return conn, nil
+	case <-pl.closedCh:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close closes the listener.
+func (pl *pipeListener) Close() error {
+	pl.closeOnce.Do(func() {
+		close(pl.closedCh)
+	})
+
+	return nil
+}
+
+// Addr returns the listener address.
+func (pl *pipeListener) Addr() net.Addr {
+	return &net.UnixAddr{Name: "pipe", Net: "pipe"}
+}
+
+func Test_Proxy_Serve(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = io.WriteString(w, "hello")
+	}))
+	t.Cleanup(target.Close)
+
+	cfg := testConfig()
+	cfg.MaxBytes = 1 << 20
+
+	p, err := NewProxy(
+		slog.New(slog.NewTextHandler(io.Discard, nil)),
+		cfg,
+		WithRecorder(&RecorderMock{}),
+		WithDB(memory.NewDB()),
+	)
+	require.NoError(t, err)
+
+	pl := newPipeListener()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	errCh := make(chan error, 1)
+
+	go func() {
+		errCh <- p.Serve(ctx, pl)
+	}()
+
+	require.Eventually(t, func() bool {
+		return p.Addr() != nil
+	}, time.Second, 10*time.Millisecond)
+
+	assert.Equal(t, pl.Addr(), p.Addr())
+
+	conn, err := pl.Dial()
+	require.NoError(t, err)
+
+	defer conn.Close()
+
+	_, err = fmt.Fprintf(
+		conn,
+		"GET %s HTTP/1.1\r\nHost: %s\r\nProxy-Authorization: Basic dXNlcjpwYXNz\r\n\r\n",
+		target.URL,
+		target.Listener.Addr(),
+	)
+	require.NoError(t, err)
+
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	require.NoError(t, err)
+
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "hello", string(body))
+
+	// NOTE: The bytes are limited, so the listener must be intercepted.
+	assert.Eventually(t, func() bool {
+		stats, err := p.Stats()
+		return err == nil && stats.Used > 0
+	}, time.Second, 10*time.Millisecond)
+
+	cancel()
+
+	select {
+	case err := <-errCh:
+		assert.NoError(t, err)
+	case <-time.After(time.Second):
+		assert.Fail(t, "server was not closed")
+	}
+
+	assert.Nil(t, p.Addr())
+
+	// the listener is closed once serving stops
+	_, err = pl.Dial()
+	assert.ErrorIs(t, err, net.ErrClosed)
+}
+
+func Test_Proxy_Addr(t *testing.T) {
+	p, err := NewProxy(
+		slog.New(slog.NewTextHandler(io.Discard, nil)),
+		testConfig(),
+		WithRecorder(&RecorderMock{}),
+	)
+	require.NoError(t, err)
+
+	assert.Nil(t, p.Addr())
+
+	errCh := make(chan error, 1)
+
+	go func() {
+		errCh <- p.ListenAndServe(context.Background())
+	}()
+
+	require.Eventually(t, func() bool {
+		return p.Addr() != nil
+	}, time.Second, 10*time.Millisecond)
+
+	addr, ok := p.Addr().(*net.TCPAddr)
+	require.True(t, ok)
+	assert.NotZero(t, addr.Port)
+
+	conn, err := net.Dial("tcp", addr.String())
+	require.NoError(t, err)
+	require.NoError(t, conn.Close())
+
+	require.NoError(t, p.Close())
+
+	select {
+	case err := <-errCh:
+		assert.NoError(t, err)
+	case <-time.After(time.Second):
+		assert.Fail(t, "server was not closed")
+	}
+
+	assert.Nil(t, p.Addr())
+}
+
+func Test_Proxy_Close(t *testing.T) {
+	p, err := NewProxy(
+		slog.New(slog.NewTextHandler(io.Discard, nil)),
+		testConfig(),
+		WithRecorder(&RecorderMock{}),
+	)
+	require.NoError(t, err)
+
+	errCh := make(chan error, 1)
+
+	go func() {
+		errCh <- p.ListenAndServe(context.Background())
+	}()
+
+	require.NoError(t, p.Close())
+
+	select {
+	case err := <-errCh:
+		assert.NoError(t, err)
+	case <-time.After(time.Second):
+		assert.Fail(t, "server was not closed")
+	}
+
+	// NOTE: The second call must be a no-op.
+	assert.NoError(t, p.Close())
+}
+
+func Test_Proxy_Close_ShutdownTimeout(t *testing.T) {
+	receivedCh := make(chan struct{})
+	releaseCh := make(chan struct{})
+
+	target := httptest.NewServer(http.HandlerFunc(func(_ http.ResponseWriter, _ *http.Request) {
+		close(receivedCh)
+		<-releaseCh
+	}))
+	t.Cleanup(target.Close)
+	t.Cleanup(func() { close(releaseCh) })
+
+	cfg := testConfig()
+	cfg.ShutdownTimeout = 100 * time.Millisecond
+
+	p, err := NewProxy(
+		slog.New(slog.NewTextHandler(io.Discard, nil)),
+		cfg,
+		WithRecorder(&RecorderMock{}),
+	)
+	require.NoError(t, err)
+
+	errCh := make(chan error, 1)
+
+	go func() {
+		errCh <- p.ListenAndServe(context.Background())
+	}()
+
+	require.Eventually(t, func() bool {
+		return p.Addr() != nil
+	}, time.Second, 10*time.Millisecond)
+
+	conn, err := net.Dial("tcp", p.Addr().String())
+	require.NoError(t, err)
+
+	defer conn.Close()
+
+	_, err = fmt.Fprintf(
+		conn,
+		"GET http://%[1]s/slow HTTP/1.1\r\nHost: %[1]s\r\nProxy-Authorization: Basic dXNlcjpwYXNz\r\n\r\n",
+		target.Listener.Addr().String(),
+	)
+	require.NoError(t, err)
+
+	select {
+	case <-receivedCh:
+	case <-time.After(time.Second):
+		require.Fail(t, "request was not forwarded to the target service")
+	}
+
+	start := time.Now()
+
+	err = p.Close()
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.GreaterOrEqual(t, time.Since(start), cfg.ShutdownTimeout)
+	assert.Less(t, time.Since(start), time.Second)
+
+	// NOTE: The active connection is closed forcibly.
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(time.Second)))
+
+	_, err = conn.Read(make([]byte, 1))
+	assert.ErrorIs(t, err, io.EOF)
+
+	select {
+	case err := <-errCh:
+		assert.NoError(t, err)
+	case <-time.After(time.Second):
+		assert.Fail(t, "server was not closed")
+	}
+}
+
+func Test_Proxy_shutdownTimeout(t *testing.T) {
+	tests := map[string]struct {
+		Timeout time.Duration
+		Result  time.Duration
+	}{
+		"Zero timeout uses the default": {
+			Result: 5 * time.Second,
+		},
+		"Configured timeout": {
+			Timeout: time.Second,
+			Result:  time.Second,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			p := &Proxy{}
+			p.cfg.ShutdownTimeout = test.Timeout
+
+			assert.Equal(t, test.Result, p.shutdownTimeout())
+		})
+	}
+}
+
+func Test_fatalListenError(t *testing.T) {
+	assert.True(t, fatalListenError(&net.OpError{Op: "listen", Err: os.NewSyscallError("bind", syscall.EADDRINUSE)}))
+	assert.True(t, fatalListenError(syscall.EACCES))
+	assert.False(t, fatalListenError(assert.AnError))
+}
+
+func Test_Proxy_Stats(t *testing.T) {
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	// not limited
+	p, err := NewProxy(log, testConfig(), WithRecorder(&RecorderMock{}))
+	require.NoError(t, err)
+
+	stats, err := p.Stats()
+	require.NoError(t, err)
+	assert.Equal(t, enforce.Stats{}, stats)
+
+	// limited
+	db := memory.NewDB()
+	_, err = db.IncreaseBytes(context.Background(), 300)
+	require.NoError(t, err)
+
+	cfg := testConfig()
+	cfg.MaxBytes = 500
+
+	p, err = NewProxy(log, cfg, WithRecorder(&RecorderMock{}), WithDB(db))
+	require.NoError(t, err)
+
+	stats, err = p.Stats()
+	require.NoError(t, err)
+	assert.Equal(t, enforce.Stats{Used: 300, Max: 500}, stats)
+}
+
+func Test_Proxy_authHandler_Draining(t *testing.T) {
+	target := startEchoServer(t)
+
+	cfg := testConfig()
+
+	p, err := NewProxy(
+		slog.New(slog.NewTextHandler(io.Discard, nil)),
+		cfg,
+		WithRecorder(&RecorderMock{}),
+	)
+	require.NoError(t, err)
+
+	srv := httptest.NewServer(http.HandlerFunc(p.authHandler))
+	t.Cleanup(srv.Close)
+
+	connect := func() (net.Conn, *bufio.Reader, *http.Response) {
+		conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+		require.NoError(t, err)
+
+		_, err = fmt.Fprintf(
+			conn,
+			"CONNECT %[1]s HTTP/1.1\r\nHost: %[1]s\r\nProxy-Authorization: Basic dXNlcjpwYXNz\r\n\r\n",
+			target.Addr().String(),
+		)
+		require.NoError(t, err)
+
+		br := bufio.NewReader(conn)
+
+		resp, err := http.ReadResponse(br, nil)
+		require.NoError(t, err)
+
+		return conn, br, resp
+	}
+
+	existing, br, resp := connect()
+	defer existing.Close()
+
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	p.draining.Store(true)
+
+	rejected, _, resp := connect()
+	defer rejected.Close()
+
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+	assert.True(t, resp.Close)
+
+	_, err = existing.Write([]byte("ping"))
+	require.NoError(t, err)
+
+	data := make([]byte, 4)
+
+	_, err = io.ReadFull(br, data)
+	require.NoError(t, err)
+	assert.Equal(t, "ping", string(data))
+}
+
+func Test_Proxy_authorizeHandler(t *testing.T) {
+	blockHost := func(host string) *AuthorizerMock {
+		return &AuthorizerMock{
+			AuthorizeFunc: func(r *http.Request) (bool, error) {
+				return r.Host != host, nil
+			},
+		}
+	}
+
+	stubRecorder := func(err error) *RecorderMock {
+		return &RecorderMock{
+			HandleFunc: func(_ request.Record) error {
+				return err
+			},
+		}
+	}
+
+	tests := map[string]struct {
+		Authorizer    *AuthorizerMock
+		Recorder      *RecorderMock
+		Host          string
+		Status        int
+		RecorderCalls int
+	}{
+		"authorizer.Authorize returns an error": {
+			Authorizer: &AuthorizerMock{
+				AuthorizeFunc: func(_ *http.Request) (bool, error) {
+					return false, assert.AnError
+				},
+			},
+			Recorder: stubRecorder(nil),
+			Host:     "example.com:443",
+			Status:   http.StatusInternalServerError,
+		},
+		"Successfully blocked a request": {
+			Authorizer: blockHost("blocked.com:443"),
+			Recorder:   stubRecorder(nil),
+			Host:       "blocked.com:443",
+			Status:     http.StatusForbidden,
+		},
+		"Successfully allowed a request": {
+			Authorizer:    blockHost("blocked.com:443"),
+			Recorder:      stubRecorder(assert.AnError),
+			Host:          "example.com:443",
+			Status:        http.StatusBadRequest,
+			RecorderCalls: 1,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			p := &Proxy{
+				log:     slog.New(slog.NewTextHandler(io.Discard, nil)),
+				rec:     test.Recorder,
+				authz:   test.Authorizer,
+				metrics: noopMetrics{},
+				tracer:  noop.NewTracerProvider().Tracer(""),
+				clock:   clock.New(),
+				limiter: &switchLimiter{limiter: enforce.NewNoopBytesLimiter()},
+			}
+
+			r := httptest.NewRequest(http.MethodConnect, "http://"+test.Host, http.NoBody)
+			r.Host = test.Host
+
+			w := httptest.NewRecorder()
+
+			p.authorizeHandler(w, r)
+
+			assert.Equal(t, test.Status, w.Code)
+			assert.Len(t, test.Authorizer.AuthorizeCalls(), 1)
+			assert.Len(t, test.Recorder.HandleCalls(), test.RecorderCalls)
+		})
+	}
+}
+
+func Test_Proxy_methodHandler(t *testing.T) {
+	tests := map[string]struct {
+		Methods []string
+		Ports   []int
+		Method  string
+		Host    string
+		Status  int
+		Allow   string
+	}{
+		"All methods are allowed": {
+			Method: http.MethodPost,
+			Host:   "example.com",
+			Status: http.StatusForbidden,
+		},
+		"Allowed method": {
+			Methods: []string{"get", "HEAD"},
+			Method:  http.MethodGet,
+			Host:    "example.com",
+			Status:  http.StatusForbidden,
+		},
+		"Disallowed method": {
+			Methods: []string{"get", "HEAD"},
+			Method:  http.MethodPost,
+			Host:    "example.com",
+			Status:  http.StatusMethodNotAllowed,
+			Allow:   "GET, HEAD",
+		},
+		"Disallowed CONNECT method": {
+			Methods: []string{http.MethodGet},
+			Method:  http.MethodConnect,
+			Host:    "example.com:443",
+			Status:  http.StatusMethodNotAllowed,
+			Allow:   "GET",
+		},
+		"Allowed CONNECT port": {
+			Methods: []string{http.MethodGet, http.MethodConnect},
+			Ports:   []int{443},
+			Method:  http.MethodConnect,
+			Host:    "example.com:443",
+			Status:  http.StatusForbidden,
+		},
+		"Disallowed CONNECT port": {
+			Methods: []string{http.MethodGet, http.MethodConnect},
+			Ports:   []int{443},
+			Method:  http.MethodConnect,
+			Host:    "example.com:22",
+			Status:  http.StatusMethodNotAllowed,
+			Allow:   "GET, CONNECT",
+		},
+		"Disallowed CONNECT port with all methods allowed": {
+			Ports:  []int{443},
+			Method: http.MethodConnect,
+			Host:   "example.com:22",
+			Status: http.StatusMethodNotAllowed,
+		},
+		"CONNECT target without a port": {
+			Ports:  []int{443},
+			Method: http.MethodConnect,
+			Host:   "example.com",
+			Status: http.StatusForbidden,
+		},
+		"Ports are not checked for other methods": {
+			Ports:  []int{443},
+			Method: http.MethodGet,
+			Host:   "example.com:8080",
+			Status: http.StatusForbidden,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			// the authorizer rejects every request that passes the
+			// method check.
+			authz := &AuthorizerMock{
+				AuthorizeFunc: func(_ *http.Request) (bool, error) {
+					return false, nil
+				},
+			}
+
+			p := &Proxy{
+				log:   slog.New(slog.NewTextHandler(io.Discard, nil)),
+				authz: authz,
+			}
+
+			p.cfg.AllowedMethods = test.Methods
+			p.cfg.AllowedConnectPorts = test.Ports
+
+			r := httptest.NewRequest(test.Method, "http://example.com", http.NoBody)
+			r.Host = test.Host
+
+			w := httptest.NewRecorder()
+
+			p.methodHandler(w, r)
+
+			assert.Equal(t, test.Status, w.Code)
+			assert.Equal(t, test.Allow, w.Header().Get("Allow"))
+
+			if test.Status == http.StatusMethodNotAllowed {
+				assert.Empty(t, authz.AuthorizeCalls())
+				assert.Equal(t, "method is not allowed\n", w.Body.String())
+			}
+		})
+	}
+}
+
+func Test_Proxy_authHandler(t *testing.T) {
+	tests := map[string]struct {
+		Authorization string
+		Status        int
+		Challenge     string
+		Body          string
+		AuthFailures  int
+		Requests      int
+	}{
+		"Missing credentials": {
+			Status:       http.StatusProxyAuthRequired,
+			Challenge:    `Basic realm="corp proxy"`,
+			Body:         "proxy authentication required\n",
+			AuthFailures: 1,
+		},
+		"Invalid credentials": {
+			Authorization: "Basic dXNlcjp3cm9uZw==", // user:wrong
+			Status:        http.StatusProxyAuthRequired,
+			Challenge:     `Basic realm="corp proxy"`,
+			Body:          "proxy authentication required\n",
+			AuthFailures:  1,
+		},
+		"Missing basic auth credentials": {
+			Authorization: "Basic",
+			Status:        http.StatusProxyAuthRequired,
+			Challenge:     `Basic realm="corp proxy"`,
+			Body:          "proxy authentication required\n",
+			AuthFailures:  1,
+		},
+		"Invalid basic auth encoding": {
+			Authorization: "Basic !!!",
+			Status:        http.StatusProxyAuthRequired,
+			Challenge:     `Basic realm="corp proxy"`,
+			Body:          "proxy authentication required\n",
+			AuthFailures:  1,
+		},
+		"Successfully authenticated": {
+			Authorization: "Basic dXNlcjpwYXNz", // user:pass
+			Status:        http.StatusBadRequest,
+			Requests:      1,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			mm := &MetricsMock{}
+
+			p := &Proxy{
+				log: slog.New(slog.NewTextHandler(io.Discard, nil)),
+				rec: &RecorderMock{
+					HandleFunc: func(_ request.Record) error {
+						return assert.AnError
+					},
+				},
+				authz:   allowAuthorizer{},
+				metrics: mm,
+				tracer:  noop.NewTracerProvider().Tracer(""),
+				clock:   clock.New(),
+				limiter: &switchLimiter{limiter: enforce.NewNoopBytesLimiter()},
+			}
+
+			p.cfg.Auth.Username = "user"
+			p.cfg.Auth.Password = "pass"
+			p.cfg.Auth.Realm = "corp proxy"
+
+			r := httptest.NewRequest(http.MethodConnect, "example.com:443", http.NoBody)
+			r.Header.Set("Proxy-Authorization", test.Authorization)
+
+			w := httptest.NewRecorder()
+
+			p.authHandler(w, r)
+
+			assert.Equal(t, test.Status, w.Code)
+			assert.Equal(t, test.Challenge, w.Header().Get("Proxy-Authenticate"))
+
+			if test.Body != "" {
+				assert.Equal(t, test.Body, w.Body.String())
+			}
+
+			assert.Len(t, mm.IncAuthFailureCalls(), test.AuthFailures)
+			assert.Len(t, mm.IncRequestsCalls(), test.Requests)
+		})
+	}
+}
+
+func Test_Proxy_authHandler_KeepAlive(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = io.WriteString(w, "hello")
+	}))
+	t.Cleanup(target.Close)
+
+	p, err := NewProxy(
+		slog.New(slog.NewTextHandler(io.Discard, nil)),
+		testConfig(),
+		WithRecorder(&RecorderMock{}),
+	)
+	require.NoError(t, err)
+
+	ln, err := p.listen()
+	require.NoError(t, err)
+
+	go func() {
+		_ = p.srv.Serve(ln)
+	}()
+
+	defer p.srv.Close()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	require.NoError(t, err)
+
+	defer conn.Close()
+
+	br := bufio.NewReader(conn)
+
+	send := func(authorization string) *http.Response {
+		t.Helper()
+
+		_, err := fmt.Fprintf(conn, "GET %s HTTP/1.1\r\nHost: %s\r\n", target.URL, target.Listener.Addr())
+		require.NoError(t, err)
+
+		if authorization != "" {
+			_, err = fmt.Fprintf(conn, "Proxy-Authorization: %s\r\n", authorization)
+			require.NoError(t, err)
+		}
+
+		_, err = io.WriteString(conn, "\r\n")
+		require.NoError(t, err)
+
+		resp, err := http.ReadResponse(br, nil)
+		require.NoError(t, err)
+
+		_, err = io.Copy(io.Discard, resp.Body)
+		require.NoError(t, err)
+		require.NoError(t, resp.Body.Close())
+
+		return resp
+	}
+
+	// authenticated request
+	resp := send("Basic dXNlcjpwYXNz")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// unauthenticated request on the same connection
+	resp = send("")
+	assert.Equal(t, http.StatusProxyAuthRequired, resp.StatusCode)
+	assert.NotEmpty(t, resp.Header.Get("Proxy-Authenticate"))
+
+	// invalid credentials on the same connection
+	resp = send("Basic dXNlcjp3cm9uZw==")
+	assert.Equal(t, http.StatusProxyAuthRequired, resp.StatusCode)
+
+	// credentials are accepted again after the challenge
+	resp = send("Basic dXNlcjpwYXNz")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+}
+
+func Test_Proxy_authHandler_Challenges(t *testing.T) {
+	tests := map[string]struct {
+		Scheme        string
+		BearerToken   string
+		Authorization string
+		Status        int
+		Challenges    []string
+	}{
+		"Default scheme": {
+			Status:     http.StatusProxyAuthRequired,
+			Challenges: []string{`Basic realm="corp proxy"`},
+		},
+		"Custom scheme casing": {
+			Scheme:     "BASIC",
+			Status:     http.StatusProxyAuthRequired,
+			Challenges: []string{`BASIC realm="corp proxy"`},
+		},
+		"Basic and bearer challenges": {
+			Scheme:      "basic",
+			BearerToken: "token",
+			Status:      http.StatusProxyAuthRequired,
+			Challenges: []string{
+				`basic realm="corp proxy"`,
+				`Bearer realm="corp proxy"`,
+			},
+		},
+		"Bearer is turned off": {
+			Authorization: "Bearer token",
+			Status:        http.StatusProxyAuthRequired,
+			Challenges:    []string{`Basic realm="corp proxy"`},
+		},
+		"Invalid bearer token": {
+			BearerToken:   "token",
+			Authorization: "Bearer wrong",
+			Status:        http.StatusProxyAuthRequired,
+			Challenges: []string{
+				`Basic realm="corp proxy"`,
+				`Bearer realm="corp proxy"`,
+			},
+		},
+		"Successfully authenticated with a bearer token": {
+			BearerToken:   "token",
+			Authorization: "bearer token",
+			Status:        http.StatusBadRequest,
+		},
+		"Successfully authenticated with a lowercase basic scheme": {
+			BearerToken:   "token",
+			Authorization: "basic dXNlcjpwYXNz", // user:pass
+			Status:        http.StatusBadRequest,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			p := &Proxy{
+				log: slog.New(slog.NewTextHandler(io.Discard, nil)),
+				rec: &RecorderMock{
+					HandleFunc: func(_ request.Record) error {
+						return assert.AnError
+					},
+				},
+				authz:   allowAuthorizer{},
+				metrics: noopMetrics{},
+				tracer:  noop.NewTracerProvider().Tracer(""),
+				clock:   clock.New(),
+				limiter: &switchLimiter{limiter: enforce.NewNoopBytesLimiter()},
+			}
+
+			p.cfg.Auth.Username = "user"
+			p.cfg.Auth.Password = "pass"
+			p.cfg.Auth.Realm = "corp proxy"
+			p.cfg.Auth.Scheme = test.Scheme
+			p.cfg.Auth.BearerToken = test.BearerToken
+
+			r := httptest.NewRequest(http.MethodConnect, "example.com:443", http.NoBody)
+			r.Header.Set("Proxy-Authorization", test.Authorization)
+
+			w := httptest.NewRecorder()
+
+			p.authHandler(w, r)
+
+			assert.Equal(t, test.Status, w.Code)
+			assert.Equal(t, test.Challenges, w.Header().Values("Proxy-Authenticate"))
+		})
+	}
+}
+
+func Test_Proxy_auth_FailureLog(t *testing.T) {
+	tests := map[string]struct {
+		Level         slog.Level
+		Authorization string
+		Log           []string
+	}{
+		"Missing credentials are not logged": {
+			Level: slog.LevelInfo,
+		},
+		"Failure is below the logged level": {
+			Level:         slog.LevelDebug - 1,
+			Authorization: "Basic dXNlcjpzZWNyZXQ=", // user:secret
+		},
+		"Invalid scheme is logged": {
+			Level:         slog.LevelInfo,
+			Authorization: "Bearer token",
+			Log: []string{
+				"level=INFO",
+				`msg="authentication failed"`,
+				`reason="unsupported authentication scheme"`,
+				"remote_addr=192.0.2.1:1234",
+				"username=\"\"",
+			},
+		},
+		"Invalid credentials are logged": {
+			Level:         slog.LevelWarn,
+			Authorization: "Basic dXNlcjpzZWNyZXQ=", // user:secret
+			Log: []string{
+				"level=WARN",
+				`msg="authentication failed"`,
+				`reason="invalid basic auth credentials"`,
+				"remote_addr=192.0.2.1:1234",
+				"username=user",
+			},
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			var buffer bytes.Buffer
+
+			p := &Proxy{
+				log: slog.New(slog.NewTextHandler(&buffer, nil)),
+			}
+
+			p.cfg.Auth.Username = "admin"
+			p.cfg.Auth.Password = "pass"
+			p.cfg.Auth.FailureLogLevel = test.Level
+
+			r := httptest.NewRequest(http.MethodConnect, "example.com:443", http.NoBody)
+			r.RemoteAddr = "192.0.2.1:1234"
+			r.Header.Set("Proxy-Authorization", test.Authorization)
+
+			assert.False(t, p.auth(r))
+
+			if len(test.Log) == 0 {
+				assert.Empty(t, buffer.String())
+				return
+			}
+
+			for _, part := range test.Log {
+				assert.Contains(t, buffer.String(), part)
+			}
+
+			assert.NotContains(t, buffer.String(), "secret")
+		})
+	}
+}
+
+func Test_Proxy_recordHandler(t *testing.T) {
+	sr := tracetest.NewSpanRecorder()
+
+	p := &Proxy{
+		log: slog.New(slog.NewTextHandler(io.Discard, nil)),
+		rec: &RecorderMock{
+			HandleFunc: func(_ request.Record) error {
+				return assert.AnError
+			},
+		},
+		metrics: noopMetrics{},
+		tracer: sdktrace.NewTracerProvider(
+			sdktrace.WithSpanProcessor(sr),
+		).Tracer(_tracerName),
+		clock: clock.New(),
+	}
+
+	r := httptest.NewRequest(http.MethodConnect, "example.com:443", http.NoBody)
+	w := httptest.NewRecorder()
+
+	p.recordHandler(w, r)
+
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	spans := sr.Ended()
+	require.Len(t, spans, 1)
+	assert.Equal(t, "proxy.request", spans[0].Name())
+	assert.Equal(t, codes.Error, spans[0].Status().Code)
+	assert.ElementsMatch(t, []attribute.KeyValue{
+		attribute.String("host", "example.com:443"),
+		attribute.String("method", http.MethodConnect),
+	}, spans[0].Attributes())
+}
+
+func Test_Proxy_recordHandler_Tunnel(t *testing.T) {
+	tests := map[string]struct {
+		Method string
+		Target string
+		Tunnel bool
+	}{
+		"CONNECT request": {
+			Method: http.MethodConnect,
+			Target: "example.com:443",
+			Tunnel: true,
+		},
+		"Plain HTTP request": {
+			Method: http.MethodGet,
+			Target: "http://example.com/path",
+			Tunnel: false,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			rec := &RecorderMock{
+				HandleFunc: func(_ request.Record) error {
+					return assert.AnError
+				},
+			}
+
+			p := &Proxy{
+				log:     slog.New(slog.NewTextHandler(io.Discard, nil)),
+				rec:     rec,
+				metrics: noopMetrics{},
+				tracer:  noop.NewTracerProvider().Tracer(_tracerName),
+				clock:   clock.New(),
+			}
+
+			p.recordHandler(
+				httptest.NewRecorder(),
+				httptest.NewRequest(test.Method, test.Target, http.NoBody),
+			)
+
+			require.Len(t, rec.HandleCalls(), 1)
+			assert.Equal(t, test.Tunnel, rec.HandleCalls()[0].Rec.Tunnel)
+		})
+	}
+}
+
+func Test_Proxy_recordHandler_RequestID(t *testing.T) {
+	// NOTE: A closed listener address is used to make the target dial
+	// fail.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	require.NoError(t, ln.Close())
+
+	var buffer bytes.Buffer
+
+	rec := &RecorderMock{
+		HandleFunc: func(_ request.Record) error {
+			return nil
+		},
+	}
+
+	p := &Proxy{
+		log: slog.New(slog.NewTextHandler(&buffer, &slog.HandlerOptions{
+			Level: slog.LevelDebug,
+		})),
+		rec:     rec,
+		metrics: noopMetrics{},
+		tracer:  noop.NewTracerProvider().Tracer(""),
+		clock:   clock.New(),
+		dial:    (&net.Dialer{}).DialContext,
+	}
+
+	r := httptest.NewRequest(http.MethodConnect, ln.Addr().String(), http.NoBody)
+	w := httptest.NewRecorder()
+
+	p.recordHandler(w, r)
+
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	require.Len(t, rec.HandleCalls(), 1)
+	assert.Contains(
+		t,
+		buffer.String(),
+		fmt.Sprintf(
+			"level=DEBUG msg=\"dialing target service\" request_id=%s",
+			rec.HandleCalls()[0].Rec.ID.String(),
+		),
+	)
+}
+
+func Test_Proxy_silentError(t *testing.T) {
+	id := xid.New()
+
+	tests := map[string]struct {
+		Context context.Context
+		Error   error
+		Output  string
+	}{
+		"Error is logged without a request ID": {
+			Context: context.Background(),
+			Error:   assert.AnError,
+			Output:  "level=ERROR msg=test error=\"assert.AnError general error for testing\"\n",
+		},
+		"Error is logged with a request ID": {
+			Context: context.WithValue(context.Background(), requestIDKey{}, id),
+			Error:   assert.AnError,
+			Output: fmt.Sprintf(
+				"level=ERROR msg=test request_id=%s error=\"assert.AnError general error for testing\"\n",
+				id.String(),
+			),
+		},
+		"Silenced error is logged at the debug level": {
+			Context: context.Background(),
+			Error:   net.ErrClosed,
+			Output:  "level=DEBUG msg=test error=\"use of closed network connection\"\n",
+		},
+		"Closed pipe error is logged at the debug level": {
+			Context: context.Background(),
+			Error:   io.ErrClosedPipe,
+			Output:  "level=DEBUG msg=test error=\"io: read/write on closed pipe\"\n",
+		},
+		"Broken pipe error is logged at the debug level": {
+			Context: context.Background(),
+			Error:   &net.OpError{Op: "write", Net: "tcp", Err: os.NewSyscallError("write", syscall.EPIPE)},
+			Output:  "level=DEBUG msg=test error=\"write tcp: write: broken pipe\"\n",
+		},
+		"Connection reset error is logged at the debug level": {
+			Context: context.Background(),
+			Error:   &net.OpError{Op: "read", Net: "tcp", Err: os.NewSyscallError("read", syscall.ECONNRESET)},
+			Output:  "level=DEBUG msg=test error=\"read tcp: read: connection reset by peer\"\n",
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			var buffer bytes.Buffer
+
+			p := &Proxy{
+				log: slog.New(slog.NewTextHandler(&buffer, &slog.HandlerOptions{
+					Level: slog.LevelDebug,
+				})),
+			}
+
+			p.silentError(test.Context, test.Error, "test")
+
+			assert.Contains(t, buffer.String(), test.Output)
+		})
+	}
+}
+
+// generateCertificate generates a self-signed certificate for localhost and
+// writes it to the provided directory. It returns the certificate and key
+// paths together with a pool containing the certificate.
+func generateCertificate(t *testing.T, dir string) (string, string, *x509.CertPool) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	require.NoError(t, err)
+
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	certPath := filepath.Join(dir, "cert.pem")
+	keyPath := filepath.Join(dir, "key.pem")
+
+	require.NoError(t, os.WriteFile(
+		certPath,
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		0o600,
+	))
+
+	require.NoError(t, os.WriteFile(
+		keyPath,
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}),
+		0o600,
+	))
+
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+
+	return certPath, keyPath, pool
+}
+
+func Benchmark_Proxy_recordHandler(b *testing.B) {
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	stdoutProc, err := stdout.NewProcessor(log, io.Discard, stdout.FormatText)
+	require.NoError(b, err)
+
+	recorders := map[string]Recorder{
+		"noop":   noopprocess.NewProcessor(),
+		"stdout": stdoutProc,
+	}
+
+	for name, rec := range recorders {
+		b.Run(name, func(b *testing.B) {
+			p := &Proxy{
+				log:     log,
+				rec:     rec,
+				metrics: noopMetrics{},
+				tracer:  noop.NewTracerProvider().Tracer(""),
+				clock:   clock.New(),
+			}
+
+			// NOTE: The relative request target is rejected right after
+			// the recording, so the benchmark measures the recording
+			// overhead only.
+			r := httptest.NewRequest(http.MethodGet, "/path", http.NoBody)
+
+			b.ResetTimer()
+
+			for range b.N {
+				p.recordHandler(httptest.NewRecorder(), r)
+			}
+		})
+	}
+}
@@ -0,0 +1,106 @@
+package proxy
+
+import (
+	"fmt"
+	"runtime/debug"
+	"sync"
+
+	"github.com/davseby/lwproxy/internal/request"
+	"golang.org/x/exp/slog"
+)
+
+// asyncRecorder is a recorder that hands the records over to the wrapped
+// recorder in a background worker, so that a slow recorder does not stall
+// the proxied requests. Records are dropped when the buffer is full.
+type asyncRecorder struct {
+	log *slog.Logger
+	rec Recorder
+
+	mu     sync.RWMutex
+	closed bool
+
+	recCh  chan request.Record
+	doneCh chan struct{}
+}
+
+// newAsyncRecorder creates a new asynchronous recorder with the provided
+// buffer size and starts its worker.
+func newAsyncRecorder(log *slog.Logger, rec Recorder, size int) *asyncRecorder {
+	ar := &asyncRecorder{
+		log:    log,
+		rec:    rec,
+		recCh:  make(chan request.Record, size),
+		doneCh: make(chan struct{}),
+	}
+
+	go ar.run()
+
+	return ar
+}
+
+// Handle queues the record. The record is dropped if the buffer is full or
+// the recorder is closed. It never returns an error.
+func (ar *asyncRecorder) Handle(rec request.Record) error {
+	ar.mu.RLock()
+	defer ar.mu.RUnlock()
+
+	if ar.closed {
+		ar.log.Warn("dropping request record, recorder is closed", slog.String("request_id", rec.ID.String()))
+		return nil
+	}
+
+	select {
+	case ar.recCh <- rec:
+	default:
+		ar.log.Warn("dropping request record, buffer is full", slog.String("request_id", rec.ID.String()))
+	}
+
+	return nil
+}
+
+// Close stops accepting new records and waits until the queued records
+// are handled.
+func (ar *asyncRecorder) Close() {
+	ar.mu.Lock()
+
+	if !ar.closed {
+		ar.closed = true
+		close(ar.recCh)
+	}
+
+	ar.mu.Unlock()
+
+	<-ar.doneCh
+}
+
+// run handles the queued records until the recorder is closed.
+func (ar *asyncRecorder) run() {
+	defer close(ar.doneCh)
+
+	for rec := range ar.recCh {
+		ar.handle(rec)
+	}
+}
+
+// handle passes the record to the wrapped recorder. The recorder panics
+// are recovered, so that a faulty recorder could not crash the process.
+func (ar *asyncRecorder) handle(rec request.Record) {
+	defer func() {
+		if v := recover(); v != nil {
+			ar.log.Error(
+				"handling request record",
+				slog.String("request_id", rec.ID.String()),
+				slog.String("panic", fmt.Sprint(v)),
+				slog.String("stack", string(debug.Stack())),
+			)
+		}
+	}()
+
+	if err := ar.rec.Handle(rec); err != nil {
+		ar.log.Error(
+			"handling request record",
+			slog.String("request_id", rec.ID.String()),
+			slog.String("error", err.Error()),
+		)
+	}
+}
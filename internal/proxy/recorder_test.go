@@ -0,0 +1,102 @@
+package proxy
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/davseby/lwproxy/internal/clock"
+	"github.com/davseby/lwproxy/internal/request"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/exp/slog"
+)
+
+func Test_newAsyncRecorder(t *testing.T) {
+	rec := &RecorderMock{}
+
+	ar := newAsyncRecorder(slog.New(slog.NewTextHandler(io.Discard, nil)), rec, 5)
+	require.NotNil(t, ar)
+	assert.Same(t, rec, ar.rec)
+	assert.Equal(t, 5, cap(ar.recCh))
+
+	ar.Close()
+}
+
+func Test_asyncRecorder_Handle(t *testing.T) {
+	var buffer bytes.Buffer
+
+	releaseCh := make(chan struct{})
+
+	rec := &RecorderMock{
+		HandleFunc: func(_ request.Record) error {
+			<-releaseCh
+
+			return assert.AnError
+		},
+	}
+
+	ar := newAsyncRecorder(slog.New(slog.NewTextHandler(&buffer, nil)), rec, 1)
+
+	first := request.NewRecord(clock.New(), "first.com")
+	second := request.NewRecord(clock.New(), "second.com")
+	third := request.NewRecord(clock.New(), "third.com")
+
+	// NOTE: The first record is taken by the blocked worker, the second
+	// one fills the buffer and the third one is dropped.
+	require.NoError(t, ar.Handle(first))
+
+	assert.Eventually(t, func() bool {
+		return len(rec.HandleCalls()) == 1
+	}, time.Second, time.Millisecond)
+
+	require.NoError(t, ar.Handle(second))
+	require.NoError(t, ar.Handle(third))
+
+	close(releaseCh)
+	ar.Close()
+
+	calls := rec.HandleCalls()
+	require.Len(t, calls, 2)
+	assert.Equal(t, first, calls[0].Rec)
+	assert.Equal(t, second, calls[1].Rec)
+
+	assert.Contains(t, buffer.String(), "level=WARN msg=\"dropping request record, buffer is full\" request_id="+third.ID.String())
+	assert.Contains(t, buffer.String(), "level=ERROR msg=\"handling request record\" request_id="+first.ID.String())
+
+	// closed
+	require.NoError(t, ar.Handle(request.NewRecord(clock.New(), "fourth.com")))
+	assert.Len(t, rec.HandleCalls(), 2)
+	assert.Contains(t, buffer.String(), "dropping request record, recorder is closed")
+
+	// NOTE: Closing the recorder again must not block nor panic.
+	ar.Close()
+}
+
+func Test_asyncRecorder_Handle_Panic(t *testing.T) {
+	var buffer bytes.Buffer
+
+	rec := &RecorderMock{
+		HandleFunc: func(rec request.Record) error {
+			if rec.Host == "panic.com" {
+				panic("recorder failure")
+			}
+
+			return nil
+		},
+	}
+
+	ar := newAsyncRecorder(slog.New(slog.NewTextHandler(&buffer, nil)), rec, 2)
+
+	failed := request.NewRecord(clock.New(), "panic.com")
+
+	require.NoError(t, ar.Handle(failed))
+	require.NoError(t, ar.Handle(request.NewRecord(clock.New(), "example.com")))
+
+	ar.Close()
+
+	// NOTE: The worker keeps handling the records after the panic.
+	assert.Len(t, rec.HandleCalls(), 2)
+	assert.Contains(t, buffer.String(), "level=ERROR msg=\"handling request record\" request_id="+failed.ID.String()+" panic=\"recorder failure\"")
+}
@@ -0,0 +1,56 @@
+package proxy
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// _byteSizeUnits are the multipliers of the supported byte size units.
+// The units are case-insensitive.
+var _byteSizeUnits = map[string]int64{
+	"":    1,
+	"b":   1,
+	"kb":  1_000,
+	"mb":  1_000_000,
+	"gb":  1_000_000_000,
+	"tb":  1_000_000_000_000,
+	"kib": 1 << 10,
+	"mib": 1 << 20,
+	"gib": 1 << 30,
+	"tib": 1 << 40,
+}
+
+// ByteSize is an amount of bytes that can be configured either as a plain
+// integer or as a human-readable size, e.g. "1GB" or "512MiB".
+type ByteSize int64
+
+// UnmarshalText parses the byte size. The decimal (KB, MB, GB, TB) and
+// binary (KiB, MiB, GiB, TiB) units are supported, a plain integer is
+// treated as bytes.
+func (bs *ByteSize) UnmarshalText(text []byte) error {
+	s := strings.TrimSpace(string(text))
+	unit := strings.TrimLeft(s, "+-0123456789")
+	number := s[:len(s)-len(unit)]
+	unit = strings.TrimSpace(unit)
+
+	n, err := strconv.ParseInt(number, 10, 64)
+	if err != nil || strings.IndexFunc(unit, func(r rune) bool { return !unicode.IsLetter(r) }) >= 0 {
+		return fmt.Errorf("invalid byte size %q", s)
+	}
+
+	mult, ok := _byteSizeUnits[strings.ToLower(unit)]
+	if !ok {
+		return fmt.Errorf("unknown byte size unit %q", unit)
+	}
+
+	if n > math.MaxInt64/mult || n < math.MinInt64/mult {
+		return fmt.Errorf("byte size %q is too large", s)
+	}
+
+	*bs = ByteSize(n * mult)
+
+	return nil
+}
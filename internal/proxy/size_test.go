@@ -0,0 +1,78 @@
+package proxy
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_ByteSize_UnmarshalText(t *testing.T) {
+	tests := map[string]struct {
+		Text   string
+		Result ByteSize
+		Error  string
+	}{
+		"Size is empty": {
+			Text:  "",
+			Error: `invalid byte size ""`,
+		},
+		"Size has no number": {
+			Text:  "GB",
+			Error: `invalid byte size "GB"`,
+		},
+		"Size is a fraction": {
+			Text:  "1.5GB",
+			Error: `invalid byte size "1.5GB"`,
+		},
+		"Size unit is unknown": {
+			Text:  "1PB",
+			Error: `unknown byte size unit "PB"`,
+		},
+		"Size overflows": {
+			Text:  "9000000000GiB",
+			Error: `byte size "9000000000GiB" is too large`,
+		},
+		"Successfully parsed a bare integer": {
+			Text:   "1000000000",
+			Result: 1_000_000_000,
+		},
+		"Successfully parsed a negative integer": {
+			Text:   "-1",
+			Result: -1,
+		},
+		"Successfully parsed bytes": {
+			Text:   "100B",
+			Result: 100,
+		},
+		"Successfully parsed decimal gigabytes": {
+			Text:   "1GB",
+			Result: 1_000_000_000,
+		},
+		"Successfully parsed binary mebibytes": {
+			Text:   "512MiB",
+			Result: 512 << 20,
+		},
+		"Successfully parsed a size with spaces and lowercase unit": {
+			Text:   " 2 kib ",
+			Result: 2048,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			var bs ByteSize
+
+			err := bs.UnmarshalText([]byte(test.Text))
+			if test.Error != "" {
+				assert.EqualError(t, err, test.Error)
+				return
+			}
+
+			require.NoError(t, err)
+			assert.Equal(t, test.Result, bs)
+		})
+	}
+}
@@ -0,0 +1,151 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/davseby/lwproxy/internal/request"
+	"golang.org/x/exp/slog"
+)
+
+const (
+	// _tlsRecordHeaderLen is the length of the TLS record header.
+	_tlsRecordHeaderLen = 5
+
+	// _tlsMaxRecordLen is the maximum length of a plaintext TLS record,
+	// which the client hello is sent in.
+	_tlsMaxRecordLen = 1 << 14
+
+	// _tlsHandshakeRecord is the content type of the TLS handshake
+	// records.
+	_tlsHandshakeRecord = 0x16
+)
+
+// errClientHelloRead is used to stop the TLS handshake once the client
+// hello is read.
+var errClientHelloRead = errors.New("client hello is read")
+
+// pendingRecordKey is the context key of the pending tunnel record.
+type pendingRecordKey struct{}
+
+// pendingRecord is a tunnel record that is published once the server name
+// is peeked from the tunneled TLS client hello.
+type pendingRecord struct {
+	once sync.Once
+	rec  request.Record
+}
+
+// publishRecord publishes the pending tunnel record, if there is one in
+// the context, with the provided server name. The record is published
+// only once, the further calls return nil.
+func (p *Proxy) publishRecord(ctx context.Context, sni string) error {
+	pr, ok := ctx.Value(pendingRecordKey{}).(*pendingRecord)
+	if !ok {
+		return nil
+	}
+
+	var err error
+
+	pr.once.Do(func() {
+		pr.rec.SNI = sni
+		err = p.rec.Handle(pr.rec)
+	})
+
+	return err
+}
+
+// peekServerName reads the TLS client hello sent by the client and returns
+// the bytes that were read together with the server name. The bytes must
+// be forwarded to the target service. No server name is returned if the
+// client does not start a TLS handshake within the peek timeout.
+func (p *Proxy) peekServerName(ctx context.Context, conn net.Conn, r io.Reader) ([]byte, string) {
+	if timeout := p.cfg.SNI.PeekTimeout; timeout > 0 {
+		if err := conn.SetReadDeadline(p.clock.Now().Add(timeout)); err != nil {
+			p.silentError(ctx, err, "setting client hello peek deadline")
+		}
+
+		defer func() {
+			if err := conn.SetReadDeadline(time.Time{}); err != nil {
+				p.silentError(ctx, err, "resetting client hello peek deadline")
+			}
+		}()
+	}
+
+	data, err := readClientHello(r)
+	if err != nil {
+		p.logger(ctx).Debug("peeking tls client hello", slog.String("error", err.Error()))
+		return data, ""
+	}
+
+	return data, serverName(data)
+}
+
+// readClientHello reads the first TLS record from the reader. The bytes
+// read so far are returned even if the record cannot be read or it is not
+// a TLS handshake record.
+func readClientHello(r io.Reader) ([]byte, error) {
+	data := make([]byte, _tlsRecordHeaderLen)
+
+	n, err := io.ReadFull(r, data)
+	if err != nil {
+		return data[:n], err
+	}
+
+	if data[0] != _tlsHandshakeRecord {
+		return data, errors.New("not a tls handshake record")
+	}
+
+	length := int(data[3])<<8 | int(data[4])
+	if length > _tlsMaxRecordLen {
+		return data, errors.New("tls record is too large")
+	}
+
+	data = append(data, make([]byte, length)...)
+
+	n, err = io.ReadFull(r, data[_tlsRecordHeaderLen:])
+
+	return data[:_tlsRecordHeaderLen+n], err
+}
+
+// serverName returns the server name indicated in the TLS client hello.
+// The client hello is parsed by starting a TLS handshake that is stopped
+// once the client hello is read.
+func serverName(clientHello []byte) string {
+	var sni string
+
+	//nolint: gosec // the handshake never completes.
+	conn := tls.Server(&helloConn{r: bytes.NewReader(clientHello)}, &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			sni = hello.ServerName
+			return nil, errClientHelloRead
+		},
+	})
+
+	_ = conn.Handshake()
+
+	return sni
+}
+
+// helloConn is a connection that serves reads from the client hello and
+// discards writes. It is only used to parse the client hello.
+type helloConn struct {
+	net.Conn
+
+	r io.Reader
+}
+
+// Read reads the client hello.
+func (hc *helloConn) Read(b []byte) (int, error) {
+	return hc.r.Read(b)
+}
+
+// Write discards the data.
+func (hc *helloConn) Write(b []byte) (int, error) {
+	return len(b), nil
+}
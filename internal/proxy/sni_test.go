@@ -0,0 +1,280 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/davseby/lwproxy/internal/clock"
+	"github.com/davseby/lwproxy/internal/request"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/trace/noop"
+	"golang.org/x/exp/slog"
+)
+
+// clientHello returns the first TLS record sent by a client that
+// indicates the provided server name.
+func clientHello(t *testing.T, sni string) []byte {
+	t.Helper()
+
+	client, server := net.Pipe()
+
+	defer server.Close()
+
+	go func() {
+		defer client.Close()
+
+		//nolint: gosec // the handshake never completes.
+		_ = tls.Client(client, &tls.Config{ServerName: sni, InsecureSkipVerify: true}).Handshake()
+	}()
+
+	data, err := readClientHello(server)
+	require.NoError(t, err)
+
+	return data
+}
+
+func Test_readClientHello(t *testing.T) {
+	hello := clientHello(t, "example.com")
+
+	tests := map[string]struct {
+		Data   []byte
+		Result []byte
+		Error  string
+	}{
+		"Incomplete header": {
+			Data:   []byte{0x16, 0x03},
+			Result: []byte{0x16, 0x03},
+			Error:  "unexpected EOF",
+		},
+		"Not a handshake record": {
+			Data:   []byte("GET / HTTP/1.1\r\n"),
+			Result: []byte("GET /"),
+			Error:  "not a tls handshake record",
+		},
+		"Record is too large": {
+			Data:   []byte{0x16, 0x03, 0x01, 0xff, 0xff, 0x01},
+			Result: []byte{0x16, 0x03, 0x01, 0xff, 0xff},
+			Error:  "tls record is too large",
+		},
+		"Incomplete record": {
+			Data:   hello[:20],
+			Result: hello[:20],
+			Error:  "unexpected EOF",
+		},
+		"Successfully read a client hello": {
+			Data:   append(bytes.Clone(hello), "rest"...),
+			Result: hello,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			data, err := readClientHello(bytes.NewReader(test.Data))
+			if test.Error != "" {
+				assert.EqualError(t, err, test.Error)
+			} else {
+				assert.NoError(t, err)
+			}
+
+			assert.Equal(t, test.Result, data)
+		})
+	}
+}
+
+func Test_serverName(t *testing.T) {
+	assert.Equal(t, "example.com", serverName(clientHello(t, "example.com")))
+	assert.Equal(t, "", serverName(clientHello(t, "127.0.0.1")))
+	assert.Equal(t, "", serverName([]byte("GET / HTTP/1.1\r\n")))
+	assert.Equal(t, "", serverName(nil))
+}
+
+func Test_Proxy_publishRecord(t *testing.T) {
+	rm := &RecorderMock{}
+
+	p := &Proxy{
+		rec: rm,
+	}
+
+	// no pending record
+	require.NoError(t, p.publishRecord(context.Background(), "example.com"))
+	assert.Empty(t, rm.HandleCalls())
+
+	// pending record
+	rec := request.Record{Host: "127.0.0.1", Tunnel: true}
+	ctx := context.WithValue(context.Background(), pendingRecordKey{}, &pendingRecord{rec: rec})
+
+	require.NoError(t, p.publishRecord(ctx, "example.com"))
+	require.NoError(t, p.publishRecord(ctx, ""))
+
+	rec.SNI = "example.com"
+
+	require.Len(t, rm.HandleCalls(), 1)
+	assert.Equal(t, rec, rm.HandleCalls()[0].Rec)
+
+	// recorder error
+	rm.HandleFunc = func(_ request.Record) error {
+		return assert.AnError
+	}
+
+	ctx = context.WithValue(context.Background(), pendingRecordKey{}, &pendingRecord{rec: rec})
+	assert.Equal(t, assert.AnError, p.publishRecord(ctx, ""))
+}
+
+func Test_Proxy_tunnelingHandler_SNI(t *testing.T) {
+	target := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = io.WriteString(w, "hello")
+	}))
+	t.Cleanup(target.Close)
+
+	echo := startEchoServer(t)
+
+	rm := &RecorderMock{}
+
+	p := &Proxy{
+		log:     slog.New(slog.NewTextHandler(io.Discard, nil)),
+		rec:     rm,
+		metrics: noopMetrics{},
+		tracer:  noop.NewTracerProvider().Tracer(""),
+		clock:   clock.New(),
+		dial:    (&net.Dialer{}).DialContext,
+	}
+
+	p.cfg.SNI.Capture = true
+	p.cfg.SNI.PeekTimeout = 50 * time.Millisecond
+
+	srv := httptest.NewServer(http.HandlerFunc(p.recordHandler))
+	t.Cleanup(srv.Close)
+
+	connect := func(addr string) (net.Conn, *bufio.Reader) {
+		conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+		require.NoError(t, err)
+
+		t.Cleanup(func() {
+			conn.Close()
+		})
+
+		_, err = fmt.Fprintf(conn, "CONNECT %[1]s HTTP/1.1\r\nHost: %[1]s\r\n\r\n", addr)
+		require.NoError(t, err)
+
+		br := bufio.NewReader(conn)
+
+		resp, err := http.ReadResponse(br, nil)
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+
+		return conn, br
+	}
+
+	// TLS communication
+	conn, br := connect(target.Listener.Addr().String())
+
+	//nolint: gosec // the test server certificate is self-signed.
+	tlsConn := tls.Client(&bufferedConn{Conn: conn, r: br}, &tls.Config{
+		ServerName:         "fronted.example.com",
+		InsecureSkipVerify: true,
+	})
+
+	_, err := io.WriteString(tlsConn, "GET / HTTP/1.1\r\nHost: fronted.example.com\r\n\r\n")
+	require.NoError(t, err)
+
+	resp, err := http.ReadResponse(bufio.NewReader(tlsConn), nil)
+	require.NoError(t, err)
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 5))
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(body))
+
+	require.Len(t, rm.HandleCalls(), 1)
+	assert.Equal(t, "fronted.example.com", rm.HandleCalls()[0].Rec.SNI)
+	assert.Equal(t, "127.0.0.1", rm.HandleCalls()[0].Rec.Host)
+	assert.True(t, rm.HandleCalls()[0].Rec.Tunnel)
+
+	// plain communication shorter than a TLS record header
+	conn, br = connect(echo.Addr().String())
+
+	_, err = io.WriteString(conn, "ping")
+	require.NoError(t, err)
+
+	data := make([]byte, 4)
+
+	_, err = io.ReadFull(br, data)
+	require.NoError(t, err)
+	assert.Equal(t, "ping", string(data))
+
+	require.Len(t, rm.HandleCalls(), 2)
+	assert.Empty(t, rm.HandleCalls()[1].Rec.SNI)
+
+	// plain communication longer than a TLS record header
+	conn, br = connect(echo.Addr().String())
+
+	_, err = io.WriteString(conn, "ping pong")
+	require.NoError(t, err)
+
+	data = make([]byte, 9)
+
+	_, err = io.ReadFull(br, data)
+	require.NoError(t, err)
+	assert.Equal(t, "ping pong", string(data))
+
+	require.Len(t, rm.HandleCalls(), 3)
+	assert.Empty(t, rm.HandleCalls()[2].Rec.SNI)
+}
+
+func Test_Proxy_tunnelingHandler_SNI_RecorderError(t *testing.T) {
+	echo := startEchoServer(t)
+
+	rm := &RecorderMock{
+		HandleFunc: func(_ request.Record) error {
+			return assert.AnError
+		},
+	}
+
+	p := &Proxy{
+		log:     slog.New(slog.NewTextHandler(io.Discard, nil)),
+		rec:     rm,
+		metrics: noopMetrics{},
+		tracer:  noop.NewTracerProvider().Tracer(""),
+		clock:   clock.New(),
+		dial:    (&net.Dialer{}).DialContext,
+	}
+
+	p.cfg.SNI.Capture = true
+	p.cfg.SNI.PeekTimeout = 50 * time.Millisecond
+
+	srv := httptest.NewServer(http.HandlerFunc(p.recordHandler))
+	t.Cleanup(srv.Close)
+
+	conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+	require.NoError(t, err)
+
+	defer conn.Close()
+
+	_, err = fmt.Fprintf(conn, "CONNECT %[1]s HTTP/1.1\r\nHost: %[1]s\r\n\r\n", echo.Addr().String())
+	require.NoError(t, err)
+
+	br := bufio.NewReader(conn)
+
+	resp, err := http.ReadResponse(br, nil)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	_, err = io.WriteString(conn, "ping pong")
+	require.NoError(t, err)
+
+	// the tunnel is closed without relaying the data.
+	_, err = br.ReadByte()
+	assert.Error(t, err)
+	assert.Len(t, rm.HandleCalls(), 1)
+}
@@ -2,78 +2,281 @@ package proxy
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"io"
 	"net"
 	"net/http"
+	"strconv"
+	"strings"
 	"sync"
+	"syscall"
+	"time"
+
+	"github.com/davseby/lwproxy/internal/clock"
+	"github.com/davseby/lwproxy/internal/proxy/internal/intercept"
+	"go.opentelemetry.io/otel/codes"
+	"golang.org/x/exp/slog"
+)
+
+// _targetOverrideHeader is the header used to override the tunneled target
+// address when the override is enabled.
+const _targetOverrideHeader = "X-Lwproxy-Target"
+
+var (
+	// errMissingHost is returned when the request target has no host.
+	errMissingHost = errors.New("missing target host")
+
+	// errMissingPort is returned when the CONNECT request target has no
+	// port.
+	errMissingPort = errors.New("missing target port")
+
+	// errInvalidPort is returned when the request target port is not a
+	// valid port number.
+	errInvalidPort = errors.New("invalid target port")
 )
 
-// tunnelingHandler handles tunneling (e.g proxying).
-func (p *Proxy) tunnelingHandler(w http.ResponseWriter, r *http.Request, secure bool) {
-	targetConn, err := net.DialTimeout("tcp", r.Host, _targetDialTimeout)
+// tunnelingHandler handles CONNECT requests tunneling.
+func (p *Proxy) tunnelingHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, span := p.tracer.Start(r.Context(), "proxy.tunnel")
+	defer span.End()
+
+	addr, err := p.tunnelTarget(r)
 	if err != nil {
-		http.Error(w, "target service is unreachable", http.StatusServiceUnavailable)
+		span.SetStatus(codes.Error, err.Error())
+		p.writeError(w, err.Error(), http.StatusBadRequest)
+
 		return
 	}
 
-	if secure {
-		// NOTE: We need to write the status header before hijacking the
-		// connection. This will tell the client that we've established the
-		// connection between the client and the target server. Used
-		// for TLS.
-		w.WriteHeader(http.StatusOK)
-	} else {
-		err = r.Write(targetConn)
-		if err != nil {
-			http.Error(w, "writing request to the target service", http.StatusInternalServerError)
-			return
+	if p.loopTarget(ctx, addr) {
+		span.SetStatus(codes.Error, "request target is the proxy itself")
+		p.writeError(w, "request target is the proxy itself", http.StatusMisdirectedRequest)
+
+		return
+	}
+
+	start := p.clock.Now()
+
+	targetConn, err := p.dialEstablishTarget(ctx, addr)
+	if err != nil {
+		p.logger(ctx).Debug("dialing target service", slog.String("error", err.Error()))
+		span.SetStatus(codes.Error, err.Error())
+		p.writeError(w, "target service is unreachable", http.StatusServiceUnavailable)
+
+		return
+	}
+
+	if err := intercept.SetKeepAlive(targetConn, p.cfg.KeepAlivePeriod); err != nil {
+		p.silentError(ctx, err, "setting target connection keep-alive")
+	}
+
+	if timeout := p.cfg.ConnectEstablishTimeout; timeout > 0 {
+		targetConn = p.newEstablishConn(ctx, targetConn, timeout-p.clock.Now().Sub(start))
+	}
+
+	closeTarget := func() {
+		if err := targetConn.Close(); err != nil {
+			p.silentError(ctx, err, "closing target connection")
 		}
 	}
 
 	hijacker, ok := w.(http.Hijacker)
 	if !ok {
-		http.Error(w, "hijacking is not supported", http.StatusInternalServerError)
+		closeTarget()
+		p.writeError(w, "hijacking is not supported", http.StatusInternalServerError)
+
 		return
 	}
 
-	baseConn, _, err := hijacker.Hijack()
+	baseConn, brw, err := hijacker.Hijack()
 	if err != nil {
-		http.Error(w, "cannot hijack a connection", http.StatusServiceUnavailable)
+		closeTarget()
+		p.writeError(w, "cannot hijack a connection", http.StatusServiceUnavailable)
+
 		return
 	}
 
-	p.establishCommunication(r.Context(), baseConn, targetConn)
-}
+	// NOTE: We write the status line directly to the hijacked connection
+	// instead of using the response writer. This will tell the client that
+	// we've established the connection between the client and the target
+	// server. The response writer would add headers (e.g.
+	// Transfer-Encoding or Connection) that must not be present in a
+	// CONNECT response and it would not be possible to echo the HTTP/1.0
+	// version for legacy clients.
+	_, err = fmt.Fprintf(
+		baseConn,
+		"HTTP/%d.%d 200 Connection established\r\n\r\n",
+		r.ProtoMajor,
+		r.ProtoMinor,
+	)
+	if err != nil {
+		p.silentError(ctx, err, "writing connection established response")
+		closeTarget()
 
-// establishCommunication establishes communication between the base and
-// target connections. This also handles the deadline for the communication
-// and closes the connections when the communication is done.
-func (p *Proxy) establishCommunication(ctx context.Context, baseConn, targetConn net.Conn) {
-	deadline, ok := ctx.Deadline()
-	if ok {
-		err := baseConn.SetDeadline(deadline)
-		if err != nil {
-			p.silentError(err, "setting base connection deadline")
+		if err := baseConn.Close(); err != nil {
+			p.silentError(ctx, err, "closing base connection")
 		}
 
-		err = targetConn.SetDeadline(deadline)
-		if err != nil {
-			p.silentError(err, "setting target connection deadline")
+		return
+	}
+
+	if p.mitm != nil {
+		host, _, _ := net.SplitHostPort(addr)
+
+		if p.mitm.Match(host) {
+			if err := p.publishRecord(ctx, ""); err != nil {
+				p.closeTunnel(ctx, err, baseConn, targetConn)
+				return
+			}
+
+			p.interceptCommunication(
+				ctx,
+				&bufferedConn{Conn: baseConn, r: brw.Reader},
+				targetConn,
+				host,
+			)
+
+			return
+		}
+	}
+
+	var hello []byte
+	var sni string
+
+	if p.cfg.SNI.Capture {
+		// NOTE: The buffered bytes are read first and the rest is read
+		// from the base connection directly, as the hijacked reader
+		// would cancel the request context on the peek timeout.
+		hello, sni = p.peekServerName(ctx, baseConn, io.MultiReader(
+			io.LimitReader(brw.Reader, int64(brw.Reader.Buffered())),
+			baseConn,
+		))
+	}
+
+	if err := p.publishRecord(ctx, sni); err != nil {
+		p.closeTunnel(ctx, err, baseConn, targetConn)
+		return
+	}
+
+	// NOTE: The peeked bytes are replayed to the target service, so the
+	// TLS communication is not affected.
+	if len(hello) > 0 {
+		if _, err := targetConn.Write(hello); err != nil {
+			p.silentError(ctx, err, "writing client hello to the target service")
+		}
+	}
+
+	// NOTE: The client may have sent data right after the request headers
+	// and it could already be buffered by the server. It has to be
+	// forwarded before relaying the rest of the communication.
+	if n := brw.Reader.Buffered(); n > 0 {
+		buffered, _ := brw.Reader.Peek(n)
+
+		if _, err := targetConn.Write(buffered); err != nil {
+			p.silentError(ctx, err, "writing buffered data to the target service")
 		}
 	}
 
+	p.establishCommunication(ctx, baseConn, targetConn, addr, r.RemoteAddr)
+}
+
+// closeTunnel closes the established tunnel connections when its record
+// cannot be published.
+func (p *Proxy) closeTunnel(ctx context.Context, err error, baseConn, targetConn net.Conn) {
+	p.silentError(ctx, err, "publishing tunnel record")
+
+	if err := targetConn.Close(); err != nil {
+		p.silentError(ctx, err, "closing target connection")
+	}
+
+	if err := baseConn.Close(); err != nil {
+		p.silentError(ctx, err, "closing base connection")
+	}
+}
+
+// establishCommunication establishes communication between the base and
+// target connections. This also handles the deadline for the communication
+// and closes the connections when the communication is done. When one of
+// the directions finishes, its destination connection is half-closed so
+// that the other direction could still deliver the remaining data. Both
+// connections are closed once either direction fails or the context is
+// done. The target and client addresses are attached to the logs.
+func (p *Proxy) establishCommunication(
+	ctx context.Context,
+	baseConn net.Conn,
+	targetConn net.Conn,
+	target string,
+	client string,
+) {
+	ctx = withLogAttrs(ctx, slog.String("target", target), slog.String("client", client))
+
+	p.applyDeadline(ctx, baseConn, targetConn)
+
+	var closeOnce sync.Once
+
 	closeConnections := func() {
-		err := targetConn.Close()
+		closeOnce.Do(func() {
+			err := targetConn.Close()
+			if err != nil {
+				p.silentError(ctx, err, "closing target connection")
+			}
+
+			err = baseConn.Close()
+			if err != nil {
+				p.silentError(ctx, err, "closing base connection")
+			}
+		})
+	}
+
+	relay := func(dst, src net.Conn, msg string) {
+		defer func() {
+			if v := recover(); v != nil {
+				p.logPanic(ctx, v, msg)
+				closeConnections()
+			}
+		}()
+
+		_, err := io.Copy(dst, src)
 		if err != nil {
-			p.silentError(err, "closing target connection")
+			p.silentError(ctx, err, msg)
+			closeConnections()
+
+			return
 		}
 
-		err = baseConn.Close()
-		if err != nil {
-			p.silentError(err, "closing base connection")
+		// NOTE: The source has reached EOF, so we only signal the end of
+		// data to the destination. If half-closing is not supported,
+		// both connections are closed straight away.
+		cw, ok := dst.(closeWriter)
+		if !ok {
+			closeConnections()
+			return
+		}
+
+		if err := cw.CloseWrite(); err != nil {
+			if !errors.Is(err, errors.ErrUnsupported) {
+				p.silentError(ctx, err, "half-closing connection")
+			}
+
+			closeConnections()
 		}
 	}
 
+	// NOTE: Closing the connections unblocks both relays, so the
+	// communication is stopped as soon as the context is cancelled,
+	// even if one of the sides keeps a half-open connection.
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			closeConnections()
+		case <-stopCh:
+		}
+	}()
+
 	var wg sync.WaitGroup
 
 	wg.Add(1)
@@ -81,12 +284,7 @@ func (p *Proxy) establishCommunication(ctx context.Context, baseConn, targetConn
 	go func() {
 		defer wg.Done()
 
-		_, err := io.Copy(baseConn, targetConn)
-		if err != nil {
-			p.silentError(err, "handling base to target communication")
-		}
-
-		closeConnections()
+		relay(baseConn, targetConn, "handling base to target communication")
 	}()
 
 	wg.Add(1)
@@ -94,13 +292,264 @@ func (p *Proxy) establishCommunication(ctx context.Context, baseConn, targetConn
 	go func() {
 		defer wg.Done()
 
-		_, err := io.Copy(targetConn, baseConn)
-		if err != nil {
-			p.silentError(err, "handling target to base communication")
+		relay(targetConn, baseConn, "handling target to base communication")
+	}()
+
+	wg.Wait()
+
+	closeConnections()
+}
+
+// dialTarget connects to the target service. Dials that were refused or
+// timed out are retried with an exponential backoff.
+func (p *Proxy) dialTarget(ctx context.Context, addr string) (net.Conn, error) {
+	for attempt := 0; ; attempt++ {
+		dialCtx, cancel := context.WithTimeout(ctx, _targetDialTimeout)
+		conn, err := p.dial(dialCtx, "tcp", addr)
+
+		cancel()
+
+		if err == nil || attempt >= p.cfg.Dial.Retries || !retryableDialError(err) {
+			return conn, err
 		}
 
-		closeConnections()
+		p.logger(ctx).Debug(
+			"retrying target dial",
+			slog.Int("attempt", attempt+1),
+			slog.String("error", err.Error()),
+		)
+
+		timer := p.clock.NewTimer(p.cfg.Dial.RetryDelay << attempt)
+
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+
+			return nil, err
+		case <-timer.C():
+		}
+	}
+}
+
+// dialEstablishTarget dials the target service within the connect
+// establish timeout, if it is set.
+func (p *Proxy) dialEstablishTarget(ctx context.Context, addr string) (net.Conn, error) {
+	if p.cfg.ConnectEstablishTimeout <= 0 {
+		return p.dialTarget(ctx, addr)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, p.cfg.ConnectEstablishTimeout)
+	defer cancel()
+
+	return p.dialTarget(ctx, addr)
+}
+
+// retryableDialError returns true if the dial error is likely temporary.
+// DNS resolution errors are never retried.
+func retryableDialError(err error) bool {
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return false
+	}
+
+	if errors.Is(err, syscall.ECONNREFUSED) {
+		return true
+	}
+
+	var netErr net.Error
+
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// applyDeadline sets the context deadline, if there is one, on the base
+// and target connections.
+func (p *Proxy) applyDeadline(ctx context.Context, baseConn, targetConn net.Conn) {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return
+	}
+
+	err := baseConn.SetDeadline(deadline)
+	if err != nil {
+		p.silentError(ctx, err, "setting base connection deadline")
+	}
+
+	err = targetConn.SetDeadline(deadline)
+	if err != nil {
+		p.silentError(ctx, err, "setting target connection deadline")
+	}
+}
+
+// tunnelTarget returns the address of the tunneled target service. When
+// the target override is enabled, the address can be replaced by the
+// X-Lwproxy-Target header.
+func (p *Proxy) tunnelTarget(r *http.Request) (string, error) {
+	addr, err := targetAddr(r)
+	if err != nil {
+		return "", err
+	}
+
+	override := r.Header.Get(_targetOverrideHeader)
+	if !p.cfg.TargetOverride || override == "" {
+		return addr, nil
+	}
+
+	return targetAddr(&http.Request{
+		Method: http.MethodConnect,
+		Host:   override,
+	})
+}
+
+// targetAddr returns the address of the target service. CONNECT requests
+// must specify the port explicitly, while plain HTTP requests fall back to
+// the default HTTP port.
+func targetAddr(r *http.Request) (string, error) {
+	host, port, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		if r.Method == http.MethodConnect {
+			return "", errMissingPort
+		}
+
+		host, port = strings.Trim(r.Host, "[]"), "80"
+	}
+
+	if host == "" {
+		return "", errMissingHost
+	}
+
+	if n, err := strconv.ParseUint(port, 10, 16); err != nil || n == 0 {
+		return "", errInvalidPort
+	}
+
+	return net.JoinHostPort(host, port), nil
+}
+
+// loopTarget returns true if the target address resolves to the proxy
+// listening address. Such requests would be proxied back to the proxy
+// over and over again. The host is resolved with the same dial function
+// that is used to connect to the targets.
+func (p *Proxy) loopTarget(ctx context.Context, addr string) bool {
+	listenAddr, ok := p.Addr().(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil || port != strconv.Itoa(listenAddr.Port) {
+		return false
+	}
+
+	// NOTE: Targets that cannot be resolved are not loops, dialing them
+	// fails anyway.
+	ips, err := p.dns.LookupIPAddr(ctx, host)
+	if err != nil {
+		return false
+	}
+
+	for _, ip := range ips {
+		if listenAddr.IP.IsUnspecified() && localIP(ip.IP) || listenAddr.IP.Equal(ip.IP) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// localIP returns true if the IP address belongs to this host.
+func localIP(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsUnspecified() {
+		return true
+	}
+
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.Equal(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// establishConn is a target connection that is closed unless the target
+// sends its first bytes in time.
+type establishConn struct {
+	net.Conn
+
+	timer clock.Timer
+	done  chan struct{}
+	once  sync.Once
+}
+
+// newEstablishConn creates a new target connection that is closed once
+// the timeout elapses without receiving any bytes from the target.
+func (p *Proxy) newEstablishConn(ctx context.Context, conn net.Conn, timeout time.Duration) *establishConn {
+	ec := &establishConn{
+		Conn:  conn,
+		timer: p.clock.NewTimer(timeout),
+		done:  make(chan struct{}),
+	}
+
+	go func() {
+		select {
+		case <-ec.timer.C():
+			p.logger(ctx).Debug("tunnel was not established in time")
+
+			if err := conn.Close(); err != nil {
+				p.silentError(ctx, err, "closing target connection")
+			}
+		case <-ec.done:
+		}
 	}()
 
-	wg.Wait()
+	return ec
+}
+
+// Read reads data from the target connection. The establishment timer is
+// stopped once the first bytes are received.
+func (ec *establishConn) Read(b []byte) (int, error) {
+	n, err := ec.Conn.Read(b)
+	if n > 0 {
+		ec.stop()
+	}
+
+	return n, err
+}
+
+// CloseWrite shuts down the writing side of the target connection. It
+// returns errors.ErrUnsupported if the connection does not support
+// half-closing.
+func (ec *establishConn) CloseWrite() error {
+	cw, ok := ec.Conn.(closeWriter)
+	if !ok {
+		return errors.ErrUnsupported
+	}
+
+	return cw.CloseWrite()
+}
+
+// Close stops the establishment timer and closes the target connection.
+func (ec *establishConn) Close() error {
+	ec.stop()
+
+	return ec.Conn.Close()
+}
+
+// stop stops the establishment timer. It is safe to call it multiple
+// times.
+func (ec *establishConn) stop() {
+	ec.once.Do(func() {
+		ec.timer.Stop()
+		close(ec.done)
+	})
+}
+
+// closeWriter is a connection that supports half-closing.
+type closeWriter interface {
+	// CloseWrite should shut down the writing side of the connection.
+	CloseWrite() error
 }
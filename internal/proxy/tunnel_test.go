@@ -0,0 +1,1149 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/davseby/lwproxy/internal/clock"
+	"github.com/davseby/lwproxy/internal/request"
+	"github.com/rs/xid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/trace/noop"
+	"golang.org/x/exp/slog"
+)
+
+// startEchoServer starts a TCP server that echoes everything it receives.
+func startEchoServer(t *testing.T) net.Listener {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	t.Cleanup(func() {
+		ln.Close()
+	})
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer conn.Close()
+
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	return ln
+}
+
+func Test_Proxy_tunnelingHandler(t *testing.T) {
+	target := startEchoServer(t)
+
+	p := &Proxy{
+		log:    slog.New(slog.NewTextHandler(io.Discard, nil)),
+		tracer: noop.NewTracerProvider().Tracer(""),
+		clock:  clock.New(),
+		dial:   (&net.Dialer{}).DialContext,
+	}
+
+	srv := httptest.NewServer(http.HandlerFunc(p.tunnelingHandler))
+	t.Cleanup(srv.Close)
+
+	tests := map[string]struct {
+		Target     string
+		Proto      string
+		Status     int
+		ProtoMajor int
+		ProtoMinor int
+	}{
+		"Target host has no port": {
+			Target:     "127.0.0.1",
+			Proto:      "HTTP/1.1",
+			Status:     http.StatusBadRequest,
+			ProtoMajor: 1,
+			ProtoMinor: 1,
+		},
+		"Target host has an invalid port": {
+			Target:     "127.0.0.1:http",
+			Proto:      "HTTP/1.1",
+			Status:     http.StatusBadRequest,
+			ProtoMajor: 1,
+			ProtoMinor: 1,
+		},
+		"Successfully established HTTP/1.0 tunnel": {
+			Target:     target.Addr().String(),
+			Proto:      "HTTP/1.0",
+			Status:     http.StatusOK,
+			ProtoMajor: 1,
+			ProtoMinor: 0,
+		},
+		"Successfully established HTTP/1.1 tunnel": {
+			Target:     target.Addr().String(),
+			Proto:      "HTTP/1.1",
+			Status:     http.StatusOK,
+			ProtoMajor: 1,
+			ProtoMinor: 1,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+			require.NoError(t, err)
+
+			defer conn.Close()
+
+			_, err = fmt.Fprintf(
+				conn,
+				"CONNECT %[1]s %[2]s\r\nHost: %[1]s\r\n\r\n",
+				test.Target,
+				test.Proto,
+			)
+			require.NoError(t, err)
+
+			br := bufio.NewReader(conn)
+
+			resp, err := http.ReadResponse(br, nil)
+			require.NoError(t, err)
+
+			assert.Equal(t, test.Status, resp.StatusCode)
+			assert.Equal(t, test.ProtoMajor, resp.ProtoMajor)
+			assert.Equal(t, test.ProtoMinor, resp.ProtoMinor)
+
+			if test.Status != http.StatusOK {
+				return
+			}
+
+			assert.Empty(t, resp.TransferEncoding)
+			assert.Empty(t, resp.Header)
+
+			_, err = conn.Write([]byte("ping"))
+			require.NoError(t, err)
+
+			data := make([]byte, 4)
+
+			_, err = io.ReadFull(br, data)
+			require.NoError(t, err)
+			assert.Equal(t, "ping", string(data))
+		})
+	}
+}
+
+// hijackRecorder is a response recorder that can be hijacked.
+type hijackRecorder struct {
+	*httptest.ResponseRecorder
+
+	conn net.Conn
+}
+
+// Hijack returns the recorder connection.
+func (hr *hijackRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return hr.conn, bufio.NewReadWriter(bufio.NewReader(hr.conn), bufio.NewWriter(hr.conn)), nil
+}
+
+func Test_Proxy_tunnelingHandler_HTTP2(t *testing.T) {
+	origin := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, r.Proto)
+	}))
+	origin.EnableHTTP2 = true
+	origin.StartTLS()
+	t.Cleanup(origin.Close)
+
+	pool := x509.NewCertPool()
+	pool.AddCert(origin.Certificate())
+
+	// NOTE: The targets are dialed at the origin address, so that the
+	// client could use a host name the origin certificate is valid for.
+	dial := func(ctx context.Context, network, _ string) (net.Conn, error) {
+		return (&net.Dialer{}).DialContext(ctx, network, origin.Listener.Addr().String())
+	}
+
+	tests := map[string]struct {
+		CaptureSNI bool
+		SNI        string
+	}{
+		"Successfully reached an HTTP/2 origin": {},
+		"Successfully reached an HTTP/2 origin with SNI capture": {
+			CaptureSNI: true,
+			SNI:        "example.com",
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			rm := &RecorderMock{}
+
+			cfg := testConfig()
+			cfg.SNI.Capture = test.CaptureSNI
+			cfg.SNI.PeekTimeout = time.Second
+
+			p, err := NewProxy(
+				slog.New(slog.NewTextHandler(io.Discard, nil)),
+				cfg,
+				WithRecorder(rm),
+				WithDial(dial),
+			)
+			require.NoError(t, err)
+
+			ln, err := p.listen()
+			require.NoError(t, err)
+
+			go func() {
+				_ = p.srv.Serve(ln)
+			}()
+
+			defer p.srv.Close()
+
+			client := &http.Client{
+				Transport: &http.Transport{
+					Proxy: http.ProxyURL(&url.URL{
+						Scheme: "http",
+						User:   url.UserPassword("user", "pass"),
+						Host:   ln.Addr().String(),
+					}),
+					TLSClientConfig: &tls.Config{
+						RootCAs:    pool,
+						MinVersion: tls.VersionTLS12,
+					},
+					ForceAttemptHTTP2: true,
+				},
+			}
+
+			defer client.CloseIdleConnections()
+
+			resp, err := client.Get("https://example.com/")
+			require.NoError(t, err)
+
+			defer resp.Body.Close()
+
+			body, err := io.ReadAll(resp.Body)
+			require.NoError(t, err)
+
+			// the protocol is negotiated between the client and the
+			// origin, the proxy only relays the bytes.
+			assert.Equal(t, http.StatusOK, resp.StatusCode)
+			assert.Equal(t, 2, resp.ProtoMajor)
+			assert.Equal(t, "h2", resp.TLS.NegotiatedProtocol)
+			assert.Equal(t, "HTTP/2.0", string(body))
+
+			require.Len(t, rm.HandleCalls(), 1)
+			assert.True(t, rm.HandleCalls()[0].Rec.Tunnel)
+			assert.Equal(t, test.SNI, rm.HandleCalls()[0].Rec.SNI)
+		})
+	}
+}
+
+func Test_Proxy_tunnelingHandler_ClosedClient(t *testing.T) {
+	target := startEchoServer(t)
+
+	var buffer bytes.Buffer
+
+	p := &Proxy{
+		log: slog.New(slog.NewTextHandler(&buffer, &slog.HandlerOptions{
+			Level: slog.LevelDebug,
+		})),
+		tracer: noop.NewTracerProvider().Tracer(""),
+		clock:  clock.New(),
+		dial:   (&net.Dialer{}).DialContext,
+	}
+
+	// NOTE: The client goes away before the connection is hijacked.
+	server, client := net.Pipe()
+	require.NoError(t, client.Close())
+
+	w := &hijackRecorder{
+		ResponseRecorder: httptest.NewRecorder(),
+		conn:             server,
+	}
+
+	p.tunnelingHandler(w, httptest.NewRequest(http.MethodConnect, target.Addr().String(), http.NoBody))
+
+	assert.Contains(t, buffer.String(), "level=DEBUG msg=\"writing connection established response\"")
+	assert.NotContains(t, buffer.String(), "level=ERROR")
+}
+
+func Test_Proxy_tunnelingHandler_JSONError(t *testing.T) {
+	p := &Proxy{
+		log:    slog.New(slog.NewTextHandler(io.Discard, nil)),
+		tracer: noop.NewTracerProvider().Tracer(""),
+		clock:  clock.New(),
+		cfg:    Config{ErrorFormat: "json"},
+	}
+
+	w := httptest.NewRecorder()
+	p.tunnelingHandler(w, httptest.NewRequest(http.MethodConnect, "example.com", http.NoBody))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+	assert.JSONEq(t, `{"error":"missing target port","code":400}`, w.Body.String())
+}
+
+func Test_Proxy_tunnelingHandler_DialRetries(t *testing.T) {
+	target := startEchoServer(t)
+
+	var dials atomic.Int64
+
+	p := &Proxy{
+		log:    slog.New(slog.NewTextHandler(io.Discard, nil)),
+		tracer: noop.NewTracerProvider().Tracer(""),
+		clock:  clock.New(),
+		dial: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			// NOTE: The first dial fails as if the target was not ready.
+			if dials.Add(1) == 1 {
+				return nil, &net.OpError{
+					Op:  "dial",
+					Net: network,
+					Err: os.NewSyscallError("connect", syscall.ECONNREFUSED),
+				}
+			}
+
+			return (&net.Dialer{}).DialContext(ctx, network, addr)
+		},
+	}
+
+	p.cfg.Dial.Retries = 2
+	p.cfg.Dial.RetryDelay = time.Millisecond
+
+	srv := httptest.NewServer(http.HandlerFunc(p.tunnelingHandler))
+	t.Cleanup(srv.Close)
+
+	conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+	require.NoError(t, err)
+
+	defer conn.Close()
+
+	_, err = fmt.Fprintf(conn, "CONNECT %[1]s HTTP/1.1\r\nHost: %[1]s\r\n\r\n", target.Addr().String())
+	require.NoError(t, err)
+
+	br := bufio.NewReader(conn)
+
+	resp, err := http.ReadResponse(br, nil)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, int64(2), dials.Load())
+
+	_, err = conn.Write([]byte("ping"))
+	require.NoError(t, err)
+
+	data := make([]byte, 4)
+
+	_, err = io.ReadFull(br, data)
+	require.NoError(t, err)
+	assert.Equal(t, "ping", string(data))
+}
+
+func Test_Proxy_dialTarget(t *testing.T) {
+	refused := &net.OpError{
+		Op:  "dial",
+		Net: "tcp",
+		Err: os.NewSyscallError("connect", syscall.ECONNREFUSED),
+	}
+
+	tests := map[string]struct {
+		Error   error
+		Retries int
+		Dials   int64
+	}{
+		"Retries are turned off": {
+			Error: refused,
+			Dials: 1,
+		},
+		"Refused dial is retried": {
+			Error:   refused,
+			Retries: 2,
+			Dials:   3,
+		},
+		"DNS error is not retried": {
+			Error:   &net.DNSError{Err: "no such host", Name: "example.invalid", IsNotFound: true},
+			Retries: 2,
+			Dials:   1,
+		},
+		"Unknown error is not retried": {
+			Error:   assert.AnError,
+			Retries: 2,
+			Dials:   1,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			var dials atomic.Int64
+
+			p := &Proxy{
+				log: slog.New(slog.NewTextHandler(io.Discard, nil)),
+				dial: func(_ context.Context, _, _ string) (net.Conn, error) {
+					dials.Add(1)
+
+					return nil, test.Error
+				},
+				clock: clock.New(),
+			}
+
+			p.cfg.Dial.Retries = test.Retries
+			p.cfg.Dial.RetryDelay = time.Millisecond
+
+			conn, err := p.dialTarget(context.Background(), "example.com:443")
+			assert.Nil(t, conn)
+			assert.Equal(t, test.Error, err)
+			assert.Equal(t, test.Dials, dials.Load())
+		})
+	}
+}
+
+func Test_retryableDialError(t *testing.T) {
+	assert.True(t, retryableDialError(&net.OpError{
+		Op:  "dial",
+		Err: os.NewSyscallError("connect", syscall.ECONNREFUSED),
+	}))
+	assert.True(t, retryableDialError(context.DeadlineExceeded))
+	assert.False(t, retryableDialError(&net.DNSError{Err: "i/o timeout", IsTimeout: true}))
+	assert.False(t, retryableDialError(assert.AnError))
+}
+
+// tcpPair returns two connected TCP connections.
+func tcpPair(t *testing.T) (net.Conn, net.Conn) {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	defer ln.Close()
+
+	client, err := net.Dial("tcp", ln.Addr().String())
+	require.NoError(t, err)
+
+	server, err := ln.Accept()
+	require.NoError(t, err)
+
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+
+	return client, server
+}
+
+func Test_Proxy_establishCommunication(t *testing.T) {
+	client, baseConn := tcpPair(t)
+	targetConn, target := tcpPair(t)
+
+	p := &Proxy{
+		log: slog.New(slog.NewTextHandler(io.Discard, nil)),
+	}
+
+	doneCh := make(chan struct{})
+
+	go func() {
+		defer close(doneCh)
+
+		p.establishCommunication(context.Background(), baseConn, targetConn, "example.com:443", "127.0.0.1:5000")
+	}()
+
+	// NOTE: The target responds only after the client has finished
+	// sending and it responds slower than the client, so the response
+	// would be truncated if both connections were closed as soon as the
+	// client direction finished.
+	go func() {
+		defer target.Close()
+
+		data, err := io.ReadAll(target)
+		if err != nil {
+			return
+		}
+
+		time.Sleep(50 * time.Millisecond)
+
+		_, _ = target.Write([]byte("response to " + string(data)))
+	}()
+
+	_, err := client.Write([]byte("request"))
+	require.NoError(t, err)
+
+	tcpClient, ok := client.(*net.TCPConn)
+	require.True(t, ok)
+	require.NoError(t, tcpClient.CloseWrite())
+
+	data, err := io.ReadAll(client)
+	require.NoError(t, err)
+	assert.Equal(t, "response to request", string(data))
+
+	select {
+	case <-doneCh:
+	case <-time.After(time.Second):
+		assert.Fail(t, "communication was not finished")
+	}
+}
+
+// blockingConn is a connection whose reads block until it is closed.
+type blockingConn struct {
+	net.Conn
+
+	closeOnce sync.Once
+	closeCh   chan struct{}
+}
+
+// newBlockingConn creates a new blocking connection.
+func newBlockingConn() *blockingConn {
+	return &blockingConn{
+		closeCh: make(chan struct{}),
+	}
+}
+
+// Read blocks until the connection is closed.
+func (bc *blockingConn) Read(_ []byte) (int, error) {
+	<-bc.closeCh
+
+	return 0, net.ErrClosed
+}
+
+// Write discards the data.
+func (bc *blockingConn) Write(b []byte) (int, error) {
+	return len(b), nil
+}
+
+// Close unblocks the reads.
+func (bc *blockingConn) Close() error {
+	bc.closeOnce.Do(func() {
+		close(bc.closeCh)
+	})
+
+	return nil
+}
+
+// SetDeadline does nothing.
+func (bc *blockingConn) SetDeadline(_ time.Time) error {
+	return nil
+}
+
+// panicConn is a connection whose reads panic.
+type panicConn struct {
+	*blockingConn
+}
+
+// Read panics.
+func (*panicConn) Read(_ []byte) (int, error) {
+	panic("read failure")
+}
+
+func Test_Proxy_establishCommunication_Panic(t *testing.T) {
+	var buffer bytes.Buffer
+
+	p := &Proxy{
+		log: slog.New(slog.NewTextHandler(&buffer, nil)),
+	}
+
+	base := newBlockingConn()
+	target := &panicConn{blockingConn: newBlockingConn()}
+
+	doneCh := make(chan struct{})
+
+	go func() {
+		defer close(doneCh)
+
+		p.establishCommunication(context.Background(), base, target, "example.com:443", "127.0.0.1:5000")
+	}()
+
+	select {
+	case <-doneCh:
+	case <-time.After(time.Second):
+		require.Fail(t, "communication goroutines were not stopped")
+	}
+
+	assert.Contains(
+		t,
+		buffer.String(),
+		`level=ERROR msg="handling base to target communication" target=example.com:443 client=127.0.0.1:5000 panic="read failure"`,
+	)
+}
+
+// errConn is a connection whose reads fail.
+type errConn struct {
+	*blockingConn
+}
+
+// Read returns an error.
+func (*errConn) Read(_ []byte) (int, error) {
+	return 0, assert.AnError
+}
+
+func Test_Proxy_establishCommunication_ErrorLog(t *testing.T) {
+	var buffer bytes.Buffer
+
+	p := &Proxy{
+		log: slog.New(slog.NewTextHandler(&buffer, nil)),
+	}
+
+	ctx := context.WithValue(context.Background(), requestIDKey{}, xid.New())
+
+	base := newBlockingConn()
+	target := &errConn{blockingConn: newBlockingConn()}
+
+	doneCh := make(chan struct{})
+
+	go func() {
+		defer close(doneCh)
+
+		p.establishCommunication(ctx, base, target, "example.com:443", "127.0.0.1:5000")
+	}()
+
+	select {
+	case <-doneCh:
+	case <-time.After(time.Second):
+		require.Fail(t, "communication goroutines were not stopped")
+	}
+
+	assert.Regexp(
+		t,
+		`level=ERROR msg="handling base to target communication" request_id=\w+ target=example.com:443 client=127.0.0.1:5000 error="assert.AnError general error for testing"`,
+		buffer.String(),
+	)
+}
+
+func Test_Proxy_establishCommunication_Unblock(t *testing.T) {
+	tests := map[string]struct {
+		Cancel bool
+		Target func() net.Conn
+	}{
+		"One of the directions failed": {
+			Target: func() net.Conn {
+				client, server := net.Pipe()
+				client.Close()
+
+				return server
+			},
+		},
+		"Context was cancelled": {
+			Cancel: true,
+			Target: func() net.Conn {
+				return newBlockingConn()
+			},
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			p := &Proxy{
+				log: slog.New(slog.NewTextHandler(io.Discard, nil)),
+			}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			base := newBlockingConn()
+			doneCh := make(chan struct{})
+
+			go func() {
+				defer close(doneCh)
+
+				p.establishCommunication(ctx, base, test.Target(), "example.com:443", "127.0.0.1:5000")
+			}()
+
+			if test.Cancel {
+				cancel()
+			}
+
+			select {
+			case <-doneCh:
+			case <-time.After(time.Second):
+				require.Fail(t, "communication goroutines were not stopped")
+			}
+
+			select {
+			case <-base.closeCh:
+			default:
+				assert.Fail(t, "base connection was not closed")
+			}
+		})
+	}
+}
+
+func Test_Proxy_tunnelTarget(t *testing.T) {
+	tests := map[string]struct {
+		Host     string
+		Override string
+		Enabled  bool
+		Addr     string
+		Error    error
+	}{
+		"Invalid request target": {
+			Host:     "example.com",
+			Override: "127.0.0.1:8443",
+			Enabled:  true,
+			Error:    errMissingPort,
+		},
+		"Override is turned off": {
+			Host:     "example.com:443",
+			Override: "127.0.0.1:8443",
+			Addr:     "example.com:443",
+		},
+		"Override header is missing": {
+			Host:    "example.com:443",
+			Enabled: true,
+			Addr:    "example.com:443",
+		},
+		"Override has no port": {
+			Host:     "example.com:443",
+			Override: "127.0.0.1",
+			Enabled:  true,
+			Error:    errMissingPort,
+		},
+		"Successfully overridden target": {
+			Host:     "example.com:443",
+			Override: "127.0.0.1:8443",
+			Enabled:  true,
+			Addr:     "127.0.0.1:8443",
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			p := &Proxy{}
+			p.cfg.TargetOverride = test.Enabled
+
+			r := httptest.NewRequest(http.MethodConnect, test.Host, http.NoBody)
+
+			if test.Override != "" {
+				r.Header.Set("X-Lwproxy-Target", test.Override)
+			}
+
+			addr, err := p.tunnelTarget(r)
+			assert.Equal(t, test.Error, err)
+			assert.Equal(t, test.Addr, addr)
+		})
+	}
+}
+
+func Test_Proxy_tunnelingHandler_TargetOverride(t *testing.T) {
+	target := startEchoServer(t)
+
+	var dialed atomic.Pointer[string]
+
+	p := &Proxy{
+		log:    slog.New(slog.NewTextHandler(io.Discard, nil)),
+		tracer: noop.NewTracerProvider().Tracer(""),
+		clock:  clock.New(),
+		dial: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			dialed.Store(&addr)
+
+			return (&net.Dialer{}).DialContext(ctx, network, addr)
+		},
+	}
+
+	p.cfg.TargetOverride = true
+
+	srv := httptest.NewServer(http.HandlerFunc(p.tunnelingHandler))
+	t.Cleanup(srv.Close)
+
+	conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+	require.NoError(t, err)
+
+	defer conn.Close()
+
+	_, err = fmt.Fprintf(
+		conn,
+		"CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\nX-Lwproxy-Target: %s\r\n\r\n",
+		target.Addr().String(),
+	)
+	require.NoError(t, err)
+
+	br := bufio.NewReader(conn)
+
+	resp, err := http.ReadResponse(br, nil)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	require.NotNil(t, dialed.Load())
+	assert.Equal(t, target.Addr().String(), *dialed.Load())
+
+	_, err = conn.Write([]byte("ping"))
+	require.NoError(t, err)
+
+	data := make([]byte, 4)
+
+	_, err = io.ReadFull(br, data)
+	require.NoError(t, err)
+	assert.Equal(t, "ping", string(data))
+}
+
+func Test_targetAddr(t *testing.T) {
+	tests := map[string]struct {
+		Method string
+		Host   string
+		Addr   string
+		Error  error
+	}{
+		"CONNECT target has no port": {
+			Method: http.MethodConnect,
+			Host:   "example.com",
+			Error:  errMissingPort,
+		},
+		"CONNECT target has a non numeric port": {
+			Method: http.MethodConnect,
+			Host:   "example.com:https",
+			Error:  errInvalidPort,
+		},
+		"CONNECT target has an out of range port": {
+			Method: http.MethodConnect,
+			Host:   "example.com:70000",
+			Error:  errInvalidPort,
+		},
+		"CONNECT target has no host": {
+			Method: http.MethodConnect,
+			Host:   ":443",
+			Error:  errMissingHost,
+		},
+		"Successfully returned CONNECT target address": {
+			Method: http.MethodConnect,
+			Host:   "example.com:443",
+			Addr:   "example.com:443",
+		},
+		"Successfully returned CONNECT IPv6 target address": {
+			Method: http.MethodConnect,
+			Host:   "[2001:db8::1]:443",
+			Addr:   "[2001:db8::1]:443",
+		},
+		"Successfully returned HTTP target address with a default port": {
+			Method: http.MethodGet,
+			Host:   "example.com",
+			Addr:   "example.com:80",
+		},
+		"Successfully returned HTTP target address": {
+			Method: http.MethodGet,
+			Host:   "example.com:8080",
+			Addr:   "example.com:8080",
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			addr, err := targetAddr(&http.Request{
+				Method: test.Method,
+				Host:   test.Host,
+			})
+			assert.Equal(t, test.Error, err)
+			assert.Equal(t, test.Addr, addr)
+		})
+	}
+}
+
+func Test_Proxy_loopTarget(t *testing.T) {
+	tests := map[string]struct {
+		ListenAddr net.Addr
+		Target     string
+		Result     bool
+	}{
+		"Proxy is not listening": {
+			Target: "127.0.0.1:8081",
+		},
+		"Proxy listens on a unix socket": {
+			ListenAddr: &net.UnixAddr{Name: "/tmp/lwproxy.sock", Net: "unix"},
+			Target:     "127.0.0.1:8081",
+		},
+		"Target port differs": {
+			ListenAddr: &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 8081},
+			Target:     "127.0.0.1:8082",
+		},
+		"Target host cannot be resolved": {
+			ListenAddr: &net.TCPAddr{IP: net.IPv4zero, Port: 8081},
+			Target:     "lwproxy.invalid:8081",
+		},
+		"Target IP differs": {
+			ListenAddr: &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 8081},
+			Target:     "127.0.0.2:8081",
+		},
+		"Target IP is the listening IP": {
+			ListenAddr: &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 8081},
+			Target:     "127.0.0.1:8081",
+			Result:     true,
+		},
+		"Target is a loopback address of an unspecified listening IP": {
+			ListenAddr: &net.TCPAddr{IP: net.IPv6unspecified, Port: 8081},
+			Target:     "[::1]:8081",
+			Result:     true,
+		},
+		"Target resolves to a loopback address": {
+			ListenAddr: &net.TCPAddr{IP: net.IPv4zero, Port: 8081},
+			Target:     "localhost:8081",
+			Result:     true,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			p := &Proxy{}
+			p.setAddr(test.ListenAddr)
+
+			assert.Equal(t, test.Result, p.loopTarget(context.Background(), test.Target))
+		})
+	}
+}
+
+func Test_Proxy_loopTarget_Dial(t *testing.T) {
+	var dialed atomic.Bool
+
+	p, err := NewProxy(
+		slog.New(slog.NewTextHandler(io.Discard, nil)),
+		testConfig(),
+		WithDial(func(_ context.Context, _, _ string) (net.Conn, error) {
+			dialed.Store(true)
+			return nil, assert.AnError
+		}),
+	)
+	require.NoError(t, err)
+
+	p.setAddr(&net.TCPAddr{IP: net.IPv4zero, Port: 8081})
+
+	assert.False(t, p.loopTarget(context.Background(), "lwproxy.example:8081"))
+	assert.True(t, dialed.Load())
+}
+
+func Test_Proxy_Loop(t *testing.T) {
+	p, err := NewProxy(
+		slog.New(slog.NewTextHandler(io.Discard, nil)),
+		testConfig(),
+		WithRecorder(&RecorderMock{
+			HandleFunc: func(_ request.Record) error {
+				return nil
+			},
+		}),
+	)
+	require.NoError(t, err)
+
+	go func() {
+		_ = p.ListenAndServe(context.Background())
+	}()
+
+	t.Cleanup(func() {
+		_ = p.Close()
+	})
+
+	require.Eventually(t, func() bool {
+		return p.Addr() != nil
+	}, time.Second, 10*time.Millisecond)
+
+	addr := p.Addr().String()
+
+	for _, target := range []string{
+		fmt.Sprintf("CONNECT %[1]s HTTP/1.1\r\nHost: %[1]s\r\n", addr),
+		fmt.Sprintf("GET http://%[1]s/path HTTP/1.1\r\nHost: %[1]s\r\n", addr),
+	} {
+		conn, err := net.Dial("tcp", addr)
+		require.NoError(t, err)
+
+		_, err = fmt.Fprintf(conn, "%sProxy-Authorization: Basic dXNlcjpwYXNz\r\n\r\n", target)
+		require.NoError(t, err)
+
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusMisdirectedRequest, resp.StatusCode)
+
+		require.NoError(t, conn.Close())
+	}
+}
+
+func Test_Proxy_tunnelingHandler_ConnectEstablishTimeout(t *testing.T) {
+	// NOTE: The silent target accepts the connections, but never
+	// responds.
+	silent, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	t.Cleanup(func() {
+		silent.Close()
+	})
+
+	go func() {
+		for {
+			conn, err := silent.Accept()
+			if err != nil {
+				return
+			}
+
+			t.Cleanup(func() {
+				conn.Close()
+			})
+		}
+	}()
+
+	echo := startEchoServer(t)
+
+	p := &Proxy{
+		log:    slog.New(slog.NewTextHandler(io.Discard, nil)),
+		tracer: noop.NewTracerProvider().Tracer(""),
+		clock:  clock.New(),
+		dial:   (&net.Dialer{}).DialContext,
+	}
+
+	p.cfg.ConnectEstablishTimeout = 100 * time.Millisecond
+
+	srv := httptest.NewServer(http.HandlerFunc(p.tunnelingHandler))
+	t.Cleanup(srv.Close)
+
+	connect := func(target string) (net.Conn, *bufio.Reader) {
+		conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+		require.NoError(t, err)
+
+		t.Cleanup(func() {
+			conn.Close()
+		})
+
+		_, err = fmt.Fprintf(conn, "CONNECT %[1]s HTTP/1.1\r\nHost: %[1]s\r\n\r\n", target)
+		require.NoError(t, err)
+
+		br := bufio.NewReader(conn)
+
+		resp, err := http.ReadResponse(br, nil)
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+		return conn, br
+	}
+
+	// target never responds
+	conn, br := connect(silent.Addr().String())
+
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(time.Second)))
+
+	start := time.Now()
+
+	_, err = br.ReadByte()
+	assert.ErrorIs(t, err, io.EOF)
+	assert.Less(t, time.Since(start), time.Second)
+
+	// target responds in time
+	conn, br = connect(echo.Addr().String())
+
+	_, err = conn.Write([]byte("ping"))
+	require.NoError(t, err)
+
+	data := make([]byte, 4)
+
+	_, err = io.ReadFull(br, data)
+	require.NoError(t, err)
+
+	time.Sleep(200 * time.Millisecond)
+
+	_, err = conn.Write([]byte("pong"))
+	require.NoError(t, err)
+
+	_, err = io.ReadFull(br, data)
+	require.NoError(t, err)
+	assert.Equal(t, "pong", string(data))
+}
+
+// manualClock is a clock which timer fires only when a time is sent to
+// its channel.
+type manualClock struct {
+	clock.Real
+
+	timer *manualTimer
+}
+
+// NewTimer returns the manual timer.
+func (mc manualClock) NewTimer(_ time.Duration) clock.Timer { //nolint: ireturn // the timer is swapped in tests.
+	return mc.timer
+}
+
+// manualTimer is a timer that fires when a time is sent to its channel.
+type manualTimer struct {
+	ch      chan time.Time
+	stopped atomic.Bool
+}
+
+// C returns the timer channel.
+func (mt *manualTimer) C() <-chan time.Time {
+	return mt.ch
+}
+
+// Stop marks the timer as stopped.
+func (mt *manualTimer) Stop() bool {
+	return !mt.stopped.Swap(true)
+}
+
+// Reset does nothing as the timer fires only when a time is sent to its
+// channel.
+func (mt *manualTimer) Reset(_ time.Duration) bool {
+	return !mt.stopped.Load()
+}
+
+func Test_Proxy_newEstablishConn(t *testing.T) {
+	tests := map[string]struct {
+		Fire bool
+	}{
+		"Connection is closed once the timer fires": {
+			Fire: true,
+		},
+		"Timer is stopped once the first bytes are received": {},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			timer := &manualTimer{ch: make(chan time.Time, 1)}
+
+			p := &Proxy{
+				log:   slog.New(slog.NewTextHandler(io.Discard, nil)),
+				clock: manualClock{timer: timer},
+			}
+
+			target, peer := net.Pipe()
+
+			defer peer.Close()
+
+			ec := p.newEstablishConn(context.Background(), target, time.Hour)
+
+			if test.Fire {
+				timer.ch <- time.Now()
+
+				_, err := peer.Read(make([]byte, 1))
+				assert.ErrorIs(t, err, io.EOF)
+
+				return
+			}
+
+			go func() {
+				_, _ = peer.Write([]byte("x"))
+			}()
+
+			n, err := ec.Read(make([]byte, 1))
+			require.NoError(t, err)
+			assert.Equal(t, 1, n)
+			assert.True(t, timer.stopped.Load())
+
+			require.NoError(t, ec.Close())
+		})
+	}
+}
@@ -0,0 +1,147 @@
+// Code generated by moq; DO NOT EDIT.
+// github.com/matryer/moq
+
+package batch
+
+import (
+	"github.com/davseby/lwproxy/internal/request"
+	"sync"
+)
+
+// Ensure, that SinkMock does implement Sink.
+// If this is not the case, regenerate this file with moq.
+var _ Sink = &SinkMock{}
+
+// SinkMock is a mock implementation of Sink.
+//
+//	func TestSomethingThatUsesSink(t *testing.T) {
+//
+//		// make and configure a mocked Sink
+//		mockedSink := &SinkMock{
+//			HandleBatchFunc: func(recs []request.Record) error {
+//				panic("mock out the HandleBatch method")
+//			},
+//		}
+//
+//		// use mockedSink in code that requires Sink
+//		// and then make assertions.
+//
+//	}
+type SinkMock struct {
+	// HandleBatchFunc mocks the HandleBatch method.
+	HandleBatchFunc func(recs []request.Record) error
+
+	// calls tracks calls to the methods.
+	calls struct {
+		// HandleBatch holds details about calls to the HandleBatch method.
+		HandleBatch []struct {
+			// Recs is the recs argument value.
+			Recs []request.Record
+		}
+	}
+	lockHandleBatch sync.RWMutex
+}
+
+// HandleBatch calls HandleBatchFunc.
+func (mock *SinkMock) HandleBatch(recs []request.Record) error {
+	callInfo := struct {
+		Recs []request.Record
+	}{
+		Recs: recs,
+	}
+	mock.lockHandleBatch.Lock()
+	mock.calls.HandleBatch = append(mock.calls.HandleBatch, callInfo)
+	mock.lockHandleBatch.Unlock()
+	if mock.HandleBatchFunc == nil {
+		var (
+			errOut error
+		)
+		return errOut
+	}
+	return mock.HandleBatchFunc(recs)
+}
+
+// HandleBatchCalls gets all the calls that were made to HandleBatch.
+// Check the length with:
+//
+//	len(mockedSink.HandleBatchCalls())
+func (mock *SinkMock) HandleBatchCalls() []struct {
+	Recs []request.Record
+} {
+	var calls []struct {
+		Recs []request.Record
+	}
+	mock.lockHandleBatch.RLock()
+	calls = mock.calls.HandleBatch
+	mock.lockHandleBatch.RUnlock()
+	return calls
+}
+
+// Ensure, that HandlerMock does implement Handler.
+// If this is not the case, regenerate this file with moq.
+var _ Handler = &HandlerMock{}
+
+// HandlerMock is a mock implementation of Handler.
+//
+//	func TestSomethingThatUsesHandler(t *testing.T) {
+//
+//		// make and configure a mocked Handler
+//		mockedHandler := &HandlerMock{
+//			HandleFunc: func(rec request.Record) error {
+//				panic("mock out the Handle method")
+//			},
+//		}
+//
+//		// use mockedHandler in code that requires Handler
+//		// and then make assertions.
+//
+//	}
+type HandlerMock struct {
+	// HandleFunc mocks the Handle method.
+	HandleFunc func(rec request.Record) error
+
+	// calls tracks calls to the methods.
+	calls struct {
+		// Handle holds details about calls to the Handle method.
+		Handle []struct {
+			// Rec is the rec argument value.
+			Rec request.Record
+		}
+	}
+	lockHandle sync.RWMutex
+}
+
+// Handle calls HandleFunc.
+func (mock *HandlerMock) Handle(rec request.Record) error {
+	callInfo := struct {
+		Rec request.Record
+	}{
+		Rec: rec,
+	}
+	mock.lockHandle.Lock()
+	mock.calls.Handle = append(mock.calls.Handle, callInfo)
+	mock.lockHandle.Unlock()
+	if mock.HandleFunc == nil {
+		var (
+			errOut error
+		)
+		return errOut
+	}
+	return mock.HandleFunc(rec)
+}
+
+// HandleCalls gets all the calls that were made to Handle.
+// Check the length with:
+//
+//	len(mockedHandler.HandleCalls())
+func (mock *HandlerMock) HandleCalls() []struct {
+	Rec request.Record
+} {
+	var calls []struct {
+		Rec request.Record
+	}
+	mock.lockHandle.RLock()
+	calls = mock.calls.Handle
+	mock.lockHandle.RUnlock()
+	return calls
+}
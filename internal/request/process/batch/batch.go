@@ -0,0 +1,208 @@
+// Package batch implements a request processor that collects requests and
+// passes them to a batch capable sink.
+//
+//go:generate moq --stub -out 0moq_test.go . Sink:SinkMock Handler:HandlerMock
+package batch
+
+import (
+	"errors"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/davseby/lwproxy/internal/request"
+	"golang.org/x/exp/slog"
+)
+
+// ErrClosed is returned when a record is handled after the processor is
+// closed.
+var ErrClosed = errors.New("batch processor is closed")
+
+// Processor is a requests processor that collects the records and passes
+// them to the sink in batches. A batch is flushed once it reaches the
+// batch size or the flush interval elapses. The processor must be closed
+// after the proxy is stopped, so that the remaining records are flushed.
+type Processor struct {
+	log  *slog.Logger
+	sink Sink
+
+	size int
+
+	mu      sync.Mutex
+	records []request.Record
+	closed  bool
+
+	flushCh chan struct{}
+	stopCh  chan struct{}
+	doneCh  chan struct{}
+}
+
+// NewProcessor creates a new request processor and starts its flushing
+// worker. Size is the number of records after which a batch is flushed
+// and interval is the maximum time the records wait for a flush. Sizes
+// lower than one flush every record and non-positive interval turns the
+// time based flushing off.
+func NewProcessor(log *slog.Logger, sink Sink, size int, interval time.Duration) *Processor {
+	p := &Processor{
+		log:     log.With("job", "requests-batch-processor"),
+		sink:    sink,
+		size:    max(size, 1),
+		flushCh: make(chan struct{}, 1),
+		stopCh:  make(chan struct{}),
+		doneCh:  make(chan struct{}),
+	}
+
+	go p.run(interval)
+
+	return p
+}
+
+// Handle queues the record for the next batch.
+func (p *Processor) Handle(rec request.Record) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closed {
+		return ErrClosed
+	}
+
+	p.records = append(p.records, rec)
+
+	if len(p.records) >= p.size {
+		select {
+		case p.flushCh <- struct{}{}:
+		default:
+		}
+	}
+
+	return nil
+}
+
+// Close stops the worker, flushes the remaining records and closes the
+// sink, if it can be closed. It is safe to call Close multiple times.
+func (p *Processor) Close() error {
+	p.mu.Lock()
+
+	if p.closed {
+		p.mu.Unlock()
+		return nil
+	}
+
+	p.closed = true
+	p.mu.Unlock()
+
+	close(p.stopCh)
+	<-p.doneCh
+
+	if closer, ok := p.sink.(io.Closer); ok {
+		return closer.Close()
+	}
+
+	return nil
+}
+
+// run flushes the batches until the processor is closed.
+func (p *Processor) run(interval time.Duration) {
+	defer close(p.doneCh)
+
+	var tickCh <-chan time.Time
+
+	if interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		tickCh = ticker.C
+	}
+
+	for {
+		select {
+		case <-p.stopCh:
+			p.flush(true)
+			return
+		case <-p.flushCh:
+			p.flush(false)
+		case <-tickCh:
+			p.flush(true)
+		}
+	}
+}
+
+// flush passes the queued records to the sink in batches of at most the
+// batch size. The last incomplete batch is flushed only if partial is
+// true, otherwise it is kept for the next flush.
+func (p *Processor) flush(partial bool) {
+	p.mu.Lock()
+
+	n := len(p.records)
+	if !partial {
+		n -= n % p.size
+	}
+
+	records := p.records[:n:n]
+	p.records = append([]request.Record(nil), p.records[n:]...)
+	p.mu.Unlock()
+
+	for len(records) > 0 {
+		n := min(len(records), p.size)
+
+		if err := p.sink.HandleBatch(records[:n]); err != nil {
+			p.log.Error(
+				"handling request records batch",
+				slog.Int("records", n),
+				slog.String("error", err.Error()),
+			)
+		}
+
+		records = records[n:]
+	}
+}
+
+// HandlerSink is a sink that passes the batch records to the handler one
+// by one. It allows batching the records of the handlers that are not
+// batch capable, so that the records are handled off the request path.
+type HandlerSink struct {
+	handler Handler
+}
+
+// NewHandlerSink creates a new sink that passes the records to the
+// handler.
+func NewHandlerSink(handler Handler) *HandlerSink {
+	return &HandlerSink{
+		handler: handler,
+	}
+}
+
+// HandleBatch passes the records to the handler. The remaining records
+// are still passed when the handler fails.
+func (hs *HandlerSink) HandleBatch(recs []request.Record) error {
+	var errs []error
+
+	for _, rec := range recs {
+		if err := hs.handler.Handle(rec); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// Close closes the handler, if it can be closed.
+func (hs *HandlerSink) Close() error {
+	if closer, ok := hs.handler.(io.Closer); ok {
+		return closer.Close()
+	}
+
+	return nil
+}
+
+// Sink should be used to handle the request records in batches.
+type Sink interface {
+	// HandleBatch should handle the batch of records.
+	HandleBatch(recs []request.Record) error
+}
+
+// Handler should be used to handle the request records one by one.
+type Handler interface {
+	// Handle should handle a single record.
+	Handle(rec request.Record) error
+}
@@ -0,0 +1,224 @@
+package batch
+
+import (
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/davseby/lwproxy/internal/request"
+	"github.com/rs/xid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/exp/slog"
+)
+
+// recordingSink returns a sink that collects the handled batches.
+func recordingSink(err error) (*SinkMock, func() [][]request.Record) {
+	var (
+		mu      sync.Mutex
+		batches [][]request.Record
+	)
+
+	sink := &SinkMock{
+		HandleBatchFunc: func(recs []request.Record) error {
+			mu.Lock()
+			defer mu.Unlock()
+
+			batches = append(batches, append([]request.Record(nil), recs...))
+
+			return err
+		},
+	}
+
+	return sink, func() [][]request.Record {
+		mu.Lock()
+		defer mu.Unlock()
+
+		return batches
+	}
+}
+
+// newRecords creates the given number of request records.
+func newRecords(n int) []request.Record {
+	recs := make([]request.Record, n)
+
+	for i := range recs {
+		recs[i] = request.Record{ID: xid.New(), Host: "example.com"}
+	}
+
+	return recs
+}
+
+func Test_NewProcessor(t *testing.T) {
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+	sink := &SinkMock{}
+
+	proc := NewProcessor(log, sink, 10, time.Second)
+	require.NotNil(t, proc)
+	assert.Equal(t, log.With("job", "requests-batch-processor"), proc.log)
+	assert.Same(t, sink, proc.sink)
+	assert.Equal(t, 10, proc.size)
+	require.NoError(t, proc.Close())
+
+	// invalid size
+	proc = NewProcessor(log, sink, 0, 0)
+	assert.Equal(t, 1, proc.size)
+	require.NoError(t, proc.Close())
+}
+
+func Test_Processor_Handle_Size(t *testing.T) {
+	sink, batches := recordingSink(nil)
+
+	proc := NewProcessor(slog.New(slog.NewTextHandler(io.Discard, nil)), sink, 2, time.Hour)
+
+	defer proc.Close()
+
+	recs := newRecords(3)
+
+	for _, rec := range recs {
+		require.NoError(t, proc.Handle(rec))
+	}
+
+	require.Eventually(t, func() bool {
+		return len(batches()) == 1
+	}, time.Second, 10*time.Millisecond)
+
+	assert.Equal(t, [][]request.Record{recs[:2]}, batches())
+}
+
+func Test_Processor_Handle_Interval(t *testing.T) {
+	sink, batches := recordingSink(nil)
+
+	proc := NewProcessor(slog.New(slog.NewTextHandler(io.Discard, nil)), sink, 100, 50*time.Millisecond)
+
+	defer proc.Close()
+
+	recs := newRecords(3)
+
+	for _, rec := range recs {
+		require.NoError(t, proc.Handle(rec))
+	}
+
+	require.Eventually(t, func() bool {
+		return len(batches()) == 1
+	}, time.Second, 10*time.Millisecond)
+
+	assert.Equal(t, [][]request.Record{recs}, batches())
+}
+
+func Test_Processor_Close(t *testing.T) {
+	sink, batches := recordingSink(assert.AnError)
+
+	proc := NewProcessor(slog.New(slog.NewTextHandler(io.Discard, nil)), sink, 2, 0)
+
+	// NOTE: The worker is blocked, so that all records are flushed only
+	// on close.
+	proc.mu.Lock()
+
+	recs := newRecords(5)
+
+	proc.records = append(proc.records, recs...)
+	proc.mu.Unlock()
+
+	require.NoError(t, proc.Close())
+	assert.Equal(t, [][]request.Record{recs[:2], recs[2:4], recs[4:]}, batches())
+
+	// closed
+	assert.ErrorIs(t, proc.Handle(recs[0]), ErrClosed)
+	require.NoError(t, proc.Close())
+	assert.Len(t, batches(), 3)
+}
+
+func Test_Processor_Close_Sink(t *testing.T) {
+	handler := &closableHandler{HandlerMock: &HandlerMock{}}
+
+	proc := NewProcessor(slog.New(slog.NewTextHandler(io.Discard, nil)), NewHandlerSink(handler), 10, 0)
+
+	recs := newRecords(2)
+
+	for _, rec := range recs {
+		require.NoError(t, proc.Handle(rec))
+	}
+
+	assert.ErrorIs(t, proc.Close(), assert.AnError)
+	assert.True(t, handler.closed)
+	assert.Len(t, handler.HandleCalls(), 2)
+}
+
+// closableHandler is a handler that can be closed.
+type closableHandler struct {
+	*HandlerMock
+
+	closed bool
+}
+
+// Close marks the handler as closed.
+func (ch *closableHandler) Close() error {
+	ch.closed = true
+
+	return assert.AnError
+}
+
+func Test_NewHandlerSink(t *testing.T) {
+	handler := &HandlerMock{}
+
+	hs := NewHandlerSink(handler)
+	require.NotNil(t, hs)
+	assert.Same(t, handler, hs.handler)
+}
+
+func Test_HandlerSink_HandleBatch(t *testing.T) {
+	recs := newRecords(3)
+
+	tests := map[string]struct {
+		Error  error
+		Result error
+	}{
+		"All records are handled": {},
+		"Remaining records are handled after a failure": {
+			Error:  assert.AnError,
+			Result: assert.AnError,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			handler := &HandlerMock{
+				HandleFunc: func(rec request.Record) error {
+					if rec.ID == recs[0].ID {
+						return test.Error
+					}
+
+					return nil
+				},
+			}
+
+			err := NewHandlerSink(handler).HandleBatch(recs)
+			if test.Result != nil {
+				assert.ErrorIs(t, err, test.Result)
+			} else {
+				assert.NoError(t, err)
+			}
+
+			require.Len(t, handler.HandleCalls(), 3)
+
+			for i, call := range handler.HandleCalls() {
+				assert.Equal(t, recs[i], call.Rec)
+			}
+		})
+	}
+}
+
+func Test_HandlerSink_Close(t *testing.T) {
+	// handler without close
+	assert.NoError(t, NewHandlerSink(&HandlerMock{}).Close())
+
+	// closable handler
+	handler := &closableHandler{HandlerMock: &HandlerMock{}}
+
+	assert.ErrorIs(t, NewHandlerSink(handler).Close(), assert.AnError)
+	assert.True(t, handler.closed)
+}
@@ -0,0 +1,46 @@
+// Package multi implements a request processor that passes requests to
+// multiple processors.
+//
+//go:generate moq --stub -out 0moq_test.go . Handler:HandlerMock
+package multi
+
+import (
+	"errors"
+
+	"github.com/davseby/lwproxy/internal/request"
+)
+
+// Processor is a requests processor that passes every record to all of
+// its processors.
+type Processor struct {
+	handlers []Handler
+}
+
+// NewProcessor creates a new request processor that fans records out to
+// the provided handlers.
+func NewProcessor(handlers ...Handler) *Processor {
+	return &Processor{
+		handlers: handlers,
+	}
+}
+
+// Handle passes the record to every handler. A failing handler does not
+// prevent the remaining handlers from receiving the record, all of the
+// encountered errors are joined and returned.
+func (p *Processor) Handle(rec request.Record) error {
+	var errs []error
+
+	for _, h := range p.handlers {
+		if err := h.Handle(rec); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// Handler should be used to handle request records.
+type Handler interface {
+	// Handle should handle a new record.
+	Handle(rec request.Record) error
+}
@@ -0,0 +1,94 @@
+package multi
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/davseby/lwproxy/internal/request"
+	"github.com/rs/xid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_NewProcessor(t *testing.T) {
+	h1 := &HandlerMock{}
+	h2 := &HandlerMock{}
+
+	proc := NewProcessor(h1, h2)
+	require.NotNil(t, proc)
+	assert.Equal(t, []Handler{h1, h2}, proc.handlers)
+}
+
+func Test_Processor_Handle(t *testing.T) {
+	stubHandler := func(err error) *HandlerMock {
+		return &HandlerMock{
+			HandleFunc: func(_ request.Record) error {
+				return err
+			},
+		}
+	}
+
+	errSecond := errors.New("second")
+
+	tests := map[string]struct {
+		Handlers []*HandlerMock
+		Errors   []error
+	}{
+		"No handlers": {},
+		"All handlers succeeded": {
+			Handlers: []*HandlerMock{
+				stubHandler(nil),
+				stubHandler(nil),
+			},
+		},
+		"One of the handlers failed": {
+			Handlers: []*HandlerMock{
+				stubHandler(assert.AnError),
+				stubHandler(nil),
+			},
+			Errors: []error{assert.AnError},
+		},
+		"All handlers failed": {
+			Handlers: []*HandlerMock{
+				stubHandler(assert.AnError),
+				stubHandler(errSecond),
+			},
+			Errors: []error{assert.AnError, errSecond},
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			handlers := make([]Handler, 0, len(test.Handlers))
+
+			for _, h := range test.Handlers {
+				handlers = append(handlers, h)
+			}
+
+			rec := request.Record{
+				ID:        xid.New(),
+				Host:      "example.com",
+				CreatedAt: time.Now(),
+			}
+
+			err := NewProcessor(handlers...).Handle(rec)
+
+			if len(test.Errors) == 0 {
+				require.NoError(t, err)
+			}
+
+			for _, e := range test.Errors {
+				assert.ErrorIs(t, err, e)
+			}
+
+			for _, h := range test.Handlers {
+				calls := h.HandleCalls()
+				require.Len(t, calls, 1)
+				assert.Equal(t, rec, calls[0].Rec)
+			}
+		})
+	}
+}
@@ -0,0 +1,17 @@
+// Package noop implements a request processor that discards requests.
+package noop
+
+import "github.com/davseby/lwproxy/internal/request"
+
+// Processor is a requests processor that discards all requests.
+type Processor struct{}
+
+// NewProcessor creates a new request processor.
+func NewProcessor() *Processor {
+	return &Processor{}
+}
+
+// Handle discards the record.
+func (*Processor) Handle(_ request.Record) error {
+	return nil
+}
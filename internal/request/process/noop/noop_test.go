@@ -0,0 +1,20 @@
+package noop
+
+import (
+	"testing"
+
+	"github.com/davseby/lwproxy/internal/clock"
+	"github.com/davseby/lwproxy/internal/request"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_NewProcessor(t *testing.T) {
+	require.NotNil(t, NewProcessor())
+}
+
+func Test_Processor_Handle(t *testing.T) {
+	proc := &Processor{}
+
+	assert.NoError(t, proc.Handle(request.NewRecord(clock.New(), "example.com")))
+}
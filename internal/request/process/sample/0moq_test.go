@@ -0,0 +1,78 @@
+// Code generated by moq; DO NOT EDIT.
+// github.com/matryer/moq
+
+package sample
+
+import (
+	"github.com/davseby/lwproxy/internal/request"
+	"sync"
+)
+
+// Ensure, that HandlerMock does implement Handler.
+// If this is not the case, regenerate this file with moq.
+var _ Handler = &HandlerMock{}
+
+// HandlerMock is a mock implementation of Handler.
+//
+//	func TestSomethingThatUsesHandler(t *testing.T) {
+//
+//		// make and configure a mocked Handler
+//		mockedHandler := &HandlerMock{
+//			HandleFunc: func(rec request.Record) error {
+//				panic("mock out the Handle method")
+//			},
+//		}
+//
+//		// use mockedHandler in code that requires Handler
+//		// and then make assertions.
+//
+//	}
+type HandlerMock struct {
+	// HandleFunc mocks the Handle method.
+	HandleFunc func(rec request.Record) error
+
+	// calls tracks calls to the methods.
+	calls struct {
+		// Handle holds details about calls to the Handle method.
+		Handle []struct {
+			// Rec is the rec argument value.
+			Rec request.Record
+		}
+	}
+	lockHandle sync.RWMutex
+}
+
+// Handle calls HandleFunc.
+func (mock *HandlerMock) Handle(rec request.Record) error {
+	callInfo := struct {
+		Rec request.Record
+	}{
+		Rec: rec,
+	}
+	mock.lockHandle.Lock()
+	mock.calls.Handle = append(mock.calls.Handle, callInfo)
+	mock.lockHandle.Unlock()
+	if mock.HandleFunc == nil {
+		var (
+			errOut error
+		)
+		return errOut
+	}
+	return mock.HandleFunc(rec)
+}
+
+// HandleCalls gets all the calls that were made to Handle.
+// Check the length with:
+//
+//	len(mockedHandler.HandleCalls())
+func (mock *HandlerMock) HandleCalls() []struct {
+	Rec request.Record
+} {
+	var calls []struct {
+		Rec request.Record
+	}
+	mock.lockHandle.RLock()
+	calls = mock.calls.Handle
+	mock.lockHandle.RUnlock()
+	return calls
+}
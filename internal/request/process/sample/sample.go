@@ -0,0 +1,47 @@
+// Package sample implements a request processor that passes only a sample
+// of requests to another handler.
+//
+//go:generate moq --stub -out 0moq_test.go . Handler:HandlerMock
+package sample
+
+import (
+	"sync/atomic"
+
+	"github.com/davseby/lwproxy/internal/request"
+)
+
+// Processor is a requests processor that passes only every Nth record to
+// the handler and drops the rest, which reduces the recording load of
+// high-volume proxies. The sampling is deterministic, so exactly one of N
+// records is passed.
+type Processor struct {
+	handler Handler
+	every   uint64
+	count   atomic.Uint64
+}
+
+// NewProcessor creates a new request processor that passes one of every
+// records to the handler, starting with the first one. Values lower than
+// two pass all records.
+func NewProcessor(handler Handler, every int) *Processor {
+	return &Processor{
+		handler: handler,
+		every:   uint64(max(every, 1)), //nolint: gosec // the value is positive.
+	}
+}
+
+// Handle passes the record to the handler if it is sampled, otherwise the
+// record is dropped.
+func (p *Processor) Handle(rec request.Record) error {
+	if (p.count.Add(1)-1)%p.every != 0 {
+		return nil
+	}
+
+	return p.handler.Handle(rec)
+}
+
+// Handler should be used to handle request records.
+type Handler interface {
+	// Handle should handle a new record.
+	Handle(rec request.Record) error
+}
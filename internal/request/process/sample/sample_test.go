@@ -0,0 +1,83 @@
+package sample
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/davseby/lwproxy/internal/request"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_NewProcessor(t *testing.T) {
+	h := &HandlerMock{}
+
+	proc := NewProcessor(h, 10)
+	require.NotNil(t, proc)
+	assert.Same(t, h, proc.handler)
+	assert.Equal(t, uint64(10), proc.every)
+
+	// NOTE: Non-positive values pass all records.
+	assert.Equal(t, uint64(1), NewProcessor(h, 0).every)
+	assert.Equal(t, uint64(1), NewProcessor(h, -5).every)
+}
+
+func Test_Processor_Handle(t *testing.T) {
+	tests := map[string]struct {
+		Every   int
+		Records int
+		Handled int
+	}{
+		"All records are passed": {
+			Every:   1,
+			Records: 1000,
+			Handled: 1000,
+		},
+		"Every tenth record is passed": {
+			Every:   10,
+			Records: 1000,
+			Handled: 100,
+		},
+		"First record of an incomplete sample is passed": {
+			Every:   3,
+			Records: 10,
+			Handled: 4,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			h := &HandlerMock{}
+			proc := NewProcessor(h, test.Every)
+
+			var wg sync.WaitGroup
+
+			for range test.Records {
+				wg.Add(1)
+
+				go func() {
+					defer wg.Done()
+
+					assert.NoError(t, proc.Handle(request.Record{Host: "example.com"}))
+				}()
+			}
+
+			wg.Wait()
+
+			assert.Len(t, h.HandleCalls(), test.Handled)
+		})
+	}
+
+	// error
+	h := &HandlerMock{
+		HandleFunc: func(_ request.Record) error {
+			return assert.AnError
+		},
+	}
+
+	proc := NewProcessor(h, 2)
+	assert.ErrorIs(t, proc.Handle(request.Record{}), assert.AnError)
+	assert.NoError(t, proc.Handle(request.Record{}))
+}
@@ -3,30 +3,128 @@
 package stdout
 
 import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
 	"github.com/davseby/lwproxy/internal/request"
 	"golang.org/x/exp/slog"
 )
 
-// Processor is a requests processor that uses standard output to log
-// requests.
+// Format is the output format of the request records.
+type Format string
+
+const (
+	// FormatText logs the records with the provided logger, so that they
+	// have the format of the application logs.
+	FormatText Format = "text"
+
+	// FormatJSON writes every record as a single line JSON object,
+	// regardless of the application logs format.
+	FormatJSON Format = "json"
+)
+
+// Processor is a requests processor that writes the request records to
+// the provided output, e.g. standard output or the application logs file.
 type Processor struct {
-	log *slog.Logger
+	log    *slog.Logger
+	format Format
+
+	mu  sync.Mutex
+	out io.Writer
 }
 
-// NewProcessor creates a new request processor.
-func NewProcessor(log *slog.Logger) *Processor {
-	return &Processor{
-		log: log.With("job", "requests-stdout-processor"),
+// NewProcessor creates a new request processor that outputs the records
+// in the provided format. Empty format is the same as FormatText. The
+// FormatJSON records are written to out, which should be the output of
+// the logger, so that both formats end up in the same place.
+func NewProcessor(log *slog.Logger, out io.Writer, format Format) (*Processor, error) {
+	switch format {
+	case "":
+		format = FormatText
+	case FormatText, FormatJSON:
+	default:
+		return nil, fmt.Errorf("unsupported stdout format %q", format)
 	}
+
+	return &Processor{
+		log:    log.With("job", "requests-stdout-processor"),
+		format: format,
+		out:    out,
+	}, nil
 }
 
 // Handle handles a new record.
 func (p *Processor) Handle(rec request.Record) error {
-	p.log.Info(
-		"publishing request record",
+	if p.format == FormatJSON {
+		return p.writeJSON(rec)
+	}
+
+	attrs := []any{
 		slog.String("id", rec.ID.String()),
 		slog.String("host", rec.Host),
-	)
+		slog.Bool("tunnel", rec.Tunnel),
+	}
+
+	if rec.SNI != "" {
+		attrs = append(attrs, slog.String("sni", rec.SNI))
+	}
+
+	if rec.Method != "" {
+		attrs = append(attrs, slog.String("method", rec.Method))
+	}
+
+	if rec.Path != "" {
+		attrs = append(attrs, slog.String("path", rec.Path))
+	}
+
+	if rec.Instance != "" {
+		attrs = append(attrs, slog.String("instance", rec.Instance))
+	}
+
+	p.log.Info("publishing request record", attrs...)
+
+	return nil
+}
+
+// jsonRecord is the JSON representation of a request record.
+type jsonRecord struct {
+	ID        string    `json:"id"`
+	Host      string    `json:"host"`
+	Tunnel    bool      `json:"tunnel"`
+	SNI       string    `json:"sni,omitempty"`
+	Method    string    `json:"method,omitempty"`
+	Path      string    `json:"path,omitempty"`
+	Instance  string    `json:"instance,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// writeJSON writes the record as a single line JSON object.
+func (p *Processor) writeJSON(rec request.Record) error {
+	data, err := json.Marshal(jsonRecord{
+		ID:        rec.ID.String(),
+		Host:      rec.Host,
+		Tunnel:    rec.Tunnel,
+		SNI:       rec.SNI,
+		Method:    rec.Method,
+		Path:      rec.Path,
+		Instance:  rec.Instance,
+		CreatedAt: rec.CreatedAt,
+	})
+	if err != nil {
+		return fmt.Errorf("marshaling request record: %w", err)
+	}
+
+	// NOTE: The record is written with a single call, so that the
+	// concurrently handled records are not interleaved.
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if _, err := p.out.Write(append(data, '\n')); err != nil {
+		return fmt.Errorf("writing request record: %w", err)
+	}
 
 	return nil
 }
@@ -3,7 +3,7 @@ package stdout
 import (
 	"bytes"
 	"fmt"
-	"io"
+	"net/http"
 	"testing"
 	"time"
 
@@ -15,11 +15,51 @@ import (
 )
 
 func Test_NewProcessor(t *testing.T) {
-	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+	var out bytes.Buffer
 
-	proc := NewProcessor(log)
-	require.NotNil(t, proc)
-	assert.Equal(t, log.With("job", "requests-stdout-processor"), proc.log)
+	log := slog.New(slog.NewTextHandler(&out, nil))
+
+	tests := map[string]struct {
+		Format Format
+		Result Format
+		Error  string
+	}{
+		"Empty format": {
+			Result: FormatText,
+		},
+		"Text format": {
+			Format: FormatText,
+			Result: FormatText,
+		},
+		"JSON format": {
+			Format: FormatJSON,
+			Result: FormatJSON,
+		},
+		"Unsupported format": {
+			Format: "xml",
+			Error:  `unsupported stdout format "xml"`,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			proc, err := NewProcessor(log, &out, test.Format)
+			if test.Error != "" {
+				assert.EqualError(t, err, test.Error)
+				assert.Nil(t, proc)
+
+				return
+			}
+
+			require.NoError(t, err)
+			require.NotNil(t, proc)
+			assert.Equal(t, log.With("job", "requests-stdout-processor"), proc.log)
+			assert.Equal(t, test.Result, proc.format)
+			assert.Same(t, &out, proc.out)
+		})
+	}
 }
 
 func Test_Processor_Handle(t *testing.T) {
@@ -27,12 +67,14 @@ func Test_Processor_Handle(t *testing.T) {
 
 	log := slog.New(slog.NewTextHandler(&buffer, nil))
 	proc := &Processor{
-		log: log,
+		log:    log,
+		format: FormatText,
 	}
 
 	rec := request.Record{
 		ID:        xid.New(),
 		Host:      "example.com",
+		Tunnel:    true,
 		CreatedAt: time.Now(),
 	}
 
@@ -43,9 +85,103 @@ func Test_Processor_Handle(t *testing.T) {
 		t,
 		buffer.String(),
 		fmt.Sprintf(
-			"level=INFO msg=\"publishing request record\" id=%s host=%s\n",
+			"level=INFO msg=\"publishing request record\" id=%s host=%s tunnel=true\n",
 			rec.ID.String(),
 			rec.Host,
 		),
 	)
 }
+
+func Test_Processor_Handle_SNI(t *testing.T) {
+	var buffer bytes.Buffer
+
+	proc := &Processor{
+		log:    slog.New(slog.NewTextHandler(&buffer, nil)),
+		format: FormatText,
+	}
+
+	rec := request.Record{
+		ID:     xid.New(),
+		Host:   "127.0.0.1",
+		Tunnel: true,
+		SNI:    "example.com",
+	}
+
+	require.NoError(t, proc.Handle(rec))
+
+	assert.Contains(
+		t,
+		buffer.String(),
+		fmt.Sprintf(
+			"level=INFO msg=\"publishing request record\" id=%s host=127.0.0.1 tunnel=true sni=example.com\n",
+			rec.ID.String(),
+		),
+	)
+}
+
+func Test_Processor_Handle_MITM(t *testing.T) {
+	var buffer bytes.Buffer
+
+	proc := &Processor{
+		log:    slog.New(slog.NewTextHandler(&buffer, nil)),
+		format: FormatText,
+	}
+
+	rec := request.Record{
+		ID:       xid.New(),
+		Host:     "example.com",
+		SNI:      "example.com",
+		Method:   http.MethodGet,
+		Path:     "/index.html",
+		Instance: "proxy-1",
+	}
+
+	require.NoError(t, proc.Handle(rec))
+
+	assert.Contains(
+		t,
+		buffer.String(),
+		fmt.Sprintf(
+			"level=INFO msg=\"publishing request record\" id=%s host=example.com tunnel=false sni=example.com method=GET path=/index.html instance=proxy-1\n",
+			rec.ID.String(),
+		),
+	)
+}
+
+func Test_Processor_Handle_JSON(t *testing.T) {
+	var logBuffer, buffer bytes.Buffer
+
+	proc := &Processor{
+		log:    slog.New(slog.NewTextHandler(&logBuffer, nil)),
+		format: FormatJSON,
+		out:    &buffer,
+	}
+
+	rec := request.Record{
+		ID:        xid.New(),
+		Host:      "example.com",
+		Tunnel:    true,
+		CreatedAt: time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC),
+	}
+
+	require.NoError(t, proc.Handle(rec))
+
+	rec.Tunnel = false
+	rec.SNI = "example.com"
+	rec.Method = http.MethodGet
+	rec.Path = "/index.html"
+	rec.Instance = "proxy-1"
+
+	require.NoError(t, proc.Handle(rec))
+
+	assert.Equal(
+		t,
+		fmt.Sprintf(
+			"{\"id\":%[1]q,\"host\":\"example.com\",\"tunnel\":true,\"created_at\":\"2024-01-02T03:04:05Z\"}\n"+
+				"{\"id\":%[1]q,\"host\":\"example.com\",\"tunnel\":false,\"sni\":\"example.com\",\"method\":\"GET\",\"path\":\"/index.html\",\"instance\":\"proxy-1\",\"created_at\":\"2024-01-02T03:04:05Z\"}\n",
+			rec.ID.String(),
+		),
+		buffer.String(),
+	)
+	assert.Empty(t, logBuffer.String())
+}
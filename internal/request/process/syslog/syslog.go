@@ -0,0 +1,118 @@
+// Package syslog implements a request processor that ships requests to a
+// syslog server.
+package syslog
+
+import (
+	"fmt"
+	gosyslog "log/syslog"
+	"sync"
+	"time"
+
+	"github.com/davseby/lwproxy/internal/request"
+)
+
+// Processor is a requests processor that writes every record to a syslog
+// server. The connection is established on the first record and it is
+// established again once writing fails.
+type Processor struct {
+	network string
+	addr    string
+	tag     string
+
+	mu sync.Mutex
+	w  *gosyslog.Writer
+}
+
+// NewProcessor creates a new request processor. The network and address
+// specify the syslog server, e.g. "udp" and "localhost:514". Empty
+// network connects to the local syslog server.
+func NewProcessor(network, addr, tag string) *Processor {
+	return &Processor{
+		network: network,
+		addr:    addr,
+		tag:     tag,
+	}
+}
+
+// Handle writes the record to the syslog server. When the write fails,
+// the connection is established again and the write is retried once.
+func (p *Processor) Handle(rec request.Record) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	msg := format(rec)
+
+	err := p.write(msg)
+	if err == nil {
+		return nil
+	}
+
+	p.close()
+
+	if err := p.write(msg); err != nil {
+		p.close()
+		return fmt.Errorf("writing request record to syslog: %w", err)
+	}
+
+	return nil
+}
+
+// Close closes the syslog server connection.
+func (p *Processor) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.close()
+}
+
+// write writes the message and connects to the syslog server first, if
+// the connection is not established.
+func (p *Processor) write(msg string) error {
+	if p.w == nil {
+		w, err := gosyslog.Dial(p.network, p.addr, gosyslog.LOG_INFO|gosyslog.LOG_DAEMON, p.tag)
+		if err != nil {
+			return err
+		}
+
+		p.w = w
+	}
+
+	return p.w.Info(msg)
+}
+
+// close closes the connection, if it is established.
+func (p *Processor) close() error {
+	if p.w == nil {
+		return nil
+	}
+
+	err := p.w.Close()
+	p.w = nil
+
+	return err
+}
+
+// format formats the record as a syslog message.
+func format(rec request.Record) string {
+	msg := fmt.Sprintf(
+		"id=%s host=%s tunnel=%t created_at=%s",
+		rec.ID.String(),
+		rec.Host,
+		rec.Tunnel,
+		rec.CreatedAt.UTC().Format(time.RFC3339Nano),
+	)
+
+	if rec.SNI != "" {
+		msg += " sni=" + rec.SNI
+	}
+
+	if rec.Method != "" {
+		msg += fmt.Sprintf(" method=%s path=%q", rec.Method, rec.Path)
+	}
+
+	if rec.Instance != "" {
+		msg += " instance=" + rec.Instance
+	}
+
+	return msg
+}
@@ -0,0 +1,152 @@
+package syslog
+
+import (
+	"bufio"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/davseby/lwproxy/internal/request"
+	"github.com/rs/xid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_NewProcessor(t *testing.T) {
+	proc := NewProcessor("udp", "localhost:514", "lwproxy")
+	require.NotNil(t, proc)
+	assert.Equal(t, "udp", proc.network)
+	assert.Equal(t, "localhost:514", proc.addr)
+	assert.Equal(t, "lwproxy", proc.tag)
+	assert.Nil(t, proc.w)
+}
+
+func Test_Processor_Handle(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	defer pc.Close()
+
+	proc := NewProcessor("udp", pc.LocalAddr().String(), "lwproxy")
+
+	defer proc.Close()
+
+	rec := request.Record{
+		ID:        xid.New(),
+		Host:      "example.com",
+		CreatedAt: time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC),
+	}
+
+	require.NoError(t, proc.Handle(rec))
+
+	require.NoError(t, pc.SetReadDeadline(time.Now().Add(time.Second)))
+
+	data := make([]byte, 1024)
+
+	n, _, err := pc.ReadFrom(data)
+	require.NoError(t, err)
+
+	msg := string(data[:n])
+
+	// NOTE: The priority is LOG_DAEMON|LOG_INFO.
+	assert.Contains(t, msg, "<30>")
+	assert.Contains(t, msg, "lwproxy[")
+	assert.Contains(t, msg, "id="+rec.ID.String()+" host=example.com tunnel=false created_at=2026-01-01T12:00:00Z")
+}
+
+func Test_Processor_Handle_Reconnect(t *testing.T) {
+	// NOTE: The address is reserved and released, so that the first
+	// connection attempt is refused.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	addr := ln.Addr().String()
+	require.NoError(t, ln.Close())
+
+	proc := NewProcessor("tcp", addr, "lwproxy")
+
+	defer proc.Close()
+
+	rec := request.Record{
+		ID:   xid.New(),
+		Host: "example.com",
+	}
+
+	assert.Error(t, proc.Handle(rec))
+	assert.Nil(t, proc.w)
+
+	ln, err = net.Listen("tcp", addr)
+	require.NoError(t, err)
+
+	defer ln.Close()
+
+	require.NoError(t, proc.Handle(rec))
+
+	conn, err := ln.Accept()
+	require.NoError(t, err)
+
+	defer conn.Close()
+
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(time.Second)))
+
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	require.NoError(t, err)
+	assert.Contains(t, line, "id="+rec.ID.String()+" host=example.com")
+}
+
+func Test_format(t *testing.T) {
+	id := xid.New()
+	createdAt := time.Date(2026, 1, 1, 12, 0, 0, 0, time.FixedZone("", 3600))
+
+	tests := map[string]struct {
+		Record request.Record
+		Result string
+	}{
+		"Tunneled request": {
+			Record: request.Record{
+				ID:        id,
+				Host:      "example.com",
+				Tunnel:    true,
+				CreatedAt: createdAt,
+			},
+			Result: "id=" + id.String() + " host=example.com tunnel=true created_at=2026-01-01T11:00:00Z",
+		},
+		"Tunneled request with a captured server name": {
+			Record: request.Record{
+				ID:        id,
+				Host:      "example.com",
+				Tunnel:    true,
+				SNI:       "www.example.com",
+				CreatedAt: createdAt,
+			},
+			Result: "id=" + id.String() + " host=example.com tunnel=true created_at=2026-01-01T11:00:00Z sni=www.example.com",
+		},
+		"Intercepted request": {
+			Record: request.Record{
+				ID:        id,
+				Host:      "example.com",
+				Method:    "GET",
+				Path:      "/a path",
+				CreatedAt: createdAt,
+			},
+			Result: "id=" + id.String() + ` host=example.com tunnel=false created_at=2026-01-01T11:00:00Z method=GET path="/a path"`,
+		},
+		"Request of a named instance": {
+			Record: request.Record{
+				ID:        id,
+				Host:      "example.com",
+				Instance:  "proxy-1",
+				CreatedAt: createdAt,
+			},
+			Result: "id=" + id.String() + " host=example.com tunnel=false created_at=2026-01-01T11:00:00Z instance=proxy-1",
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			assert.Equal(t, test.Result, format(test.Record))
+		})
+	}
+}
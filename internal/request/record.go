@@ -3,9 +3,11 @@
 package request
 
 import (
+	"net"
 	"strings"
 	"time"
 
+	"github.com/davseby/lwproxy/internal/clock"
 	"github.com/rs/xid"
 )
 
@@ -14,18 +16,52 @@ type Record struct {
 	// ID is the unique identifier of the request.
 	ID xid.ID
 
-	// Host is the host of the request.
+	// Host is the lowercase host of the request without the port.
 	Host string
 
+	// Tunnel is true for the CONNECT requests that establish a tunnel and
+	// false for the plain HTTP requests.
+	Tunnel bool
+
+	// SNI is the server name indicated in the TLS client hello of the
+	// tunneled communication. It is only set for the tunnels when the
+	// server name capturing is turned on and the client starts a TLS
+	// handshake.
+	SNI string
+
+	// Method is the HTTP method of the request. It is only set for the
+	// requests intercepted inside of the TLS tunnels.
+	Method string
+
+	// Path is the URL path of the request. It is only set for the
+	// requests intercepted inside of the TLS tunnels.
+	Path string
+
+	// Instance is the name of the proxy instance that handled the
+	// request. It is empty when the instance name is not configured.
+	Instance string
+
 	// CreatedAt is the time when the request was created.
 	CreatedAt time.Time
 }
 
-// NewRecord creates a new request record.
-func NewRecord(host string) Record {
+// NewRecord creates a new request record. The creation time is taken
+// from the provided clock.
+func NewRecord(clk clock.Clock, host string) Record {
 	return Record{
 		ID:        xid.New(),
-		Host:      strings.Split(host, ":")[0],
-		CreatedAt: time.Now(),
+		Host:      hostname(host),
+		CreatedAt: clk.Now(),
 	}
 }
+
+// hostname strips the port and the IPv6 brackets from the host and
+// converts it to lowercase, so that the same host is always recorded the
+// same way.
+func hostname(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		return strings.ToLower(h)
+	}
+
+	return strings.ToLower(strings.TrimSuffix(strings.TrimPrefix(host, "["), "]"))
+}
@@ -4,13 +4,87 @@ import (
 	"testing"
 	"time"
 
+	"github.com/davseby/lwproxy/internal/clock"
 	"github.com/stretchr/testify/assert"
 )
 
+// fixedClock is a clock that always returns the same time.
+type fixedClock struct {
+	clock.Real
+
+	now time.Time
+}
+
+// Now returns the fixed time.
+func (fc fixedClock) Now() time.Time {
+	return fc.now
+}
+
 func Test_NewRecord(t *testing.T) {
-	rec := NewRecord("example.com")
+	rec := NewRecord(clock.New(), "example.com")
 
 	assert.NotEmpty(t, rec.ID)
 	assert.Equal(t, "example.com", rec.Host)
 	assert.WithinDuration(t, time.Now(), rec.CreatedAt, time.Second*5)
+
+	rec = NewRecord(clock.New(), "[2001:db8::1]:443")
+	assert.Equal(t, "2001:db8::1", rec.Host)
+
+	// fixed clock
+	now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	rec = NewRecord(fixedClock{now: now}, "example.com")
+	assert.Equal(t, now, rec.CreatedAt)
+}
+
+func Test_hostname(t *testing.T) {
+	tests := map[string]struct {
+		Host   string
+		Result string
+	}{
+		"Host with a port": {
+			Host:   "example.com:443",
+			Result: "example.com",
+		},
+		"Host without a port": {
+			Host:   "example.com",
+			Result: "example.com",
+		},
+		"IPv6 literal with a port": {
+			Host:   "[2001:db8::1]:443",
+			Result: "2001:db8::1",
+		},
+		"IPv6 literal without a port": {
+			Host:   "[2001:db8::1]",
+			Result: "2001:db8::1",
+		},
+		"Mixed case host with the default HTTPS port": {
+			Host:   "Example.COM:443",
+			Result: "example.com",
+		},
+		"Mixed case host with the default HTTP port": {
+			Host:   "WWW.Example.com:80",
+			Result: "www.example.com",
+		},
+		"Mixed case host without a port": {
+			Host:   "Example.com",
+			Result: "example.com",
+		},
+		"Mixed case IPv6 literal with a port": {
+			Host:   "[2001:DB8::1]:443",
+			Result: "2001:db8::1",
+		},
+		"IPv6 address without brackets": {
+			Host:   "2001:db8::1",
+			Result: "2001:db8::1",
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			assert.Equal(t, test.Result, hostname(test.Host))
+		})
+	}
 }